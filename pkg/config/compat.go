@@ -0,0 +1,72 @@
+package config
+
+// Check whether a structure saved with the config a can be restored into one running with
+// the config b. Returns false if they differ on a field that changes the bucket layout or
+// what the buckets hold: L, M, MPerLevel, MurmurSeed or BucketModel. Differences in Pi, Pd
+// and Lambda only change how the restored probabilities evolve, so they're reported as
+// warnings and still return true. The returned names list the layout fields first and then
+// the tuning ones. A nil config is never compatible.
+func Compatible(a, b *FairnessTrackerConfig) (bool, []string) {
+	if a == nil || b == nil {
+		return false, nil
+	}
+
+	var fields []string
+	if a.L != b.L {
+		fields = append(fields, "L")
+	} else if !sameLevelSizes(a, b) {
+		if a.MPerLevel == nil && b.MPerLevel == nil {
+			fields = append(fields, "M")
+		} else {
+			fields = append(fields, "MPerLevel")
+		}
+	}
+	if !sameSeed(a.MurmurSeed, b.MurmurSeed) {
+		fields = append(fields, "MurmurSeed")
+	}
+	if a.BucketModel != b.BucketModel {
+		fields = append(fields, "BucketModel")
+	}
+	compatible := len(fields) == 0
+
+	if a.Pi != b.Pi {
+		fields = append(fields, "Pi")
+	}
+	if a.Pd != b.Pd {
+		fields = append(fields, "Pd")
+	}
+	if a.Lambda != b.Lambda {
+		fields = append(fields, "Lambda")
+	}
+
+	return compatible, fields
+}
+
+// Returns true if both configs with the same L have the same number of buckets at every level
+func sameLevelSizes(a, b *FairnessTrackerConfig) bool {
+	for l := 0; l < int(a.L); l++ {
+		if levelSize(a, l) != levelSize(b, l) {
+			return false
+		}
+	}
+	return true
+}
+
+// The number of buckets at the level, or 0 if MPerLevel doesn't cover it
+func levelSize(c *FairnessTrackerConfig, level int) uint32 {
+	if c.MPerLevel == nil {
+		return c.M
+	}
+	if level >= len(c.MPerLevel) {
+		return 0
+	}
+	return c.MPerLevel[level]
+}
+
+// Returns true if both seeds are unset or set to the same value
+func sameSeed(a, b *uint32) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
@@ -0,0 +1,46 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompatible(t *testing.T) {
+	seed := func(v uint32) *uint32 { return &v }
+	base := func() *FairnessTrackerConfig {
+		return &FairnessTrackerConfig{M: 1000, L: 3, Pi: .15, Pd: .01, Lambda: .01, MurmurSeed: seed(7)}
+	}
+
+	cases := []struct {
+		name       string
+		modify     func(*FairnessTrackerConfig)
+		compatible bool
+		fields     []string
+	}{
+		{"Same", func(*FairnessTrackerConfig) {}, true, nil},
+		{"L", func(c *FairnessTrackerConfig) { c.L = 4 }, false, []string{"L"}},
+		{"M", func(c *FairnessTrackerConfig) { c.M = 2000 }, false, []string{"M"}},
+		{"MPerLevel", func(c *FairnessTrackerConfig) { c.MPerLevel = []uint32{1000, 1000, 500} }, false, []string{"MPerLevel"}},
+		{"MPerLevelSameSizes", func(c *FairnessTrackerConfig) { c.MPerLevel = []uint32{1000, 1000, 1000} }, true, nil},
+		{"Seed", func(c *FairnessTrackerConfig) { c.MurmurSeed = seed(8) }, false, []string{"MurmurSeed"}},
+		{"UnsetSeed", func(c *FairnessTrackerConfig) { c.MurmurSeed = nil }, false, []string{"MurmurSeed"}},
+		{"BucketModel", func(c *FairnessTrackerConfig) { c.BucketModel = BucketModelRatio }, false, []string{"BucketModel"}},
+		{"Tuning", func(c *FairnessTrackerConfig) { c.Pi, c.Pd, c.Lambda = .2, .02, .1 }, true, []string{"Pi", "Pd", "Lambda"}},
+		{"LayoutAndTuning", func(c *FairnessTrackerConfig) { c.M, c.Pi = 2000, .2 }, false, []string{"M", "Pi"}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			other := base()
+			tc.modify(other)
+
+			compatible, fields := Compatible(base(), other)
+			assert.Equal(t, compatible, tc.compatible)
+			assert.Equal(t, fields, tc.fields)
+		})
+	}
+
+	compatible, _ := Compatible(nil, base())
+	assert.False(t, compatible)
+}
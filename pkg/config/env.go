@@ -0,0 +1,156 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A config field read from an environment variable by FromEnv
+type envVar struct {
+	// The name of the variable without the prefix
+	name string
+	// The name of the field in FairnessTrackerConfig, as reported by ValidationError
+	field string
+	// Parse the value into the field of the config
+	parse func(value string) error
+}
+
+// Build a config from the environment variables with the given prefix, e.g. APP_L for the
+// prefix APP, starting from DefaultFairnessTrackerConfig for the variables that are unset
+// or empty. The variables are:
+//   - _L, _M: the number of levels and the size of every level
+//   - _PI, _PD, _MIN_PD, _LAMBDA: the probability deltas and the decay rate
+//   - _ROTATION, _ROTATION_JITTER: the rotation frequency and its jitter
+//   - _DECAY_SWEEP_INTERVAL, _MAX_BUCKET_AGE: the background sweep
+//   - _SAMPLE_RATE, _TIMEOUT_PENALTY_FRACTION, _MAX_PROBABILITY, _BLOCK_THRESHOLD
+//   - _MAX_THROTTLES_PER_SECOND, _BACKOFF_BASE
+//   - _INCLUDE_STATS, _DRY_RUN
+//
+// Durations are parsed with time.ParseDuration, e.g. 5m, and booleans with
+// strconv.ParseBool. A malformed or out of range value returns an error naming the
+// variable, and the resulting config is checked with Validate, whose error names the
+// offending variables, so a config loaded without an error also builds a tracker.
+func FromEnv(prefix string) (*FairnessTrackerConfig, error) {
+	conf := DefaultFairnessTrackerConfig()
+
+	vars := []envVar{
+		{"L", "L", envUint32(&conf.L, 1, MaxL)},
+		{"M", "M", envUint32(&conf.M, 1, MaxM)},
+		{"PI", "Pi", envFloat(&conf.Pi, 0, 1)},
+		{"PD", "Pd", envFloat(&conf.Pd, 0, 1)},
+		{"MIN_PD", "MinPd", envFloat(&conf.MinPd, 0, 1)},
+		{"LAMBDA", "Lambda", envFloat(&conf.Lambda, 0, math.Inf(1))},
+		{"ROTATION", "RotationFrequency", envDuration(&conf.RotationFrequency)},
+		{"ROTATION_JITTER", "RotationJitter", envDuration(&conf.RotationJitter)},
+		{"DECAY_SWEEP_INTERVAL", "DecaySweepInterval", envDuration(&conf.DecaySweepInterval)},
+		{"MAX_BUCKET_AGE", "MaxBucketAge", envDuration(&conf.MaxBucketAge)},
+		{"SAMPLE_RATE", "SampleRate", envFloat(&conf.SampleRate, 0, 1)},
+		{"TIMEOUT_PENALTY_FRACTION", "TimeoutPenaltyFraction", envFloat(&conf.TimeoutPenaltyFraction, 0, 1)},
+		{"MAX_PROBABILITY", "MaxProbability", envFloat(&conf.MaxProbability, 0, 1)},
+		{"BLOCK_THRESHOLD", "BlockThreshold", envFloat(&conf.BlockThreshold, 0, 1)},
+		{"MAX_THROTTLES_PER_SECOND", "MaxThrottlesPerSecond", envFloat(&conf.MaxThrottlesPerSecond, 0, math.Inf(1))},
+		{"BACKOFF_BASE", "BackoffBase", envDuration(&conf.BackoffBase)},
+		{"INCLUDE_STATS", "IncludeStats", envBool(&conf.IncludeStats)},
+		{"DRY_RUN", "DryRun", envBool(&conf.DryRun)},
+	}
+
+	for _, v := range vars {
+		key := prefix + "_" + v.name
+		value := strings.TrimSpace(os.Getenv(key))
+		if value == "" {
+			continue
+		}
+		if err := v.parse(value); err != nil {
+			return nil, fmt.Errorf("invalid value %q of %s: %w", value, key, err)
+		}
+	}
+
+	if err := conf.Validate(); err != nil {
+		var validationErr *ValidationError
+		if errors.As(err, &validationErr) {
+			return nil, fmt.Errorf("invalid config from %s: %w", strings.Join(envNames(prefix, vars, validationErr.Fields), ", "), err)
+		}
+		return nil, fmt.Errorf("invalid config from the variables with the prefix %s: %w", prefix, err)
+	}
+
+	return conf, nil
+}
+
+// Map the fields of the config to the names of their variables. A field without a
+// variable keeps its own name.
+func envNames(prefix string, vars []envVar, fields []string) []string {
+	names := make([]string, 0, len(fields))
+	for _, field := range fields {
+		name := field
+		for _, v := range vars {
+			if v.field == field {
+				name = prefix + "_" + v.name
+				break
+			}
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+// Parse an integer in [lo, hi]
+func envUint32(dst *uint32, lo, hi uint32) func(string) error {
+	return func(value string) error {
+		n, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return err
+		}
+		if uint32(n) < lo || uint32(n) > hi {
+			return fmt.Errorf("must be in [%d, %d]", lo, hi)
+		}
+		*dst = uint32(n)
+		return nil
+	}
+}
+
+// Parse a float in [lo, hi]
+func envFloat(dst *float64, lo, hi float64) func(string) error {
+	return func(value string) error {
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		if math.IsNaN(f) || f < lo || f > hi {
+			return fmt.Errorf("must be in [%g, %g]", lo, hi)
+		}
+		*dst = f
+		return nil
+	}
+}
+
+// Parse a non-negative duration
+func envDuration(dst *time.Duration) func(string) error {
+	return func(value string) error {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		if d < 0 {
+			return fmt.Errorf("must not be negative")
+		}
+		*dst = d
+		return nil
+	}
+}
+
+// Parse a boolean
+func envBool(dst *bool) func(string) error {
+	return func(value string) error {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		*dst = b
+		return nil
+	}
+}
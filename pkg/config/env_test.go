@@ -0,0 +1,83 @@
+package config
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFromEnv(t *testing.T) {
+	// Nothing set falls back to the defaults
+	conf, err := FromEnv("FAIR_TEST")
+	assert.NoError(t, err)
+	def := DefaultFairnessTrackerConfig()
+	assert.Equal(t, conf.L, def.L)
+	assert.Equal(t, conf.M, def.M)
+	assert.Equal(t, conf.Pi, def.Pi)
+	assert.Equal(t, conf.RotationFrequency, def.RotationFrequency)
+	assert.NotNil(t, conf.FinalProbabilityFunction)
+
+	t.Setenv("FAIR_TEST_L", "4")
+	t.Setenv("FAIR_TEST_M", " 2000 ")
+	t.Setenv("FAIR_TEST_PI", "0.2")
+	t.Setenv("FAIR_TEST_PD", "0.01")
+	t.Setenv("FAIR_TEST_LAMBDA", "0")
+	t.Setenv("FAIR_TEST_ROTATION", "90s")
+	t.Setenv("FAIR_TEST_DRY_RUN", "true")
+	t.Setenv("FAIR_TEST_MIN_PD", "")
+
+	conf, err = FromEnv("FAIR_TEST")
+	assert.NoError(t, err)
+	assert.Equal(t, conf.L, uint32(4))
+	assert.Equal(t, conf.M, uint32(2000))
+	assert.Equal(t, conf.Pi, .2)
+	assert.Equal(t, conf.Pd, .01)
+	assert.Equal(t, conf.Lambda, 0.)
+	assert.Equal(t, conf.RotationFrequency, 90*time.Second)
+	assert.True(t, conf.DryRun)
+	assert.Equal(t, conf.MinPd, def.MinPd)
+}
+
+func TestFromEnvInvalid(t *testing.T) {
+	cases := []struct {
+		name  string
+		value string
+		err   string
+	}{
+		{"ROTATION", "5 minutes", `invalid value "5 minutes" of FAIR_TEST_ROTATION`},
+		{"ROTATION", "-1m", "must not be negative"},
+		{"L", "0", "must be in [1, 32]"},
+		{"M", "abc", "FAIR_TEST_M"},
+		{"PI", "1.5", "must be in [0, 1]"},
+		{"LAMBDA", "NaN", "FAIR_TEST_LAMBDA"},
+		{"DRY_RUN", "maybe", "FAIR_TEST_DRY_RUN"},
+		// Checked against the default Pi
+		{"PD", "0.9", "invalid config from FAIR_TEST_PI, FAIR_TEST_PD: the value of Pd is expected to be smaller than Pi"},
+		// Checked against the default rotation frequency
+		{"ROTATION_JITTER", "1h", "invalid config from FAIR_TEST_ROTATION_JITTER, FAIR_TEST_ROTATION: the RotationJitter must be less"},
+		// Only rejected by the validation of the whole config
+		{"PI", "1", "the values of Pi and Pd must <=1"},
+		{"ROTATION", "1us", "the RotationFrequency must be at least"},
+		{"MAX_BUCKET_AGE", "1h", "the MaxBucketAge requires the DecaySweepInterval"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("FAIR_TEST_"+tc.name, tc.value)
+			_, err := FromEnv("FAIR_TEST")
+			assert.ErrorContains(t, err, tc.err)
+		})
+	}
+}
+
+func TestFromEnvJitterWithoutRotation(t *testing.T) {
+	// The jitter is ignored when the rotation is disabled, as in Validate
+	t.Setenv("FAIR_TEST_ROTATION", "0")
+	t.Setenv("FAIR_TEST_ROTATION_JITTER", "1m")
+
+	conf, err := FromEnv("FAIR_TEST")
+	assert.NoError(t, err)
+	assert.Equal(t, conf.RotationFrequency, time.Duration(0))
+	assert.Equal(t, conf.RotationJitter, time.Minute)
+}
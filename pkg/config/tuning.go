@@ -1,8 +1,12 @@
 package config
 
 import (
-	"log"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"math"
+	"sort"
 	"time"
 )
 
@@ -26,15 +30,70 @@ const (
 	minL = 3
 	// The default rotation duration
 	defaultRotationDuration = time.Minute * 5
+	// The default ceiling of the probabilities
+	defaultMaxProbability = 1.
+	// The default smoothing for the failure ratio of BucketModelRatio
+	defaultRatioSmoothing = 1
+	// The default weight of a new outcome for BucketModelEWMA
+	defaultEWMAAlpha = 0.1
+	// The tolerance when rounding up a number of failures
+	failuresEpsilon = 1e-9
+	// The memory taken by a bucket of the default in-memory store in bytes: its
+	// probability, success and failure counts, timestamp and mutex stored inline in its level
+	BucketMemoryBytes = 40
+	// The number of structures a tracker keeps in memory, the main and the secondary one
+	structuresPerTracker = 2
+	// The number of times the suggested backoff doubles from a final probability of 0 to 1
+	backoffDoublings = 10
+	// The max number of levels of a structure. A structure allocates all its buckets up
+	// front, so a mis-tuned config is refused rather than exhausting the memory.
+	MaxL uint32 = 32
+	// The max number of buckets per level of a structure. See MaxL.
+	MaxM uint32 = 1 << 20
 )
 
+var errEmptyBuckets = errors.New("cannot compute final probability with empty buckets slice")
+
 // The function to choose the final probability based on all bucket probabilities
-type FinalProbabilityFunction func([]float64) float64
+// Returns an error if the final probability cannot be computed from the given buckets.
+type FinalProbabilityFunction func([]float64) (float64, error)
+
+// The key of the final probability function override in a context
+type finalProbabilityFunctionKey struct{}
+
+// Attach a final probability function to the context of a request, which RegisterRequest
+// uses instead of the ones in the config for just that request, e.g. to be stricter on a
+// sensitive endpoint while sharing one tracker. The bucket probabilities are the same.
+func WithFinalProbabilityFunction(ctx context.Context, fn FinalProbabilityFunction) context.Context {
+	return context.WithValue(ctx, finalProbabilityFunctionKey{}, fn)
+}
+
+// Get the function attached to the context with WithFinalProbabilityFunction, or nil if
+// there's none
+func FinalProbabilityFunctionFromContext(ctx context.Context) FinalProbabilityFunction {
+	fn, _ := ctx.Value(finalProbabilityFunctionKey{}).(FinalProbabilityFunction)
+	return fn
+}
+
+// The probability of the bucket a request hashed to at a level
+type LevelProb struct {
+	// The level of the bucket
+	Level uint32
+	// The index of the bucket at its level
+	Index uint32
+	// The probability of the bucket
+	Probability float64
+}
+
+// The function to choose the final probability based on all bucket probabilities along
+// with the level and index of each bucket, e.g. to weight the levels differently. The
+// probabilities are ordered by level.
+type FinalProbabilityFuncEx func([]LevelProb) (float64, error)
 
 var (
-	MinFinalProbabilityFunction FinalProbabilityFunction = func(buckets []float64) float64 {
+	MinFinalProbabilityFunction FinalProbabilityFunction = func(buckets []float64) (float64, error) {
 		if len(buckets) == 0 {
-			log.Fatalf("Cannot compute final probability with empty buckets slice")
+			return 0, errEmptyBuckets
 		}
 
 		var min float64 = 1.
@@ -42,12 +101,12 @@ var (
 			min = math.Min(min, b)
 		}
 
-		return min
+		return min, nil
 	}
 
-	MeanFinalProbabilityFunction FinalProbabilityFunction = func(buckets []float64) float64 {
+	MeanFinalProbabilityFunction FinalProbabilityFunction = func(buckets []float64) (float64, error) {
 		if len(buckets) == 0 {
-			log.Fatalf("Cannot compute final probability with empty buckets slice")
+			return 0, errEmptyBuckets
 		}
 
 		var total float64
@@ -55,10 +114,44 @@ var (
 			total += b
 		}
 
-		return total / float64(len(buckets))
+		return total / float64(len(buckets)), nil
 	}
 )
 
+// The function to canonicalize a client identifier before it's hashed. Must be
+// deterministic and must not modify its input.
+type KeyNormalizer func([]byte) []byte
+
+// Normalizes the client identifiers by trimming the surrounding whitespace and lowering
+// the case, e.g. "User:123 " and "user:123" are the same flow
+var TrimSpaceLowerNormalizer KeyNormalizer = func(key []byte) []byte {
+	return bytes.ToLower(bytes.TrimSpace(key))
+}
+
+// Creates a function that chooses the p-th percentile of the bucket probabilities
+// as the final probability, interpolating linearly between the closest ranks.
+// p is clamped to [0, 1] so 0 behaves like Min, 0.5 is the median and 1 is the max.
+func PercentileFinalProbabilityFunction(p float64) FinalProbabilityFunction {
+	p = math.Max(0, math.Min(1, p))
+
+	return func(buckets []float64) (float64, error) {
+		if len(buckets) == 0 {
+			return 0, errEmptyBuckets
+		}
+
+		sorted := make([]float64, len(buckets))
+		copy(sorted, buckets)
+		sort.Float64s(sorted)
+
+		rank := p * float64(len(sorted)-1)
+		lower := int(math.Floor(rank))
+		upper := int(math.Ceil(rank))
+		frac := rank - float64(lower)
+
+		return sorted[lower] + frac*(sorted[upper]-sorted[lower]), nil
+	}
+}
+
 // The default config that's supposed to work in most cases
 func DefaultFairnessTrackerConfig() *FairnessTrackerConfig {
 	return GenerateTunedStructureConfig(
@@ -78,17 +171,32 @@ func DefaultFairnessTrackerConfig() *FairnessTrackerConfig {
 // bucketsPerLevel - Number of buckets per level in the core structure
 // tolerableBadRequestsPerBadFlow - Number of requests we can tolerate before we fully shut down a flow
 func GenerateTunedStructureConfig(expectedClientFlows, bucketsPerLevel, tolerableBadRequestsPerBadFlow uint32) *FairnessTrackerConfig {
+	conf, _ := GenerateTunedStructureConfigWithReport(expectedClientFlows, bucketsPerLevel, tolerableBadRequestsPerBadFlow)
+	return conf
+}
+
+// Like GenerateTunedStructureConfig but also reports how L was chosen and the collision
+// probability it achieves
+func GenerateTunedStructureConfigWithReport(expectedClientFlows, bucketsPerLevel, tolerableBadRequestsPerBadFlow uint32) (*FairnessTrackerConfig, TuningReport) {
 	M := uint32(math.Ceil(float64(expectedClientFlows) * percentBadClientFlows))
-	L := CalculateL(bucketsPerLevel, M, lowProbability)
-	if L < minL {
-		L = minL
-	}
+	rawL := calculateRawL(bucketsPerLevel, M, lowProbability)
+	L := min(max(rawL, minL), MaxL)
 
 	// The probability to add per bad outcome so we fully block a flow after tolerable failures
 	Pi := 1 / float64(tolerableBadRequestsPerBadFlow)
 	// We want a slower recovery than the speed of marking workloads as bad
 	Pd := pdSlowingFactor * Pi
 
+	report := TuningReport{
+		M:                    bucketsPerLevel,
+		ExpectedBadFlows:     M,
+		RawL:                 rawL,
+		L:                    L,
+		MinLApplied:          rawL < minL,
+		MaxLApplied:          rawL > MaxL,
+		CollisionProbability: CollisionProbability(bucketsPerLevel, M, L),
+	}
+
 	return &FairnessTrackerConfig{
 		M:                        bucketsPerLevel,
 		L:                        L,
@@ -98,7 +206,83 @@ func GenerateTunedStructureConfig(expectedClientFlows, bucketsPerLevel, tolerabl
 		RotationFrequency:        defaultRotationDuration,
 		IncludeStats:             false,
 		FinalProbabilityFunction: MinFinalProbabilityFunction,
+		BucketModel:              BucketModelProbability,
+		MaxProbability:           defaultMaxProbability,
+		RatioSmoothing:           defaultRatioSmoothing,
+		EWMAAlpha:                defaultEWMAAlpha,
+	}, report
+}
+
+// Generates a config like GenerateTunedStructureConfig with the largest M whose buckets
+// fit in the memory budget in bytes, assuming BucketMemoryBytes per bucket and the two
+// structures of a tracker. L follows from M as in GenerateTunedStructureConfig. If the
+// budget is too small to reach the target collision probability with any L, the minimum
+// L is used. M is at least 1 and at most MaxM, so a budget below the size of a single
+// bucket per level is exceeded.
+func TuneForMemoryBudget(bytes uint64, expectedClientFlows uint32) *FairnessTrackerConfig {
+	mFor := func(L uint32) uint32 {
+		return uint32(min(bytes/(structuresPerTracker*uint64(L)*BucketMemoryBytes), uint64(MaxM)))
+	}
+
+	// The fewer levels, the more buckets per level fit. Pick the fewest levels that
+	// still reach the target collision probability with the buckets that fit.
+	for L := uint32(minL); L <= MaxL && mFor(L) > 0; L++ {
+		if conf := GenerateTunedStructureConfig(expectedClientFlows, mFor(L), defaultTolerableBadRequestsPerBadFlow); conf.L <= L {
+			return conf
+		}
 	}
+
+	conf := GenerateTunedStructureConfig(expectedClientFlows, max(mFor(minL), 1), defaultTolerableBadRequestsPerBadFlow)
+	conf.L = minL
+	return conf
+}
+
+// Explains the config GenerateTunedStructureConfig would generate for the given inputs.
+// Useful to understand how expectedClientFlows affects the structure without building it.
+func ExplainTuning(expectedClientFlows, bucketsPerLevel, tolerableBadRequestsPerBadFlow uint32) TuningExplanation {
+	conf, report := GenerateTunedStructureConfigWithReport(expectedClientFlows, bucketsPerLevel, tolerableBadRequestsPerBadFlow)
+
+	notes := []string{
+		fmt.Sprintf("%d of %d expected client flows (%.1f%%) are assumed to need throttling",
+			report.ExpectedBadFlows, expectedClientFlows, percentBadClientFlows*100),
+	}
+	switch {
+	case report.MinLApplied:
+		notes = append(notes, fmt.Sprintf("L floored at minimum %d (calculated %d for a target collision probability of %g)",
+			report.L, report.RawL, lowProbability))
+	case report.MaxLApplied && report.RawL == math.MaxUint32:
+		notes = append(notes, fmt.Sprintf("L capped at maximum %d since no number of levels achieves the target collision probability of %g",
+			report.L, lowProbability))
+	case report.MaxLApplied:
+		notes = append(notes, fmt.Sprintf("L capped at maximum %d (calculated %d for a target collision probability of %g)",
+			report.L, report.RawL, lowProbability))
+	default:
+		notes = append(notes, fmt.Sprintf("L of %d achieves the target collision probability of %g", report.L, lowProbability))
+	}
+	notes = append(notes, fmt.Sprintf("a bad flow is fully throttled after %d failures and recovers %.0fx slower",
+		tolerableBadRequestsPerBadFlow, 1/pdSlowingFactor))
+
+	return TuningExplanation{
+		TuningReport: report,
+		Pi:           conf.Pi,
+		Pd:           conf.Pd,
+		Notes:        notes,
+	}
+}
+
+// Get the probability of an innocent flow colliding with a bad one at every level:
+// p = (1 - (1 - (1/B))^M)^L
+//
+// params:
+// -------
+// B - Buckets per level.
+// M - Expected "bad" client flows that'll need throttling.
+// L - Number of levels.
+//
+// This is the inverse of CalculateL and useful to check a hand-tuned config.
+func CollisionProbability(B, M, L uint32) float64 {
+	term := 1 - math.Pow(1-1/float64(B), float64(M))
+	return math.Pow(term, float64(L))
 }
 
 // Get the appropriate number of levels to achieve the target collision probability:
@@ -115,9 +299,81 @@ func GenerateTunedStructureConfig(expectedClientFlows, bucketsPerLevel, tolerabl
 // https://rtcl.eecs.umich.edu/rtclweb/assets/publications/2001/feng2001fair.pdf
 //
 // Most users should use GenerateTunedStructureConfig which uses this function but it's
-// kept public in case someone wants to do their own tuning.
+// kept public in case someone wants to do their own tuning. The result is capped at MaxL
+// since the formula explodes when nearly every bucket is taken by a bad flow. See
+// GenerateTunedStructureConfigWithReport to tell whether the cap applied.
 func CalculateL(B, M uint32, p float64) uint32 {
+	return min(calculateRawL(B, M, p), MaxL)
+}
+
+// Like CalculateL without the cap at MaxL. Returns math.MaxUint32 if no number of levels
+// achieves the target, i.e. the formula gives NaN, infinity or a value beyond uint32.
+func calculateRawL(B, M uint32, p float64) uint32 {
 	term := 1 - math.Pow(1-1/float64(B), float64(M))
-	L := math.Log(p) / math.Log(term)
-	return uint32(math.Ceil(L))
+	L := math.Ceil(math.Log(p) / math.Log(term))
+	if math.IsNaN(L) || math.IsInf(L, 0) || L > math.MaxUint32 {
+		return math.MaxUint32
+	}
+	// A target probability of 1 or more is met without any level
+	return uint32(math.Max(L, 0))
+}
+
+// Get the backoff to suggest to a throttled request with the given final probability. It
+// grows exponentially from the BackoffBase at 0 to 1024 times the BackoffBase at 1, so
+// the deeper a flow is into throttling, the longer it's asked to wait. Returns 0 if the
+// BackoffBase isn't positive.
+func (c *FairnessTrackerConfig) SuggestedBackoff(probability float64) time.Duration {
+	if c.BackoffBase <= 0 {
+		return 0
+	}
+
+	probability = math.Min(math.Max(probability, 0), 1)
+	return time.Duration(float64(c.BackoffBase) * math.Exp2(backoffDoublings*probability))
+}
+
+// Get the number of consecutive failures of a flow, with no successes in between, after
+// which its probability reaches the target. Returns -1 if the target is out of reach
+// since it's above the MaxProbability. Assumes the probability bucket model without
+// the adaptive mode, no other flow colliding with the flow and no decay between the
+// failures, which is close enough for failures in quick succession. See
+// FailuresToReachProbabilityWithInterval to account for the decay.
+func (c *FairnessTrackerConfig) FailuresToReachProbability(target float64) int {
+	return c.FailuresToReachProbabilityWithInterval(target, 0)
+}
+
+// Like FailuresToReachProbability but with the given time between the failures, so the
+// probability decays with Lambda before every failure. The probability then converges
+// to Pi / (1 - exp(-Lambda * interval)), so a target above it is out of reach and -1
+// is returned.
+//
+// The probability after n failures is the geometric series:
+// p(n) = Pi * (1 - r^n) / (1 - r), where r = exp(-Lambda * interval)
+func (c *FairnessTrackerConfig) FailuresToReachProbabilityWithInterval(target float64, interval time.Duration) int {
+	if target <= 0 {
+		return 0
+	}
+
+	maxProbability := c.MaxProbability
+	if maxProbability == 0 {
+		maxProbability = defaultMaxProbability
+	}
+	if target > maxProbability || c.Pi <= 0 {
+		return -1
+	}
+
+	r := math.Exp(-c.Lambda * interval.Seconds())
+	var n float64
+	if r >= 1 {
+		n = target / c.Pi
+	} else {
+		// Reachable only if the target is below the limit of the series
+		x := 1 - target*(1-r)/c.Pi
+		if x <= 0 {
+			return -1
+		}
+		n = math.Log(x) / math.Log(r)
+	}
+
+	// Absorb the floating point error so e.g. .3 / .1 takes 3 failures, not 4
+	return int(math.Ceil(n - failuresEpsilon))
 }
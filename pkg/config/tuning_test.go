@@ -1,29 +1,128 @@
 package config
 
 import (
+	"math"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
 
-func TestCalculateL(t *testing.T) {
-	// Manually calculated by hand
-	L := CalculateL(1000, 100, 0.0001)
-	assert.Equal(t, int(L), 4)
+func TestFailuresToReachProbability(t *testing.T) {
+	// The tuned Pi shuts a flow down after the tolerable number of bad requests
+	conf := GenerateTunedStructureConfig(1000, 1000, 25)
+	assert.Equal(t, conf.FailuresToReachProbability(1), 25)
+
+	conf = &FairnessTrackerConfig{Pi: .1, Lambda: .1}
+	assert.Equal(t, conf.FailuresToReachProbability(0), 0)
+	assert.Equal(t, conf.FailuresToReachProbability(.3), 3)
+	assert.Equal(t, conf.FailuresToReachProbability(.35), 4)
+	assert.Equal(t, conf.FailuresToReachProbability(1), 10)
+
+	conf.MaxProbability = .5
+	assert.Equal(t, conf.FailuresToReachProbability(.6), -1)
+	conf.MaxProbability = 0
+
+	// The decay makes it take longer, up to never reaching the limit of the series
+	// .1 / (1 - exp(-.1)) ~= 1.05
+	assert.Equal(t, conf.FailuresToReachProbabilityWithInterval(.3, 0), 3)
+	assert.Equal(t, conf.FailuresToReachProbabilityWithInterval(.3, time.Second), 4)
+	assert.Equal(t, conf.FailuresToReachProbabilityWithInterval(1, time.Second), 31)
+	assert.Equal(t, conf.FailuresToReachProbabilityWithInterval(1, 10*time.Second), -1)
 }
 
-func TestGenerateTunedStructureConfig(t *testing.T) {
-	conf := GenerateTunedStructureConfig(1000, 1000, 25)
-	assert.Equal(t, int(conf.L), 3)
-	assert.Equal(t, int(conf.M), 1000)
-	assert.Equal(t, conf.Pi*25, float64(1))
-	assert.Equal(t, conf.Pd*25*1000, float64(1))
+func TestSuggestedBackoff(t *testing.T) {
+	conf := &FairnessTrackerConfig{}
+	assert.Equal(t, conf.SuggestedBackoff(.5), time.Duration(0))
+
+	conf.BackoffBase = 100 * time.Millisecond
+	assert.Equal(t, conf.SuggestedBackoff(0), 100*time.Millisecond)
+	assert.Equal(t, conf.SuggestedBackoff(.1), 200*time.Millisecond)
+	assert.Equal(t, conf.SuggestedBackoff(1), 1024*100*time.Millisecond)
+	// Out of range probabilities are clamped
+	assert.Equal(t, conf.SuggestedBackoff(2), conf.SuggestedBackoff(1))
+
+	prev := conf.SuggestedBackoff(0)
+	for p := .05; p <= 1; p += .05 {
+		backoff := conf.SuggestedBackoff(p)
+		assert.Greater(t, backoff, prev, "probability %f", p)
+		prev = backoff
+	}
+}
+
+func TestGenerateTunedStructureConfigWithReport(t *testing.T) {
+	// A single bad flow in many buckets needs very few levels, so the floor applies
+	conf, report := GenerateTunedStructureConfigWithReport(1000, 1000, 25)
+	assert.True(t, report.MinLApplied)
+	assert.Less(t, report.RawL, report.L)
+	assert.Equal(t, report.L, uint32(minL))
+	assert.Equal(t, conf.L, report.L)
+	assert.Equal(t, report.M, conf.M)
+	assert.Equal(t, report.CollisionProbability, CollisionProbability(conf.M, report.ExpectedBadFlows, conf.L))
+
+	conf, report = GenerateTunedStructureConfigWithReport(1_000_000, 1000, 25)
+	assert.False(t, report.MinLApplied)
+	assert.False(t, report.MaxLApplied)
+	assert.Equal(t, report.RawL, report.L)
+	assert.Equal(t, conf.L, report.L)
+	assert.LessOrEqual(t, report.CollisionProbability, lowProbability)
+
+	// Nearly every bucket is taken by a bad flow, so L is capped and misses the target
+	conf, report = GenerateTunedStructureConfigWithReport(1_000_000, 100, 25)
+	assert.True(t, report.MaxLApplied)
+	assert.Greater(t, report.RawL, MaxL)
+	assert.Less(t, report.RawL, uint32(math.MaxUint32))
+	assert.Equal(t, report.L, MaxL)
+	assert.Equal(t, conf.L, MaxL)
+	assert.Greater(t, report.CollisionProbability, lowProbability)
+
+	// Every bucket is taken, so no L reaches the target
+	_, report = GenerateTunedStructureConfigWithReport(1_000_000, 1, 25)
+	assert.True(t, report.MaxLApplied)
+	assert.Equal(t, report.RawL, uint32(math.MaxUint32))
+	assert.Equal(t, report.L, MaxL)
+}
+
+func TestExplainTuning(t *testing.T) {
+	conf, report := GenerateTunedStructureConfigWithReport(1000, 1000, 25)
+	exp := ExplainTuning(1000, 1000, 25)
+	assert.Equal(t, exp.TuningReport, report)
+	assert.Equal(t, exp.Pi, conf.Pi)
+	assert.Equal(t, exp.Pd, conf.Pd)
+	assert.Contains(t, exp.Notes[1], "floored")
+
+	exp = ExplainTuning(1_000_000, 1000, 25)
+	assert.False(t, exp.MinLApplied)
+	assert.Contains(t, exp.Notes[1], "achieves")
+
+	exp = ExplainTuning(1_000_000, 100, 25)
+	assert.True(t, exp.MaxLApplied)
+	assert.Contains(t, exp.Notes[1], "capped")
+}
+
+func TestCalculateLCapped(t *testing.T) {
+	// Every bucket is nearly certainly taken by a bad flow, so no L is enough
+	assert.Equal(t, CalculateL(2, 1000, lowProbability), MaxL)
+	assert.Equal(t, CalculateL(1, 1, lowProbability), MaxL)
+	assert.Equal(t, CalculateL(1000, 1, lowProbability), uint32(2))
 }
 
-func TestDefaultStructureConfig(t *testing.T) {
-	conf := DefaultFairnessTrackerConfig()
-	assert.Equal(t, int(conf.L), 3)
-	assert.Equal(t, int(conf.M), 1000)
-	assert.Equal(t, conf.Pi*25, float64(1))
-	assert.Equal(t, conf.Pd*25*1000, float64(1))
+func TestTuneForMemoryBudget(t *testing.T) {
+	for _, budget := range []uint64{1 << 10, 1 << 16, 1 << 20, 64 << 20} {
+		for _, flows := range []uint32{100, 100_000, 10_000_000} {
+			conf := TuneForMemoryBudget(budget, flows)
+			used := uint64(conf.L) * uint64(conf.M) * BucketMemoryBytes * 2
+			assert.LessOrEqual(t, used, budget, "budget %d flows %d", budget, flows)
+			assert.GreaterOrEqual(t, conf.L, uint32(minL))
+			assert.Greater(t, conf.Pi, float64(0))
+
+			// One more bucket per level wouldn't fit
+			assert.Greater(t, uint64(conf.L)*uint64(conf.M+1)*BucketMemoryBytes*2, budget, "budget %d flows %d", budget, flows)
+		}
+	}
+
+	// 64MB fits a lot of buckets with the minimum levels
+	conf := TuneForMemoryBudget(64<<20, 1000)
+	assert.Equal(t, conf.L, uint32(minL))
+	assert.Equal(t, conf.M, uint32(64<<20/(2*minL*BucketMemoryBytes)))
 }
@@ -1,6 +1,47 @@
 package config
 
-import "time"
+import (
+	"fmt"
+	"reflect"
+	"time"
+)
+
+// The model the buckets use to track the throttling probability
+type BucketModel int
+
+const (
+	// The probability model adds Pi to the bucket probability on a failure and
+	// subtracts Pd on a success.
+	BucketModelProbability BucketModel = iota
+
+	// The ratio model tracks decayed success and failure counts in every bucket
+	// and uses the smoothed failure ratio failures/(successes+failures+RatioSmoothing)
+	// as the bucket probability. Pi and Pd are not used by this model.
+	BucketModelRatio
+
+	// The EWMA model keeps an exponentially weighted moving average of the outcomes in
+	// every bucket, feeding 1 for a failure and 0 for a success with a weight of
+	// EWMAAlpha, and uses it as the bucket probability. A failure and a success count
+	// the same, so the probability recovers as fast as it rises and converges to the
+	// failure rate of the flow. Deltas are weighted in units of Pi and Pd.
+	BucketModelEWMA
+)
+
+// How the probabilities decay with the time since a bucket was last updated
+type DecayStrategy int
+
+const (
+	// The exponential decay multiplies the probability by exp(-Lambda * t), with t the
+	// elapsed seconds
+	DecayExponential DecayStrategy = iota
+
+	// The linear decay subtracts Lambda per elapsed second from the probability
+	DecayLinear
+
+	// The step decay keeps the probability as is until the bucket has been idle for
+	// DecayStepIdle, then resets it to 0. Lambda is not used by this strategy.
+	DecayStep
+)
 
 // The config for the underlying data structure. Largely for internal use.
 type FairnessTrackerConfig struct {
@@ -8,16 +49,184 @@ type FairnessTrackerConfig struct {
 	M uint32
 	// Number of levels in the structure
 	L uint32
+	// The seed of the murmur hashes of the structures. A random seed is picked for every
+	// structure if nil. Setting it makes the bucket indexes reproducible, e.g. in tests,
+	// but a tracker's rotations then no longer reshuffle the flows across the buckets.
+	MurmurSeed *uint32
+	// The size of the row at every level, overriding M when set. Must have exactly L
+	// positive entries. Shapes the collisions at every level independently.
+	MPerLevel []uint32
 	// The delta P to add to a bucket's probability when there's an error
 	Pi float64
 	// The delta P to subtract from a bucket's probability when there's a success
 	Pd float64
-	// The exponential decay rate for the probabilities
+	// The floor of the delta P subtracted on a success, so flows recover in a reasonable
+	// number of successes even with a tiny Pd. The larger of Pd and MinPd is used. 0 disables it.
+	MinPd float64
+	// The decay rate for the probabilities, see DecayStrategy
 	Lambda float64
-	// The frequency of rotation
+	// How the probabilities decay with time. The default is DecayExponential.
+	DecayStrategy DecayStrategy
+	// The idle time after which DecayStep resets a bucket. Must be positive with DecayStep.
+	DecayStepIdle time.Duration
+	// Only write the decay back to the buckets when an outcome is reported. RegisterRequest
+	// still decides with the decayed probabilities but leaves the buckets and their last
+	// update times as they are, so registering a request doesn't write to the buckets
+	// unless it seeds them after a rotation. The bucket locks are still taken.
+	DecayOnReportOnly bool
+	// The fraction of the reported outcomes applied to the buckets, to save the updates
+	// under a very high load. The applied ones are scaled by 1/SampleRate so the expected
+	// probabilities stay the same, at the cost of more noise. Registering requests is not
+	// sampled. Must be in (0, 1]; 0 means 1, i.e. every outcome is applied.
+	SampleRate float64
+	// The fraction of Pi to add to a bucket's probability when there's a timeout. Must be
+	// in [0, 1]. The default of 0 makes reporting a timeout a no-op.
+	TimeoutPenaltyFraction float64
+	// The frequency of rotation. A zero or negative value disables the rotation and
+	// the structures stay fixed for the lifetime of the tracker.
 	RotationFrequency time.Duration
+	// The max random offset added to or subtracted from the RotationFrequency for every
+	// rotation, so instances started together don't rotate in lockstep. Must be less than
+	// the RotationFrequency. The default of 0 rotates at a fixed frequency.
+	RotationJitter time.Duration
+	// Update the secondary structure along with the main one on every request and outcome,
+	// so the structure taking over at a rotation already knows the bad flows. Turning it
+	// off halves the hashing and locking work, but every rotation then starts with a
+	// structure that has only seen the requests since the previous rotation. Nil means true.
+	WarmSecondary *bool
+	// The interval of a background sweep applying the pending decay to all buckets, so
+	// idle buckets don't keep stale probabilities until a request touches them. A zero or
+	// negative value disables the sweep, which is the default.
+	DecaySweepInterval time.Duration
+	// The age after which the sweep resets a bucket that no request touched to a pristine
+	// zero state, so stale buckets don't inflate the occupancy. While set, the sweep only
+	// evicts and leaves the pending decay of younger buckets to the requests. Requires the
+	// DecaySweepInterval to be set. The default of 0 disables the eviction.
+	MaxBucketAge time.Duration
+	// The max number of dimensions of RegisterRequestMulti and ReportOutcomeMulti. Every
+	// dimension keeps its own pair of structures, so calls with more keys are rejected
+	// instead of growing the memory without a bound. The default of 0 allows 8 dimensions.
+	MaxDimensions uint32
+	// The max number of requests throttled per second across all flows, so a storm never
+	// drops more traffic than the downstream systems can absorb. Requests that should be
+	// throttled are let through once it's reached. The default of 0 disables the cap.
+	MaxThrottlesPerSecond float64
+	// The backoff suggested to a throttled request at a final probability of 0. The
+	// suggestion doubles with every tenth of the final probability, see SuggestedBackoff.
+	// The default of 0 disables the suggestions.
+	BackoffBase time.Duration
+	// Observe only: the tracker computes every decision as usual but lets all the requests
+	// through, counting the ones it would have throttled, to validate a config before
+	// enforcing it.
+	DryRun bool
 	// Include result stats. Useful for debugging but may slightly affect performance.
 	IncludeStats bool
 	// The function to choose the final probability from all the bucket probabilities
 	FinalProbabilityFunction FinalProbabilityFunction
+	// The function to choose the final probability knowing the level and index of every
+	// bucket. Takes precedence over FinalProbabilityFunction if set, which may then be nil.
+	FinalProbabilityFunctionEx FinalProbabilityFuncEx
+	// The function to canonicalize the client identifiers before hashing them, so keys
+	// that only differ in insignificant ways are tracked as one flow. Nil keeps them as is.
+	KeyNormalizer KeyNormalizer
+	// Called with the ID of every structure created by a rotation, e.g. to prepare an
+	// external cache for it. Runs on the rotating goroutine outside of any lock, so a
+	// long-running callback delays the rotation and should spawn its own goroutine.
+	OnStructureCreated func(id uint64)
+	// Called with the ID of every structure retired by a rotation, e.g. to ship its last
+	// snapshot. Runs like OnStructureCreated, after OnStructureCreated.
+	OnStructureRetired func(id uint64)
+	// The model used by the buckets to track the throttling probability
+	BucketModel BucketModel
+	// Scale Pi down when the failure rate across all flows is high, which signals a
+	// systemic problem rather than a single abusive flow
+	AdaptiveMode bool
+	// The ceiling of the bucket and final probabilities, so a misbehaving flow is never
+	// fully locked out which could mask its recovery. Must be in (0, 1]; 0 means 1.
+	MaxProbability float64
+	// The final probability at or above which a flow is considered fully blocked by
+	// IsBlocked. Must be in (0, 1]; 0 means 0.99. A threshold above MaxProbability
+	// never reports a flow as blocked.
+	BlockThreshold float64
+	// The number of requests a structure must register before it's allowed to throttle.
+	// Avoids throttling on noise right after startup or rotation. 0 disables it.
+	WarmUpRequests uint64
+	// The time since its creation before a structure is allowed to throttle. 0 disables it.
+	WarmUpDuration time.Duration
+	// The smoothing added to the denominator of the failure ratio in BucketModelRatio
+	// so a handful of failures don't immediately throttle a flow.
+	RatioSmoothing float64
+	// The weight of a new outcome in the moving average of BucketModelEWMA. Must be in
+	// (0, 1] with that model. Higher values react faster but are noisier.
+	EWMAAlpha float64
+	// Throttle an exact fraction of the requests instead of throttling every request
+	// at random with the final probability. A structure accumulates the final
+	// probabilities of the requests at the bucket with the lowest probability of every
+	// request and throttles whenever the sum there reaches 1, so the decisions are
+	// reproducible and every flow loses about its own share. Trades the randomness for
+	// predictability and takes another 8 bytes per bucket.
+	DeterministicThrottle bool
+}
+
+// A human-readable summary of the main parameters, e.g. for startup logs. The final
+// probability function is named if it's one of the built-ins.
+func (c FairnessTrackerConfig) String() string {
+	return fmt.Sprintf("FairnessTrackerConfig{L=%d M=%d Pi=%g Pd=%g Lambda=%g RotationFrequency=%v IncludeStats=%t FinalProbabilityFunction=%s}",
+		c.L, c.M, c.Pi, c.Pd, c.Lambda, c.RotationFrequency, c.IncludeStats, c.finalProbabilityFunctionName())
+}
+
+func (c FairnessTrackerConfig) finalProbabilityFunctionName() string {
+	if c.FinalProbabilityFunctionEx != nil {
+		return "CustomEx"
+	}
+	return FinalProbabilityFunctionName(c.FinalProbabilityFunction)
+}
+
+// The name of a final probability function, detected by comparing the function pointer
+// with the built-ins. Other functions are named Custom.
+func FinalProbabilityFunctionName(fn FinalProbabilityFunction) string {
+	if fn == nil {
+		return "nil"
+	}
+
+	switch reflect.ValueOf(fn).Pointer() {
+	case reflect.ValueOf(MinFinalProbabilityFunction).Pointer():
+		return "MinFinalProbabilityFunction"
+	case reflect.ValueOf(MeanFinalProbabilityFunction).Pointer():
+		return "MeanFinalProbabilityFunction"
+	default:
+		return "Custom"
+	}
+}
+
+// The report of how GenerateTunedStructureConfigWithReport chose the structure parameters
+type TuningReport struct {
+	// The number of buckets per level (M in the config)
+	M uint32
+	// The expected number of "bad" client flows that'll need throttling
+	ExpectedBadFlows uint32
+	// The number of levels achieving the target collision probability, before the floor
+	// and the cap. math.MaxUint32 if no number of levels achieves it.
+	RawL uint32
+	// The number of levels in the config (L in the config)
+	L uint32
+	// If true, RawL was below the minimum number of levels and L was floored
+	MinLApplied bool
+	// If true, RawL was above MaxL and L was capped, so the collision probability misses
+	// the target
+	MaxLApplied bool
+	// The probability of an innocent flow colliding with bad flows at every level with L
+	CollisionProbability float64
+}
+
+// The explanation of how GenerateTunedStructureConfig arrives at the config for given inputs
+type TuningExplanation struct {
+	// The structure parameters as reported by GenerateTunedStructureConfigWithReport
+	TuningReport
+	// The delta P added to a bucket on a failure
+	Pi float64
+	// The delta P subtracted from a bucket on a success
+	Pd float64
+	// Plain-language notes about the decisions made while tuning
+	Notes []string
 }
@@ -0,0 +1,28 @@
+package config
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigString(t *testing.T) {
+	conf := DefaultFairnessTrackerConfig()
+	str := conf.String()
+	assert.Contains(t, str, "L=3")
+	assert.Contains(t, str, "M=1000")
+	assert.Contains(t, str, "RotationFrequency=5m0s")
+	assert.Contains(t, str, "FinalProbabilityFunction=MinFinalProbabilityFunction")
+	assert.False(t, strings.Contains(str, "0x"), "no function pointers: %s", str)
+
+	conf.FinalProbabilityFunction = MeanFinalProbabilityFunction
+	assert.Contains(t, conf.String(), "FinalProbabilityFunction=MeanFinalProbabilityFunction")
+
+	conf.FinalProbabilityFunction = PercentileFinalProbabilityFunction(.5)
+	assert.Contains(t, conf.String(), "FinalProbabilityFunction=Custom}")
+
+	conf.RotationFrequency = 90 * time.Second
+	assert.Contains(t, conf.String(), "RotationFrequency=1m30s")
+}
@@ -0,0 +1,200 @@
+package config
+
+import (
+	"time"
+
+	"github.com/satmihir/fair/pkg/utils"
+)
+
+const (
+	// The smallest positive rotation frequency. Rotating more often would spend
+	// most of the time rebuilding structures.
+	MinRotationFrequency = time.Millisecond
+	// The smallest positive interval of the decay sweep, which walks all buckets
+	MinDecaySweepInterval = time.Millisecond
+)
+
+// The error returned when a config fails validation. Carries the offending fields so
+// callers can react programmatically, e.g. by correcting Pi and Pd.
+type ValidationError struct {
+	*utils.BaseError
+	// The names of the offending fields of FairnessTrackerConfig
+	Fields []string
+	// The values of the offending fields, in the same order as Fields
+	Values []any
+}
+
+func NewValidationError(fields []string, values []any, msg string, args ...any) *ValidationError {
+	return &ValidationError{
+		BaseError: utils.NewBaseError(nil, msg, args...),
+		Fields:    fields,
+		Values:    values,
+	}
+}
+
+// Validate the whole config as a tracker does when it's built: the parameters of the
+// structures and the ones used by the tracker itself, e.g. the rotation
+func (conf *FairnessTrackerConfig) Validate() error {
+	if err := conf.ValidateStructure(); err != nil {
+		return err
+	}
+
+	if conf.FinalProbabilityFunction == nil && conf.FinalProbabilityFunctionEx == nil {
+		return NewValidationError([]string{"FinalProbabilityFunction"}, []any{nil},
+			"the FinalProbabilityFunction must not be nil unless the FinalProbabilityFunctionEx is set")
+	}
+
+	if conf.DecaySweepInterval > 0 && conf.DecaySweepInterval < MinDecaySweepInterval {
+		return NewValidationError([]string{"DecaySweepInterval"}, []any{conf.DecaySweepInterval},
+			"the DecaySweepInterval must be at least %v or <=0 to disable the sweep, found: %v",
+			MinDecaySweepInterval, conf.DecaySweepInterval)
+	}
+
+	// The eviction is driven by the sweeper
+	if conf.MaxBucketAge > 0 && conf.DecaySweepInterval <= 0 {
+		return NewValidationError([]string{"MaxBucketAge", "DecaySweepInterval"}, []any{conf.MaxBucketAge, conf.DecaySweepInterval},
+			"the MaxBucketAge requires the DecaySweepInterval to be set, found MaxBucketAge: %v", conf.MaxBucketAge)
+	}
+
+	if conf.MaxThrottlesPerSecond < 0 {
+		return NewValidationError([]string{"MaxThrottlesPerSecond"}, []any{conf.MaxThrottlesPerSecond},
+			"the MaxThrottlesPerSecond must not be negative, found: %f", conf.MaxThrottlesPerSecond)
+	}
+
+	if conf.RotationJitter < 0 {
+		return NewValidationError([]string{"RotationJitter"}, []any{conf.RotationJitter},
+			"the RotationJitter must not be negative, found: %v", conf.RotationJitter)
+	}
+	if conf.RotationFrequency > 0 && conf.RotationJitter >= conf.RotationFrequency {
+		return NewValidationError([]string{"RotationJitter", "RotationFrequency"}, []any{conf.RotationJitter, conf.RotationFrequency},
+			"the RotationJitter must be less than the RotationFrequency %v, found: %v", conf.RotationFrequency, conf.RotationJitter)
+	}
+
+	// Zero or negative disables the rotation
+	if conf.RotationFrequency > 0 && conf.RotationFrequency < MinRotationFrequency {
+		return NewValidationError([]string{"RotationFrequency"}, []any{conf.RotationFrequency},
+			"the RotationFrequency must be at least %v or <=0 to disable rotation, found: %v",
+			MinRotationFrequency, conf.RotationFrequency)
+	}
+
+	return nil
+}
+
+// Validate the parameters of the structures against their invariants. Validate checks
+// the rest of the config too.
+func (conf *FairnessTrackerConfig) ValidateStructure() error {
+	// M is not used when MPerLevel is set
+	if conf.L <= 0 || (conf.M <= 0 && conf.MPerLevel == nil) {
+		return NewValidationError([]string{"L", "M"}, []any{conf.L, conf.M},
+			"the values of L and M must be at least 1, found L: %d and M: %d", conf.L, conf.M)
+	}
+
+	// Refuse sizes that would allocate an absurd number of buckets up front
+	if conf.L > MaxL || (conf.MPerLevel == nil && conf.M > MaxM) {
+		return NewValidationError([]string{"L", "M"}, []any{conf.L, conf.M},
+			"the values of L and M must be at most %d and %d, found L: %d and M: %d", MaxL, MaxM, conf.L, conf.M)
+	}
+
+	if conf.MPerLevel != nil {
+		if uint32(len(conf.MPerLevel)) != conf.L {
+			return NewValidationError([]string{"MPerLevel", "L"}, []any{conf.MPerLevel, conf.L},
+				"the length of MPerLevel must be equal to L, found %d sizes for L: %d", len(conf.MPerLevel), conf.L)
+		}
+		for l, m := range conf.MPerLevel {
+			if m == 0 || m > MaxM {
+				return NewValidationError([]string{"MPerLevel"}, []any{conf.MPerLevel},
+					"the values of MPerLevel must be in [1, %d], found %d at level %d", MaxM, m, l)
+			}
+		}
+	}
+
+	if conf.TimeoutPenaltyFraction < 0 || conf.TimeoutPenaltyFraction > 1 {
+		return NewValidationError([]string{"TimeoutPenaltyFraction"}, []any{conf.TimeoutPenaltyFraction},
+			"the value of TimeoutPenaltyFraction must be in [0, 1], found: %f", conf.TimeoutPenaltyFraction)
+	}
+
+	// A negative decay rate would grow the probabilities over time instead
+	if conf.Lambda < 0 {
+		return NewValidationError([]string{"Lambda"}, []any{conf.Lambda},
+			"the value of Lambda must be >=0, found: %f", conf.Lambda)
+	}
+
+	if conf.WarmUpDuration < 0 {
+		return NewValidationError([]string{"WarmUpDuration"}, []any{conf.WarmUpDuration},
+			"the value of WarmUpDuration must be >=0, found: %v", conf.WarmUpDuration)
+	}
+
+	if conf.MaxProbability < 0 || conf.MaxProbability > 1 {
+		return NewValidationError([]string{"MaxProbability"}, []any{conf.MaxProbability},
+			"the value of MaxProbability must be in (0, 1] or 0 for the default of 1, found: %f", conf.MaxProbability)
+	}
+
+	if conf.BlockThreshold < 0 || conf.BlockThreshold > 1 {
+		return NewValidationError([]string{"BlockThreshold"}, []any{conf.BlockThreshold},
+			"the value of BlockThreshold must be in (0, 1] or 0 for the default, found: %f", conf.BlockThreshold)
+	}
+
+	if conf.RatioSmoothing < 0 {
+		return NewValidationError([]string{"RatioSmoothing"}, []any{conf.RatioSmoothing},
+			"the value of RatioSmoothing must be >=0, found: %f", conf.RatioSmoothing)
+	}
+
+	if conf.BucketModel == BucketModelEWMA && (conf.EWMAAlpha <= 0 || conf.EWMAAlpha > 1) {
+		return NewValidationError([]string{"EWMAAlpha"}, []any{conf.EWMAAlpha},
+			"the value of EWMAAlpha must be in (0, 1] with BucketModelEWMA, found: %f", conf.EWMAAlpha)
+	}
+
+	if conf.SampleRate < 0 || conf.SampleRate > 1 {
+		return NewValidationError([]string{"SampleRate"}, []any{conf.SampleRate},
+			"the value of SampleRate must be in (0, 1] or 0 for the default of 1, found: %f", conf.SampleRate)
+	}
+
+	if conf.DecayStrategy < DecayExponential || conf.DecayStrategy > DecayStep {
+		return NewValidationError([]string{"DecayStrategy"}, []any{conf.DecayStrategy},
+			"unknown DecayStrategy: %d", conf.DecayStrategy)
+	}
+
+	if conf.DecayStrategy == DecayStep && conf.DecayStepIdle <= 0 {
+		return NewValidationError([]string{"DecayStepIdle"}, []any{conf.DecayStepIdle},
+			"the value of DecayStepIdle must be positive with DecayStep, found: %v", conf.DecayStepIdle)
+	}
+
+	if conf.BackoffBase < 0 {
+		return NewValidationError([]string{"BackoffBase"}, []any{conf.BackoffBase},
+			"the value of BackoffBase must not be negative, found: %v", conf.BackoffBase)
+	}
+
+	if conf.MaxBucketAge < 0 {
+		return NewValidationError([]string{"MaxBucketAge"}, []any{conf.MaxBucketAge},
+			"the value of MaxBucketAge must not be negative, found: %v", conf.MaxBucketAge)
+	}
+
+	if conf.MinPd < 0 || conf.MinPd > 1 {
+		return NewValidationError([]string{"MinPd"}, []any{conf.MinPd},
+			"the value of MinPd must be in [0, 1], found: %f", conf.MinPd)
+	}
+
+	if conf.Pd <= 0 || conf.Pi <= 0 {
+		return NewValidationError([]string{"Pi", "Pd"}, []any{conf.Pi, conf.Pd},
+			"the values of Pi and Pd must >0, found Pi: %f and Pd: %f", conf.Pi, conf.Pd)
+	}
+
+	if conf.Pd > 1 || conf.Pi >= 1 {
+		return NewValidationError([]string{"Pi", "Pd"}, []any{conf.Pi, conf.Pd},
+			"the values of Pi and Pd must <=1, found Pi: %f and Pd: %f", conf.Pi, conf.Pd)
+	}
+
+	// The expectation is we quickly throttle the client when bad things start to happen
+	// but cautiously bring it back to avoid retry-storms.
+	if conf.Pi <= conf.Pd {
+		return NewValidationError([]string{"Pi", "Pd"}, []any{conf.Pi, conf.Pd},
+			"the value of Pd is expected to be smaller than Pi")
+	}
+
+	if conf.Pi <= conf.MinPd {
+		return NewValidationError([]string{"Pi", "MinPd"}, []any{conf.Pi, conf.MinPd},
+			"the value of MinPd is expected to be smaller than Pi")
+	}
+
+	return nil
+}
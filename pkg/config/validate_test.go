@@ -0,0 +1,98 @@
+package config
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateStructConfig(t *testing.T) {
+	conf := &FairnessTrackerConfig{
+		L: 0,
+	}
+
+	err := conf.ValidateStructure()
+	assert.Error(t, err)
+
+	conf = &FairnessTrackerConfig{
+		L: 1,
+		M: 0,
+	}
+
+	err = conf.ValidateStructure()
+	assert.Error(t, err)
+
+	conf = &FairnessTrackerConfig{
+		L:  1,
+		M:  1,
+		Pd: 0,
+		Pi: 0,
+	}
+
+	err = conf.ValidateStructure()
+	assert.Error(t, err)
+
+	conf = &FairnessTrackerConfig{
+		L:  1,
+		M:  1,
+		Pd: 10,
+		Pi: 10,
+	}
+
+	err = conf.ValidateStructure()
+	assert.Error(t, err)
+
+	conf = &FairnessTrackerConfig{
+		L:  1,
+		M:  1,
+		Pd: .15,
+		Pi: .1,
+	}
+
+	err = conf.ValidateStructure()
+	assert.Error(t, err)
+
+	conf = &FairnessTrackerConfig{
+		L:  1,
+		M:  1,
+		Pd: .1,
+		Pi: .15,
+	}
+
+	err = conf.ValidateStructure()
+	assert.NoError(t, err)
+
+	conf.BackoffBase = -time.Second
+	err = conf.ValidateStructure()
+	assert.Error(t, err)
+}
+
+func TestValidate(t *testing.T) {
+	assert.NoError(t, DefaultFairnessTrackerConfig().Validate())
+
+	cases := []struct {
+		mutate func(*FairnessTrackerConfig)
+		fields []string
+	}{
+		{func(c *FairnessTrackerConfig) { c.Pi = 1 }, []string{"Pi", "Pd"}},
+		{func(c *FairnessTrackerConfig) { c.MaxProbability = 2 }, []string{"MaxProbability"}},
+		{func(c *FairnessTrackerConfig) { c.FinalProbabilityFunction = nil }, []string{"FinalProbabilityFunction"}},
+		{func(c *FairnessTrackerConfig) { c.DecaySweepInterval = time.Microsecond }, []string{"DecaySweepInterval"}},
+		{func(c *FairnessTrackerConfig) { c.MaxBucketAge = time.Minute }, []string{"MaxBucketAge", "DecaySweepInterval"}},
+		{func(c *FairnessTrackerConfig) { c.MaxThrottlesPerSecond = -1 }, []string{"MaxThrottlesPerSecond"}},
+		{func(c *FairnessTrackerConfig) { c.RotationJitter = -time.Second }, []string{"RotationJitter"}},
+		{func(c *FairnessTrackerConfig) { c.RotationJitter = c.RotationFrequency }, []string{"RotationJitter", "RotationFrequency"}},
+		{func(c *FairnessTrackerConfig) { c.RotationFrequency = time.Microsecond }, []string{"RotationFrequency"}},
+	}
+
+	for i, tc := range cases {
+		conf := DefaultFairnessTrackerConfig()
+		tc.mutate(conf)
+
+		var validationErr *ValidationError
+		assert.True(t, errors.As(conf.Validate(), &validationErr), "case %d", i)
+		assert.Equal(t, validationErr.Fields, tc.fields, "case %d", i)
+	}
+}
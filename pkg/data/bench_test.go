@@ -0,0 +1,113 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/satmihir/fair/pkg/config"
+	"github.com/satmihir/fair/pkg/request"
+)
+
+// How to read these benchmarks:
+//
+// The DistinctKeys variants spread the requests over many flows, so the buckets being
+// touched are mostly different and the per-bucket mutexes are rarely contended. They
+// measure the raw cost of hashing and visiting L buckets.
+//
+// The HotKey variants send every request to the same flow, so all of them land on the
+// same L buckets. In the parallel benchmark this is the worst case for the per-bucket
+// mutexes. The gap between the two variants shows the cost of contention, which is what
+// any lock or atomic redesign of the buckets should shrink.
+//
+// Run with: go test -run '^$' -bench . -benchmem ./pkg/data
+
+const benchDistinctKeys = 10000
+
+func benchStructure(b *testing.B) *Structure {
+	b.Helper()
+
+	s, err := NewStructure(config.DefaultFairnessTrackerConfig(), 1, false)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return s
+}
+
+func benchKeys(hot bool) [][]byte {
+	if hot {
+		return [][]byte{[]byte("hot_client")}
+	}
+
+	keys := make([][]byte, benchDistinctKeys)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("client_%d", i))
+	}
+	return keys
+}
+
+func benchVariants(b *testing.B, fn func(b *testing.B, keys [][]byte)) {
+	b.Run("DistinctKeys", func(b *testing.B) { fn(b, benchKeys(false)) })
+	b.Run("HotKey", func(b *testing.B) { fn(b, benchKeys(true)) })
+}
+
+func BenchmarkRegisterRequest(b *testing.B) {
+	benchVariants(b, func(b *testing.B, keys [][]byte) {
+		s := benchStructure(b)
+		ctx := context.Background()
+
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := s.RegisterRequest(ctx, keys[i%len(keys)]); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkReportOutcome(b *testing.B) {
+	benchVariants(b, func(b *testing.B, keys [][]byte) {
+		s := benchStructure(b)
+		ctx := context.Background()
+
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := s.ReportOutcome(ctx, keys[i%len(keys)], request.OutcomeFailure); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// Every iteration registers a request and reports its outcome, with one in ten failing
+func BenchmarkConcurrentMixed(b *testing.B) {
+	benchVariants(b, func(b *testing.B, keys [][]byte) {
+		s := benchStructure(b)
+		ctx := context.Background()
+
+		b.ReportAllocs()
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			i := 0
+			for pb.Next() {
+				key := keys[i%len(keys)]
+				if _, err := s.RegisterRequest(ctx, key); err != nil {
+					b.Error(err)
+					return
+				}
+
+				outcome := request.OutcomeSuccess
+				if i%10 == 0 {
+					outcome = request.OutcomeFailure
+				}
+				if _, err := s.ReportOutcome(ctx, key, outcome); err != nil {
+					b.Error(err)
+					return
+				}
+				i++
+			}
+		})
+	})
+}
@@ -2,78 +2,212 @@ package data
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"math"
 	"math/rand"
-	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/spaolacci/murmur3"
 
 	"github.com/satmihir/fair/pkg/config"
+	"github.com/satmihir/fair/pkg/logger"
 	"github.com/satmihir/fair/pkg/request"
 	"github.com/satmihir/fair/pkg/utils"
 )
 
+const (
+	// The weight of a new outcome in the moving global failure rate of the adaptive mode
+	adaptiveEWMAAlpha = 0.01
+	// The smallest fraction of Pi used by the adaptive mode, so flows are still throttled
+	// in a full outage
+	adaptiveMinPiScale = 0.1
+	// The drop in the probability of a bucket from a single decay that is worth logging
+	largeDecayToLog = 0.25
+	// The value below which a decayed probability is considered to be 0
+	minDecayedProbability = 1e-9
+	// The probability above which a bucket is reported by ActiveBuckets
+	activeBucketEpsilon = 1e-6
+	// The final probability at or above which a flow is considered blocked when the
+	// config doesn't set one
+	defaultBlockThreshold = 0.99
+)
+
 // Represents a bucket in the leveled structure
 type bucket struct {
 	// Probability that a request falling on this bucket should be dropped
 	probability float64
+	// Decayed count of successes reported to this bucket. Only used by the ratio model.
+	successes float64
+	// Decayed count of failures reported to this bucket. Only used by the ratio model.
+	failures float64
 	// Time in millis since the bucket was last updated
 	lastUpdatedTimeMillis uint64
-	// A mutex to protect the state of this bucket from concurrent access
-	lock *sync.Mutex
-}
-
-func newBucket(clock utils.IClock) *bucket {
-	return &bucket{
-		probability:           0,
-		lastUpdatedTimeMillis: uint64(clock.Now().UnixMilli()),
-		lock:                  &sync.Mutex{},
-	}
 }
 
 // Implements IStructure with a multi-leveled Bloom filter bucket structure
 // to track the throttling probability Pt that starts with 0 for all buckets
 // and increases when resource contention is experienced and decreases when
-// requests are successful.
+// requests are successful. With the ratio bucket model, Pt is instead the smoothed
+// ratio of the decayed failure and success counts of the bucket.
 type Structure struct {
-	// The data at all levels. Every value is a float64 representing the probability
-	// of throttling the request.
-	levels [][]*bucket
+	// The buckets at all levels
+	store BucketStore
 	// The config associated with this structure
 	config *config.FairnessTrackerConfig
 	// The unique ID of the structure
 	id uint64
-	// The murmur hash seed
-	murmurSeed uint32
+	// The murmur hash seed, which Import may replace
+	murmurSeed atomic.Uint32
 	// The clock to use for getting the time
 	clock utils.IClock
 	// Includes stats in results. Useful for debugging but may slightly affect performance.
 	includeStats bool
+	// The function to choose the final probability. Starts as the one in the config
+	// and may be swapped at runtime.
+	finalProbabilityFunction atomic.Pointer[config.FinalProbabilityFunction]
+	// The structure to carry probabilities forward from while warming up, if any
+	seedSource atomic.Pointer[Structure]
+	// The moving average of the global failure rate used by the adaptive mode
+	globalFailureRate FailureRate
+	// The failure rate shared by the structures of a tracker, if set with ShareFailureRate.
+	// It replaces the own failure rate and is only read by the structure.
+	sharedFailureRate atomic.Pointer[FailureRate]
+	// The ceiling of the bucket and final probabilities
+	maxProbability float64
+	// The effective delta P subtracted on a success, Pd raised to MinPd
+	pd float64
+	// The fraction of the reported outcomes that are applied
+	sampleRate float64
+	// The final probability at or above which a flow is considered blocked
+	blockThreshold float64
+	// The time the structure was created at according to its clock
+	createdAt time.Time
+	// The number of requests registered with the structure, for the warm-up
+	requestCount atomic.Uint64
+	// The logger for the diagnostics emitted when includeStats is set
+	logger atomic.Pointer[logger.Logger]
+	// The bits of the accumulated final probabilities not yet spent on a throttle for
+	// every bucket by level, used by the deterministic throttle. Nil without it.
+	throttleCredits [][]atomic.Uint64
 }
 
 func NewStructureWithClock(config *config.FairnessTrackerConfig, id uint64, includeStats bool, clock utils.IClock) (*Structure, error) {
-	if err := validateStructureConfig(config); err != nil {
+	return NewStructureWithStore(config, id, includeStats, clock, newBucketStore)
+}
+
+// Create a structure that keeps its buckets in the store made by the factory instead of
+// the default in-memory one
+func NewStructureWithStore(config *config.FairnessTrackerConfig, id uint64, includeStats bool, clock utils.IClock, factory BucketStoreFactory) (*Structure, error) {
+	if err := config.ValidateStructure(); err != nil {
 		return nil, NewDataError(err, "The input config failed validation: %v", config)
 	}
+	if factory == nil {
+		return nil, NewDataError(nil, "The bucket store factory must not be nil")
+	}
+
+	sizes := make([]uint32, config.L)
+	for i := range sizes {
+		sizes[i] = levelSize(config, i)
+	}
+	store := factory(sizes, uint64(clock.Now().UnixMilli()))
+	for i, size := range sizes {
+		if store.Len(uint32(i)) != size {
+			return nil, NewDataError(nil, "The bucket store has %d buckets at level %d but the config expects %d", store.Len(uint32(i)), i, size)
+		}
+	}
+
+	// An unset MaxProbability means no cap below 1
+	maxProbability := 1.
+	if config.MaxProbability > 0 {
+		maxProbability = config.MaxProbability
+	}
 
-	levels := make([][]*bucket, config.L)
-	for i := 0; i < int(config.L); i++ {
-		levels[i] = make([]*bucket, config.M)
+	blockThreshold := defaultBlockThreshold
+	if config.BlockThreshold > 0 {
+		blockThreshold = config.BlockThreshold
+	}
+
+	// An unset SampleRate means every outcome is applied
+	sampleRate := 1.
+	if config.SampleRate > 0 {
+		sampleRate = config.SampleRate
+	}
 
-		for j := 0; j < int(config.M); j++ {
-			levels[i][j] = newBucket(clock)
+	murmurSeed := rand.Uint32()
+	if config.MurmurSeed != nil {
+		murmurSeed = *config.MurmurSeed
+	}
+
+	s := &Structure{
+		store:          store,
+		config:         config,
+		id:             id,
+		clock:          clock,
+		includeStats:   includeStats,
+		maxProbability: maxProbability,
+		pd:             math.Max(config.Pd, config.MinPd),
+		sampleRate:     sampleRate,
+		blockThreshold: blockThreshold,
+		createdAt:      clock.Now(),
+	}
+	if config.DeterministicThrottle {
+		s.throttleCredits = make([][]atomic.Uint64, config.L)
+		for l, size := range sizes {
+			s.throttleCredits[l] = make([]atomic.Uint64, size)
 		}
 	}
+	s.murmurSeed.Store(murmurSeed)
+	s.SetLogger(nil)
+	s.SetFinalProbabilityFunction(config.FinalProbabilityFunction)
 
-	return &Structure{
-		levels:       levels,
-		config:       config,
-		id:           id,
-		murmurSeed:   rand.Uint32(),
-		clock:        clock,
-		includeStats: includeStats,
-	}, nil
+	return s, nil
+}
+
+// Restore a structure from a state previously taken with Structure.State
+func NewStructureFromState(state *StructureState, includeStats bool, clock utils.IClock) (*Structure, error) {
+	if err := checkStateLayout(state.Config, state.Buckets); err != nil {
+		return nil, err
+	}
+
+	s, err := NewStructureWithClock(state.Config, state.ID, includeStats, clock)
+	if err != nil {
+		return nil, err
+	}
+
+	s.restoreBuckets(state.MurmurSeed, state.Buckets)
+	return s, nil
+}
+
+// Check that the bucket states have the levels and level sizes of the config
+func checkStateLayout(conf *config.FairnessTrackerConfig, buckets [][]BucketState) error {
+	if uint32(len(buckets)) != conf.L {
+		return NewDataError(nil, "The state has %d levels but the config expects %d", len(buckets), conf.L)
+	}
+	for l, lvl := range buckets {
+		if uint32(len(lvl)) != levelSize(conf, l) {
+			return NewDataError(nil, "The state has %d buckets at level %d but the config expects %d", len(lvl), l, levelSize(conf, l))
+		}
+	}
+	return nil
+}
+
+// Overwrite the seed and every bucket with the given states of a matching layout
+func (s *Structure) restoreBuckets(murmurSeed uint32, buckets [][]BucketState) {
+	s.murmurSeed.Store(murmurSeed)
+	for l, lvl := range buckets {
+		for m, b := range lvl {
+			s.store.Lock(uint32(l), uint32(m))
+			s.storeBucket(uint32(l), uint32(m), &bucket{
+				probability:           b.Probability,
+				successes:             b.Successes,
+				failures:              b.Failures,
+				lastUpdatedTimeMillis: b.LastUpdatedTimeMillis,
+			})
+			s.store.Unlock(uint32(l), uint32(m))
+		}
+	}
 }
 
 func NewStructure(config *config.FairnessTrackerConfig, id uint64, includeStats bool) (*Structure, error) {
@@ -84,17 +218,107 @@ func (s *Structure) GetID() uint64 {
 	return s.id
 }
 
+// Get how long the structure has existed at the given time. Useful to distrust the
+// decisions of a structure that was created very recently.
+func (s *Structure) Age(now time.Time) time.Duration {
+	if now.Before(s.createdAt) {
+		return 0
+	}
+	return now.Sub(s.createdAt)
+}
+
 func (s *Structure) Close() {
 }
 
-func (s *Structure) RegisterRequest(_ context.Context, clientIdentifier []byte) (*request.RegisterRequestResult, error) {
+// Atomically swap the function used to choose the final probability by subsequent
+// RegisterRequest calls. In-flight calls keep using the function they started with.
+func (s *Structure) SetFinalProbabilityFunction(fn config.FinalProbabilityFunction) {
+	s.finalProbabilityFunction.Store(&fn)
+}
+
+// Set the logger for the diagnostics of the structure. A nil logger means the global one
+// at the time of the call. Diagnostics are only emitted when includeStats is set.
+func (s *Structure) SetLogger(l logger.Logger) {
+	if l == nil {
+		l = logger.GetLogger()
+	}
+	s.logger.Store(&l)
+}
+
+func (s *Structure) debugf(ctx context.Context, format string, v ...any) {
+	if !s.includeStats {
+		return
+	}
+	// The logger of the request takes precedence over the one of the structure
+	if l := logger.LoggerFromContext(ctx); l != nil {
+		l.Debugf(format, v...)
+		return
+	}
+	(*s.logger.Load()).Debugf(format, v...)
+}
+
+// Seed this structure from another one so flows don't get a clean slate when it
+// replaces the other structure. Since the murmur seeds of the two structures differ,
+// the buckets of one can't be mapped to the other directly. Instead, the copy is made
+// lazily as the hashing allows: whenever a flow registers a request with this structure,
+// its buckets are raised to at least the decayed final probability of the same flow in
+// the other structure. The approximation is that a bucket shared by several flows takes
+// the highest seeded probability among them. Seeding only applies to the probability
+// bucket model. Passing nil stops the seeding and releases the other structure.
+func (s *Structure) Seed(other *Structure) {
+	s.seedSource.Store(other)
+}
+
+// Set the probability of all buckets of the client, clamped to [0, MaxProbability], e.g.
+// to throttle a flow known to be abusive elsewhere right away. Other flows sharing any of
+// the buckets are affected too, on every level they collide. With the ratio model, the
+// probability only holds until the next outcome reported to the bucket.
+func (s *Structure) SeedClient(clientIdentifier []byte, probability float64) {
+	probability = math.Min(math.Max(probability, 0), s.maxProbability)
+
+	// We can ignore the error since the handler never returns one
+	_ = s.visitBuckets(context.Background(), clientIdentifier, false, func(_ uint32, _ uint32, b *bucket) error {
+		b.probability = probability
+		return nil
+	})
+}
+
+func (s *Structure) RegisterRequest(ctx context.Context, clientIdentifier []byte) (*request.RegisterRequestResult, error) {
 	var stats *request.ResultStats
 
+	seedProbability, err := s.seedProbability(clientIdentifier)
+	if err != nil {
+		return nil, NewDataError(err, "Failed to compute the seed probability")
+	}
+
 	bucketProbabilities := make([]float64, s.config.L)
+	bucketIndexes := s.newBucketIndexes()
+	// The bucket with the lowest probability, which holds the throttle credit of the request
+	var minLevel, minIndex uint32
+
+	// The real time rather than the clock of the structure, which may be a mock
+	var visitStart time.Time
+	if s.includeStats {
+		visitStart = time.Now()
+	}
 
 	// We can ignore the error since the handler never returns one
-	_ = s.visitBuckets(clientIdentifier, func(l uint32, m uint32, b *bucket) error {
+	_ = s.visitBuckets(ctx, clientIdentifier, s.config.DecayOnReportOnly, func(l uint32, m uint32, b *bucket) error {
+		if b.probability < seedProbability {
+			b.probability = seedProbability
+			// The seed is kept even if the decay isn't written back
+			if s.config.DecayOnReportOnly {
+				s.storeBucket(l, m, b)
+			}
+		}
+
 		bucketProbabilities[l] = b.probability
+		if bucketIndexes != nil {
+			bucketIndexes[l] = m
+		}
+		if l == 0 || b.probability < bucketProbabilities[minLevel] {
+			minLevel, minIndex = l, m
+		}
 		if s.includeStats {
 			if stats == nil {
 				stats = &request.ResultStats{
@@ -106,43 +330,208 @@ func (s *Structure) RegisterRequest(_ context.Context, clientIdentifier []byte)
 		return nil
 	})
 
-	pFinal := s.config.FinalProbabilityFunction(bucketProbabilities)
+	var visitDurationNs int64
+	if s.includeStats {
+		visitDurationNs = time.Since(visitStart).Nanoseconds()
+	}
+
+	pFinal, err := s.computeRequestFinalProbability(ctx, bucketProbabilities, bucketIndexes)
+	if err != nil {
+		return nil, NewDataError(err, "Failed to compute the final probability")
+	}
 
 	if s.includeStats {
+		stats.VisitDurationNs = visitDurationNs
 		stats.BucketProbabilities = bucketProbabilities
 		stats.FinalProbability = pFinal
+		stats.RequestMeta = request.RequestMetaFromContext(ctx)
 	}
 
-	// Decide whether to throttle the request based on the probability
+	// Decide whether to throttle the request based on the probability, unless we
+	// don't have enough data yet to trust it
 	shouldThrottle := false
-	if rand.Float64() <= pFinal {
-		shouldThrottle = true
+	if !s.warmingUp() {
+		if s.config.DeterministicThrottle {
+			shouldThrottle = s.spendThrottleCredit(minLevel, minIndex, pFinal)
+		} else {
+			shouldThrottle = rand.Float64() <= pFinal
+		}
+	}
+
+	var backoff time.Duration
+	if shouldThrottle {
+		backoff = s.config.SuggestedBackoff(pFinal)
 	}
 
 	return &request.RegisterRequestResult{
-		ShouldThrottle: shouldThrottle,
-		ResultStats:    stats,
+		ShouldThrottle:   shouldThrottle,
+		SuggestedBackoff: backoff,
+		ResultStats:      stats,
 	}, nil
 }
 
-func (s *Structure) ReportOutcome(_ context.Context, clientIdentifier []byte, outcome request.Outcome) (*request.ReportOutcomeResult, error) {
-	adjustment := s.config.Pi
-	if outcome == request.OutcomeSuccess {
-		adjustment = -1 * s.config.Pd
+// Add the final probability of a request to the throttle credit of the given bucket and
+// decide to throttle it if the credit reached 1, which is then spent. Over many requests,
+// exactly the sum of their final probabilities are throttled. The credit is kept at the
+// bucket with the lowest probability of the request, so the credit left by an abusive
+// flow isn't spent on the next innocent one: the lowest bucket of an innocent flow is
+// one the abusive flows don't share.
+func (s *Structure) spendThrottleCredit(level, index uint32, pFinal float64) bool {
+	credits := &s.throttleCredits[level][index]
+	for {
+		old := credits.Load()
+		credit := math.Float64frombits(old) + pFinal
+
+		throttle := credit >= 1
+		if throttle {
+			credit--
+		}
+
+		if credits.CompareAndSwap(old, math.Float64bits(credit)) {
+			return throttle
+		}
 	}
+}
 
-	err := s.visitBuckets(clientIdentifier, func(_ uint32, _ uint32, b *bucket) error {
-		p := b.probability + adjustment
-		if p < 0 {
-			p = 0
+// Count a registered request and check if the structure is still warming up, in which
+// case it must not throttle. The warm-up lasts for the first WarmUpRequests requests and
+// for WarmUpDuration since creation, whichever ends later.
+func (s *Structure) warmingUp() bool {
+	return s.warmingUpAt(s.requestCount.Add(1))
+}
+
+// Check if the structure is warming up for the request with the given count
+func (s *Structure) warmingUpAt(count uint64) bool {
+	if count <= s.config.WarmUpRequests {
+		return true
+	}
+
+	if s.config.WarmUpDuration > 0 {
+		if s.clock.Now().Before(s.createdAt.Add(s.config.WarmUpDuration)) {
+			return true
 		}
+	}
+
+	return false
+}
+
+// Compute the final probability for the given client without any side effects other
+// than applying the decay to its buckets, which is skipped with DecayOnReportOnly
+func (s *Structure) finalProbability(clientIdentifier []byte) (float64, error) {
+	return s.probeFinalProbability(clientIdentifier, s.config.DecayOnReportOnly)
+}
+
+// The final probability of the client in the structure seeding this one, or 0 if there is
+// none. The seed source is only read: writing its decay back would decay its buckets
+// again on top of its own requests and take the bucket locks for writing once more.
+func (s *Structure) seedProbability(clientIdentifier []byte) (float64, error) {
+	src := s.seedSource.Load()
+	if src == nil || s.config.BucketModel == config.BucketModelRatio {
+		return 0, nil
+	}
+	return src.probeFinalProbability(clientIdentifier, true)
+}
+
+// Compute the final probability for the given client from its decayed buckets, writing
+// the decay back unless readOnly is set
+func (s *Structure) probeFinalProbability(clientIdentifier []byte, readOnly bool) (float64, error) {
+	bucketProbabilities := make([]float64, s.config.L)
+	bucketIndexes := s.newBucketIndexes()
+
+	_ = s.visitBuckets(context.Background(), clientIdentifier, readOnly, func(l uint32, m uint32, b *bucket) error {
+		bucketProbabilities[l] = b.probability
+		if bucketIndexes != nil {
+			bucketIndexes[l] = m
+		}
+		return nil
+	})
+
+	return s.computeFinalProbability(bucketProbabilities, bucketIndexes)
+}
+
+// Check if the final probability of the client reached the block threshold, i.e. its
+// requests are effectively all throttled. Doesn't register a request. A structure still
+// seeding from another one uses the higher probability of the two, like RegisterRequest.
+// The buckets are only read, so polling doesn't hold off their decay.
+func (s *Structure) IsBlocked(clientIdentifier []byte) (bool, error) {
+	p, err := s.probeFinalProbability(clientIdentifier, true)
+	if err != nil {
+		return false, NewDataError(err, "Failed to compute the final probability")
+	}
+
+	seedProbability, err := s.seedProbability(clientIdentifier)
+	if err != nil {
+		return false, NewDataError(err, "Failed to compute the seed probability")
+	}
+	p = math.Max(p, seedProbability)
+
+	return p >= s.blockThreshold, nil
+}
 
-		if p > 1 {
-			p = 1
+// Report the outcome of a request from the client. With a SampleRate below 1, only a
+// random fraction of the outcomes is applied, scaled up by 1/SampleRate so the expected
+// change of the probabilities stays the same.
+func (s *Structure) ReportOutcome(ctx context.Context, clientIdentifier []byte, outcome request.Outcome) (*request.ReportOutcomeResult, error) {
+	return s.ReportOutcomeWeighted(ctx, clientIdentifier, outcome, 1)
+}
+
+// Report the outcome of a request from the client with the change it makes to the
+// probabilities multiplied by a non-negative weight. The result is clamped like any
+// other outcome.
+func (s *Structure) ReportOutcomeWeighted(ctx context.Context, clientIdentifier []byte, outcome request.Outcome, weight float64) (*request.ReportOutcomeResult, error) {
+	if weight < 0 || math.IsNaN(weight) {
+		return nil, NewDataError(nil, "The weight must not be negative, found: %f", weight)
+	}
+
+	if s.sampleRate < 1 && rand.Float64() >= s.sampleRate {
+		return &request.ReportOutcomeResult{}, nil
+	}
+
+	// Timeouts don't count towards the global failure rate of the adaptive mode and
+	// don't touch the buckets at all without a penalty
+	if outcome == request.OutcomeTimeout {
+		if s.timeoutDelta() == 0 {
+			return &request.ReportOutcomeResult{}, nil
 		}
+		return s.applyDelta(ctx, clientIdentifier, weight*s.timeoutDelta()/s.sampleRate)
+	}
+
+	adjustment := s.config.Pi
+	if s.config.AdaptiveMode {
+		adjustment *= s.adaptivePiScale(outcome)
+	}
+	if outcome == request.OutcomeSuccess {
+		adjustment = -1 * s.pd
+	}
+
+	return s.applyDelta(ctx, clientIdentifier, weight*adjustment/s.sampleRate)
+}
+
+// The delta to apply to the buckets on a timeout
+func (s *Structure) timeoutDelta() float64 {
+	return s.config.Pi * s.config.TimeoutPenaltyFraction
+}
+
+// Report an outcome as an arbitrary signed delta to apply to the probabilities of the
+// client's buckets, which are clamped to [0, 1]. Useful for outcomes beyond binary success
+// and failure, e.g. a soft failure worth half of Pi. A delta of Pi is the same as
+// reporting OutcomeFailure and -Pd the same as OutcomeSuccess, except that the adaptive
+// mode doesn't scale deltas. Pd here is the effective one, raised to MinPd if set. With the
+// ratio model, a positive delta counts as delta/Pi failures and a negative one as -delta/Pd
+// successes.
+func (s *Structure) ReportOutcomeDelta(ctx context.Context, clientIdentifier []byte, delta float64) (*request.ReportOutcomeResult, error) {
+	return s.applyDelta(ctx, clientIdentifier, delta)
+}
 
-		b.probability = p
-		b.lastUpdatedTimeMillis = s.currentMillis()
+func (s *Structure) applyDelta(ctx context.Context, clientIdentifier []byte, delta float64) (*request.ReportOutcomeResult, error) {
+	err := s.visitBuckets(ctx, clientIdentifier, false, func(l uint32, m uint32, b *bucket) error {
+		before, unclamped := b.probability, b.probability+delta
+		b.probability, b.successes, b.failures = s.deltaState(b.probability, b.successes, b.failures, delta)
+
+		// Only log when the bucket reaches the bound, not on every outcome while it stays there
+		if s.config.BucketModel == config.BucketModelProbability && unclamped != b.probability && before != b.probability {
+			s.debugf(ctx, "Structure %d: probability of bucket %d at level %d clamped to %f from %f", s.id, m, l, b.probability, unclamped)
+		}
 
 		return nil
 	})
@@ -150,63 +539,683 @@ func (s *Structure) ReportOutcome(_ context.Context, clientIdentifier []byte, ou
 	return &request.ReportOutcomeResult{}, err
 }
 
-// Visit the buckets belonging to the given clientIdentifier
-// Also takes the bucket lock and manages probability decay prior to calling the handler
-func (s *Structure) visitBuckets(clientIdentifier []byte, fn func(uint32, uint32, *bucket) error) error {
-	levelHashes := generateNHashesUsing64Bit(clientIdentifier, s.config.L, s.murmurSeed)
+// Apply the delta to the state of a bucket according to the bucket model of the
+// structure and return the new probability, successes and failures.
+func (s *Structure) deltaState(p, successes, failures, delta float64) (float64, float64, float64) {
+	if s.config.BucketModel == config.BucketModelRatio {
+		if delta > 0 {
+			failures += delta / s.config.Pi
+		} else {
+			successes += -delta / s.pd
+		}
+		return s.failureRatio(successes, failures), successes, failures
+	}
+
+	if s.config.BucketModel == config.BucketModelEWMA {
+		target, weight := 1., delta/s.config.Pi
+		if delta <= 0 {
+			target, weight = 0, -delta/s.pd
+		}
+		alpha := math.Min(s.config.EWMAAlpha*weight, 1)
+		p += alpha * (target - p)
+		return math.Min(p, s.maxProbability), successes, failures
+	}
+
+	p += delta
+	if p < 0 {
+		p = 0
+	}
+
+	if p > s.maxProbability {
+		p = s.maxProbability
+	}
+
+	return p, successes, failures
+}
+
+// Project the final probability of the client if the given outcome were reported, without
+// mutating any state. The projection applies the same seed floor as RegisterRequest and
+// the same decay and Pi/Pd adjustment as ReportOutcome, so it matches the final
+// probability after really registering the request and reporting its outcome. Like
+// RegisterRequest, it uses the function attached by config.WithFinalProbabilityFunction.
+func (s *Structure) TryRegisterRequest(ctx context.Context, clientIdentifier []byte, outcome request.Outcome) (*request.TryRegisterRequestResult, error) {
+	adjustment := s.config.Pi
+	if s.config.AdaptiveMode {
+		adjustment *= adaptiveScale(nextFailureRate(s.failureRate().Rate(), outcome))
+	}
+	if outcome == request.OutcomeSuccess {
+		adjustment = -1 * s.pd
+	}
+	if outcome == request.OutcomeTimeout {
+		adjustment = s.timeoutDelta()
+	}
+
+	// The next request raises the buckets to the seed probability, like RegisterRequest
+	seedProbability, err := s.seedProbability(clientIdentifier)
+	if err != nil {
+		return nil, NewDataError(err, "Failed to compute the seed probability")
+	}
+
+	current := make([]float64, s.config.L)
+	projected := make([]float64, s.config.L)
+	bucketIndexes := s.newBucketIndexes()
 
+	now := s.currentMillis()
+	levelHashes := s.levelHashes(clientIdentifier)
 	for l := 0; l < int(s.config.L); l++ {
-		lvl := s.levels[l]
-		m := levelHashes[l] % s.config.M
-		buck := lvl[m]
+		m := levelHashes[l] % s.store.Len(uint32(l))
+		if bucketIndexes != nil {
+			bucketIndexes[l] = m
+		}
 
-		buck.lock.Lock()
+		b := s.readBucket(uint32(l), m)
+		var deltaT uint64
+		if now > b.lastUpdatedTimeMillis {
+			deltaT = now - b.lastUpdatedTimeMillis
+		}
+		p, successes, failures := s.decay(b.probability, b.successes, b.failures, deltaT)
+		p = math.Max(p, seedProbability)
 
-		cur := s.currentMillis()
-		deltaT := cur - buck.lastUpdatedTimeMillis
-		pm := adjustProbability(buck.probability, s.config.Lambda, deltaT)
+		current[l] = p
+		projected[l], _, _ = s.deltaState(p, successes, failures, adjustment)
+	}
 
-		buck.lastUpdatedTimeMillis = cur
-		buck.probability = pm
+	pCurrent, err := s.computeRequestFinalProbability(ctx, current, bucketIndexes)
+	if err != nil {
+		return nil, NewDataError(err, "Failed to compute the final probability")
+	}
 
-		if err := fn(uint32(l), m, buck); err != nil {
-			buck.lock.Unlock()
-			return err
+	pProjected, err := s.computeRequestFinalProbability(ctx, projected, bucketIndexes)
+	if err != nil {
+		return nil, NewDataError(err, "Failed to compute the projected final probability")
+	}
+
+	return &request.TryRegisterRequestResult{
+		CurrentProbability:   pCurrent,
+		ProjectedProbability: pProjected,
+	}, nil
+}
+
+// Estimate how long the client has to wait for its final probability to decay to the
+// target, e.g. for a Retry-After header. Since every bucket decays as p*exp(-lambda*t),
+// the final probability decays the same way for final probability functions that scale
+// with the buckets like the min, mean and percentiles. Returns 0 if the probability is
+// already at or below the target, or if it can't be estimated because there's no decay,
+// the target is not positive, the ratio model is used or the decay isn't exponential.
+func (s *Structure) EstimateRetryAfter(ctx context.Context, clientIdentifier []byte, targetProbability float64) (time.Duration, error) {
+	if s.config.Lambda == 0 || targetProbability <= 0 || s.config.BucketModel == config.BucketModelRatio ||
+		s.config.DecayStrategy != config.DecayExponential {
+		return 0, nil
+	}
+
+	resp, err := s.TryRegisterRequest(ctx, clientIdentifier, request.OutcomeSuccess)
+	if err != nil {
+		return 0, err
+	}
+
+	p := resp.CurrentProbability
+	if p <= targetProbability {
+		return 0, nil
+	}
+
+	seconds := math.Log(p/targetProbability) / s.config.Lambda
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// Explain the throttling decision the next request of the client would get, without
+// registering it or mutating any state. Unlike the ResultStats, it doesn't need
+// IncludeStats and describes how the decision is made.
+func (s *Structure) Explain(clientIdentifier []byte) (*Explanation, error) {
+	seedProbability, err := s.seedProbability(clientIdentifier)
+	if err != nil {
+		return nil, NewDataError(err, "Failed to compute the seed probability")
+	}
+
+	levels := make([]config.LevelProb, s.config.L)
+	bucketProbabilities := make([]float64, s.config.L)
+	bucketIndexes := make([]uint32, s.config.L)
+
+	now := s.currentMillis()
+	levelHashes := s.levelHashes(clientIdentifier)
+	for l := 0; l < int(s.config.L); l++ {
+		m := levelHashes[l] % s.store.Len(uint32(l))
+
+		b := s.readBucket(uint32(l), m)
+		var deltaT uint64
+		if now > b.lastUpdatedTimeMillis {
+			deltaT = now - b.lastUpdatedTimeMillis
 		}
+		p, _, _ := s.decay(b.probability, b.successes, b.failures, deltaT)
+
+		// The next request raises the buckets to the seed probability
+		p = math.Max(p, seedProbability)
+
+		levels[l] = config.LevelProb{Level: uint32(l), Index: m, Probability: p}
+		bucketProbabilities[l] = p
+		bucketIndexes[l] = m
+	}
+
+	pFinal, err := s.computeFinalProbability(bucketProbabilities, bucketIndexes)
+	if err != nil {
+		return nil, NewDataError(err, "Failed to compute the final probability")
+	}
 
-		buck.lock.Unlock()
+	functionName := "FinalProbabilityFunctionEx"
+	if s.config.FinalProbabilityFunctionEx == nil {
+		functionName = config.FinalProbabilityFunctionName(*s.finalProbabilityFunction.Load())
 	}
 
+	e := &Explanation{
+		StructureID:              s.id,
+		Levels:                   levels,
+		SeedProbability:          seedProbability,
+		FinalProbabilityFunction: functionName,
+		MaxProbability:           s.maxProbability,
+		FinalProbability:         pFinal,
+		WarmingUp:                s.warmingUpAt(s.requestCount.Load() + 1),
+		Deterministic:            s.config.DeterministicThrottle,
+		BlockThreshold:           s.blockThreshold,
+		Blocked:                  pFinal >= s.blockThreshold,
+	}
+
+	decision := "throttled at random with the final probability"
+	switch {
+	case e.WarmingUp:
+		decision = "not throttled since the structure is still warming up"
+	case e.Deterministic:
+		decision = "throttled deterministically, at a rate of the final probability"
+	}
+	e.Decision = fmt.Sprintf("The final probability %g is chosen by %s from the bucket probabilities and capped at %g. The request is %s.",
+		pFinal, functionName, s.maxProbability, decision)
+
+	return e, nil
+}
+
+// Apply the pending decay to every bucket that has anything to decay, so its stored
+// state reflects the elapsed time even if no request touched it, e.g. for State or
+// ExportChangedSince. With a MaxBucketAge, it instead resets every bucket not updated
+// for longer than that to a zero state. Called periodically by the tracker's sweeper.
+// Every bucket lock is held only while updating that bucket.
+func (s *Structure) Sweep() {
+	maxAgeMillis := uint64(s.config.MaxBucketAge.Milliseconds())
+	if !s.decays() && maxAgeMillis == 0 {
+		return
+	}
+
+	now := s.currentMillis()
+	for l := uint32(0); l < s.config.L; l++ {
+		for m := uint32(0); m < s.store.Len(l); m++ {
+			s.store.Lock(l, m)
+			b := s.loadBucket(l, m)
+			changed := false
+			if maxAgeMillis > 0 {
+				// Refreshing the timestamps by decaying would keep the buckets from ever aging out
+				if now > b.lastUpdatedTimeMillis && now-b.lastUpdatedTimeMillis > maxAgeMillis {
+					b.probability, b.successes, b.failures = 0, 0, 0
+					b.lastUpdatedTimeMillis = now
+					changed = true
+				}
+			} else if now > b.lastUpdatedTimeMillis && (b.probability > 0 || b.successes > 0 || b.failures > 0) {
+				// Only refresh the timestamp if the state changed, or DecayStep would never
+				// see the bucket as idle
+				p, successes, failures := s.decay(b.probability, b.successes, b.failures, now-b.lastUpdatedTimeMillis)
+				if p != b.probability || successes != b.successes || failures != b.failures {
+					b.probability, b.successes, b.failures = p, successes, failures
+					b.lastUpdatedTimeMillis = now
+					changed = true
+				}
+			}
+			if changed {
+				s.storeBucket(l, m, &b)
+			}
+			s.store.Unlock(l, m)
+		}
+	}
+}
+
+// Get the occupancy of every level of the structure. The decayed probability of every
+// bucket is read while holding its lock, one bucket at a time.
+func (s *Structure) Occupancy() []LevelOccupancy {
+	now := s.currentMillis()
+
+	occupancy := make([]LevelOccupancy, s.config.L)
+	for l := range occupancy {
+		var total float64
+		size := s.store.Len(uint32(l))
+		occ := LevelOccupancy{Buckets: size}
+
+		for m := uint32(0); m < size; m++ {
+			b := s.readBucket(uint32(l), m)
+			var deltaT uint64
+			if now > b.lastUpdatedTimeMillis {
+				deltaT = now - b.lastUpdatedTimeMillis
+			}
+			p, _, _ := s.decay(b.probability, b.successes, b.failures, deltaT)
+
+			if p > 0 {
+				occ.NonZeroBuckets++
+			}
+			occ.MaxProbability = math.Max(occ.MaxProbability, p)
+			total += p
+		}
+
+		if size > 0 {
+			occ.MeanProbability = total / float64(size)
+		}
+		occupancy[l] = occ
+	}
+
+	return occupancy
+}
+
+// Count the buckets of all levels by their decayed probability in bins of equal width
+// over [0, 1], e.g. [0, .1), [.1, .2) and so on up to [.9, 1] for 10 bins. Like
+// Occupancy, the buckets are read one at a time. Returns nil if bins isn't positive.
+func (s *Structure) ProbabilityHistogram(bins int) []uint64 {
+	if bins <= 0 {
+		return nil
+	}
+	now := s.currentMillis()
+
+	histogram := make([]uint64, bins)
+	for l := uint32(0); l < s.config.L; l++ {
+		for m := uint32(0); m < s.store.Len(l); m++ {
+			b := s.readBucket(l, m)
+			var deltaT uint64
+			if now > b.lastUpdatedTimeMillis {
+				deltaT = now - b.lastUpdatedTimeMillis
+			}
+			p, _, _ := s.decay(b.probability, b.successes, b.failures, deltaT)
+
+			// A probability of 1 falls in the last bin
+			bin := min(int(p*float64(bins)), bins-1)
+			histogram[max(bin, 0)]++
+		}
+	}
+
+	return histogram
+}
+
+// Get the full state of the structure to persist it and restore it later with
+// NewStructureFromState. Like Snapshot, every bucket lock is held only while copying
+// that bucket, so the state is consistent per bucket but not across buckets.
+func (s *Structure) State() *StructureState {
+	buckets := make([][]BucketState, s.config.L)
+	for l := range buckets {
+		buckets[l] = make([]BucketState, s.store.Len(uint32(l)))
+
+		for m := range buckets[l] {
+			b := s.readBucket(uint32(l), uint32(m))
+			buckets[l][m] = BucketState{
+				Probability:           b.probability,
+				Successes:             b.successes,
+				Failures:              b.failures,
+				LastUpdatedTimeMillis: b.lastUpdatedTimeMillis,
+			}
+		}
+	}
+
+	// A copy, so editing the state doesn't change the config of the running structure
+	c := *s.config
+	c.FinalProbabilityFunction = *s.finalProbabilityFunction.Load()
+	if c.MPerLevel != nil {
+		c.MPerLevel = append([]uint32(nil), c.MPerLevel...)
+	}
+
+	return &StructureState{
+		ID:         s.id,
+		MurmurSeed: s.murmurSeed.Load(),
+		Config:     &c,
+		Buckets:    buckets,
+	}
+}
+
+// The state of a structure encoded by Export. The config isn't included since the
+// importing structure keeps its own.
+type exportedStructure struct {
+	MurmurSeed uint32          `json:"murmur_seed"`
+	Buckets    [][]BucketState `json:"buckets"`
+}
+
+// Export the hash seed and the buckets of the structure, to restore them into a structure
+// with the same bucket layout with Import. Consistent per bucket like State.
+func (s *Structure) Export() ([]byte, error) {
+	state := s.State()
+	b, err := json.Marshal(&exportedStructure{MurmurSeed: state.MurmurSeed, Buckets: state.Buckets})
+	if err != nil {
+		return nil, NewDataError(err, "Failed to encode the structure state")
+	}
+	return b, nil
+}
+
+// Replace the hash seed and the buckets of the structure with ones exported by Export.
+// The structure keeps its own ID and config, whose bucket layout must match. Requests in
+// flight during the import may see a mix of the old and the new buckets.
+func (s *Structure) Import(state []byte) error {
+	var es exportedStructure
+	if err := json.Unmarshal(state, &es); err != nil {
+		return NewDataError(err, "Failed to decode the structure state")
+	}
+	if err := checkStateLayout(s.config, es.Buckets); err != nil {
+		return err
+	}
+
+	s.restoreBuckets(es.MurmurSeed, es.Buckets)
 	return nil
 }
 
-func (s *Structure) currentMillis() uint64 {
-	return uint64(s.clock.Now().UnixMilli())
+// Visit the buckets updated after sinceMs, e.g. to ship only the changes since the last
+// backup to a central store. The callback gets the stored probability, without the decay
+// since its last update, so it can be restored together with lastUpdatedMs. It's called
+// while holding the lock of the bucket so it must be quick and must not call back into
+// the structure.
+func (s *Structure) ExportChangedSince(sinceMs uint64, fn func(level, index uint32, prob float64, lastUpdatedMs uint64)) {
+	for l := uint32(0); l < s.config.L; l++ {
+		for m := uint32(0); m < s.store.Len(l); m++ {
+			s.store.Lock(l, m)
+			if lastUpdated := s.store.GetLastUpdated(l, m); lastUpdated > sinceMs {
+				fn(l, m, s.store.GetProbability(l, m), lastUpdated)
+			}
+			s.store.Unlock(l, m)
+		}
+	}
 }
 
-// Validate the input config against invariants
-func validateStructureConfig(config *config.FairnessTrackerConfig) error {
-	if config.L <= 0 || config.M <= 0 {
-		return fmt.Errorf("the values of L and M must be at least 1, found L: %d and M: %d", config.L, config.M)
+// Take a snapshot of the probabilities of all buckets in the structure.
+// Every bucket lock is held only for as long as it takes to copy that bucket, so the
+// request path is never blocked on the whole structure. As a result the snapshot is
+// consistent per bucket but not across buckets: a request that lands while the snapshot
+// is being taken may be reflected in some of its buckets and not in others.
+func (s *Structure) Snapshot() *StructureSnapshot {
+	now := s.currentMillis()
+
+	probabilities := make([][]float64, s.config.L)
+	for l := range probabilities {
+		probabilities[l] = make([]float64, s.store.Len(uint32(l)))
+
+		for m := range probabilities[l] {
+			b := s.readBucket(uint32(l), uint32(m))
+
+			// The decay is computed outside the lock and not written back
+			var deltaT uint64
+			if now > b.lastUpdatedTimeMillis {
+				deltaT = now - b.lastUpdatedTimeMillis
+			}
+			probabilities[l][m], _, _ = s.decay(b.probability, b.successes, b.failures, deltaT)
+		}
 	}
 
-	if config.Pd <= 0 || config.Pi <= 0 {
-		return fmt.Errorf("the values of Pi and Pd must >0, found Pi: %f and Pd: %f", config.Pi, config.Pd)
+	return &StructureSnapshot{
+		ID:            s.id,
+		TakenAtMillis: now,
+		Probabilities: probabilities,
 	}
+}
+
+// Get the buckets with a decayed probability above a small epsilon, ordered by level and
+// then index. Client identifiers can't be recovered from the hashes, so this is the closest
+// to listing the flows being throttled. Like Snapshot, every bucket lock is held only
+// while copying that bucket and the decay is not written back.
+func (s *Structure) ActiveBuckets() []BucketInfo {
+	now := s.currentMillis()
+
+	var active []BucketInfo
+	for l := uint32(0); l < s.config.L; l++ {
+		for m := uint32(0); m < s.store.Len(l); m++ {
+			b := s.readBucket(l, m)
 
-	if config.Pd > 1 || config.Pi >= 1 {
-		return fmt.Errorf("the values of Pi and Pd must <=1, found Pi: %f and Pd: %f", config.Pi, config.Pd)
+			var deltaT uint64
+			if now > b.lastUpdatedTimeMillis {
+				deltaT = now - b.lastUpdatedTimeMillis
+			}
+			p, _, _ := s.decay(b.probability, b.successes, b.failures, deltaT)
+
+			if p > activeBucketEpsilon {
+				active = append(active, BucketInfo{
+					Level:         l,
+					Index:         m,
+					Probability:   p,
+					LastUpdatedMs: b.lastUpdatedTimeMillis,
+				})
+			}
+		}
 	}
 
-	// The expectation is we quickly throttle the client when bad things start to happen
-	// but cautiously bring it back to avoid retry-storms.
-	if config.Pi <= config.Pd {
-		return fmt.Errorf("the value of Pd is expected to be smaller than Pi")
+	return active
+}
+
+// Visit the buckets belonging to the given clientIdentifier
+// Also takes the bucket lock and manages probability decay prior to calling the handler.
+// If readOnly, the decayed bucket and the changes of the handler are not written back
+// unless the handler stores the bucket itself.
+func (s *Structure) visitBuckets(ctx context.Context, clientIdentifier []byte, readOnly bool, fn func(uint32, uint32, *bucket) error) error {
+	levelHashes := s.levelHashes(clientIdentifier)
+
+	// Reused across the levels since handing it to the callback moves it to the heap
+	var buck bucket
+	for l := uint32(0); l < s.config.L; l++ {
+		m := levelHashes[l] % s.store.Len(l)
+
+		s.store.Lock(l, m)
+		buck = s.loadBucket(l, m)
+
+		// If the clock went backwards, nothing is decayed until it catches up with the last
+		// update again instead of the difference underflowing and zeroing the probability
+		cur := s.currentMillis()
+		var deltaT uint64
+		if cur > buck.lastUpdatedTimeMillis {
+			deltaT = cur - buck.lastUpdatedTimeMillis
+			buck.lastUpdatedTimeMillis = cur
+		}
+
+		before := buck.probability
+		buck.probability, buck.successes, buck.failures = s.decay(buck.probability, buck.successes, buck.failures, deltaT)
+
+		if before-buck.probability >= largeDecayToLog {
+			s.debugf(ctx, "Structure %d: probability of bucket %d at level %d decayed to %f from %f over %dms", s.id, m, l, buck.probability, before, deltaT)
+		}
+
+		err := fn(l, m, &buck)
+		if !readOnly {
+			s.storeBucket(l, m, &buck)
+		}
+		s.store.Unlock(l, m)
+		if err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
+// Load the state of a bucket from the store. Must be called with the bucket lock held.
+func (s *Structure) loadBucket(l, m uint32) bucket {
+	successes, failures := s.store.GetCounts(l, m)
+	return bucket{
+		probability:           s.store.GetProbability(l, m),
+		successes:             successes,
+		failures:              failures,
+		lastUpdatedTimeMillis: s.store.GetLastUpdated(l, m),
+	}
+}
+
+// Write the state of a bucket back to the store. Must be called with the bucket lock held.
+func (s *Structure) storeBucket(l, m uint32, b *bucket) {
+	s.store.SetProbability(l, m, b.probability)
+	s.store.SetCounts(l, m, b.successes, b.failures)
+	s.store.SetLastUpdated(l, m, b.lastUpdatedTimeMillis)
+}
+
+// Copy the state of a bucket while holding its lock
+func (s *Structure) readBucket(l, m uint32) bucket {
+	s.store.Lock(l, m)
+	defer s.store.Unlock(l, m)
+
+	return s.loadBucket(l, m)
+}
+
+// Share a failure rate between structures in the adaptive mode, e.g. all the structures
+// of a tracker, so the rate survives the rotations and all of them scale Pi the same. The
+// structure only reads the shared rate: the owner must Add every outcome to it once,
+// before reporting the outcome to the structures.
+func (s *Structure) ShareFailureRate(rate *FailureRate) {
+	s.sharedFailureRate.Store(rate)
+}
+
+// The failure rate used by the adaptive mode, the shared one if set
+func (s *Structure) failureRate() *FailureRate {
+	if shared := s.sharedFailureRate.Load(); shared != nil {
+		return shared
+	}
+	return &s.globalFailureRate
+}
+
+// Update the moving average of the global failure rate with the given outcome and return
+// the fraction of Pi to use. The higher the failure rate across all flows, the less a
+// single failure counts against a flow. A shared failure rate already has the outcome.
+func (s *Structure) adaptivePiScale(outcome request.Outcome) float64 {
+	if shared := s.sharedFailureRate.Load(); shared != nil {
+		return adaptiveScale(shared.Rate())
+	}
+	return adaptiveScale(s.globalFailureRate.Add(outcome))
+}
+
+// The moving average of the failure rate across all flows used by the adaptive mode.
+// The zero value is a rate of 0 and it's safe for concurrent use.
+type FailureRate struct {
+	// The bits of the average
+	bits atomic.Uint64
+}
+
+// The current average
+func (r *FailureRate) Rate() float64 {
+	return math.Float64frombits(r.bits.Load())
+}
+
+// Add an outcome to the average and return the new average
+func (r *FailureRate) Add(outcome request.Outcome) float64 {
+	for {
+		old := r.bits.Load()
+		rate := nextFailureRate(math.Float64frombits(old), outcome)
+		if r.bits.CompareAndSwap(old, math.Float64bits(rate)) {
+			return rate
+		}
+	}
+}
+
+// The moving average of the global failure rate after the given outcome
+func nextFailureRate(rate float64, outcome request.Outcome) float64 {
+	var sample float64
+	if outcome == request.OutcomeFailure {
+		sample = 1
+	}
+	return rate + adaptiveEWMAAlpha*(sample-rate)
+}
+
+// The fraction of Pi to use for the given global failure rate
+func adaptiveScale(rate float64) float64 {
+	return math.Max(1-rate, adaptiveMinPiScale)
+}
+
+// Decay the state of a bucket by deltaMs according to the bucket model of the structure
+// and return the decayed probability, successes and failures.
+func (s *Structure) decay(p, successes, failures float64, deltaMs uint64) (float64, float64, float64) {
+	if s.config.BucketModel == config.BucketModelRatio {
+		successes = s.adjustProbability(successes, deltaMs)
+		failures = s.adjustProbability(failures, deltaMs)
+		return s.failureRatio(successes, failures), successes, failures
+	}
+
+	return s.adjustProbability(p, deltaMs), successes, failures
+}
+
+// Decay a probability, or a count of the ratio model, by the elapsed time with the decay
+// strategy of the structure
+func (s *Structure) adjustProbability(prob float64, deltaMs uint64) float64 {
+	return AdjustProbability(s.config.DecayStrategy, prob, s.config.Lambda, uint64(s.config.DecayStepIdle.Milliseconds()), deltaMs)
+}
+
+// Returns true if the probabilities decay with time at all
+func (s *Structure) decays() bool {
+	return s.config.Lambda > 0 || s.config.DecayStrategy == config.DecayStep
+}
+
+// The smoothed failure ratio used as the bucket probability by the ratio model
+func (s *Structure) failureRatio(successes, failures float64) float64 {
+	total := successes + failures + s.config.RatioSmoothing
+	if total <= 0 {
+		return 0
+	}
+	return math.Min(failures/total, s.maxProbability)
+}
+
+// Make the slice to collect the bucket indexes for the FinalProbabilityFunctionEx, or nil
+// if it's not set so the common path doesn't pay for it
+func (s *Structure) newBucketIndexes() []uint32 {
+	if s.config.FinalProbabilityFunctionEx == nil {
+		return nil
+	}
+	return make([]uint32, s.config.L)
+}
+
+// Choose the final probability of a request with the function attached to its context
+// by config.WithFinalProbabilityFunction if any, and otherwise like computeFinalProbability
+func (s *Structure) computeRequestFinalProbability(ctx context.Context, bucketProbabilities []float64, bucketIndexes []uint32) (float64, error) {
+	fn := config.FinalProbabilityFunctionFromContext(ctx)
+	if fn == nil {
+		return s.computeFinalProbability(bucketProbabilities, bucketIndexes)
+	}
+
+	p, err := fn(bucketProbabilities)
+	if err != nil {
+		return 0, err
+	}
+	return math.Min(p, s.maxProbability), nil
+}
+
+// Choose the final probability from the bucket probabilities with the current function,
+// capped at the max probability. The bucket indexes are only used, and only needed, with
+// the FinalProbabilityFunctionEx.
+func (s *Structure) computeFinalProbability(bucketProbabilities []float64, bucketIndexes []uint32) (float64, error) {
+	var p float64
+	var err error
+	if fn := s.config.FinalProbabilityFunctionEx; fn != nil {
+		levelProbs := make([]config.LevelProb, len(bucketProbabilities))
+		for l, prob := range bucketProbabilities {
+			levelProbs[l] = config.LevelProb{Level: uint32(l), Index: bucketIndexes[l], Probability: prob}
+		}
+		p, err = fn(levelProbs)
+	} else {
+		finalProbabilityFunction := *s.finalProbabilityFunction.Load()
+		p, err = finalProbabilityFunction(bucketProbabilities)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return math.Min(p, s.maxProbability), nil
+}
+
+// The number of buckets at the given level of a structure with the given config
+func levelSize(conf *config.FairnessTrackerConfig, level int) uint32 {
+	if conf.MPerLevel != nil {
+		return conf.MPerLevel[level]
+	}
+	return conf.M
+}
+
+func (s *Structure) currentMillis() uint64 {
+	return uint64(s.clock.Now().UnixMilli())
+}
+
+// Hash the client identifier for every level, after normalizing it with the KeyNormalizer
+// of the config if set
+func (s *Structure) levelHashes(clientIdentifier []byte) []uint32 {
+	if s.config.KeyNormalizer != nil {
+		clientIdentifier = s.config.KeyNormalizer(clientIdentifier)
+	}
+	return generateNHashesUsing64Bit(clientIdentifier, s.config.L, s.murmurSeed.Load())
+}
+
 // Calculate n hashes of the given input using murmur hash.
 // To optimize, we only calculate a single 64-bit hash and use a technique outlined in
 // the paper below to compute more based on them:
@@ -217,28 +1226,59 @@ func generateNHashesUsing64Bit(input []byte, n uint32, seed uint32) []uint32 {
 	h.Write(input)
 	hash64 := h.Sum64()
 
-	// Split the 64-bit hash into two 32-bit hashes
-	hash1 := uint32(hash64)       // Lower 32 bits
-	hash2 := uint32(hash64 >> 32) // Upper 32 bits
+	// Split the 64-bit hash into two 32-bit hashes. The second one is forced to be odd
+	// so that it is co-prime with 2^32 and the sequence never degenerates when it is 0.
+	hash1 := uint32(hash64)         // Lower 32 bits
+	hash2 := uint32(hash64>>32) | 1 // Upper 32 bits
 
-	// Generate the n hashes using the combination: hash_i = hash1 + i * hash2
+	// Generate the n hashes using the enhanced double hashing combination from the same
+	// authors: hash_i = hash1 + i * hash2 + (i^3 - i) / 6. Each result is passed through
+	// the murmur3 finalizer so that the indices taken modulo M are not correlated across
+	// levels when hash2 shares factors with M.
 	hashes := make([]uint32, n)
 	for i := 0; i < int(n); i++ {
-		hashes[i] = hash1 + uint32(i)*hash2
+		x := uint32(i)
+		hashes[i] = fmix32(hash1 + x*hash2 + (x*x*x-x)/6)
 	}
 
 	return hashes
 }
 
-// AdjustProbability applies exponential decay to the given probability.
+// The murmur3 32-bit finalizer which avalanches all the bits of the input.
+func fmix32(h uint32) uint32 {
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+	return h
+}
+
+// AdjustProbability applies the decay of the given strategy to the given probability.
+// The result is never negative nor above the input, so a probability stays in [0, 1].
 // prob: the current probability value (between 0 and 1)
 // lambda: the decay rate (higher values mean faster decay)
+// stepIdleMs: the idle time in milliseconds after which DecayStep resets the probability
 // deltaMs: the time difference in milliseconds
-func adjustProbability(prob float64, lambda float64, deltaMs uint64) float64 {
+func AdjustProbability(strategy config.DecayStrategy, prob float64, lambda float64, stepIdleMs uint64, deltaMs uint64) float64 {
 	deltaSec := float64(deltaMs) / 1000.0
-	decayedProb := prob * math.Exp(-lambda*deltaSec)
 
-	if decayedProb < 0 {
+	var decayedProb float64
+	switch strategy {
+	case config.DecayLinear:
+		decayedProb = prob - lambda*deltaSec
+	case config.DecayStep:
+		decayedProb = prob
+		if deltaMs > 0 && deltaMs >= stepIdleMs {
+			decayedProb = 0
+		}
+	default:
+		decayedProb = prob * math.Exp(-lambda*deltaSec)
+	}
+
+	// Snap tiny values to 0 so long untouched buckets count as empty and never
+	// linger as denormals
+	if decayedProb < minDecayedProbability {
 		return 0
 	}
 	return decayedProb
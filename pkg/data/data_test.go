@@ -2,80 +2,82 @@ package data
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 
 	"github.com/satmihir/fair/pkg/config"
+	"github.com/satmihir/fair/pkg/logger"
 	"github.com/satmihir/fair/pkg/request"
+	"github.com/satmihir/fair/pkg/testutils"
+	"github.com/satmihir/fair/pkg/utils"
 )
 
-func TestValidateStructConfig(t *testing.T) {
+func TestNewStructureFailsValidation(t *testing.T) {
 	conf := &config.FairnessTrackerConfig{
-		L: 0,
-	}
-
-	err := validateStructureConfig(conf)
-	assert.Error(t, err)
-
-	conf = &config.FairnessTrackerConfig{
-		L: 1,
-		M: 0,
-	}
-
-	err = validateStructureConfig(conf)
-	assert.Error(t, err)
-
-	conf = &config.FairnessTrackerConfig{
 		L:  1,
 		M:  1,
-		Pd: 0,
-		Pi: 0,
+		Pd: .15,
+		Pi: .1,
 	}
-
-	err = validateStructureConfig(conf)
+	_, err := NewStructure(conf, 1, true)
 	assert.Error(t, err)
+}
 
-	conf = &config.FairnessTrackerConfig{
-		L:  1,
-		M:  1,
-		Pd: 10,
-		Pi: 10,
+func TestNewStructureValidationErrorFields(t *testing.T) {
+	valid := func() *config.FairnessTrackerConfig {
+		return &config.FairnessTrackerConfig{L: 1, M: 1, Pd: .1, Pi: .15}
 	}
 
-	err = validateStructureConfig(conf)
-	assert.Error(t, err)
-
-	conf = &config.FairnessTrackerConfig{
-		L:  1,
-		M:  1,
-		Pd: .15,
-		Pi: .1,
+	cases := []struct {
+		mutate func(*config.FairnessTrackerConfig)
+		fields []string
+	}{
+		{func(c *config.FairnessTrackerConfig) { c.L = 0 }, []string{"L", "M"}},
+		{func(c *config.FairnessTrackerConfig) { c.M = 0 }, []string{"L", "M"}},
+		{func(c *config.FairnessTrackerConfig) { c.MPerLevel = []uint32{1, 2} }, []string{"MPerLevel", "L"}},
+		{func(c *config.FairnessTrackerConfig) { c.MPerLevel = []uint32{0} }, []string{"MPerLevel"}},
+		{func(c *config.FairnessTrackerConfig) { c.L = config.MaxL + 1 }, []string{"L", "M"}},
+		{func(c *config.FairnessTrackerConfig) { c.M = config.MaxM + 1 }, []string{"L", "M"}},
+		{func(c *config.FairnessTrackerConfig) { c.MPerLevel = []uint32{config.MaxM + 1} }, []string{"MPerLevel"}},
+		{func(c *config.FairnessTrackerConfig) { c.Lambda = -1 }, []string{"Lambda"}},
+		{func(c *config.FairnessTrackerConfig) { c.WarmUpDuration = -time.Second }, []string{"WarmUpDuration"}},
+		{func(c *config.FairnessTrackerConfig) { c.MaxProbability = 2 }, []string{"MaxProbability"}},
+		{func(c *config.FairnessTrackerConfig) { c.BlockThreshold = 1.5 }, []string{"BlockThreshold"}},
+		{func(c *config.FairnessTrackerConfig) { c.RatioSmoothing = -1 }, []string{"RatioSmoothing"}},
+		{func(c *config.FairnessTrackerConfig) { c.BucketModel = config.BucketModelEWMA }, []string{"EWMAAlpha"}},
+		{func(c *config.FairnessTrackerConfig) { c.SampleRate = 2 }, []string{"SampleRate"}},
+		{func(c *config.FairnessTrackerConfig) { c.MinPd = -1 }, []string{"MinPd"}},
+		{func(c *config.FairnessTrackerConfig) { c.MinPd = .5 }, []string{"Pi", "MinPd"}},
+		{func(c *config.FairnessTrackerConfig) { c.Pi, c.Pd = 0, 0 }, []string{"Pi", "Pd"}},
+		{func(c *config.FairnessTrackerConfig) { c.Pi, c.Pd = 10, 10 }, []string{"Pi", "Pd"}},
+		{func(c *config.FairnessTrackerConfig) { c.Pi, c.Pd = .1, .15 }, []string{"Pi", "Pd"}},
 	}
 
-	err = validateStructureConfig(conf)
-	assert.Error(t, err)
+	for i, tc := range cases {
+		conf := valid()
+		tc.mutate(conf)
 
-	conf = &config.FairnessTrackerConfig{
-		L:  1,
-		M:  1,
-		Pd: .1,
-		Pi: .15,
+		_, err := NewStructure(conf, 1, true)
+		var validationErr *ConfigValidationError
+		assert.True(t, errors.As(err, &validationErr), "case %d", i)
+		assert.Equal(t, validationErr.Fields, tc.fields, "case %d", i)
+		assert.Equal(t, len(validationErr.Values), len(tc.fields), "case %d", i)
 	}
 
-	err = validateStructureConfig(conf)
-	assert.NoError(t, err)
-}
-
-func TestNewStructureFailsValidation(t *testing.T) {
-	conf := &config.FairnessTrackerConfig{
-		L:  1,
-		M:  1,
-		Pd: .15,
-		Pi: .1,
-	}
+	conf := valid()
+	conf.Pi, conf.Pd = .1, .15
 	_, err := NewStructure(conf, 1, true)
-	assert.Error(t, err)
+	var validationErr *ConfigValidationError
+	assert.True(t, errors.As(err, &validationErr))
+	assert.Equal(t, validationErr.Values, []any{.1, .15})
+	assert.Contains(t, err.Error(), "the value of Pd is expected to be smaller than Pi")
 }
 
 func TestNewStructure(t *testing.T) {
@@ -89,8 +91,8 @@ func TestNewStructure(t *testing.T) {
 	assert.NoError(t, err)
 	assert.NotNil(t, structure)
 
-	assert.Equal(t, len(structure.levels), 2)
-	assert.Equal(t, len(structure.levels[0]), 24)
+	assert.Equal(t, len(structure.Snapshot().Probabilities), 2)
+	assert.Equal(t, structure.store.Len(0), uint32(24))
 }
 
 func TestHashes(t *testing.T) {
@@ -106,6 +108,61 @@ func TestHashes(t *testing.T) {
 	assert.Equal(t, hashes[2], hashes2[2])
 }
 
+func TestHashDistribution(t *testing.T) {
+	const L, M, N = 16, 1000, 100000
+
+	counts := make([][]int, L)
+	for l := range counts {
+		counts[l] = make([]int, M)
+	}
+	indices := make([][]float64, L)
+	for l := range indices {
+		indices[l] = make([]float64, N)
+	}
+
+	for i := 0; i < N; i++ {
+		hashes := generateNHashesUsing64Bit([]byte(fmt.Sprintf("flow-%d", i)), L, 42)
+		for l, h := range hashes {
+			idx := h % M
+			counts[l][idx]++
+			indices[l][i] = float64(idx)
+		}
+	}
+
+	// The chi-squared statistic with M-1 degrees of freedom has a mean of M-1 and a
+	// standard deviation of about 45 here, so this bound is only exceeded by a bad hash.
+	expected := float64(N) / M
+	for l := 0; l < L; l++ {
+		chi2 := 0.0
+		for _, c := range counts[l] {
+			d := float64(c) - expected
+			chi2 += d * d / expected
+		}
+		assert.Less(t, chi2, 1.3*(M-1), "level %d is not uniform", l)
+	}
+
+	// Indices of different levels for the same input should be uncorrelated
+	for a := 0; a < L; a++ {
+		for b := a + 1; b < L; b++ {
+			r := correlation(indices[a], indices[b])
+			assert.Less(t, math.Abs(r), .02, "levels %d and %d are correlated", a, b)
+		}
+	}
+}
+
+func correlation(x, y []float64) float64 {
+	var sx, sy, sxx, syy, sxy float64
+	n := float64(len(x))
+	for i := range x {
+		sx += x[i]
+		sy += y[i]
+		sxx += x[i] * x[i]
+		syy += y[i] * y[i]
+		sxy += x[i] * y[i]
+	}
+	return (n*sxy - sx*sy) / math.Sqrt((n*sxx-sx*sx)*(n*syy-sy*sy))
+}
+
 func TestGetID(t *testing.T) {
 	conf := &config.FairnessTrackerConfig{
 		L:  2,
@@ -162,7 +219,1900 @@ func TestEndToEnd(t *testing.T) {
 	assert.True(t, resp.ShouldThrottle)
 }
 
+func TestFinalProbabilityFunctionError(t *testing.T) {
+	conf := &config.FairnessTrackerConfig{
+		L:  2,
+		M:  24,
+		Pd: .1,
+		Pi: .15,
+		FinalProbabilityFunction: func([]float64) (float64, error) {
+			return 0, fmt.Errorf("failed")
+		},
+	}
+	structure, err := NewStructure(conf, 1, true)
+	assert.NoError(t, err)
+
+	_, err = structure.RegisterRequest(context.Background(), []byte("hello_world"))
+	assert.Error(t, err)
+}
+
+func TestExcessiveSize(t *testing.T) {
+	// Would allocate 4 billion buckets
+	conf := &config.FairnessTrackerConfig{
+		L:                        1 << 12,
+		M:                        1 << 20,
+		Pd:                       .001,
+		Pi:                       .1,
+		FinalProbabilityFunction: config.MinFinalProbabilityFunction,
+	}
+	_, err := NewStructure(conf, 1, true)
+	var validationErr *ConfigValidationError
+	assert.True(t, errors.As(err, &validationErr))
+	assert.Equal(t, validationErr.Fields, []string{"L", "M"})
+
+	// The bounds themselves are allowed
+	conf.L, conf.M = config.MaxL, 10
+	_, err = NewStructure(conf, 1, true)
+	assert.NoError(t, err)
+}
+
 func TestAdjustProbability(t *testing.T) {
-	res := adjustProbability(0.90, .01, 10)
+	res := AdjustProbability(config.DecayExponential, 0.90, .01, 0, 10)
 	assert.Equal(t, res, 0.89991000449985)
+
+	// Very old buckets decay to exactly 0 instead of a tiny positive number
+	assert.Equal(t, AdjustProbability(config.DecayExponential, 1, .01, 0, 1e12), float64(0))
+	assert.Equal(t, AdjustProbability(config.DecayExponential, 1, 1, 0, 30_000), float64(0))
+	assert.Equal(t, AdjustProbability(config.DecayExponential, 1e-9, 0, 0, 0), 1e-9)
+}
+
+func TestDecayStrategies(t *testing.T) {
+	// Linear subtracts lambda per second down to 0
+	assert.Equal(t, AdjustProbability(config.DecayLinear, .5, .01, 0, 0), .5)
+	assert.InDelta(t, AdjustProbability(config.DecayLinear, .5, .01, 0, 10_000), .4, 1e-12)
+	assert.Equal(t, AdjustProbability(config.DecayLinear, .5, .01, 0, 100_000), float64(0))
+
+	// Step keeps the probability until the bucket was idle long enough
+	assert.Equal(t, AdjustProbability(config.DecayStep, .5, 0, 60_000, 0), .5)
+	assert.Equal(t, AdjustProbability(config.DecayStep, .5, 0, 60_000, 59_999), .5)
+	assert.Equal(t, AdjustProbability(config.DecayStep, .5, 0, 60_000, 60_000), float64(0))
+
+	// A structure with the step decay resets idle buckets, including in the sweep
+	conf := &config.FairnessTrackerConfig{
+		L:                        3,
+		M:                        1000,
+		Pd:                       .001,
+		Pi:                       .5,
+		DecayStrategy:            config.DecayStep,
+		DecayStepIdle:            time.Minute,
+		FinalProbabilityFunction: config.MinFinalProbabilityFunction,
+	}
+	clk := utils.NewMockClock(time.Unix(1000, 0))
+	structure, err := NewStructureWithClock(conf, 1, true, clk)
+	assert.NoError(t, err)
+
+	id := []byte("hello_world")
+	probability := func() float64 {
+		resp, err := structure.TryRegisterRequest(context.Background(), id, request.OutcomeSuccess)
+		assert.NoError(t, err)
+		return resp.CurrentProbability
+	}
+
+	_, err = structure.ReportOutcome(context.Background(), id, request.OutcomeFailure)
+	assert.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		clk.Advance(10 * time.Second)
+		structure.Sweep()
+	}
+	assert.Equal(t, probability(), .5)
+
+	clk.Advance(10 * time.Second)
+	structure.Sweep()
+	assert.Equal(t, probability(), float64(0))
+	for _, lvl := range structure.State().Buckets {
+		for _, b := range lvl {
+			assert.Equal(t, b.Probability, float64(0))
+		}
+	}
+
+	conf.DecayStepIdle = 0
+	_, err = NewStructure(conf, 1, true)
+	assert.Error(t, err)
+}
+
+func TestSnapshot(t *testing.T) {
+	conf := &config.FairnessTrackerConfig{
+		L:                        2,
+		M:                        24,
+		Pd:                       .1,
+		Pi:                       .15,
+		FinalProbabilityFunction: config.MinFinalProbabilityFunction,
+	}
+	structure, err := NewStructure(conf, 1, true)
+	assert.NoError(t, err)
+
+	ctx := context.Background()
+	id := []byte("hello_world")
+
+	_, err = structure.ReportOutcome(ctx, id, request.OutcomeFailure)
+	assert.NoError(t, err)
+
+	resp, err := structure.RegisterRequest(ctx, id)
+	assert.NoError(t, err)
+
+	snap := structure.Snapshot()
+	assert.Equal(t, int(snap.ID), 1)
+	assert.Equal(t, len(snap.Probabilities), 2)
+	assert.Equal(t, len(snap.Probabilities[0]), 24)
+
+	for l, m := range resp.ResultStats.BucketIndexes {
+		assert.Equal(t, snap.Probabilities[l][m], .15)
+	}
+}
+
+func TestSampleRate(t *testing.T) {
+	probabilityAfterFailures := func(sampleRate float64) float64 {
+		conf := &config.FairnessTrackerConfig{
+			L:                        3,
+			M:                        1000,
+			Pd:                       .00001,
+			Pi:                       .0001,
+			SampleRate:               sampleRate,
+			FinalProbabilityFunction: config.MinFinalProbabilityFunction,
+		}
+		structure, err := NewStructure(conf, 1, true)
+		assert.NoError(t, err)
+
+		ctx := context.Background()
+		id := []byte("hello_world")
+		for i := 0; i < 5000; i++ {
+			_, err = structure.ReportOutcome(ctx, id, request.OutcomeFailure)
+			assert.NoError(t, err)
+		}
+
+		p, err := structure.finalProbability(id)
+		assert.NoError(t, err)
+		return p
+	}
+
+	assert.InDelta(t, probabilityAfterFailures(0), .5, 1e-9)
+	assert.InDelta(t, probabilityAfterFailures(1), .5, 1e-9)
+	// About 500 of the failures are applied with 10x the delta. The bound is 5 standard
+	// deviations of the binomial.
+	assert.InDelta(t, probabilityAfterFailures(.1), .5, .1)
+}
+
+func TestMinPd(t *testing.T) {
+	successesToRecover := func(minPd float64) int {
+		conf := &config.FairnessTrackerConfig{
+			L:                        3,
+			M:                        1000,
+			Pd:                       .0001,
+			MinPd:                    minPd,
+			Pi:                       .1,
+			FinalProbabilityFunction: config.MinFinalProbabilityFunction,
+		}
+		structure, err := NewStructure(conf, 1, true)
+		assert.NoError(t, err)
+
+		ctx := context.Background()
+		id := []byte("hello_world")
+		for i := 0; i < 10; i++ {
+			_, err = structure.ReportOutcome(ctx, id, request.OutcomeFailure)
+			assert.NoError(t, err)
+		}
+
+		for n := 0; ; n++ {
+			p, err := structure.finalProbability(id)
+			assert.NoError(t, err)
+			if p == 0 {
+				return n
+			}
+			_, err = structure.ReportOutcome(ctx, id, request.OutcomeSuccess)
+			assert.NoError(t, err)
+		}
+	}
+
+	// Without a floor, Pd applies as is
+	assert.InDelta(t, successesToRecover(0), 10000, 1)
+	assert.InDelta(t, successesToRecover(.00001), 10000, 1)
+	// A floor above Pd speeds up the recovery
+	assert.InDelta(t, successesToRecover(.01), 100, 1)
+}
+
+func TestFinalProbabilityFunctionEx(t *testing.T) {
+	// Trust the higher levels more
+	weights := []float64{1, 2, 3}
+	var seen []config.LevelProb
+	weighted := func(levelProbs []config.LevelProb) (float64, error) {
+		seen = levelProbs
+		var sum, total float64
+		for _, lp := range levelProbs {
+			sum += weights[lp.Level] * lp.Probability
+			total += weights[lp.Level]
+		}
+		return sum / total, nil
+	}
+
+	conf := &config.FairnessTrackerConfig{
+		L:                          3,
+		M:                          1000,
+		Pd:                         .01,
+		Pi:                         .1,
+		FinalProbabilityFunctionEx: weighted,
+	}
+	structure, err := NewStructure(conf, 1, true)
+	assert.NoError(t, err)
+
+	ctx := context.Background()
+	id := []byte("hello_world")
+
+	_, err = structure.ReportOutcome(ctx, id, request.OutcomeFailure)
+	assert.NoError(t, err)
+	resp, err := structure.RegisterRequest(ctx, id)
+	assert.NoError(t, err)
+
+	// Bump only the bucket at the last level
+	m := uint32(resp.ResultStats.BucketIndexes[2])
+	structure.store.Lock(2, m)
+	structure.store.SetProbability(2, m, .7)
+	structure.store.Unlock(2, m)
+
+	resp, err = structure.RegisterRequest(ctx, id)
+	assert.NoError(t, err)
+	assert.InDelta(t, resp.ResultStats.FinalProbability, (.1+2*.1+3*.7)/6, 1e-9)
+	for l, lp := range seen {
+		assert.Equal(t, int(lp.Level), l)
+		assert.Equal(t, int(lp.Index), resp.ResultStats.BucketIndexes[l])
+	}
+
+	// The projection uses the same function
+	try, err := structure.TryRegisterRequest(ctx, id, request.OutcomeSuccess)
+	assert.NoError(t, err)
+	assert.InDelta(t, try.CurrentProbability, (.1+2*.1+3*.7)/6, 1e-9)
+}
+
+func TestSweep(t *testing.T) {
+	conf := &config.FairnessTrackerConfig{
+		L:                        3,
+		M:                        1000,
+		Pd:                       .001,
+		Pi:                       .5,
+		Lambda:                   .1,
+		FinalProbabilityFunction: config.MinFinalProbabilityFunction,
+	}
+	clk := utils.NewMockClock(time.Unix(1000, 0))
+	structure, err := NewStructureWithClock(conf, 1, true, clk)
+	assert.NoError(t, err)
+
+	_, err = structure.ReportOutcome(context.Background(), []byte("hello_world"), request.OutcomeFailure)
+	assert.NoError(t, err)
+
+	clk.Advance(10 * time.Second)
+	structure.Sweep()
+
+	var touched int
+	for _, lvl := range structure.State().Buckets {
+		for _, b := range lvl {
+			if b.Probability > 0 {
+				touched++
+				assert.InDelta(t, b.Probability, .5*math.Exp(-1), 1e-9)
+				assert.Equal(t, b.LastUpdatedTimeMillis, uint64(1010000))
+			} else {
+				// Empty buckets are left alone
+				assert.Equal(t, b.LastUpdatedTimeMillis, uint64(1000000))
+			}
+		}
+	}
+	assert.Equal(t, touched, 3)
+}
+
+func TestFailuresToReachProbability(t *testing.T) {
+	conf := &config.FairnessTrackerConfig{
+		L:                        3,
+		M:                        1000,
+		Pd:                       .001,
+		Pi:                       .07,
+		Lambda:                   .02,
+		FinalProbabilityFunction: config.MinFinalProbabilityFunction,
+	}
+	id := []byte("hello_world")
+
+	for _, interval := range []time.Duration{0, time.Second, 2 * time.Second} {
+		for _, target := range []float64{.2, .5, .9} {
+			n := conf.FailuresToReachProbabilityWithInterval(target, interval)
+			assert.Greater(t, n, 0)
+
+			clk := utils.NewMockClock(time.Unix(1000, 0))
+			structure, err := NewStructureWithClock(conf, 1, true, clk)
+			assert.NoError(t, err)
+
+			probability := func() float64 {
+				resp, err := structure.TryRegisterRequest(context.Background(), id, request.OutcomeSuccess)
+				assert.NoError(t, err)
+				return resp.CurrentProbability
+			}
+
+			for i := 0; i < n; i++ {
+				if i > 0 {
+					clk.Advance(interval)
+				}
+				// Not there one failure short
+				if i == n-1 {
+					assert.Less(t, probability(), target, "interval %v target %f", interval, target)
+				}
+				_, err := structure.ReportOutcome(context.Background(), id, request.OutcomeFailure)
+				assert.NoError(t, err)
+			}
+			assert.GreaterOrEqual(t, probability(), target, "interval %v target %f", interval, target)
+		}
+	}
+}
+
+func TestMaxBucketAge(t *testing.T) {
+	conf := &config.FairnessTrackerConfig{
+		L:                        3,
+		M:                        1000,
+		Pd:                       .001,
+		Pi:                       .5,
+		Lambda:                   0,
+		MaxBucketAge:             time.Minute,
+		FinalProbabilityFunction: config.MinFinalProbabilityFunction,
+	}
+	clk := utils.NewMockClock(time.Unix(1000, 0))
+	structure, err := NewStructureWithClock(conf, 1, true, clk)
+	assert.NoError(t, err)
+
+	nonZero := func() uint32 {
+		var n uint32
+		for _, occ := range structure.Occupancy() {
+			n += occ.NonZeroBuckets
+		}
+		return n
+	}
+
+	_, err = structure.ReportOutcome(context.Background(), []byte("hello_world"), request.OutcomeFailure)
+	assert.NoError(t, err)
+	assert.Equal(t, nonZero(), uint32(3))
+
+	// Not old enough yet
+	clk.Advance(30 * time.Second)
+	structure.Sweep()
+	assert.Equal(t, nonZero(), uint32(3))
+
+	clk.Advance(31 * time.Second)
+	structure.Sweep()
+	assert.Equal(t, nonZero(), uint32(0))
+	for _, lvl := range structure.State().Buckets {
+		for _, b := range lvl {
+			assert.Equal(t, b, BucketState{LastUpdatedTimeMillis: 1061000})
+		}
+	}
+
+	conf.MaxBucketAge = -time.Second
+	_, err = NewStructure(conf, 1, true)
+	assert.Error(t, err)
+}
+
+func TestExplain(t *testing.T) {
+	conf := &config.FairnessTrackerConfig{
+		L:                        3,
+		M:                        1000,
+		Pd:                       .001,
+		Pi:                       .1,
+		Lambda:                   .01,
+		FinalProbabilityFunction: config.MinFinalProbabilityFunction,
+	}
+	clk := utils.NewMockClock(time.Unix(1000, 0))
+	structure, err := NewStructureWithClock(conf, 7, false, clk)
+	assert.NoError(t, err)
+
+	ctx := context.Background()
+	id := []byte("hello_world")
+	for i := 0; i < 5; i++ {
+		_, err = structure.ReportOutcome(ctx, id, request.OutcomeFailure)
+		assert.NoError(t, err)
+	}
+	clk.Advance(10 * time.Second)
+	before := structure.State()
+
+	e, err := structure.Explain(id)
+	assert.NoError(t, err)
+	assert.Equal(t, e.StructureID, uint64(7))
+	assert.Equal(t, e.FinalProbabilityFunction, "MinFinalProbabilityFunction")
+	assert.InDelta(t, e.FinalProbability, .5*math.Exp(-.1), 1e-9)
+	assert.False(t, e.WarmingUp)
+	assert.False(t, e.Blocked)
+	assert.Contains(t, e.Decision, "throttled at random")
+
+	// The explanation is a read-only probe
+	assert.Equal(t, structure.State().Buckets, before.Buckets)
+
+	_ = structure.visitBuckets(context.Background(), id, false, func(l uint32, m uint32, b *bucket) error {
+		assert.Equal(t, e.Levels[l].Level, l)
+		assert.Equal(t, e.Levels[l].Index, m)
+		assert.InDelta(t, e.Levels[l].Probability, b.probability, 1e-9)
+		return nil
+	})
+}
+
+func TestKeyNormalizer(t *testing.T) {
+	indexes := func(normalizer config.KeyNormalizer, key string) []int {
+		seed := uint32(42)
+		conf := &config.FairnessTrackerConfig{
+			L:                        3,
+			M:                        1000,
+			Pd:                       .001,
+			Pi:                       .1,
+			MurmurSeed:               &seed,
+			KeyNormalizer:            normalizer,
+			FinalProbabilityFunction: config.MinFinalProbabilityFunction,
+		}
+		structure, err := NewStructure(conf, 1, true)
+		assert.NoError(t, err)
+
+		resp, err := structure.RegisterRequest(context.Background(), []byte(key))
+		assert.NoError(t, err)
+		return resp.ResultStats.BucketIndexes
+	}
+
+	assert.NotEqual(t, indexes(nil, "user:123 "), indexes(nil, "user:123"))
+	assert.Equal(t, indexes(config.TrimSpaceLowerNormalizer, "user:123 "), indexes(config.TrimSpaceLowerNormalizer, "user:123"))
+	assert.Equal(t, indexes(config.TrimSpaceLowerNormalizer, " USER:123\t"), indexes(nil, "user:123"))
+
+	// The outcomes of near-duplicate keys land on the same flow
+	conf := &config.FairnessTrackerConfig{
+		L:                        3,
+		M:                        1000,
+		Pd:                       .001,
+		Pi:                       .1,
+		KeyNormalizer:            config.TrimSpaceLowerNormalizer,
+		FinalProbabilityFunction: config.MinFinalProbabilityFunction,
+	}
+	structure, err := NewStructure(conf, 1, true)
+	assert.NoError(t, err)
+	ctx := context.Background()
+	for _, key := range []string{"user:123", "user:123 ", "User:123"} {
+		_, err = structure.ReportOutcome(ctx, []byte(key), request.OutcomeFailure)
+		assert.NoError(t, err)
+	}
+	p, err := structure.finalProbability([]byte("user:123"))
+	assert.NoError(t, err)
+	assert.InDelta(t, p, .3, 1e-9)
+}
+
+func TestExplicitMurmurSeed(t *testing.T) {
+	seed := uint32(42)
+	conf := &config.FairnessTrackerConfig{
+		L:                        3,
+		M:                        1000,
+		Pd:                       .001,
+		Pi:                       .1,
+		MurmurSeed:               &seed,
+		FinalProbabilityFunction: config.MinFinalProbabilityFunction,
+	}
+	s1, err := NewStructure(conf, 1, true)
+	assert.NoError(t, err)
+	s2, err := NewStructure(conf, 2, true)
+	assert.NoError(t, err)
+	assert.Equal(t, s1.State().MurmurSeed, seed)
+
+	ctx := context.Background()
+	for i := 0; i < 100; i++ {
+		id := []byte(fmt.Sprintf("flow-%d", i))
+		resp1, err := s1.RegisterRequest(ctx, id)
+		assert.NoError(t, err)
+		resp2, err := s2.RegisterRequest(ctx, id)
+		assert.NoError(t, err)
+		assert.Equal(t, resp1.ResultStats.BucketIndexes, resp2.ResultStats.BucketIndexes)
+	}
+}
+
+func TestClockGoesBackwards(t *testing.T) {
+	conf := &config.FairnessTrackerConfig{
+		L:                        3,
+		M:                        1000,
+		Pd:                       .001,
+		Pi:                       .5,
+		Lambda:                   .01,
+		FinalProbabilityFunction: config.MinFinalProbabilityFunction,
+	}
+	clk := utils.NewMockClock(time.Unix(1000, 0))
+	structure, err := NewStructureWithClock(conf, 1, true, clk)
+	assert.NoError(t, err)
+
+	ctx := context.Background()
+	id := []byte("hello_world")
+
+	_, err = structure.ReportOutcome(ctx, id, request.OutcomeFailure)
+	assert.NoError(t, err)
+
+	// The probability is preserved rather than decayed to 0 by an underflow
+	clk.Advance(-time.Minute)
+	resp, err := structure.RegisterRequest(ctx, id)
+	assert.NoError(t, err)
+	assert.Equal(t, resp.ResultStats.FinalProbability, .5)
+
+	// The decay resumes once the clock is past the last update again
+	clk.Advance(time.Minute + time.Second)
+	resp, err = structure.RegisterRequest(ctx, id)
+	assert.NoError(t, err)
+	assert.InDelta(t, resp.ResultStats.FinalProbability, .5*math.Exp(-.01), 1e-9)
+}
+
+func TestDecayOnReportOnly(t *testing.T) {
+	conf := &config.FairnessTrackerConfig{
+		L:                        1,
+		M:                        1,
+		Pd:                       .001,
+		Pi:                       .5,
+		Lambda:                   .01,
+		FinalProbabilityFunction: config.MinFinalProbabilityFunction,
+		DecayOnReportOnly:        true,
+	}
+	clk := utils.NewMockClock(time.Unix(1000, 0))
+	structure, err := NewStructureWithClock(conf, 1, true, clk)
+	assert.NoError(t, err)
+
+	ctx := context.Background()
+	id := []byte("hello_world")
+
+	_, err = structure.ReportOutcome(ctx, id, request.OutcomeFailure)
+	assert.NoError(t, err)
+	reportedMs := structure.store.GetLastUpdated(0, 0)
+
+	// The request is decided with the decayed probability but the bucket isn't written
+	clk.Advance(time.Second)
+	resp, err := structure.RegisterRequest(ctx, id)
+	assert.NoError(t, err)
+	assert.InDelta(t, resp.ResultStats.FinalProbability, .5*math.Exp(-.01), 1e-9)
+	assert.Equal(t, structure.store.GetProbability(0, 0), .5)
+	assert.Equal(t, structure.store.GetLastUpdated(0, 0), reportedMs)
+
+	// Still decayed from the last outcome rather than from the last request
+	clk.Advance(time.Second)
+	resp, err = structure.RegisterRequest(ctx, id)
+	assert.NoError(t, err)
+	assert.InDelta(t, resp.ResultStats.FinalProbability, .5*math.Exp(-.02), 1e-9)
+
+	// Reporting an outcome writes the decay back
+	_, err = structure.ReportOutcome(ctx, id, request.OutcomeSuccess)
+	assert.NoError(t, err)
+	assert.InDelta(t, structure.store.GetProbability(0, 0), .5*math.Exp(-.02)-.001, 1e-9)
+	assert.Equal(t, structure.store.GetLastUpdated(0, 0), reportedMs+2000)
+}
+
+func TestExportChangedSince(t *testing.T) {
+	conf := &config.FairnessTrackerConfig{
+		L:                        2,
+		M:                        24,
+		Pd:                       .1,
+		Pi:                       .15,
+		FinalProbabilityFunction: config.MinFinalProbabilityFunction,
+	}
+	clk := utils.NewMockClock(time.Unix(1000, 0))
+	structure, err := NewStructureWithClock(conf, 1, true, clk)
+	assert.NoError(t, err)
+
+	ctx := context.Background()
+	type coordinate struct{ level, index uint32 }
+	export := func(sinceMs uint64) map[coordinate]float64 {
+		exported := make(map[coordinate]float64)
+		structure.ExportChangedSince(sinceMs, func(level, index uint32, prob float64, lastUpdatedMs uint64) {
+			assert.Greater(t, lastUpdatedMs, sinceMs)
+			exported[coordinate{level, index}] = prob
+		})
+		return exported
+	}
+
+	since := uint64(clk.Now().UnixMilli())
+	assert.Empty(t, export(since))
+
+	clk.Advance(time.Second)
+	_, err = structure.ReportOutcome(ctx, []byte("hello_world"), request.OutcomeFailure)
+	assert.NoError(t, err)
+	resp, err := structure.RegisterRequest(ctx, []byte("hello_world"))
+	assert.NoError(t, err)
+
+	exported := export(since)
+	assert.Equal(t, len(exported), 2)
+	for l, m := range resp.ResultStats.BucketIndexes {
+		assert.Equal(t, exported[coordinate{uint32(l), uint32(m)}], .15)
+	}
+
+	// Only the buckets of the second flow changed since the first one was exported
+	since = uint64(clk.Now().UnixMilli())
+	clk.Advance(time.Second)
+	resp, err = structure.RegisterRequest(ctx, []byte("other_flow"))
+	assert.NoError(t, err)
+
+	exported = export(since)
+	assert.Equal(t, len(exported), 2)
+	for l, m := range resp.ResultStats.BucketIndexes {
+		assert.Contains(t, exported, coordinate{uint32(l), uint32(m)})
+	}
+}
+
+func TestConcurrentSnapshot(t *testing.T) {
+	conf := &config.FairnessTrackerConfig{
+		L:                        3,
+		M:                        1000,
+		Pd:                       .001,
+		Pi:                       .1,
+		Lambda:                   .01,
+		FinalProbabilityFunction: config.MinFinalProbabilityFunction,
+	}
+	structure, err := NewStructure(conf, 1, false)
+	assert.NoError(t, err)
+
+	ctx := context.Background()
+	stop := make(chan struct{})
+	wg := &sync.WaitGroup{}
+
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			id := []byte(fmt.Sprintf("client-%d", i))
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				_, err := structure.RegisterRequest(ctx, id)
+				assert.NoError(t, err)
+				_, err = structure.ReportOutcome(ctx, id, request.OutcomeFailure)
+				assert.NoError(t, err)
+			}
+		}()
+	}
+
+	minP, maxP := 1., 0.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 10; i++ {
+			snap := structure.Snapshot()
+			for _, lvl := range snap.Probabilities {
+				for _, p := range lvl {
+					minP = math.Min(minP, p)
+					maxP = math.Max(maxP, p)
+				}
+			}
+		}
+	}()
+
+	// Only fails if the snapshots deadlock with the requests
+	select {
+	case <-done:
+	case <-time.After(time.Minute):
+		t.Fatal("The snapshots didn't finish")
+	}
+	close(stop)
+	wg.Wait()
+
+	assert.GreaterOrEqual(t, minP, float64(0))
+	assert.LessOrEqual(t, maxP, float64(1))
+}
+
+func TestRatioBucketModel(t *testing.T) {
+	newStructure := func(model config.BucketModel) *Structure {
+		conf := &config.FairnessTrackerConfig{
+			L:                        3,
+			M:                        1000,
+			Pd:                       .00004,
+			Pi:                       .04,
+			Lambda:                   0,
+			FinalProbabilityFunction: config.MinFinalProbabilityFunction,
+			BucketModel:              model,
+			RatioSmoothing:           1,
+		}
+		structure, err := NewStructure(conf, 1, true)
+		assert.NoError(t, err)
+		return structure
+	}
+
+	ctx := context.Background()
+	id := []byte("hello_world")
+	probability := newStructure(config.BucketModelProbability)
+	ratio := newStructure(config.BucketModelRatio)
+
+	finalProbability := func(s *Structure) float64 {
+		resp, err := s.RegisterRequest(ctx, id)
+		assert.NoError(t, err)
+		return resp.ResultStats.FinalProbability
+	}
+
+	// Replay the identical trace against both models
+	report := func(outcome request.Outcome, n int) {
+		for i := 0; i < n; i++ {
+			_, err := probability.ReportOutcome(ctx, id, outcome)
+			assert.NoError(t, err)
+			_, err = ratio.ReportOutcome(ctx, id, outcome)
+			assert.NoError(t, err)
+		}
+	}
+
+	assert.Equal(t, finalProbability(probability), float64(0))
+	assert.Equal(t, finalProbability(ratio), float64(0))
+
+	// Both models move towards throttling with failures
+	report(request.OutcomeFailure, 20)
+	assert.InDelta(t, finalProbability(probability), .8, 1e-9)
+	assert.InDelta(t, finalProbability(ratio), 20./21, 1e-9)
+
+	// The probability model barely recovers while the ratio model tracks the failure ratio
+	report(request.OutcomeSuccess, 20)
+	assert.InDelta(t, finalProbability(probability), .7992, 1e-9)
+	assert.InDelta(t, finalProbability(ratio), 20./41, 1e-9)
+}
+
+func TestEWMABucketModel(t *testing.T) {
+	newStructure := func(model config.BucketModel) *Structure {
+		conf := &config.FairnessTrackerConfig{
+			L:                        3,
+			M:                        1000,
+			Pd:                       .00004,
+			Pi:                       .04,
+			Lambda:                   0,
+			FinalProbabilityFunction: config.MinFinalProbabilityFunction,
+			BucketModel:              model,
+			EWMAAlpha:                .05,
+		}
+		structure, err := NewStructure(conf, 1, true)
+		assert.NoError(t, err)
+		return structure
+	}
+
+	ctx := context.Background()
+	id := []byte("hello_world")
+	additive := newStructure(config.BucketModelProbability)
+	ewma := newStructure(config.BucketModelEWMA)
+
+	finalProbability := func(s *Structure) float64 {
+		resp, err := s.RegisterRequest(ctx, id)
+		assert.NoError(t, err)
+		return resp.ResultStats.FinalProbability
+	}
+
+	// Replay the identical trace against both models
+	report := func(outcome request.Outcome) {
+		_, err := additive.ReportOutcome(ctx, id, outcome)
+		assert.NoError(t, err)
+		_, err = ewma.ReportOutcome(ctx, id, outcome)
+		assert.NoError(t, err)
+	}
+
+	// A flow failing 30% of the time is fully throttled by the additive model while
+	// the EWMA model converges to its failure rate
+	for i := 0; i < 1000; i++ {
+		if i%10 < 3 {
+			report(request.OutcomeFailure)
+		} else {
+			report(request.OutcomeSuccess)
+		}
+	}
+	assert.InDelta(t, finalProbability(additive), 1, 1e-2)
+	assert.InDelta(t, finalProbability(ewma), .3, .1)
+
+	// Once the flow recovers, the EWMA model forgets the failures much faster
+	for i := 0; i < 200; i++ {
+		report(request.OutcomeSuccess)
+	}
+	assert.Greater(t, finalProbability(additive), .99)
+	assert.Less(t, finalProbability(ewma), 1e-4)
+
+	// A delta of half of Pi weighs half of a failure
+	fresh := newStructure(config.BucketModelEWMA)
+	_, err := fresh.ReportOutcomeDelta(ctx, id, .02)
+	assert.NoError(t, err)
+	assert.InDelta(t, finalProbability(fresh), .025, 1e-9)
+
+	conf := &config.FairnessTrackerConfig{L: 1, M: 1, Pd: .1, Pi: .15, BucketModel: config.BucketModelEWMA}
+	_, err = NewStructure(conf, 1, true)
+	assert.Error(t, err)
+
+	conf.EWMAAlpha = 1.5
+	_, err = NewStructure(conf, 1, true)
+	assert.Error(t, err)
+}
+
+func TestRatioBucketModelDecay(t *testing.T) {
+	conf := &config.FairnessTrackerConfig{
+		L:                        2,
+		M:                        24,
+		Pd:                       .1,
+		Pi:                       .15,
+		BucketModel:              config.BucketModelRatio,
+		RatioSmoothing:           1,
+		FinalProbabilityFunction: config.MinFinalProbabilityFunction,
+	}
+	structure, err := NewStructure(conf, 1, true)
+	assert.NoError(t, err)
+
+	p, successes, failures := structure.decay(0, 10, 10, 0)
+	assert.Equal(t, p, 10./21)
+	assert.Equal(t, successes, float64(10))
+	assert.Equal(t, failures, float64(10))
+
+	conf.Lambda = 1
+	p, _, failures = structure.decay(0, 0, 10, 1000)
+	assert.Less(t, failures, float64(10))
+	assert.Equal(t, p, failures/(failures+1))
+
+	conf.RatioSmoothing = -1
+	_, err = NewStructure(conf, 1, true)
+	assert.Error(t, err)
+}
+
+func TestSeed(t *testing.T) {
+	conf := &config.FairnessTrackerConfig{
+		L:                        3,
+		M:                        1000,
+		Pd:                       .001,
+		Pi:                       .1,
+		FinalProbabilityFunction: config.MinFinalProbabilityFunction,
+	}
+	old, err := NewStructure(conf, 1, true)
+	assert.NoError(t, err)
+	fresh, err := NewStructure(conf, 2, true)
+	assert.NoError(t, err)
+
+	ctx := context.Background()
+	id := []byte("hello_world")
+
+	for i := 0; i < 10; i++ {
+		_, err = old.ReportOutcome(ctx, id, request.OutcomeFailure)
+		assert.NoError(t, err)
+	}
+
+	resp, err := fresh.RegisterRequest(ctx, id)
+	assert.NoError(t, err)
+	assert.Equal(t, resp.ResultStats.FinalProbability, float64(0))
+
+	fresh.Seed(old)
+
+	resp, err = fresh.RegisterRequest(ctx, id)
+	assert.NoError(t, err)
+	assert.True(t, resp.ShouldThrottle)
+	assert.InDelta(t, resp.ResultStats.FinalProbability, 1, 1e-9)
+
+	// Other flows are unaffected
+	resp, err = fresh.RegisterRequest(ctx, []byte("another_client"))
+	assert.NoError(t, err)
+	assert.Less(t, resp.ResultStats.FinalProbability, float64(1))
+
+	// The seeded probabilities stay after the seed source is released
+	fresh.Seed(nil)
+	resp, err = fresh.RegisterRequest(ctx, id)
+	assert.NoError(t, err)
+	assert.InDelta(t, resp.ResultStats.FinalProbability, 1, 1e-9)
+}
+
+func TestSeedSourceIsReadOnly(t *testing.T) {
+	conf := &config.FairnessTrackerConfig{
+		L:                        3,
+		M:                        1000,
+		Pd:                       .001,
+		Pi:                       .1,
+		Lambda:                   .01,
+		FinalProbabilityFunction: config.MinFinalProbabilityFunction,
+	}
+	clk := utils.NewMockClock(time.Unix(1000, 0))
+	old, err := NewStructureWithClock(conf, 1, true, clk)
+	assert.NoError(t, err)
+	fresh, err := NewStructureWithClock(conf, 2, true, clk)
+	assert.NoError(t, err)
+	fresh.Seed(old)
+
+	ctx := context.Background()
+	id := []byte("hello_world")
+	for i := 0; i < 5; i++ {
+		_, err = old.ReportOutcome(ctx, id, request.OutcomeFailure)
+		assert.NoError(t, err)
+	}
+	before := old.State()
+
+	// Seeding reads the decayed probability of the source without writing it back
+	clk.Advance(10 * time.Second)
+	resp, err := fresh.RegisterRequest(ctx, id)
+	assert.NoError(t, err)
+	assert.InDelta(t, resp.ResultStats.FinalProbability, .5*math.Exp(-.1), 1e-9)
+	_, err = fresh.IsBlocked(id)
+	assert.NoError(t, err)
+	_, err = fresh.Explain(id)
+	assert.NoError(t, err)
+
+	assert.Equal(t, old.State().Buckets, before.Buckets)
+}
+
+func TestMPerLevel(t *testing.T) {
+	sizes := []uint32{7, 1000, 31, 1}
+	conf := &config.FairnessTrackerConfig{
+		L:                        4,
+		MPerLevel:                sizes,
+		Pd:                       .001,
+		Pi:                       .1,
+		FinalProbabilityFunction: config.MinFinalProbabilityFunction,
+	}
+	structure, err := NewStructure(conf, 1, true)
+	assert.NoError(t, err)
+
+	for l, lvl := range structure.Occupancy() {
+		assert.Equal(t, lvl.Buckets, sizes[l])
+	}
+
+	// Every flow must land inside every level and the single bucket of the last level
+	// is shared by all of them
+	ctx := context.Background()
+	for i := 0; i < 1000; i++ {
+		_, err := structure.ReportOutcome(ctx, []byte(fmt.Sprintf("flow-%d", i)), request.OutcomeFailure)
+		assert.NoError(t, err)
+	}
+	occupancy := structure.Occupancy()
+	for l, lvl := range occupancy {
+		assert.LessOrEqual(t, lvl.NonZeroBuckets, sizes[l])
+	}
+	assert.Equal(t, occupancy[0].NonZeroBuckets, uint32(7))
+	assert.Equal(t, occupancy[3].NonZeroBuckets, uint32(1))
+
+	// The state round trips with the per-level sizes
+	restored, err := NewStructureFromState(structure.State(), true, utils.NewRealClock())
+	assert.NoError(t, err)
+	assert.Equal(t, restored.Occupancy(), occupancy)
+
+	// A state that doesn't match the sizes is rejected
+	state := structure.State()
+	state.Buckets[2] = state.Buckets[2][:30]
+	_, err = NewStructureFromState(state, true, utils.NewRealClock())
+	assert.Error(t, err)
+}
+
+func TestOccupancy(t *testing.T) {
+	conf := &config.FairnessTrackerConfig{
+		L:                        3,
+		M:                        1000,
+		Pd:                       .001,
+		Pi:                       .1,
+		FinalProbabilityFunction: config.MinFinalProbabilityFunction,
+	}
+	structure, err := NewStructure(conf, 1, true)
+	assert.NoError(t, err)
+
+	for _, lvl := range structure.Occupancy() {
+		assert.Equal(t, int(lvl.Buckets), 1000)
+		assert.Equal(t, int(lvl.NonZeroBuckets), 0)
+		assert.Equal(t, lvl.MaxProbability, float64(0))
+		assert.Equal(t, lvl.MeanProbability, float64(0))
+	}
+
+	ctx := context.Background()
+	for i := 0; i < 10; i++ {
+		_, err = structure.ReportOutcome(ctx, []byte(fmt.Sprintf("client-%d", i)), request.OutcomeFailure)
+		assert.NoError(t, err)
+	}
+
+	occupancy := structure.Occupancy()
+	assert.Equal(t, len(occupancy), 3)
+	for _, lvl := range occupancy {
+		assert.Greater(t, int(lvl.NonZeroBuckets), 0)
+		assert.LessOrEqual(t, int(lvl.NonZeroBuckets), 10)
+		assert.GreaterOrEqual(t, lvl.MaxProbability, .1)
+		assert.InDelta(t, lvl.MeanProbability, float64(10)*.1/1000, 1e-9)
+	}
+}
+
+func TestAdaptiveMode(t *testing.T) {
+	newStructure := func(adaptive bool) *Structure {
+		conf := &config.FairnessTrackerConfig{
+			L:                        3,
+			M:                        1000,
+			Pd:                       .0001,
+			Pi:                       .1,
+			FinalProbabilityFunction: config.MinFinalProbabilityFunction,
+			AdaptiveMode:             adaptive,
+		}
+		structure, err := NewStructure(conf, 1, true)
+		assert.NoError(t, err)
+		return structure
+	}
+
+	ctx := context.Background()
+	fixed := newStructure(false)
+	adaptive := newStructure(true)
+
+	// A global outage where every flow fails
+	for i := 0; i < 5; i++ {
+		for c := 0; c < 50; c++ {
+			id := []byte(fmt.Sprintf("client-%d", c))
+			_, err := fixed.ReportOutcome(ctx, id, request.OutcomeFailure)
+			assert.NoError(t, err)
+			_, err = adaptive.ReportOutcome(ctx, id, request.OutcomeFailure)
+			assert.NoError(t, err)
+		}
+	}
+
+	id := []byte("client-0")
+	fixedResp, err := fixed.RegisterRequest(ctx, id)
+	assert.NoError(t, err)
+	adaptiveResp, err := adaptive.RegisterRequest(ctx, id)
+	assert.NoError(t, err)
+
+	assert.InDelta(t, fixedResp.ResultStats.FinalProbability, .5, 1e-3)
+	assert.Less(t, adaptiveResp.ResultStats.FinalProbability, fixedResp.ResultStats.FinalProbability/2)
+	assert.Greater(t, adaptiveResp.ResultStats.FinalProbability, float64(0))
+}
+
+func TestAdaptivePiScale(t *testing.T) {
+	conf := &config.FairnessTrackerConfig{
+		L:                        2,
+		M:                        24,
+		Pd:                       .1,
+		Pi:                       .15,
+		FinalProbabilityFunction: config.MinFinalProbabilityFunction,
+		AdaptiveMode:             true,
+	}
+	structure, err := NewStructure(conf, 1, true)
+	assert.NoError(t, err)
+
+	assert.Equal(t, structure.adaptivePiScale(request.OutcomeSuccess), float64(1))
+	assert.InDelta(t, structure.adaptivePiScale(request.OutcomeFailure), 1-adaptiveEWMAAlpha, 1e-9)
+
+	for i := 0; i < 10000; i++ {
+		structure.adaptivePiScale(request.OutcomeFailure)
+	}
+	assert.Equal(t, structure.adaptivePiScale(request.OutcomeFailure), adaptiveMinPiScale)
+}
+
+func TestShareFailureRate(t *testing.T) {
+	conf := &config.FairnessTrackerConfig{
+		L:                        2,
+		M:                        24,
+		Pd:                       .1,
+		Pi:                       .15,
+		FinalProbabilityFunction: config.MinFinalProbabilityFunction,
+		AdaptiveMode:             true,
+	}
+	structure, err := NewStructure(conf, 1, true)
+	assert.NoError(t, err)
+
+	var shared FailureRate
+	structure.ShareFailureRate(&shared)
+
+	// The owner adds the outcomes and the structure only reads the shared rate
+	shared.Add(request.OutcomeFailure)
+	assert.InDelta(t, structure.adaptivePiScale(request.OutcomeFailure), 1-adaptiveEWMAAlpha, 1e-9)
+	assert.InDelta(t, structure.adaptivePiScale(request.OutcomeFailure), 1-adaptiveEWMAAlpha, 1e-9)
+	assert.Equal(t, structure.globalFailureRate.Rate(), float64(0))
+}
+
+func TestIsBlockedReadOnly(t *testing.T) {
+	conf := &config.FairnessTrackerConfig{
+		L:                        3,
+		M:                        1000,
+		Pd:                       .001,
+		Pi:                       .5,
+		DecayStrategy:            config.DecayStep,
+		DecayStepIdle:            time.Minute,
+		FinalProbabilityFunction: config.MinFinalProbabilityFunction,
+	}
+	clk := utils.NewMockClock(time.Unix(1000, 0))
+	structure, err := NewStructureWithClock(conf, 1, true, clk)
+	assert.NoError(t, err)
+
+	ctx := context.Background()
+	id := []byte("hello_world")
+	for i := 0; i < 2; i++ {
+		_, err = structure.ReportOutcome(ctx, id, request.OutcomeFailure)
+		assert.NoError(t, err)
+	}
+	before := structure.State()
+
+	// Polling doesn't reset the idle time of the buckets, so the flow still unblocks
+	for i := 0; i < 2; i++ {
+		blocked, err := structure.IsBlocked(id)
+		assert.NoError(t, err)
+		assert.True(t, blocked)
+		clk.Advance(30 * time.Second)
+	}
+	assert.Equal(t, structure.State().Buckets, before.Buckets)
+
+	blocked, err := structure.IsBlocked(id)
+	assert.NoError(t, err)
+	assert.False(t, blocked)
+}
+
+func TestNegativeLambda(t *testing.T) {
+	conf := &config.FairnessTrackerConfig{
+		L:      1,
+		M:      1,
+		Pd:     .1,
+		Pi:     .15,
+		Lambda: -1,
+	}
+	_, err := NewStructure(conf, 1, true)
+	assert.Error(t, err)
+
+	var dataErr *DataError
+	assert.ErrorAs(t, err, &dataErr)
+	assert.Equal(t, errors.Unwrap(err).Error(), "the value of Lambda must be >=0, found: -1.000000")
+
+	// Zero means no decay
+	conf.Lambda = 0
+	_, err = NewStructure(conf, 1, true)
+	assert.NoError(t, err)
+}
+
+func TestProbabilityHistogram(t *testing.T) {
+	conf := &config.FairnessTrackerConfig{
+		L:                        2,
+		M:                        10,
+		Pd:                       .001,
+		Pi:                       .5,
+		Lambda:                   .1,
+		FinalProbabilityFunction: config.MinFinalProbabilityFunction,
+	}
+	clk := utils.NewMockClock(time.Unix(1000, 0))
+	structure, err := NewStructureWithClock(conf, 1, false, clk)
+	assert.NoError(t, err)
+
+	_, err = structure.ReportOutcome(context.Background(), []byte("hello_world"), request.OutcomeFailure)
+	assert.NoError(t, err)
+	assert.Equal(t, structure.ProbabilityHistogram(4), []uint64{18, 0, 2, 0})
+
+	// The probabilities are decayed to now, .5*exp(-.1*10) ~= .18
+	clk.Advance(10 * time.Second)
+	assert.Equal(t, structure.ProbabilityHistogram(4), []uint64{20, 0, 0, 0})
+	assert.Nil(t, structure.ProbabilityHistogram(-1))
+}
+
+func TestStateRoundTrip(t *testing.T) {
+	conf := &config.FairnessTrackerConfig{
+		L:                        3,
+		M:                        100,
+		Pd:                       .001,
+		Pi:                       .1,
+		FinalProbabilityFunction: config.MinFinalProbabilityFunction,
+	}
+	structure, err := NewStructure(conf, 7, true)
+	assert.NoError(t, err)
+
+	ctx := context.Background()
+	id := []byte("hello_world")
+	for i := 0; i < 5; i++ {
+		_, err = structure.ReportOutcome(ctx, id, request.OutcomeFailure)
+		assert.NoError(t, err)
+	}
+
+	state := structure.State()
+	assert.Equal(t, int(state.ID), 7)
+	assert.Equal(t, state.MurmurSeed, structure.murmurSeed.Load())
+
+	restored, err := NewStructureFromState(state, true, utils.NewRealClock())
+	assert.NoError(t, err)
+	restoredState := restored.State()
+	assert.Equal(t, restoredState.ID, state.ID)
+	assert.Equal(t, restoredState.MurmurSeed, state.MurmurSeed)
+	assert.Equal(t, restoredState.Buckets, state.Buckets)
+	assert.Equal(t, restoredState.Config.String(), state.Config.String())
+
+	// The state holds a copy of the config
+	state.Config.Pi = .9
+	assert.NotEqual(t, structure.config.Pi, .9)
+	assert.NotEqual(t, structure.State().Config.Pi, .9)
+
+	resp, err := restored.RegisterRequest(ctx, id)
+	assert.NoError(t, err)
+	assert.InDelta(t, resp.ResultStats.FinalProbability, .5, 1e-3)
+
+	state.Buckets = state.Buckets[1:]
+	_, err = NewStructureFromState(state, true, utils.NewRealClock())
+	assert.Error(t, err)
+}
+
+func TestExportImport(t *testing.T) {
+	conf := &config.FairnessTrackerConfig{
+		L:                        3,
+		M:                        100,
+		Pd:                       .001,
+		Pi:                       .1,
+		FinalProbabilityFunction: config.MinFinalProbabilityFunction,
+	}
+	structure, err := NewStructure(conf, 7, true)
+	assert.NoError(t, err)
+	other, err := NewStructure(conf, 8, true)
+	assert.NoError(t, err)
+
+	ctx := context.Background()
+	id := []byte("hello_world")
+	for i := 0; i < 5; i++ {
+		_, err = structure.ReportOutcome(ctx, id, request.OutcomeFailure)
+		assert.NoError(t, err)
+	}
+
+	// Round trip through the interface, keeping the ID of the importing structure
+	var src, dst request.Tracker = structure, other
+	state, err := src.Export()
+	assert.NoError(t, err)
+	assert.NoError(t, dst.Import(state))
+	assert.Equal(t, other.GetID(), uint64(8))
+	assert.Equal(t, other.State().Buckets, structure.State().Buckets)
+
+	resp, err := dst.RegisterRequest(ctx, id)
+	assert.NoError(t, err)
+	assert.InDelta(t, resp.ResultStats.FinalProbability, .5, 1e-3)
+
+	// A structure with another layout can't import it
+	conf2 := *conf
+	conf2.M = 50
+	small, err := NewStructure(&conf2, 9, true)
+	assert.NoError(t, err)
+	assert.Error(t, small.Import(state))
+	assert.Error(t, small.Import([]byte("not json")))
+}
+
+func TestReportOutcomeDelta(t *testing.T) {
+	conf := &config.FairnessTrackerConfig{
+		L:                        3,
+		M:                        1000,
+		Pd:                       .01,
+		Pi:                       .1,
+		FinalProbabilityFunction: config.MinFinalProbabilityFunction,
+	}
+	structure, err := NewStructure(conf, 1, true)
+	assert.NoError(t, err)
+
+	ctx := context.Background()
+	id := []byte("hello_world")
+	finalProbability := func() float64 {
+		resp, err := structure.RegisterRequest(ctx, id)
+		assert.NoError(t, err)
+		return resp.ResultStats.FinalProbability
+	}
+
+	// A soft failure nudges the probability up by half of Pi
+	_, err = structure.ReportOutcomeDelta(ctx, id, conf.Pi/2)
+	assert.NoError(t, err)
+	assert.InDelta(t, finalProbability(), .05, 1e-9)
+
+	// The binary outcomes map to +Pi and -Pd
+	_, err = structure.ReportOutcome(ctx, id, request.OutcomeFailure)
+	assert.NoError(t, err)
+	assert.InDelta(t, finalProbability(), .15, 1e-9)
+	_, err = structure.ReportOutcomeDelta(ctx, id, -conf.Pd)
+	assert.NoError(t, err)
+	assert.InDelta(t, finalProbability(), .14, 1e-9)
+
+	// Deltas are clamped to [0, 1]
+	_, err = structure.ReportOutcomeDelta(ctx, id, 5)
+	assert.NoError(t, err)
+	assert.Equal(t, finalProbability(), float64(1))
+	_, err = structure.ReportOutcomeDelta(ctx, id, -5)
+	assert.NoError(t, err)
+	assert.Equal(t, finalProbability(), float64(0))
+}
+
+func TestOutcomeTimeout(t *testing.T) {
+	for _, fraction := range []float64{0, .5} {
+		conf := &config.FairnessTrackerConfig{
+			L:                        3,
+			M:                        1000,
+			Pd:                       .01,
+			Pi:                       .1,
+			Lambda:                   .01,
+			TimeoutPenaltyFraction:   fraction,
+			FinalProbabilityFunction: config.MinFinalProbabilityFunction,
+		}
+		clk := utils.NewMockClock(time.Unix(1000, 0))
+		structure, err := NewStructureWithClock(conf, 1, true, clk)
+		assert.NoError(t, err)
+
+		ctx := context.Background()
+		id := []byte("hello_world")
+
+		_, err = structure.ReportOutcome(ctx, id, request.OutcomeFailure)
+		assert.NoError(t, err)
+		before := structure.State()
+
+		try, err := structure.TryRegisterRequest(ctx, id, request.OutcomeTimeout)
+		assert.NoError(t, err)
+		assert.InDelta(t, try.ProjectedProbability, .1+fraction*conf.Pi, 1e-9)
+
+		_, err = structure.ReportOutcome(ctx, id, request.OutcomeTimeout)
+		assert.NoError(t, err)
+
+		resp, err := structure.RegisterRequest(ctx, id)
+		assert.NoError(t, err)
+		assert.InDelta(t, resp.ResultStats.FinalProbability, .1+fraction*conf.Pi, 1e-9)
+
+		// Without a penalty, a timeout doesn't touch the buckets at all
+		if fraction == 0 {
+			assert.Equal(t, structure.State().Buckets, before.Buckets)
+		}
+	}
+
+	_, err := NewStructure(&config.FairnessTrackerConfig{L: 1, M: 1, Pd: .1, Pi: .15, TimeoutPenaltyFraction: 2}, 1, false)
+	assert.Error(t, err)
+}
+
+func TestReportOutcomeDeltaRatioModel(t *testing.T) {
+	conf := &config.FairnessTrackerConfig{
+		L:                        2,
+		M:                        24,
+		Pd:                       .01,
+		Pi:                       .1,
+		BucketModel:              config.BucketModelRatio,
+		RatioSmoothing:           1,
+		FinalProbabilityFunction: config.MinFinalProbabilityFunction,
+	}
+	structure, err := NewStructure(conf, 1, true)
+	assert.NoError(t, err)
+
+	ctx := context.Background()
+	id := []byte("hello_world")
+
+	// Half a failure and a full success
+	_, err = structure.ReportOutcomeDelta(ctx, id, conf.Pi/2)
+	assert.NoError(t, err)
+	_, err = structure.ReportOutcomeDelta(ctx, id, -conf.Pd)
+	assert.NoError(t, err)
+
+	resp, err := structure.RegisterRequest(ctx, id)
+	assert.NoError(t, err)
+	assert.InDelta(t, resp.ResultStats.FinalProbability, .5/2.5, 1e-9)
+}
+
+func TestTryRegisterRequest(t *testing.T) {
+	for _, model := range []config.BucketModel{config.BucketModelProbability, config.BucketModelRatio} {
+		conf := &config.FairnessTrackerConfig{
+			L:                        3,
+			M:                        1000,
+			Pd:                       .01,
+			Pi:                       .1,
+			BucketModel:              model,
+			RatioSmoothing:           1,
+			AdaptiveMode:             true,
+			FinalProbabilityFunction: config.MinFinalProbabilityFunction,
+		}
+		structure, err := NewStructure(conf, 1, true)
+		assert.NoError(t, err)
+
+		ctx := context.Background()
+		id := []byte("hello_world")
+
+		for _, outcome := range []request.Outcome{
+			request.OutcomeFailure, request.OutcomeFailure, request.OutcomeSuccess, request.OutcomeFailure,
+		} {
+			before := structure.State()
+
+			projection, err := structure.TryRegisterRequest(ctx, id, outcome)
+			assert.NoError(t, err)
+
+			// The projection doesn't mutate the state
+			assert.Equal(t, structure.State().Buckets, before.Buckets)
+
+			_, err = structure.ReportOutcome(ctx, id, outcome)
+			assert.NoError(t, err)
+
+			resp, err := structure.RegisterRequest(ctx, id)
+			assert.NoError(t, err)
+			assert.InDelta(t, projection.ProjectedProbability, resp.ResultStats.FinalProbability, 1e-9)
+
+			next, err := structure.TryRegisterRequest(ctx, id, outcome)
+			assert.NoError(t, err)
+			assert.InDelta(t, next.CurrentProbability, resp.ResultStats.FinalProbability, 1e-9)
+		}
+	}
+}
+
+func TestTryRegisterRequestAcrossRotation(t *testing.T) {
+	conf := &config.FairnessTrackerConfig{
+		L:                        3,
+		M:                        1000,
+		Pd:                       .01,
+		Pi:                       .1,
+		FinalProbabilityFunction: config.MinFinalProbabilityFunction,
+	}
+	clk := utils.NewMockClock(time.Unix(1000, 0))
+	old, err := NewStructureWithClock(conf, 1, true, clk)
+	assert.NoError(t, err)
+	fresh, err := NewStructureWithClock(conf, 2, true, clk)
+	assert.NoError(t, err)
+
+	ctx := context.Background()
+	id := []byte("hello_world")
+	for i := 0; i < 5; i++ {
+		_, err = old.ReportOutcome(ctx, id, request.OutcomeFailure)
+		assert.NoError(t, err)
+	}
+
+	// Like a rotation, the new structure carries forward the probabilities of the old one
+	fresh.Seed(old)
+
+	projection, err := fresh.TryRegisterRequest(ctx, id, request.OutcomeFailure)
+	assert.NoError(t, err)
+	assert.InDelta(t, projection.CurrentProbability, .5, 1e-9)
+
+	resp, err := fresh.RegisterRequest(ctx, id)
+	assert.NoError(t, err)
+	assert.InDelta(t, resp.ResultStats.FinalProbability, projection.CurrentProbability, 1e-9)
+
+	_, err = fresh.ReportOutcome(ctx, id, request.OutcomeFailure)
+	assert.NoError(t, err)
+	resp, err = fresh.RegisterRequest(ctx, id)
+	assert.NoError(t, err)
+	assert.InDelta(t, resp.ResultStats.FinalProbability, projection.ProjectedProbability, 1e-9)
+	assert.InDelta(t, projection.ProjectedProbability, .6, 1e-9)
+}
+
+func TestMaxProbability(t *testing.T) {
+	conf := &config.FairnessTrackerConfig{
+		L:                        3,
+		M:                        1000,
+		Pd:                       .01,
+		Pi:                       .1,
+		MaxProbability:           .9,
+		FinalProbabilityFunction: config.MeanFinalProbabilityFunction,
+	}
+	structure, err := NewStructure(conf, 1, true)
+	assert.NoError(t, err)
+
+	ctx := context.Background()
+	id := []byte("hello_world")
+	for i := 0; i < 100; i++ {
+		_, err = structure.ReportOutcome(ctx, id, request.OutcomeFailure)
+		assert.NoError(t, err)
+	}
+
+	throttles := 0
+	for i := 0; i < 10000; i++ {
+		resp, err := structure.RegisterRequest(ctx, id)
+		assert.NoError(t, err)
+		assert.Equal(t, resp.ResultStats.FinalProbability, .9)
+		for _, p := range resp.ResultStats.BucketProbabilities {
+			assert.Equal(t, p, .9)
+		}
+
+		if resp.ShouldThrottle {
+			throttles++
+		}
+	}
+	assert.InDelta(t, throttles, 9000, 300)
+
+	// A custom function can't go over the cap either
+	structure.SetFinalProbabilityFunction(func([]float64) (float64, error) { return 1, nil })
+	resp, err := structure.RegisterRequest(ctx, id)
+	assert.NoError(t, err)
+	assert.Equal(t, resp.ResultStats.FinalProbability, .9)
+
+	conf.MaxProbability = 1.5
+	_, err = NewStructure(conf, 1, true)
+	assert.Error(t, err)
+
+	conf.MaxProbability = -.5
+	_, err = NewStructure(conf, 1, true)
+	assert.Error(t, err)
+}
+
+func TestWarmUp(t *testing.T) {
+	always := func([]float64) (float64, error) { return 1, nil }
+	ctx := context.Background()
+	id := []byte("hello_world")
+
+	conf := &config.FairnessTrackerConfig{
+		L:                        2,
+		M:                        24,
+		Pd:                       .1,
+		Pi:                       .15,
+		WarmUpRequests:           10,
+		FinalProbabilityFunction: always,
+	}
+	structure, err := NewStructure(conf, 1, true)
+	assert.NoError(t, err)
+
+	for i := 0; i < 10; i++ {
+		resp, err := structure.RegisterRequest(ctx, id)
+		assert.NoError(t, err)
+		assert.False(t, resp.ShouldThrottle)
+		assert.Equal(t, resp.ResultStats.FinalProbability, float64(1))
+	}
+
+	resp, err := structure.RegisterRequest(ctx, id)
+	assert.NoError(t, err)
+	assert.True(t, resp.ShouldThrottle)
+
+	clk := utils.NewMockClock(time.Unix(1000, 0))
+	conf.WarmUpRequests = 0
+	conf.WarmUpDuration = time.Minute
+	structure, err = NewStructureWithClock(conf, 1, true, clk)
+	assert.NoError(t, err)
+
+	for i := 0; i < 100; i++ {
+		resp, err := structure.RegisterRequest(ctx, id)
+		assert.NoError(t, err)
+		assert.False(t, resp.ShouldThrottle)
+	}
+
+	clk.Advance(time.Minute)
+	resp, err = structure.RegisterRequest(ctx, id)
+	assert.NoError(t, err)
+	assert.True(t, resp.ShouldThrottle)
+
+	conf.WarmUpDuration = -time.Minute
+	_, err = NewStructure(conf, 1, true)
+	assert.Error(t, err)
+}
+
+func TestDiagnosticLogging(t *testing.T) {
+	ctx := context.Background()
+	id := []byte("hello_world")
+	clk := utils.NewMockClock(time.Unix(1000, 0))
+
+	conf := &config.FairnessTrackerConfig{
+		L:                        2,
+		M:                        24,
+		Pd:                       .1,
+		Pi:                       .6,
+		Lambda:                   .1,
+		FinalProbabilityFunction: config.MinFinalProbabilityFunction,
+	}
+	structure, err := NewStructureWithClock(conf, 1, true, clk)
+	assert.NoError(t, err)
+	rec := testutils.NewRecordingLogger()
+	structure.SetLogger(rec)
+
+	// Only the second failure takes the buckets over 1 and the third keeps them there
+	for i := 0; i < 3; i++ {
+		_, err = structure.ReportOutcome(ctx, id, request.OutcomeFailure)
+		assert.NoError(t, err)
+	}
+
+	lines := rec.Lines("Debugf")
+	assert.Equal(t, len(lines), 2)
+	for _, line := range lines {
+		assert.Contains(t, line, "clamped to 1.000000 from 1.200000")
+	}
+
+	// Almost everything decays away and the success takes the buckets below 0
+	clk.Advance(time.Minute)
+	_, err = structure.ReportOutcome(ctx, id, request.OutcomeSuccess)
+	assert.NoError(t, err)
+
+	lines = rec.Lines("Debugf")[2:]
+	assert.Equal(t, len(lines), 4)
+	assert.Contains(t, lines[0], "decayed to 0.002479 from 1.000000 over 60000ms")
+	assert.Contains(t, lines[1], "clamped to 0.000000")
+	assert.Contains(t, lines[2], "decayed to 0.002479 from 1.000000 over 60000ms")
+	assert.Contains(t, lines[3], "clamped to 0.000000")
+
+	// Normal operation stays silent
+	structure, err = NewStructureWithClock(conf, 2, false, clk)
+	assert.NoError(t, err)
+	rec = testutils.NewRecordingLogger()
+	structure.SetLogger(rec)
+
+	for i := 0; i < 3; i++ {
+		_, err = structure.ReportOutcome(ctx, id, request.OutcomeFailure)
+		assert.NoError(t, err)
+	}
+	assert.Empty(t, rec.Lines("Debugf"))
+}
+
+func TestDeterministicThrottle(t *testing.T) {
+	fixed := func([]float64) (float64, error) { return .3, nil }
+	ctx := context.Background()
+	id := []byte("hello_world")
+
+	throttles := func(deterministic bool) []bool {
+		conf := &config.FairnessTrackerConfig{
+			L:                        2,
+			M:                        24,
+			Pd:                       .1,
+			Pi:                       .15,
+			FinalProbabilityFunction: fixed,
+			DeterministicThrottle:    deterministic,
+		}
+		structure, err := NewStructure(conf, 1, false)
+		assert.NoError(t, err)
+
+		decisions := make([]bool, 1000)
+		for i := range decisions {
+			resp, err := structure.RegisterRequest(ctx, id)
+			assert.NoError(t, err)
+			decisions[i] = resp.ShouldThrottle
+		}
+		return decisions
+	}
+
+	count := func(decisions []bool) int {
+		n := 0
+		for _, d := range decisions {
+			if d {
+				n++
+			}
+		}
+		return n
+	}
+
+	assert.InDelta(t, count(throttles(false)), 300, 60)
+
+	first := throttles(true)
+	assert.InDelta(t, count(first), 300, 1)
+	assert.Equal(t, first, throttles(true))
+	// The throttles are spread out rather than bunched up
+	for i := 1; i < len(first); i++ {
+		assert.False(t, first[i] && first[i-1])
+	}
+}
+
+func TestDeterministicThrottleMixedFlows(t *testing.T) {
+	conf := &config.FairnessTrackerConfig{
+		L:                        3,
+		M:                        1000,
+		Pd:                       .001,
+		Pi:                       .1,
+		FinalProbabilityFunction: config.MinFinalProbabilityFunction,
+		DeterministicThrottle:    true,
+	}
+	structure, err := NewStructure(conf, 1, false)
+	assert.NoError(t, err)
+
+	abuser := []byte("abuser")
+	innocent := []byte("innocent")
+	structure.SeedClient(abuser, .99)
+	structure.SeedClient(innocent, .01)
+
+	// The flows don't collide at every level
+	e, err := structure.Explain(abuser)
+	assert.NoError(t, err)
+	assert.Equal(t, e.FinalProbability, .99)
+	e, err = structure.Explain(innocent)
+	assert.NoError(t, err)
+	assert.Equal(t, e.FinalProbability, .01)
+
+	// The credit left by the abuser isn't spent on the innocent flow
+	ctx := context.Background()
+	var abuserThrottles, innocentThrottles int
+	for i := 0; i < 100; i++ {
+		resp, err := structure.RegisterRequest(ctx, abuser)
+		assert.NoError(t, err)
+		if resp.ShouldThrottle {
+			abuserThrottles++
+		}
+
+		resp, err = structure.RegisterRequest(ctx, innocent)
+		assert.NoError(t, err)
+		if resp.ShouldThrottle {
+			innocentThrottles++
+		}
+	}
+	assert.InDelta(t, abuserThrottles, 99, 1)
+	assert.LessOrEqual(t, innocentThrottles, 1)
+}
+
+func TestSuggestedBackoff(t *testing.T) {
+	ctx := context.Background()
+	id := []byte("hello_world")
+
+	// The backoff of the first throttled request at every probability
+	var prev time.Duration
+	for _, p := range []float64{.1, .3, .5, .8, 1} {
+		fixed := func([]float64) (float64, error) { return p, nil }
+		conf := &config.FairnessTrackerConfig{
+			L:                        2,
+			M:                        24,
+			Pd:                       .1,
+			Pi:                       .15,
+			FinalProbabilityFunction: fixed,
+			DeterministicThrottle:    true,
+			BackoffBase:              10 * time.Millisecond,
+		}
+		structure, err := NewStructure(conf, 1, false)
+		assert.NoError(t, err)
+
+		for {
+			resp, err := structure.RegisterRequest(ctx, id)
+			assert.NoError(t, err)
+			if !resp.ShouldThrottle {
+				assert.Equal(t, resp.SuggestedBackoff, time.Duration(0))
+				continue
+			}
+
+			assert.Equal(t, resp.SuggestedBackoff, conf.SuggestedBackoff(p))
+			assert.Greater(t, resp.SuggestedBackoff, prev, "probability %f", p)
+			prev = resp.SuggestedBackoff
+			break
+		}
+	}
+}
+
+func TestAge(t *testing.T) {
+	start := time.Unix(1000, 0)
+	clk := utils.NewMockClock(start)
+	conf := &config.FairnessTrackerConfig{
+		L:                        2,
+		M:                        24,
+		Pd:                       .1,
+		Pi:                       .15,
+		FinalProbabilityFunction: config.MinFinalProbabilityFunction,
+	}
+	structure, err := NewStructureWithClock(conf, 1, false, clk)
+	assert.NoError(t, err)
+
+	assert.Equal(t, structure.Age(clk.Now()), time.Duration(0))
+	clk.Advance(time.Minute)
+	assert.Equal(t, structure.Age(clk.Now()), time.Minute)
+	assert.Equal(t, structure.Age(start.Add(-time.Minute)), time.Duration(0))
+}
+
+func TestEstimateRetryAfter(t *testing.T) {
+	ctx := context.Background()
+	id := []byte("hello_world")
+	clk := utils.NewMockClock(time.Unix(1000, 0))
+
+	newStructure := func(lambda float64) *Structure {
+		conf := &config.FairnessTrackerConfig{
+			L:                        2,
+			M:                        24,
+			Pd:                       .1,
+			Pi:                       .5,
+			Lambda:                   lambda,
+			FinalProbabilityFunction: config.MinFinalProbabilityFunction,
+		}
+		structure, err := NewStructureWithClock(conf, 1, true, clk)
+		assert.NoError(t, err)
+
+		_, err = structure.ReportOutcome(ctx, id, request.OutcomeFailure)
+		assert.NoError(t, err)
+		return structure
+	}
+
+	for _, lambda := range []float64{.01, .1, 1} {
+		structure := newStructure(lambda)
+
+		d, err := structure.EstimateRetryAfter(ctx, id, .1)
+		assert.NoError(t, err)
+		assert.InDelta(t, d.Seconds(), math.Log(5)/lambda, 1e-6, "lambda %f", lambda)
+
+		// After waiting that long, the probability is at the target
+		clk.Advance(d)
+		resp, err := structure.TryRegisterRequest(ctx, id, request.OutcomeSuccess)
+		assert.NoError(t, err)
+		assert.InDelta(t, resp.CurrentProbability, .1, 1e-3, "lambda %f", lambda)
+
+		// Already below the target
+		d, err = structure.EstimateRetryAfter(ctx, id, .2)
+		assert.NoError(t, err)
+		assert.Equal(t, d, time.Duration(0))
+	}
+
+	// Without decay the probability never goes down on its own
+	structure := newStructure(0)
+	d, err := structure.EstimateRetryAfter(ctx, id, .1)
+	assert.NoError(t, err)
+	assert.Equal(t, d, time.Duration(0))
+
+	d, err = newStructure(.1).EstimateRetryAfter(ctx, id, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, d, time.Duration(0))
+}
+
+func TestVisitDuration(t *testing.T) {
+	conf := &config.FairnessTrackerConfig{L: 8, M: 1000, Pi: .15, Pd: .1, FinalProbabilityFunction: config.MinFinalProbabilityFunction}
+	ctx := context.Background()
+	id := []byte("hello_world")
+
+	structure, err := NewStructureWithClock(conf, 1, true, utils.NewMockClock(time.Unix(1000, 0)))
+	assert.NoError(t, err)
+
+	// Measured with the real time even with a mock clock
+	resp, err := structure.RegisterRequest(ctx, id)
+	assert.NoError(t, err)
+	assert.Greater(t, resp.ResultStats.VisitDurationNs, int64(0))
+
+	// Not measured without the stats
+	structure, err = NewStructure(conf, 1, false)
+	assert.NoError(t, err)
+	resp, err = structure.RegisterRequest(ctx, id)
+	assert.NoError(t, err)
+	assert.Nil(t, resp.ResultStats)
+}
+
+func TestFinalProbabilityFunctionOverride(t *testing.T) {
+	conf := &config.FairnessTrackerConfig{
+		L:                        3,
+		M:                        1000,
+		Pd:                       .01,
+		Pi:                       .1,
+		FinalProbabilityFunction: config.MinFinalProbabilityFunction,
+	}
+	structure, err := NewStructureWithClock(conf, 1, true, utils.NewMockClock(time.Unix(1000, 0)))
+	assert.NoError(t, err)
+
+	ctx := context.Background()
+	id := []byte("hello_world")
+
+	_, err = structure.ReportOutcome(ctx, id, request.OutcomeFailure)
+	assert.NoError(t, err)
+	resp, err := structure.RegisterRequest(ctx, id)
+	assert.NoError(t, err)
+
+	// Bump only the bucket at the last level
+	m := uint32(resp.ResultStats.BucketIndexes[2])
+	structure.store.Lock(2, m)
+	structure.store.SetProbability(2, m, .7)
+	structure.store.Unlock(2, m)
+
+	meanCtx := config.WithFinalProbabilityFunction(ctx, config.MeanFinalProbabilityFunction)
+	projection, err := structure.TryRegisterRequest(meanCtx, id, request.OutcomeFailure)
+	assert.NoError(t, err)
+	assert.InDelta(t, projection.CurrentProbability, (.1+.1+.7)/3, 1e-9)
+	assert.InDelta(t, projection.ProjectedProbability, (.2+.2+.8)/3, 1e-9)
+
+	resp, err = structure.RegisterRequest(meanCtx, id)
+	assert.NoError(t, err)
+	assert.InDelta(t, resp.ResultStats.FinalProbability, (.1+.1+.7)/3, 1e-9)
+
+	// The override only applies to the request it's attached to
+	resp, err = structure.RegisterRequest(ctx, id)
+	assert.NoError(t, err)
+	assert.InDelta(t, resp.ResultStats.FinalProbability, .1, 1e-9)
+
+	// The override takes precedence over a FinalProbabilityFunctionEx too
+	conf.FinalProbabilityFunctionEx = func([]config.LevelProb) (float64, error) { return 1, nil }
+	structure, err = NewStructure(conf, 1, true)
+	assert.NoError(t, err)
+	resp, err = structure.RegisterRequest(config.WithFinalProbabilityFunction(ctx, config.MinFinalProbabilityFunction), id)
+	assert.NoError(t, err)
+	assert.Equal(t, resp.ResultStats.FinalProbability, 0.)
+}
+
+// A logger adding the trace ID of a request to every line
+type tracedLogger struct {
+	logger.Logger
+	traceID string
+}
+
+func (tl tracedLogger) Debugf(format string, v ...any) {
+	tl.Logger.Debugf("trace_id=%s "+format, append([]any{tl.traceID}, v...)...)
+}
+
+func TestContextLogger(t *testing.T) {
+	id := []byte("hello_world")
+	conf := &config.FairnessTrackerConfig{
+		L:                        2,
+		M:                        24,
+		Pd:                       .1,
+		Pi:                       .6,
+		FinalProbabilityFunction: config.MinFinalProbabilityFunction,
+	}
+	structure, err := NewStructure(conf, 1, true)
+	assert.NoError(t, err)
+	global := testutils.NewRecordingLogger()
+	structure.SetLogger(global)
+
+	rec := testutils.NewRecordingLogger()
+	ctx := logger.WithLogger(context.Background(), tracedLogger{Logger: rec, traceID: "abc"})
+	for i := 0; i < 2; i++ {
+		_, err = structure.ReportOutcome(ctx, id, request.OutcomeFailure)
+		assert.NoError(t, err)
+	}
+
+	// The clamping of both buckets is logged with the logger of the request
+	lines := rec.Lines("Debugf")
+	assert.Equal(t, len(lines), 2)
+	for _, line := range lines {
+		assert.True(t, strings.HasPrefix(line, "trace_id=abc "))
+		assert.Contains(t, line, "clamped to 1.000000")
+	}
+	assert.Empty(t, global.Lines("Debugf"))
+
+	// Requests without a logger keep using the one of the structure
+	_, err = structure.ReportOutcomeDelta(context.Background(), id, -2)
+	assert.NoError(t, err)
+	assert.Equal(t, len(global.Lines("Debugf")), 2)
 }
@@ -0,0 +1,95 @@
+package data
+
+import "sync"
+
+// The storage of the bucket states of a structure, e.g. to keep the buckets in shared
+// memory or in an external store instead of the heap. A bucket is addressed by its level
+// and its index at that level. The structure takes the lock of a bucket before reading or
+// writing its state and holds at most one bucket lock at a time.
+type BucketStore interface {
+	// The number of buckets at the level
+	Len(level uint32) uint32
+	// Take the exclusive lock of the bucket
+	Lock(level, index uint32)
+	// Release the lock of the bucket
+	Unlock(level, index uint32)
+	// The probability of throttling a request falling on the bucket
+	GetProbability(level, index uint32) float64
+	SetProbability(level, index uint32, probability float64)
+	// The decayed success and failure counts of the bucket, only used by the ratio model
+	GetCounts(level, index uint32) (successes, failures float64)
+	SetCounts(level, index uint32, successes, failures float64)
+	// The time in millis the bucket was last updated
+	GetLastUpdated(level, index uint32) uint64
+	SetLastUpdated(level, index uint32, lastUpdatedMs uint64)
+}
+
+// Creates the store of a structure with the given number of buckets at every level. Every
+// bucket starts with a zero state last updated at nowMs.
+type BucketStoreFactory func(sizes []uint32, nowMs uint64) BucketStore
+
+// The factory of the store used by NewStructureWithClock
+var newBucketStore BucketStoreFactory = NewMemoryBucketStore
+
+// A bucket of the in-memory store
+type memoryBucket struct {
+	bucket
+	// A mutex to protect the state of this bucket from concurrent access
+	lock sync.Mutex
+}
+
+// The default BucketStore that keeps every level in a slice on the heap
+type memoryBucketStore struct {
+	levels [][]memoryBucket
+}
+
+// Create a BucketStore that keeps the buckets in memory
+func NewMemoryBucketStore(sizes []uint32, nowMs uint64) BucketStore {
+	levels := make([][]memoryBucket, len(sizes))
+	for l, size := range sizes {
+		levels[l] = make([]memoryBucket, size)
+		for m := range levels[l] {
+			levels[l][m].lastUpdatedTimeMillis = nowMs
+		}
+	}
+
+	return &memoryBucketStore{levels: levels}
+}
+
+func (ms *memoryBucketStore) Len(level uint32) uint32 {
+	return uint32(len(ms.levels[level]))
+}
+
+func (ms *memoryBucketStore) Lock(level, index uint32) {
+	ms.levels[level][index].lock.Lock()
+}
+
+func (ms *memoryBucketStore) Unlock(level, index uint32) {
+	ms.levels[level][index].lock.Unlock()
+}
+
+func (ms *memoryBucketStore) GetProbability(level, index uint32) float64 {
+	return ms.levels[level][index].probability
+}
+
+func (ms *memoryBucketStore) SetProbability(level, index uint32, probability float64) {
+	ms.levels[level][index].probability = probability
+}
+
+func (ms *memoryBucketStore) GetCounts(level, index uint32) (float64, float64) {
+	b := &ms.levels[level][index]
+	return b.successes, b.failures
+}
+
+func (ms *memoryBucketStore) SetCounts(level, index uint32, successes, failures float64) {
+	b := &ms.levels[level][index]
+	b.successes, b.failures = successes, failures
+}
+
+func (ms *memoryBucketStore) GetLastUpdated(level, index uint32) uint64 {
+	return ms.levels[level][index].lastUpdatedTimeMillis
+}
+
+func (ms *memoryBucketStore) SetLastUpdated(level, index uint32, lastUpdatedMs uint64) {
+	ms.levels[level][index].lastUpdatedTimeMillis = lastUpdatedMs
+}
@@ -0,0 +1,132 @@
+package data
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/satmihir/fair/pkg/config"
+	"github.com/satmihir/fair/pkg/utils"
+)
+
+// The number of locks shared by the buckets of a stripedBucketStore
+const storeStripes = 7
+
+// A BucketStore that keeps all levels in one flat slice and shares a few locks across
+// the buckets, to run the tests against a store other than the default one
+type stripedBucketStore struct {
+	offsets []uint32
+	buckets []bucket
+	locks   [storeStripes]sync.Mutex
+}
+
+func newStripedBucketStore(sizes []uint32, nowMs uint64) BucketStore {
+	ss := &stripedBucketStore{offsets: make([]uint32, len(sizes)+1)}
+	for l, size := range sizes {
+		ss.offsets[l+1] = ss.offsets[l] + size
+	}
+
+	ss.buckets = make([]bucket, ss.offsets[len(sizes)])
+	for i := range ss.buckets {
+		ss.buckets[i].lastUpdatedTimeMillis = nowMs
+	}
+	return ss
+}
+
+func (ss *stripedBucketStore) at(level, index uint32) uint32 {
+	return ss.offsets[level] + index
+}
+
+func (ss *stripedBucketStore) Len(level uint32) uint32 {
+	return ss.offsets[level+1] - ss.offsets[level]
+}
+
+func (ss *stripedBucketStore) Lock(level, index uint32) {
+	ss.locks[ss.at(level, index)%storeStripes].Lock()
+}
+
+func (ss *stripedBucketStore) Unlock(level, index uint32) {
+	ss.locks[ss.at(level, index)%storeStripes].Unlock()
+}
+
+func (ss *stripedBucketStore) GetProbability(level, index uint32) float64 {
+	return ss.buckets[ss.at(level, index)].probability
+}
+
+func (ss *stripedBucketStore) SetProbability(level, index uint32, probability float64) {
+	ss.buckets[ss.at(level, index)].probability = probability
+}
+
+func (ss *stripedBucketStore) GetCounts(level, index uint32) (float64, float64) {
+	b := &ss.buckets[ss.at(level, index)]
+	return b.successes, b.failures
+}
+
+func (ss *stripedBucketStore) SetCounts(level, index uint32, successes, failures float64) {
+	b := &ss.buckets[ss.at(level, index)]
+	b.successes, b.failures = successes, failures
+}
+
+func (ss *stripedBucketStore) GetLastUpdated(level, index uint32) uint64 {
+	return ss.buckets[ss.at(level, index)].lastUpdatedTimeMillis
+}
+
+func (ss *stripedBucketStore) SetLastUpdated(level, index uint32, lastUpdatedMs uint64) {
+	ss.buckets[ss.at(level, index)].lastUpdatedTimeMillis = lastUpdatedMs
+}
+
+func TestNewStructureWithStore(t *testing.T) {
+	conf := &config.FairnessTrackerConfig{L: 2, M: 24, Pi: .15, Pd: .1}
+	clock := utils.NewRealClock()
+
+	s, err := NewStructureWithStore(conf, 1, false, clock, newStripedBucketStore)
+	assert.NoError(t, err)
+	assert.Equal(t, s.store.Len(1), uint32(24))
+
+	_, err = NewStructureWithStore(conf, 1, false, clock, nil)
+	assert.Error(t, err)
+
+	// A store that doesn't match the config
+	_, err = NewStructureWithStore(conf, 1, false, clock, func(sizes []uint32, nowMs uint64) BucketStore {
+		return newStripedBucketStore([]uint32{sizes[0], sizes[1] / 2}, nowMs)
+	})
+	assert.Error(t, err)
+}
+
+// Run the structure tests against the striped store instead of the in-memory one
+func TestStripedBucketStore(t *testing.T) {
+	newBucketStore = newStripedBucketStore
+	defer func() { newBucketStore = NewMemoryBucketStore }()
+
+	cases := []struct {
+		name string
+		test func(*testing.T)
+	}{
+		{"EndToEnd", TestEndToEnd},
+		{"Snapshot", TestSnapshot},
+		{"DecayStrategies", TestDecayStrategies},
+		{"Sweep", TestSweep},
+		{"MaxBucketAge", TestMaxBucketAge},
+		{"Explain", TestExplain},
+		{"ClockGoesBackwards", TestClockGoesBackwards},
+		{"DecayOnReportOnly", TestDecayOnReportOnly},
+		{"ExportChangedSince", TestExportChangedSince},
+		{"ConcurrentSnapshot", TestConcurrentSnapshot},
+		{"RatioBucketModel", TestRatioBucketModel},
+		{"RatioBucketModelDecay", TestRatioBucketModelDecay},
+		{"Seed", TestSeed},
+		{"MPerLevel", TestMPerLevel},
+		{"Occupancy", TestOccupancy},
+		{"ProbabilityHistogram", TestProbabilityHistogram},
+		{"StateRoundTrip", TestStateRoundTrip},
+		{"TryRegisterRequest", TestTryRegisterRequest},
+		{"MaxProbability", TestMaxProbability},
+		{"FinalProbabilityFunctionEx", TestFinalProbabilityFunctionEx},
+		{"EstimateRetryAfter", TestEstimateRetryAfter},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, tc.test)
+	}
+}
@@ -1,6 +1,7 @@
 package data
 
 import (
+	"github.com/satmihir/fair/pkg/config"
 	"github.com/satmihir/fair/pkg/utils"
 )
 
@@ -13,3 +14,95 @@ func NewDataError(wrapped error, msg string, args ...any) *DataError {
 		BaseError: utils.NewBaseError(wrapped, msg, args...),
 	}
 }
+
+// The error returned when a config fails validation. See config.ValidationError.
+type ConfigValidationError = config.ValidationError
+
+func NewConfigValidationError(fields []string, values []any, msg string, args ...any) *ConfigValidationError {
+	return config.NewValidationError(fields, values, msg, args...)
+}
+
+// A copy of the bucket probabilities of a structure taken by Structure.Snapshot
+type StructureSnapshot struct {
+	// The ID of the structure the snapshot was taken from
+	ID uint64
+	// The time in millis when the snapshot was taken
+	TakenAtMillis uint64
+	// The probabilities of all buckets at every level, decayed to TakenAtMillis
+	Probabilities [][]float64
+}
+
+// The occupancy of the buckets at a level of a structure
+type LevelOccupancy struct {
+	// The number of buckets at the level
+	Buckets uint32
+	// The number of buckets with a probability > 0
+	NonZeroBuckets uint32
+	// The max probability of all buckets at the level
+	MaxProbability float64
+	// The mean probability of all buckets at the level
+	MeanProbability float64
+}
+
+// A bucket with a non-negligible probability, returned by Structure.ActiveBuckets
+type BucketInfo struct {
+	// The level of the bucket
+	Level uint32
+	// The index of the bucket at its level
+	Index uint32
+	// The probability of the bucket, decayed to the time it was read
+	Probability float64
+	// The time in millis the bucket was last updated
+	LastUpdatedMs uint64
+}
+
+// The explanation of a throttling decision returned by Structure.Explain
+type Explanation struct {
+	// The ID of the structure making the decision
+	StructureID uint64
+	// The bucket at every level with its decayed probability
+	Levels []config.LevelProb
+	// The probability carried over from the previous structure while seeding, 0 if none.
+	// The bucket probabilities already include it.
+	SeedProbability float64
+	// The name of the function choosing the final probability from the buckets
+	FinalProbabilityFunction string
+	// The cap of the final probability
+	MaxProbability float64
+	// The final probability of throttling the request
+	FinalProbability float64
+	// If true, the request is not throttled regardless of the probability
+	WarmingUp bool
+	// If true, an exact fraction of the requests is throttled instead of throttling at random
+	Deterministic bool
+	// The final probability at or above which the client is considered blocked
+	BlockThreshold float64
+	// If true, the final probability reached the block threshold
+	Blocked bool
+	// A plain-language description of how the decision is made
+	Decision string
+}
+
+// The full state of a structure taken by Structure.State that can be used to restore it
+type StructureState struct {
+	// The ID of the structure
+	ID uint64
+	// The murmur hash seed of the structure
+	MurmurSeed uint32
+	// A copy of the config of the structure with its current final probability function
+	Config *config.FairnessTrackerConfig
+	// The state of all buckets at every level
+	Buckets [][]BucketState
+}
+
+// The state of a single bucket. Unlike a snapshot, the values are not decayed.
+type BucketState struct {
+	// The probability of the bucket
+	Probability float64
+	// The decayed count of successes, only used by the ratio model
+	Successes float64
+	// The decayed count of failures, only used by the ratio model
+	Failures float64
+	// The time in millis the bucket was last updated
+	LastUpdatedTimeMillis uint64
+}
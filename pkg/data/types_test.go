@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"testing"
 
+	"github.com/stretchr/testify/assert"
+
 	"github.com/satmihir/fair/pkg/testutils"
 )
 
@@ -13,3 +15,11 @@ func TestDataError(t *testing.T) {
 
 	testutils.TestError(t, &DataError{}, dataErr, "data error occurred: original error", origErr)
 }
+
+func TestConfigValidationError(t *testing.T) {
+	err := NewConfigValidationError([]string{"Pi"}, []any{2.}, "bad Pi %f", 2.)
+
+	testutils.TestError(t, &ConfigValidationError{}, err, "bad Pi 2.000000", nil)
+	assert.Equal(t, err.Fields, []string{"Pi"})
+	assert.Equal(t, err.Values, []any{2.})
+}
@@ -0,0 +1,82 @@
+package grpcmw
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/satmihir/fair/pkg/request"
+	"github.com/satmihir/fair/pkg/tracker"
+)
+
+// The function to extract the flow identifier from the context of an incoming call
+// (for example from the gRPC metadata). Returning nil skips fairness tracking for the call.
+type KeyFunction func(context.Context) []byte
+
+// The function to classify the error returned by the handler into an outcome.
+// If the second return value is false, no outcome is reported for the call.
+type OutcomeClassifier func(error) (request.Outcome, bool)
+
+// The default classifier reports success for a nil error and failure for any error
+// that may indicate a shortage of resources. Errors caused by the caller, such as
+// InvalidArgument or NotFound, are not reported since they are unrelated to contention.
+var DefaultOutcomeClassifier OutcomeClassifier = func(err error) (request.Outcome, bool) {
+	if err == nil {
+		return request.OutcomeSuccess, true
+	}
+
+	switch status.Code(err) {
+	case codes.Canceled,
+		codes.InvalidArgument,
+		codes.NotFound,
+		codes.AlreadyExists,
+		codes.PermissionDenied,
+		codes.FailedPrecondition,
+		codes.OutOfRange,
+		codes.Unimplemented,
+		codes.Unauthenticated:
+		return request.OutcomeFailure, false
+	}
+
+	return request.OutcomeFailure, true
+}
+
+// Creates a unary server interceptor that throttles calls using the given tracker
+// and reports outcomes using the DefaultOutcomeClassifier.
+func UnaryServerInterceptor(trk *tracker.FairnessTracker, keyFn KeyFunction) grpc.UnaryServerInterceptor {
+	return UnaryServerInterceptorWithClassifier(trk, keyFn, DefaultOutcomeClassifier)
+}
+
+// Creates a unary server interceptor that registers every call with the tracker and
+// rejects it with codes.ResourceExhausted when it should be throttled. Otherwise the
+// handler is invoked and its error is classified into an outcome to report.
+// If the tracker is nil, the interceptor simply invokes the handler.
+func UnaryServerInterceptorWithClassifier(trk *tracker.FairnessTracker, keyFn KeyFunction, classifier OutcomeClassifier) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if trk == nil {
+			return handler(ctx, req)
+		}
+
+		key := keyFn(ctx)
+		if key == nil {
+			return handler(ctx, req)
+		}
+
+		// We fail open if the tracker could not register the request
+		res, err := trk.RegisterRequest(ctx, key)
+		if err == nil && res.ShouldThrottle {
+			return nil, status.Errorf(codes.ResourceExhausted, "request to %s throttled for fairness", info.FullMethod)
+		}
+
+		resp, err := handler(ctx, req)
+
+		if outcome, ok := classifier(err); ok {
+			// Failing to report the outcome should not fail the call itself
+			_, _ = trk.ReportOutcome(ctx, key, outcome)
+		}
+
+		return resp, err
+	}
+}
@@ -0,0 +1,91 @@
+package grpcmw
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/satmihir/fair/pkg/request"
+	"github.com/satmihir/fair/pkg/tracker"
+)
+
+var info = &grpc.UnaryServerInfo{FullMethod: "/test.Service/Method"}
+
+func TestDefaultOutcomeClassifier(t *testing.T) {
+	outcome, ok := DefaultOutcomeClassifier(nil)
+	assert.True(t, ok)
+	assert.Equal(t, outcome, request.OutcomeSuccess)
+
+	outcome, ok = DefaultOutcomeClassifier(status.Error(codes.ResourceExhausted, "exhausted"))
+	assert.True(t, ok)
+	assert.Equal(t, outcome, request.OutcomeFailure)
+
+	_, ok = DefaultOutcomeClassifier(status.Error(codes.InvalidArgument, "bad request"))
+	assert.False(t, ok)
+}
+
+func TestNilTracker(t *testing.T) {
+	interceptor := UnaryServerInterceptor(nil, func(context.Context) []byte {
+		return []byte("client_id")
+	})
+
+	resp, err := interceptor(context.Background(), "req", info, func(context.Context, any) (any, error) {
+		return "resp", nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, resp, "resp")
+}
+
+func TestThrottling(t *testing.T) {
+	// A couple of failures fully throttle the flow and there is no decay
+	trkB := tracker.NewFairnessTrackerBuilder()
+	trkB.SetPi(.5)
+	trkB.SetPd(.01)
+	trkB.SetLambda(0)
+	trk, err := trkB.Build()
+	assert.NoError(t, err)
+	defer trk.Close()
+
+	interceptor := UnaryServerInterceptor(trk, func(context.Context) []byte {
+		return []byte("client_id")
+	})
+
+	handlerCalls := 0
+	handler := func(context.Context, any) (any, error) {
+		handlerCalls++
+		return nil, status.Error(codes.ResourceExhausted, "no resources left")
+	}
+
+	for i := 0; i < 30; i++ {
+		_, err = interceptor(context.Background(), "req", info, handler)
+		assert.Error(t, err)
+	}
+	calls := handlerCalls
+
+	_, err = interceptor(context.Background(), "req", info, handler)
+	assert.Equal(t, status.Code(err), codes.ResourceExhausted)
+	assert.Equal(t, handlerCalls, calls)
+}
+
+func TestUserErrorsNotReported(t *testing.T) {
+	trk, err := tracker.NewFairnessTrackerBuilder().BuildWithDefaultConfig()
+	assert.NoError(t, err)
+	defer trk.Close()
+
+	interceptor := UnaryServerInterceptor(trk, func(context.Context) []byte {
+		return []byte("client_id")
+	})
+
+	handler := func(context.Context, any) (any, error) {
+		return nil, status.Error(codes.InvalidArgument, "bad request")
+	}
+
+	for i := 0; i < 100; i++ {
+		_, err = interceptor(context.Background(), "req", info, handler)
+		assert.Equal(t, status.Code(err), codes.InvalidArgument)
+	}
+}
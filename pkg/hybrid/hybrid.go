@@ -0,0 +1,210 @@
+package hybrid
+
+import (
+	"container/list"
+	"context"
+	"math"
+	"math/rand"
+	"sync"
+
+	"github.com/satmihir/fair/pkg/config"
+	"github.com/satmihir/fair/pkg/data"
+	"github.com/satmihir/fair/pkg/request"
+	"github.com/satmihir/fair/pkg/utils"
+)
+
+// A key in the LRU
+type entry struct {
+	key string
+	// The number of requests registered while the key is a candidate
+	requests uint64
+	// If true, the key is tracked exactly with the probability below
+	exact bool
+	// The probability of throttling the key if it's tracked exactly
+	probability float64
+	// Time in millis since the probability was last updated
+	lastUpdatedTimeMillis uint64
+}
+
+// A tracker for very large key spaces. A fixed number of buckets collides more as the
+// number of distinct keys grows, so the heavy hitters are tracked exactly instead. The
+// tracker keeps an LRU of the most active keys and once a key registered AdmitAfter
+// requests while in the LRU, it gets its own probability so it neither collides with nor
+// pollutes the buckets of the other keys. All other keys use the fallback tracker.
+type Tracker struct {
+	fallback Fallback
+	config   *Config
+	clock    utils.IClock
+
+	// Guards the LRU and the entries in it
+	lock sync.Mutex
+	// The entries, most recently used first
+	lru   *list.List
+	byKey map[string]*list.Element
+}
+
+func NewTracker(fallback Fallback, conf *Config) (*Tracker, error) {
+	return NewTrackerWithClock(fallback, conf, utils.NewRealClock())
+}
+
+func NewTrackerWithClock(fallback Fallback, conf *Config, clock utils.IClock) (*Tracker, error) {
+	if fallback == nil {
+		return nil, NewHybridError(nil, "The fallback tracker must not be nil")
+	}
+	if conf == nil {
+		return nil, NewHybridError(nil, "The config must not be nil")
+	}
+	if conf.Capacity < 1 || conf.AdmitAfter < 1 {
+		return nil, NewHybridError(nil, "The Capacity and AdmitAfter must be at least 1, found Capacity: %d and AdmitAfter: %d",
+			conf.Capacity, conf.AdmitAfter)
+	}
+	if conf.Pi <= 0 || conf.Pi > 1 || conf.Pd <= 0 || conf.Pd > 1 {
+		return nil, NewHybridError(nil, "The Pi and Pd must be in (0, 1], found Pi: %f and Pd: %f", conf.Pi, conf.Pd)
+	}
+	if conf.Lambda < 0 {
+		return nil, NewHybridError(nil, "The Lambda must not be negative, found: %f", conf.Lambda)
+	}
+
+	return &Tracker{
+		fallback: fallback,
+		config:   conf,
+		clock:    clock,
+		lru:      list.New(),
+		byKey:    make(map[string]*list.Element),
+	}, nil
+}
+
+// Register a request from the client. A key tracked exactly is throttled with its own
+// probability, which is reported in the ResultStats of the result. Any other key is
+// registered with the fallback tracker.
+func (t *Tracker) RegisterRequest(ctx context.Context, clientIdentifier []byte) (*request.RegisterRequestResult, error) {
+	p, exact, err := t.touch(clientIdentifier)
+	if err != nil {
+		return nil, err
+	}
+	if !exact {
+		resp, err := t.fallback.RegisterRequest(ctx, clientIdentifier)
+		if err != nil {
+			return nil, NewHybridError(err, "Failed registering the request with the fallback tracker")
+		}
+		return resp, nil
+	}
+
+	return &request.RegisterRequestResult{
+		ShouldThrottle: p > 0 && rand.Float64() <= p,
+		ResultStats:    &request.ResultStats{FinalProbability: p},
+	}, nil
+}
+
+// Report the outcome of a request from the client. The outcome of a key tracked exactly
+// only updates its own probability. Any other outcome goes to the fallback tracker.
+func (t *Tracker) ReportOutcome(ctx context.Context, clientIdentifier []byte, outcome request.Outcome) (*request.ReportOutcomeResult, error) {
+	if t.reportExact(clientIdentifier, outcome) {
+		return &request.ReportOutcomeResult{}, nil
+	}
+
+	resp, err := t.fallback.ReportOutcome(ctx, clientIdentifier, outcome)
+	if err != nil {
+		return nil, NewHybridError(err, "Failed reporting the outcome to the fallback tracker")
+	}
+	return resp, nil
+}
+
+// Returns true if the key is currently tracked exactly
+func (t *Tracker) IsExact(clientIdentifier []byte) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	el, ok := t.byKey[string(clientIdentifier)]
+	return ok && el.Value.(*entry).exact
+}
+
+// Close the fallback tracker
+func (t *Tracker) Close() {
+	t.fallback.Close()
+}
+
+// Count a request of the key in the LRU, admitting it for exact tracking once it registered
+// enough requests, and return its decayed probability if it's tracked exactly.
+func (t *Tracker) touch(clientIdentifier []byte) (float64, bool, error) {
+	now := uint64(t.clock.Now().UnixMilli())
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	e := t.lookup(clientIdentifier, true)
+	if !e.exact {
+		e.requests++
+		if e.requests < t.config.AdmitAfter {
+			return 0, false, nil
+		}
+		// The key starts from the probability the fallback tracker would throttle it with,
+		// so a heavy hitter that is already failing isn't let through by the admission
+		explanation, err := t.fallback.Explain(clientIdentifier)
+		if err != nil {
+			return 0, false, NewHybridError(err, "Failed reading the probability of the key from the fallback tracker")
+		}
+		e.exact = true
+		e.probability = explanation.FinalProbability
+		e.lastUpdatedTimeMillis = now
+	}
+
+	t.decay(e, now)
+	return e.probability, true, nil
+}
+
+// Apply the outcome to the key if it's tracked exactly. Returns false if it's not.
+func (t *Tracker) reportExact(clientIdentifier []byte, outcome request.Outcome) bool {
+	now := uint64(t.clock.Now().UnixMilli())
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	e := t.lookup(clientIdentifier, false)
+	if e == nil || !e.exact {
+		return false
+	}
+
+	t.decay(e, now)
+	switch outcome {
+	case request.OutcomeFailure:
+		e.probability = math.Min(e.probability+t.config.Pi, 1)
+	case request.OutcomeSuccess:
+		e.probability = math.Max(e.probability-t.config.Pd, 0)
+	}
+	return true
+}
+
+// Find the entry of the key and mark it as the most recently used. If create is true, a
+// missing entry is added, evicting the least recently used one if the LRU is full.
+// Must be called with the lock held.
+func (t *Tracker) lookup(clientIdentifier []byte, create bool) *entry {
+	if el, ok := t.byKey[string(clientIdentifier)]; ok {
+		t.lru.MoveToFront(el)
+		return el.Value.(*entry)
+	}
+	if !create {
+		return nil
+	}
+
+	if t.lru.Len() >= t.config.Capacity {
+		oldest := t.lru.Back()
+		t.lru.Remove(oldest)
+		delete(t.byKey, oldest.Value.(*entry).key)
+	}
+
+	e := &entry{key: string(clientIdentifier)}
+	t.byKey[e.key] = t.lru.PushFront(e)
+	return e
+}
+
+// Decay the probability of the entry to now like an exponentially decaying bucket. Must
+// be called with the lock held.
+func (t *Tracker) decay(e *entry, now uint64) {
+	if now <= e.lastUpdatedTimeMillis {
+		return
+	}
+
+	e.probability = data.AdjustProbability(config.DecayExponential, e.probability, t.config.Lambda, 0, now-e.lastUpdatedTimeMillis)
+	e.lastUpdatedTimeMillis = now
+}
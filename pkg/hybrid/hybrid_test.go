@@ -0,0 +1,121 @@
+package hybrid
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/satmihir/fair/pkg/request"
+	"github.com/satmihir/fair/pkg/tracker"
+	"github.com/satmihir/fair/pkg/utils"
+)
+
+func TestHeavyHitterTrackedExactly(t *testing.T) {
+	trkB := tracker.NewFairnessTrackerBuilder()
+	trkB.SetRotationFrequency(0)
+	trkB.SetIncludeStats(true)
+	fallback, err := trkB.Build()
+	assert.NoError(t, err)
+
+	clk := utils.NewMockClock(time.Unix(1000, 0))
+	trk, err := NewTrackerWithClock(fallback, &Config{
+		Capacity:   4,
+		AdmitAfter: 10,
+		Pi:         .1,
+		Pd:         .01,
+		Lambda:     .1,
+	}, clk)
+	assert.NoError(t, err)
+	defer trk.Close()
+
+	ctx := context.Background()
+	heavy := []byte("heavy_hitter")
+	for i := 0; i < 10; i++ {
+		_, err := trk.RegisterRequest(ctx, heavy)
+		assert.NoError(t, err)
+
+		// Cold keys churn through the LRU without ever getting admitted
+		_, err = trk.RegisterRequest(ctx, []byte{'c', byte(i)})
+		assert.NoError(t, err)
+	}
+	assert.True(t, trk.IsExact(heavy))
+	assert.False(t, trk.IsExact([]byte{'c', 9}))
+
+	// The failures of the heavy hitter only go to its own probability
+	for i := 0; i < 3; i++ {
+		_, err := trk.ReportOutcome(ctx, heavy, request.OutcomeFailure)
+		assert.NoError(t, err)
+	}
+	resp, err := trk.RegisterRequest(ctx, heavy)
+	assert.NoError(t, err)
+	assert.InDelta(t, resp.ResultStats.FinalProbability, .3, 1e-9)
+
+	resp, err = fallback.RegisterRequest(ctx, heavy)
+	assert.NoError(t, err)
+	assert.Equal(t, resp.ResultStats.FinalProbability, float64(0))
+
+	// The exact probability decays like the buckets
+	clk.Advance(10 * time.Second)
+	resp, err = trk.RegisterRequest(ctx, heavy)
+	assert.NoError(t, err)
+	assert.InDelta(t, resp.ResultStats.FinalProbability, .3*math.Exp(-1), 1e-9)
+
+	// A cold key uses the probabilistic path
+	cold := []byte("cold_key")
+	_, err = trk.ReportOutcome(ctx, cold, request.OutcomeFailure)
+	assert.NoError(t, err)
+	resp, err = trk.RegisterRequest(ctx, cold)
+	assert.NoError(t, err)
+	assert.False(t, trk.IsExact(cold))
+	assert.Greater(t, resp.ResultStats.FinalProbability, float64(0))
+
+	_, err = NewTracker(fallback, &Config{Capacity: 0, AdmitAfter: 1, Pi: .1, Pd: .01})
+	assert.Error(t, err)
+}
+
+func TestAdmittedKeyKeepsFallbackProbability(t *testing.T) {
+	trkB := tracker.NewFairnessTrackerBuilder()
+	trkB.SetRotationFrequency(0)
+	trkB.SetLambda(0)
+	fallback, err := trkB.Build()
+	assert.NoError(t, err)
+
+	clk := utils.NewMockClock(time.Unix(1000, 0))
+	trk, err := NewTrackerWithClock(fallback, &Config{
+		Capacity:   4,
+		AdmitAfter: 2,
+		Pi:         .1,
+		Pd:         .01,
+		Lambda:     .1,
+	}, clk)
+	assert.NoError(t, err)
+	defer trk.Close()
+
+	ctx := context.Background()
+	heavy := []byte("heavy_hitter")
+
+	// The key fails while it's still tracked by the fallback
+	_, err = trk.RegisterRequest(ctx, heavy)
+	assert.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		_, err = trk.ReportOutcome(ctx, heavy, request.OutcomeFailure)
+		assert.NoError(t, err)
+	}
+	explanation, err := fallback.Explain(heavy)
+	assert.NoError(t, err)
+	assert.Greater(t, explanation.FinalProbability, float64(0))
+
+	resp, err := trk.RegisterRequest(ctx, heavy)
+	assert.NoError(t, err)
+	assert.True(t, trk.IsExact(heavy))
+	assert.Equal(t, resp.ResultStats.FinalProbability, explanation.FinalProbability)
+
+	// From then on it decays with its own rate
+	clk.Advance(10 * time.Second)
+	resp, err = trk.RegisterRequest(ctx, heavy)
+	assert.NoError(t, err)
+	assert.InDelta(t, resp.ResultStats.FinalProbability, explanation.FinalProbability*math.Exp(-1), 1e-9)
+}
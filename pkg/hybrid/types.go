@@ -0,0 +1,49 @@
+package hybrid
+
+import (
+	"context"
+
+	"github.com/satmihir/fair/pkg/data"
+	"github.com/satmihir/fair/pkg/request"
+	"github.com/satmihir/fair/pkg/utils"
+)
+
+type HybridError struct {
+	*utils.BaseError
+}
+
+func NewHybridError(wrapped error, msg string, args ...any) *HybridError {
+	return &HybridError{
+		BaseError: utils.NewBaseError(wrapped, msg, args...),
+	}
+}
+
+// The tracker used for the keys that aren't tracked exactly. The subset of request.Tracker
+// implemented by both tracker.FairnessTracker and data.Structure.
+type Fallback interface {
+	RegisterRequest(ctx context.Context, clientIdentifier []byte) (*request.RegisterRequestResult, error)
+	ReportOutcome(ctx context.Context, clientIdentifier []byte, outcome request.Outcome) (*request.ReportOutcomeResult, error)
+	// Read the probability of a key without registering a request, to seed a key that
+	// gets tracked exactly
+	Explain(clientIdentifier []byte) (*data.Explanation, error)
+	Close()
+}
+
+// The config of the hybrid tracker
+type Config struct {
+	// The max number of keys tracked in the LRU, counting both the keys tracked exactly
+	// and the candidates still counting their requests. Must be at least 1.
+	Capacity int
+	// The number of requests a key must register while in the LRU before it's tracked
+	// exactly. Keys from the long tail are evicted before they get there. Must be at least 1.
+	AdmitAfter uint64
+	// The increment of the probability of a key tracked exactly on a failure. Usually the
+	// same as the Pi of the fallback tracker.
+	Pi float64
+	// The decrement of the probability of a key tracked exactly on a success. Usually the
+	// same as the Pd of the fallback tracker.
+	Pd float64
+	// The exponential decay rate per second of the probability of a key tracked exactly.
+	// Usually the same as the Lambda of the fallback tracker.
+	Lambda float64
+}
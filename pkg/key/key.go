@@ -0,0 +1,41 @@
+package key
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+// Get the key of a string identifier, e.g. a tenant or user name
+func FromString(s string) []byte {
+	return []byte(s)
+}
+
+// Get the key of an IP address. An IPv4 address and its IPv4-in-IPv6 form get the same
+// key. Returns nil for an invalid IP.
+func FromIP(ip net.IP) []byte {
+	return ip.To16()
+}
+
+// Get the key of an integer identifier as its 8 bytes in big-endian order, which is the
+// same on every platform unlike formatting it as a string with different bases or padding
+func FromUint64(n uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, n)
+}
+
+// Join the keys of several parts into one, e.g. to track a tenant and an API together.
+// Every part is prefixed with its length instead of being joined with a plain separator,
+// which a part could contain, so different parts never give the same key: ("a", "b"),
+// ("ab") and ("a|b") are all distinct.
+func Composite(parts ...[]byte) []byte {
+	size := 0
+	for _, p := range parts {
+		size += binary.MaxVarintLen64 + len(p)
+	}
+
+	out := make([]byte, 0, size)
+	for _, p := range parts {
+		out = binary.AppendUvarint(out, uint64(len(p)))
+		out = append(out, p...)
+	}
+	return out
+}
@@ -0,0 +1,54 @@
+package key
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFromString(t *testing.T) {
+	assert.Equal(t, FromString("tenant"), []byte("tenant"))
+}
+
+func TestFromIP(t *testing.T) {
+	assert.Equal(t, FromIP(net.ParseIP("10.0.0.1")), FromIP(net.IPv4(10, 0, 0, 1).To4()))
+	assert.NotEqual(t, FromIP(net.ParseIP("10.0.0.1")), FromIP(net.ParseIP("10.0.0.2")))
+	assert.Len(t, FromIP(net.ParseIP("2001:db8::1")), 16)
+	assert.Nil(t, FromIP(net.IP{1, 2}))
+}
+
+func TestFromUint64(t *testing.T) {
+	assert.Equal(t, FromUint64(1), []byte{0, 0, 0, 0, 0, 0, 0, 1})
+	assert.NotEqual(t, FromUint64(1), FromUint64(256))
+}
+
+func TestCompositeCollisions(t *testing.T) {
+	inputs := [][][]byte{
+		{},
+		{{}},
+		{{}, {}},
+		{[]byte("ab")},
+		{[]byte("a"), []byte("b")},
+		{[]byte("a|b")},
+		{[]byte("a|"), []byte("b")},
+		{[]byte("a"), []byte("|b")},
+		{[]byte("ab"), {}},
+		{{}, []byte("ab")},
+		{{1, 'a'}, []byte("b")},
+		{{1}, []byte("a"), []byte("b")},
+		{[]byte{2, 'a', 'b'}},
+	}
+
+	seen := make(map[string]int)
+	for i, parts := range inputs {
+		k := string(Composite(parts...))
+		if j, ok := seen[k]; ok {
+			t.Fatalf("inputs %d and %d have the same key %q", j, i, k)
+		}
+		seen[k] = i
+	}
+
+	// The same parts always give the same key
+	assert.Equal(t, Composite([]byte("a"), []byte("b")), Composite([]byte("a"), []byte("b")))
+}
@@ -0,0 +1,192 @@
+package logger
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The leveled logging interface used inside the library. Implement it to route the
+// library logs into the logging system of the application.
+type Logger interface {
+	Printf(format string, v ...any)
+	Print(v ...any)
+	Println(v ...any)
+	Errorf(format string, v ...any)
+	Debugf(format string, v ...any)
+	Infof(format string, v ...any)
+	Warnf(format string, v ...any)
+}
+
+// The subset of Logger without the levels. Loggers that only implement this interface
+// can still be passed to SetLogger.
+type BasicLogger interface {
+	Printf(format string, v ...any)
+	Print(v ...any)
+	Println(v ...any)
+	Errorf(format string, v ...any)
+}
+
+// The logger used when none is set. The library stays silent by default.
+type noOpLogger struct{}
+
+func (noOpLogger) Printf(string, ...any) {}
+func (noOpLogger) Print(...any)          {}
+func (noOpLogger) Println(...any)        {}
+func (noOpLogger) Errorf(string, ...any) {}
+func (noOpLogger) Debugf(string, ...any) {}
+func (noOpLogger) Infof(string, ...any)  {}
+func (noOpLogger) Warnf(string, ...any)  {}
+
+// A logger backed by the standard library. Debug lines are dropped and the other
+// levels are prefixed with their name.
+type stdLogger struct {
+	l *log.Logger
+}
+
+// Create a Logger that writes to the given standard library logger, or to the
+// default one if nil.
+func NewStdLogger(l *log.Logger) Logger {
+	if l == nil {
+		l = log.Default()
+	}
+	return &stdLogger{l: l}
+}
+
+// Create a Logger that writes to the given writer through a standard library logger with
+// the given prefix and the standard flags, e.g. to capture the library logs in a file
+// or a buffer
+func NewStdLoggerWithWriter(w io.Writer, prefix string) Logger {
+	return NewStdLogger(log.New(w, prefix, log.LstdFlags))
+}
+
+func (s *stdLogger) Printf(format string, v ...any) { s.l.Printf(format, v...) }
+func (s *stdLogger) Print(v ...any)                 { s.l.Print(v...) }
+func (s *stdLogger) Println(v ...any)               { s.l.Println(v...) }
+func (s *stdLogger) Errorf(format string, v ...any) { s.l.Printf("ERROR: "+format, v...) }
+func (s *stdLogger) Debugf(string, ...any)          {}
+func (s *stdLogger) Infof(format string, v ...any)  { s.l.Printf("INFO: "+format, v...) }
+func (s *stdLogger) Warnf(format string, v ...any)  { s.l.Printf("WARN: "+format, v...) }
+
+// A logger writing one JSON object per line with the level, msg and ts fields, e.g. for
+// log aggregators. Like the stdLogger, debug lines are dropped and the lines without a
+// level are written at the info level.
+type jsonLogger struct {
+	// Guards the writer so concurrent lines don't interleave
+	lock sync.Mutex
+	w    io.Writer
+}
+
+// A line written by the jsonLogger
+type jsonLine struct {
+	Level string `json:"level"`
+	Msg   string `json:"msg"`
+	// The time of the line in RFC 3339 with nanoseconds
+	Ts string `json:"ts"`
+}
+
+// Create a Logger that writes JSON lines to the given writer
+func NewJSONLogger(w io.Writer) Logger {
+	return &jsonLogger{w: w}
+}
+
+func (j *jsonLogger) Printf(format string, v ...any) { j.write("info", fmt.Sprintf(format, v...)) }
+func (j *jsonLogger) Print(v ...any)                 { j.write("info", fmt.Sprint(v...)) }
+func (j *jsonLogger) Println(v ...any)               { j.write("info", strings.TrimSuffix(fmt.Sprintln(v...), "\n")) }
+func (j *jsonLogger) Errorf(format string, v ...any) { j.write("error", fmt.Sprintf(format, v...)) }
+func (j *jsonLogger) Debugf(string, ...any)          {}
+func (j *jsonLogger) Infof(format string, v ...any)  { j.write("info", fmt.Sprintf(format, v...)) }
+func (j *jsonLogger) Warnf(format string, v ...any)  { j.write("warn", fmt.Sprintf(format, v...)) }
+
+func (j *jsonLogger) write(level, msg string) {
+	line, err := json.Marshal(jsonLine{Level: level, Msg: msg, Ts: time.Now().UTC().Format(time.RFC3339Nano)})
+	if err != nil {
+		// Can't happen with string fields
+		return
+	}
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	_, _ = j.w.Write(append(line, '\n'))
+}
+
+// Adapts a BasicLogger to a Logger. Debug lines are dropped and the info and warning
+// lines are written through Printf with the name of the level as a prefix.
+type basicLoggerAdapter struct {
+	BasicLogger
+}
+
+func (a basicLoggerAdapter) Debugf(string, ...any) {}
+
+func (a basicLoggerAdapter) Infof(format string, v ...any) {
+	a.Printf("INFO: "+format, v...)
+}
+
+func (a basicLoggerAdapter) Warnf(format string, v ...any) {
+	a.Printf("WARN: "+format, v...)
+}
+
+var current atomic.Pointer[Logger]
+
+func init() {
+	SetLogger(nil)
+}
+
+// Set the logger used by the library. Loggers without levels are adapted and a nil
+// logger silences the library.
+func SetLogger(l BasicLogger) {
+	var lg Logger = noOpLogger{}
+	if l != nil {
+		lg = adapt(l)
+	}
+	current.Store(&lg)
+}
+
+// Adapt a logger without levels to the Logger interface
+func adapt(l BasicLogger) Logger {
+	if lg, ok := l.(Logger); ok {
+		return lg
+	}
+	return basicLoggerAdapter{BasicLogger: l}
+}
+
+// The key of the logger in a context
+type contextKey struct{}
+
+// Attach a logger to the context of a request, e.g. one that adds the trace ID of the
+// request to every line. The library logs about that request go to it instead of the
+// global logger. Loggers without levels are adapted like in SetLogger.
+func WithLogger(ctx context.Context, l BasicLogger) context.Context {
+	return context.WithValue(ctx, contextKey{}, adapt(l))
+}
+
+// Get the logger attached to the context with WithLogger, or nil if there's none
+func LoggerFromContext(ctx context.Context) Logger {
+	l, _ := ctx.Value(contextKey{}).(Logger)
+	return l
+}
+
+// Get the logger attached to the context with WithLogger, or the global one if there's none
+func FromContext(ctx context.Context) Logger {
+	if l := LoggerFromContext(ctx); l != nil {
+		return l
+	}
+	return GetLogger()
+}
+
+// Get the logger currently used by the library
+func GetLogger() Logger {
+	return *current.Load()
+}
+
+func Printf(format string, v ...any) { GetLogger().Printf(format, v...) }
+func Errorf(format string, v ...any) { GetLogger().Errorf(format, v...) }
+func Debugf(format string, v ...any) { GetLogger().Debugf(format, v...) }
+func Infof(format string, v ...any)  { GetLogger().Infof(format, v...) }
+func Warnf(format string, v ...any)  { GetLogger().Warnf(format, v...) }
@@ -0,0 +1,152 @@
+package logger
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/satmihir/fair/pkg/testutils"
+)
+
+// A logger that only implements the methods without levels
+type basicLogger struct {
+	lines []string
+}
+
+func (b *basicLogger) Printf(format string, v ...any) {
+	b.lines = append(b.lines, fmt.Sprintf(format, v...))
+}
+func (b *basicLogger) Print(v ...any)   { b.lines = append(b.lines, fmt.Sprint(v...)) }
+func (b *basicLogger) Println(v ...any) { b.lines = append(b.lines, fmt.Sprint(v...)) }
+func (b *basicLogger) Errorf(format string, v ...any) {
+	b.lines = append(b.lines, "ERROR: "+fmt.Sprintf(format, v...))
+}
+
+func TestDefaultLoggerIsSilent(t *testing.T) {
+	assert.Equal(t, GetLogger(), Logger(noOpLogger{}))
+}
+
+func TestLevels(t *testing.T) {
+	defer SetLogger(GetLogger())
+
+	rec := testutils.NewRecordingLogger()
+	SetLogger(rec)
+	assert.Equal(t, GetLogger(), Logger(rec))
+
+	Debugf("debug %d", 1)
+	Infof("info %d", 2)
+	Warnf("warn %d", 3)
+	Errorf("error %d", 4)
+	Printf("print %d", 5)
+
+	assert.Equal(t, rec.Lines("Debugf"), []string{"debug 1"})
+	assert.Equal(t, rec.Lines("Infof"), []string{"info 2"})
+	assert.Equal(t, rec.Lines("Warnf"), []string{"warn 3"})
+	assert.Equal(t, rec.Lines("Errorf"), []string{"error 4"})
+	assert.Equal(t, rec.Lines("Printf"), []string{"print 5"})
+}
+
+func TestBasicLoggerAdapter(t *testing.T) {
+	defer SetLogger(GetLogger())
+
+	b := &basicLogger{}
+	SetLogger(b)
+
+	Debugf("debug")
+	Infof("info %s", "line")
+	Warnf("warn %s", "line")
+	Errorf("error %s", "line")
+
+	assert.Equal(t, b.lines, []string{"INFO: info line", "WARN: warn line", "ERROR: error line"})
+}
+
+func TestStdLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewStdLogger(log.New(&buf, "", 0))
+
+	l.Debugf("debug")
+	l.Infof("info")
+	l.Warnf("warn")
+	l.Errorf("error")
+
+	assert.Equal(t, buf.String(), "INFO: info\nWARN: warn\nERROR: error\n")
+}
+
+func TestStdLoggerWithWriter(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewStdLoggerWithWriter(&buf, "fair: ")
+
+	l.Debugf("debug")
+	l.Warnf("warn %d", 1)
+	l.Errorf("error")
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	assert.Len(t, lines, 2)
+	assert.Regexp(t, `^fair: \d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2} WARN: warn 1$`, lines[0])
+	assert.Regexp(t, `^fair: .* ERROR: error$`, lines[1])
+}
+
+func TestJSONLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewJSONLogger(&buf)
+
+	l.Printf("print %d", 1)
+	l.Debugf("debug")
+	l.Errorf("error %s", "line")
+	l.Println("println", 2)
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	assert.Len(t, lines, 3)
+
+	expected := []map[string]string{
+		{"level": "info", "msg": "print 1"},
+		{"level": "error", "msg": "error line"},
+		{"level": "info", "msg": "println 2"},
+	}
+	for i, line := range lines {
+		var fields map[string]string
+		assert.NoError(t, json.Unmarshal([]byte(line), &fields))
+		assert.Equal(t, fields["level"], expected[i]["level"])
+		assert.Equal(t, fields["msg"], expected[i]["msg"])
+
+		_, err := time.Parse(time.RFC3339Nano, fields["ts"])
+		assert.NoError(t, err)
+	}
+}
+
+func TestSetNilLogger(t *testing.T) {
+	defer SetLogger(GetLogger())
+
+	SetLogger(testutils.NewRecordingLogger())
+	SetLogger(nil)
+	assert.Equal(t, GetLogger(), Logger(noOpLogger{}))
+}
+
+func TestContextLogger(t *testing.T) {
+	defer SetLogger(GetLogger())
+	global := testutils.NewRecordingLogger()
+	SetLogger(global)
+
+	ctx := context.Background()
+	assert.Nil(t, LoggerFromContext(ctx))
+	assert.Equal(t, FromContext(ctx), Logger(global))
+
+	rec := testutils.NewRecordingLogger()
+	ctx = WithLogger(ctx, rec)
+	assert.Equal(t, LoggerFromContext(ctx), Logger(rec))
+	FromContext(ctx).Infof("request %s", "abc")
+	assert.Equal(t, rec.Lines("Infof"), []string{"request abc"})
+	assert.Empty(t, global.Lines("Infof"))
+
+	// Loggers without levels are adapted
+	b := &basicLogger{}
+	FromContext(WithLogger(context.Background(), b)).Warnf("warn")
+	assert.Equal(t, b.lines, []string{"WARN: warn"})
+}
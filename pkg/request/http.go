@@ -0,0 +1,26 @@
+package request
+
+import "net/http"
+
+// Classify an HTTP status code as the outcome of a request. The second return value is
+// false when the outcome should not be reported at all, since the status doesn't tell
+// whether the resource was available:
+//   - 2xx and 3xx are successes
+//   - 429 is a failure, e.g. an upstream ran out of the resource
+//   - Other 4xx are user errors and not reported
+//   - 5xx are failures
+//   - Anything else, e.g. 1xx or an invalid code, is not reported
+func ClassifyHTTPStatus(code int) (Outcome, bool) {
+	switch {
+	case code == http.StatusTooManyRequests:
+		return OutcomeFailure, true
+	case code >= 200 && code < 400:
+		return OutcomeSuccess, true
+	case code >= 400 && code < 500:
+		return OutcomeSuccess, false
+	case code >= 500 && code < 600:
+		return OutcomeFailure, true
+	default:
+		return OutcomeSuccess, false
+	}
+}
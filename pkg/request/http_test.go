@@ -0,0 +1,30 @@
+package request
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClassifyHTTPStatus(t *testing.T) {
+	cases := []struct {
+		code    int
+		outcome Outcome
+		report  bool
+	}{
+		{http.StatusOK, OutcomeSuccess, true},
+		{http.StatusTooManyRequests, OutcomeFailure, true},
+		{http.StatusBadRequest, OutcomeSuccess, false},
+		{http.StatusServiceUnavailable, OutcomeFailure, true},
+		{http.StatusBadGateway, OutcomeFailure, true},
+	}
+
+	for _, tc := range cases {
+		outcome, report := ClassifyHTTPStatus(tc.code)
+		assert.Equal(t, report, tc.report, "code %d", tc.code)
+		if tc.report {
+			assert.Equal(t, outcome, tc.outcome, "code %d", tc.code)
+		}
+	}
+}
@@ -1,6 +1,9 @@
 package request
 
-import "context"
+import (
+	"context"
+	"time"
+)
 
 // The enum for outcome for a request
 type Outcome int
@@ -15,16 +18,33 @@ const (
 	// upstream service because of a network error would not qualify
 	// as a failure here. See ReportOutcome function for when to report.
 	OutcomeFailure
+
+	// The timeout outcome means it's unknown whether the request would have
+	// got the resource, e.g. it timed out waiting for it. It's penalized with
+	// TimeoutPenaltyFraction of Pi from the config, which is 0 by default so
+	// reporting it is a no-op unless opted in.
+	OutcomeTimeout
 )
 
 // The response object of the RegisterRequest function
 type RegisterRequestResult struct {
 	// If true, this request should be throttled
 	ShouldThrottle bool
+	// How long the client should wait before retrying a throttled request, growing with
+	// its final probability. Zero if the request isn't throttled or no BackoffBase is set.
+	SuggestedBackoff time.Duration
 	// Probabilities and other useful debugging information
 	ResultStats *ResultStats
 }
 
+// The response object of the RegisterRequestMulti function
+type MultiRegisterRequestResult struct {
+	// If true, this request should be throttled because at least one dimension says so
+	ShouldThrottle bool
+	// The results of every dimension in the order of the keys
+	Dimensions []*RegisterRequestResult
+}
+
 // Probabilities and other useful debugging information from registering a request
 type ResultStats struct {
 	// The final probability used to make the throttling decision
@@ -33,11 +53,66 @@ type ResultStats struct {
 	BucketIndexes []int
 	// The probabilities of the chosen buckets
 	BucketProbabilities []float64
+	// The final probability the secondary structure computed for the same request. Only
+	// informational, the decision is always made by the main structure. Useful to debug
+	// throttling that changes around a rotation. Only set by the FairnessTracker.
+	SecondaryFinalProbability float64
+	// The probabilities of the chosen buckets in the secondary structure. Only set by the
+	// FairnessTracker.
+	SecondaryBucketProbabilities []float64
+	// The metadata attached to the context of the request with WithRequestMeta, echoed
+	// back unchanged, e.g. a request or trace ID to join the decision with the request.
+	RequestMeta any
+	// The wall time in nanoseconds spent visiting the buckets of the request, including
+	// their locks and decay, to attribute the latency of a config while tuning it. Only
+	// measured for the main structure.
+	VisitDurationNs int64
+}
+
+// The key of the request metadata in a context
+type requestMetaKey struct{}
+
+// Attach metadata to the context of a request, which RegisterRequest echoes back in the
+// ResultStats.RequestMeta of the result when stats are included
+func WithRequestMeta(ctx context.Context, meta any) context.Context {
+	return context.WithValue(ctx, requestMetaKey{}, meta)
+}
+
+// Get the metadata attached to the context with WithRequestMeta, or nil if there's none
+func RequestMetaFromContext(ctx context.Context) any {
+	return ctx.Value(requestMetaKey{})
+}
+
+// The response object of the TryRegisterRequest function
+type TryRegisterRequestResult struct {
+	// The final probability of throttling the client right now
+	CurrentProbability float64
+	// The final probability of throttling the client if the hypothetical outcome were reported
+	ProjectedProbability float64
 }
 
 // The response object of the ReportOutcome function
 type ReportOutcomeResult struct{}
 
+// An outcome pushed to the channel of a tracker's outcome reporter
+type OutcomeItem struct {
+	// The identifier of the client the outcome belongs to
+	ClientIdentifier []byte
+	// The outcome of the request
+	Outcome Outcome
+}
+
+// An outcome reported with ReportOutcomeWeightedBatch
+type WeightedOutcomeItem struct {
+	// The identifier of the client the outcome belongs to
+	ClientIdentifier []byte
+	// The outcome of the request
+	Outcome Outcome
+	// The multiplier of the change the outcome makes to the probabilities, e.g. 2 to
+	// count the outcome twice. Must not be negative.
+	Weight float64
+}
+
 // The data structure interface
 type Tracker interface {
 	// Return the int ID of this structure. Used for implementing moving hashes.
@@ -53,10 +128,19 @@ type Tracker interface {
 	// Only report the outcomes on the requests where you could either conclusively
 	// get the resource or not. For outcomes such as user errors or network failures
 	// or timeout with upstream, do NOT report any outcome, or we may wrongly throttle
-	// requests based on things not related to resource contention.
+	// requests based on things not related to resource contention. Ambiguous timeouts
+	// may be reported as OutcomeTimeout, which only counts if the config opts in.
 	// You don't have to report an outcome to every registered request.
 	ReportOutcome(ctx context.Context, clientIdentifier []byte, outcome Outcome) (*ReportOutcomeResult, error)
 
+	// Export the state of this tracker as an opaque blob, e.g. to persist it across a
+	// restart without knowing the type of the tracker. The encoding is up to the tracker.
+	Export() ([]byte, error)
+
+	// Replace the state of this tracker with a blob exported by a tracker of the same
+	// type and bucket layout. Trackers that can't restore a state return an error.
+	Import(state []byte) error
+
 	// Close this tracker when shutting down
 	Close()
 }
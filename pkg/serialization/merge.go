@@ -0,0 +1,72 @@
+package serialization
+
+import (
+	"math"
+
+	"github.com/satmihir/fair/pkg/data"
+)
+
+// The strategy to combine the probabilities of matching buckets when merging states
+type MergeStrategy int
+
+const (
+	// Take the higher probability of the two buckets, so a flow throttled by any
+	// instance is throttled in the merged state
+	MergeMax MergeStrategy = iota
+
+	// Take the mean probability of the two buckets
+	MergeMean
+)
+
+// Merge the states of two structures, e.g. to aggregate the view of several instances
+// tracking the same flows. The structures must hash the same way, i.e. have the same
+// murmur seed and bucket layout, which across instances requires setting the MurmurSeed
+// of the config. Every bucket takes the newest update time of the two and combines the
+// probabilities and the counts of the ratio model with the strategy. The values are
+// combined as stored, without decaying them to the same time, so the states should be
+// taken at about the same time. The ID and config of the result are those of a.
+func Merge(a, b *data.StructureState, strategy MergeStrategy) (*data.StructureState, error) {
+	if a.MurmurSeed != b.MurmurSeed {
+		return nil, NewSerializationError(nil, "Cannot merge structures with different murmur seeds %d and %d", a.MurmurSeed, b.MurmurSeed)
+	}
+	if len(a.Buckets) != len(b.Buckets) {
+		return nil, NewSerializationError(nil, "Cannot merge structures with %d and %d levels", len(a.Buckets), len(b.Buckets))
+	}
+	for l := range a.Buckets {
+		if len(a.Buckets[l]) != len(b.Buckets[l]) {
+			return nil, NewSerializationError(nil, "Cannot merge structures with %d and %d buckets at level %d", len(a.Buckets[l]), len(b.Buckets[l]), l)
+		}
+	}
+
+	var combine func(x, y float64) float64
+	switch strategy {
+	case MergeMax:
+		combine = math.Max
+	case MergeMean:
+		combine = func(x, y float64) float64 { return (x + y) / 2 }
+	default:
+		return nil, NewSerializationError(nil, "Unknown merge strategy %d", strategy)
+	}
+
+	buckets := make([][]data.BucketState, len(a.Buckets))
+	for l := range a.Buckets {
+		buckets[l] = make([]data.BucketState, len(a.Buckets[l]))
+
+		for m, x := range a.Buckets[l] {
+			y := b.Buckets[l][m]
+			buckets[l][m] = data.BucketState{
+				Probability:           combine(x.Probability, y.Probability),
+				Successes:             combine(x.Successes, y.Successes),
+				Failures:              combine(x.Failures, y.Failures),
+				LastUpdatedTimeMillis: max(x.LastUpdatedTimeMillis, y.LastUpdatedTimeMillis),
+			}
+		}
+	}
+
+	return &data.StructureState{
+		ID:         a.ID,
+		MurmurSeed: a.MurmurSeed,
+		Config:     a.Config,
+		Buckets:    buckets,
+	}, nil
+}
@@ -0,0 +1,51 @@
+package serialization
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/satmihir/fair/pkg/data"
+)
+
+func TestMerge(t *testing.T) {
+	a := testState()
+	b := testState()
+	b.Buckets = [][]data.BucketState{
+		{{Probability: .1, LastUpdatedTimeMillis: 1700000000005}, {Probability: .3}},
+		{{}, {Probability: .75, LastUpdatedTimeMillis: 1700000000000}},
+	}
+
+	merged, err := Merge(a, b, MergeMax)
+	assert.NoError(t, err)
+	assert.Equal(t, merged.Buckets, [][]data.BucketState{
+		{{Probability: .5, LastUpdatedTimeMillis: 1700000000005}, {Probability: .3}},
+		{{}, {Probability: .75, LastUpdatedTimeMillis: 1700000000001}},
+	})
+
+	merged, err = Merge(a, b, MergeMean)
+	assert.NoError(t, err)
+	assert.Equal(t, merged.Buckets, [][]data.BucketState{
+		{{Probability: .3, LastUpdatedTimeMillis: 1700000000005}, {Probability: .15}},
+		{{}, {Probability: .5, LastUpdatedTimeMillis: 1700000000001}},
+	})
+	assert.Equal(t, merged.ID, a.ID)
+
+	// The inputs are left untouched
+	assert.Equal(t, a.Buckets, testState().Buckets)
+}
+
+func TestMergeMismatch(t *testing.T) {
+	b := testState()
+	b.MurmurSeed++
+	_, err := Merge(testState(), b, MergeMax)
+	assert.Error(t, err)
+
+	b = testState()
+	b.Buckets[1] = b.Buckets[1][:1]
+	_, err = Merge(testState(), b, MergeMax)
+	assert.Error(t, err)
+
+	_, err = Merge(testState(), testState(), MergeStrategy(42))
+	assert.Error(t, err)
+}
@@ -0,0 +1,90 @@
+package serialization
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// Upgrades a document of the plain JSON schema, decoded into generic JSON values, from
+// the version it's registered at to the next one. The fields missing in the older version
+// are decoded with their zero values, so a migration only has to fill in the fields whose
+// zero value doesn't match the behavior of the older version.
+type plainJSONMigration func(doc map[string]any)
+
+// The migrations by the version they upgrade from. Every bump of PlainJSONSchemaVersion
+// must register the migration from the previous version.
+var plainJSONMigrations = map[int]plainJSONMigration{
+	1: migratePlainJSONV1,
+}
+
+// Upgrade a structure or tracker document to PlainJSONSchemaVersion, returning it as is
+// if it's already there. Versions newer than the current one are rejected.
+func migratePlainJSON(b []byte) ([]byte, error) {
+	var doc map[string]any
+	// Keep the numbers as they are, a float64 can't hold every uint64
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return nil, NewSerializationError(err, "Failed to unmarshal the document")
+	}
+
+	num, ok := doc["schema_version"].(json.Number)
+	if !ok {
+		return nil, NewSerializationError(nil, "The document has no schema version")
+	}
+	version, err := num.Int64()
+	if err != nil {
+		return nil, NewSerializationError(err, "The schema version %s is not an integer", num)
+	}
+	if version == PlainJSONSchemaVersion {
+		return b, nil
+	}
+	if version > PlainJSONSchemaVersion {
+		return nil, NewSerializationError(nil, "Unknown schema version %d, expected %d", version, PlainJSONSchemaVersion)
+	}
+
+	for v := int(version); v != PlainJSONSchemaVersion; v++ {
+		migrate, ok := plainJSONMigrations[v]
+		if !ok {
+			return nil, NewSerializationError(nil, "Unknown schema version %d, expected %d", version, PlainJSONSchemaVersion)
+		}
+		migrate(doc)
+	}
+	setSchemaVersion(doc, PlainJSONSchemaVersion)
+
+	out, err := json.Marshal(doc)
+	if err != nil {
+		return nil, NewSerializationError(err, "Failed to marshal the migrated document")
+	}
+	return out, nil
+}
+
+// Set the version of the document and of the structures nested in a tracker document
+func setSchemaVersion(doc map[string]any, version int) {
+	doc["schema_version"] = version
+	for _, key := range []string{"main", "secondary"} {
+		if nested, ok := doc[key].(map[string]any); ok {
+			nested["schema_version"] = version
+		}
+	}
+}
+
+// Call fn with every config of the document, i.e. the one of a structure, or the ones of
+// a tracker and its structures
+func forEachConfig(doc map[string]any, fn func(conf map[string]any)) {
+	if conf, ok := doc["config"].(map[string]any); ok {
+		fn(conf)
+	}
+	for _, key := range []string{"main", "secondary"} {
+		if nested, ok := doc[key].(map[string]any); ok {
+			forEachConfig(nested, fn)
+		}
+	}
+}
+
+// Version 2 names the final probability function. Version 1 always restored the min one.
+func migratePlainJSONV1(doc map[string]any) {
+	forEachConfig(doc, func(conf map[string]any) {
+		conf["final_probability_function"] = finalProbabilityFunctionMin
+	})
+}
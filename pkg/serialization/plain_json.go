@@ -0,0 +1,277 @@
+package serialization
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/satmihir/fair/pkg/config"
+	"github.com/satmihir/fair/pkg/data"
+	"github.com/satmihir/fair/pkg/logger"
+)
+
+// The version of the plain JSON schema written by SerializeToPlainJSON.
+// Bump it on any change to the schema that old readers cannot understand and register
+// the migration from the previous version in plainJSONMigrations.
+const PlainJSONSchemaVersion = 2
+
+// The names of the final probability functions in the schema
+const (
+	finalProbabilityFunctionMin  = "min"
+	finalProbabilityFunctionMean = "mean"
+	// Any other function, which can't be serialized
+	finalProbabilityFunctionCustom = "custom"
+)
+
+// The plain JSON schema of a structure. Every field maps directly to the state of a
+// structure and only uses ordinary JSON numbers, booleans and arrays so it can be read
+// from any language. The field names and their meaning are stable within a version.
+type plainJSONStructure struct {
+	// The version of this schema
+	SchemaVersion int `json:"schema_version"`
+	// The ID of the structure
+	ID uint64 `json:"id"`
+	// The murmur hash seed of the structure
+	MurmurSeed uint32 `json:"murmur_seed"`
+	// The config of the structure
+	Config plainJSONConfig `json:"config"`
+	// The buckets at every level, indexed as buckets[level][bucket]
+	Buckets [][]plainJSONBucket `json:"buckets"`
+}
+
+// The serializable parts of config.FairnessTrackerConfig
+type plainJSONConfig struct {
+	M uint32 `json:"m"`
+	L uint32 `json:"l"`
+	// The final probability function, one of min, mean or custom. Since version 2.
+	FinalProbabilityFunction string  `json:"final_probability_function"`
+	Pi                       float64 `json:"pi"`
+	Pd                       float64 `json:"pd"`
+	MinPd                    float64 `json:"min_pd"`
+	Lambda                   float64 `json:"lambda"`
+	// 0 for the exponential decay, 1 for the linear decay and 2 for the step decay
+	DecayStrategy int `json:"decay_strategy"`
+	// The idle time of the step decay in milliseconds
+	DecayStepIdleMs   int64 `json:"decay_step_idle_ms"`
+	DecayOnReportOnly bool  `json:"decay_on_report_only"`
+	// The size of every level when it differs between levels, overriding m
+	MPerLevel []uint32 `json:"m_per_level,omitempty"`
+	// The murmur seed set in the config, if any. The seed the structure uses is the
+	// murmur_seed of the structure.
+	MurmurSeed             *uint32 `json:"murmur_seed,omitempty"`
+	TimeoutPenaltyFraction float64 `json:"timeout_penalty_fraction"`
+	SampleRate             float64 `json:"sample_rate"`
+	// The rotation frequency in milliseconds
+	RotationFrequencyMs int64 `json:"rotation_frequency_ms"`
+	// The rotation jitter in milliseconds
+	RotationJitterMs      int64   `json:"rotation_jitter_ms"`
+	MaxThrottlesPerSecond float64 `json:"max_throttles_per_second"`
+	// The backoff base in milliseconds
+	BackoffBaseMs int64 `json:"backoff_base_ms"`
+	DryRun        bool  `json:"dry_run"`
+	// Whether the secondary structure is kept warm, if set in the config
+	WarmSecondary *bool `json:"warm_secondary,omitempty"`
+	// The decay sweep interval in milliseconds
+	DecaySweepIntervalMs int64 `json:"decay_sweep_interval_ms"`
+	// The max bucket age in milliseconds
+	MaxBucketAgeMs int64  `json:"max_bucket_age_ms"`
+	MaxDimensions  uint32 `json:"max_dimensions"`
+	IncludeStats   bool   `json:"include_stats"`
+	// 0 for the probability model, 1 for the ratio model and 2 for the EWMA model
+	BucketModel    int     `json:"bucket_model"`
+	RatioSmoothing float64 `json:"ratio_smoothing"`
+	EWMAAlpha      float64 `json:"ewma_alpha"`
+	AdaptiveMode   bool    `json:"adaptive_mode"`
+	MaxProbability float64 `json:"max_probability"`
+	BlockThreshold float64 `json:"block_threshold"`
+	WarmUpRequests uint64  `json:"warm_up_requests"`
+	// The warm-up duration in milliseconds
+	WarmUpDurationMs      int64 `json:"warm_up_duration_ms"`
+	DeterministicThrottle bool  `json:"deterministic_throttle"`
+}
+
+type plainJSONBucket struct {
+	Probability       float64 `json:"probability"`
+	Successes         float64 `json:"successes"`
+	Failures          float64 `json:"failures"`
+	LastUpdatedTimeMs uint64  `json:"last_updated_time_ms"`
+}
+
+// Serialize the state of a structure into the plain JSON schema
+func SerializeToPlainJSON(state *data.StructureState) ([]byte, error) {
+	out, err := json.MarshalIndent(toPlainJSONStructure(state), "", "  ")
+	if err != nil {
+		return nil, NewSerializationError(err, "Failed to marshal the structure")
+	}
+	return out, nil
+}
+
+// Deserialize the state of a structure from the plain JSON schema. Older schema versions
+// are migrated to the current one and newer ones are rejected. The min and mean final
+// probability functions are restored, while a custom one can't be serialized and falls
+// back to config.MinFinalProbabilityFunction.
+func DeserializeFromPlainJSON(b []byte) (*data.StructureState, error) {
+	b, err := migratePlainJSON(b)
+	if err != nil {
+		return nil, err
+	}
+
+	var ps plainJSONStructure
+	if err := json.Unmarshal(b, &ps); err != nil {
+		return nil, NewSerializationError(err, "Failed to unmarshal the structure")
+	}
+
+	return fromPlainJSONStructure(&ps), nil
+}
+
+func toPlainJSONStructure(state *data.StructureState) *plainJSONStructure {
+	ps := &plainJSONStructure{
+		SchemaVersion: PlainJSONSchemaVersion,
+		ID:            state.ID,
+		MurmurSeed:    state.MurmurSeed,
+		Config:        toPlainJSONConfig(state.Config),
+		Buckets:       make([][]plainJSONBucket, len(state.Buckets)),
+	}
+
+	for l, lvl := range state.Buckets {
+		ps.Buckets[l] = make([]plainJSONBucket, len(lvl))
+		for m, b := range lvl {
+			ps.Buckets[l][m] = plainJSONBucket{
+				Probability:       b.Probability,
+				Successes:         b.Successes,
+				Failures:          b.Failures,
+				LastUpdatedTimeMs: b.LastUpdatedTimeMillis,
+			}
+		}
+	}
+
+	return ps
+}
+
+func fromPlainJSONStructure(ps *plainJSONStructure) *data.StructureState {
+	state := &data.StructureState{
+		ID:         ps.ID,
+		MurmurSeed: ps.MurmurSeed,
+		Config:     fromPlainJSONConfig(ps.Config),
+		Buckets:    make([][]data.BucketState, len(ps.Buckets)),
+	}
+
+	for l, lvl := range ps.Buckets {
+		state.Buckets[l] = make([]data.BucketState, len(lvl))
+		for m, b := range lvl {
+			state.Buckets[l][m] = data.BucketState{
+				Probability:           b.Probability,
+				Successes:             b.Successes,
+				Failures:              b.Failures,
+				LastUpdatedTimeMillis: b.LastUpdatedTimeMs,
+			}
+		}
+	}
+
+	return state
+}
+
+func toPlainJSONConfig(conf *config.FairnessTrackerConfig) plainJSONConfig {
+	return plainJSONConfig{
+		M:                        conf.M,
+		L:                        conf.L,
+		FinalProbabilityFunction: finalProbabilityFunctionToName(conf),
+		MPerLevel:                conf.MPerLevel,
+		MurmurSeed:               conf.MurmurSeed,
+		TimeoutPenaltyFraction:   conf.TimeoutPenaltyFraction,
+		SampleRate:               conf.SampleRate,
+		Pi:                       conf.Pi,
+		Pd:                       conf.Pd,
+		MinPd:                    conf.MinPd,
+		Lambda:                   conf.Lambda,
+		DecayStrategy:            int(conf.DecayStrategy),
+		DecayStepIdleMs:          conf.DecayStepIdle.Milliseconds(),
+		DecayOnReportOnly:        conf.DecayOnReportOnly,
+		RotationFrequencyMs:      conf.RotationFrequency.Milliseconds(),
+		RotationJitterMs:         conf.RotationJitter.Milliseconds(),
+		WarmSecondary:            conf.WarmSecondary,
+		MaxThrottlesPerSecond:    conf.MaxThrottlesPerSecond,
+		BackoffBaseMs:            conf.BackoffBase.Milliseconds(),
+		DryRun:                   conf.DryRun,
+		DecaySweepIntervalMs:     conf.DecaySweepInterval.Milliseconds(),
+		MaxBucketAgeMs:           conf.MaxBucketAge.Milliseconds(),
+		MaxDimensions:            conf.MaxDimensions,
+		IncludeStats:             conf.IncludeStats,
+		BucketModel:              int(conf.BucketModel),
+		RatioSmoothing:           conf.RatioSmoothing,
+		EWMAAlpha:                conf.EWMAAlpha,
+		AdaptiveMode:             conf.AdaptiveMode,
+		MaxProbability:           conf.MaxProbability,
+		BlockThreshold:           conf.BlockThreshold,
+		WarmUpRequests:           conf.WarmUpRequests,
+		WarmUpDurationMs:         conf.WarmUpDuration.Milliseconds(),
+		DeterministicThrottle:    conf.DeterministicThrottle,
+	}
+}
+
+func fromPlainJSONConfig(pc plainJSONConfig) *config.FairnessTrackerConfig {
+	return &config.FairnessTrackerConfig{
+		M:                        pc.M,
+		L:                        pc.L,
+		MPerLevel:                pc.MPerLevel,
+		MurmurSeed:               pc.MurmurSeed,
+		TimeoutPenaltyFraction:   pc.TimeoutPenaltyFraction,
+		SampleRate:               pc.SampleRate,
+		Pi:                       pc.Pi,
+		Pd:                       pc.Pd,
+		MinPd:                    pc.MinPd,
+		Lambda:                   pc.Lambda,
+		DecayStrategy:            config.DecayStrategy(pc.DecayStrategy),
+		DecayStepIdle:            time.Duration(pc.DecayStepIdleMs) * time.Millisecond,
+		DecayOnReportOnly:        pc.DecayOnReportOnly,
+		RotationFrequency:        time.Duration(pc.RotationFrequencyMs) * time.Millisecond,
+		RotationJitter:           time.Duration(pc.RotationJitterMs) * time.Millisecond,
+		WarmSecondary:            pc.WarmSecondary,
+		MaxThrottlesPerSecond:    pc.MaxThrottlesPerSecond,
+		BackoffBase:              time.Duration(pc.BackoffBaseMs) * time.Millisecond,
+		DryRun:                   pc.DryRun,
+		DecaySweepInterval:       time.Duration(pc.DecaySweepIntervalMs) * time.Millisecond,
+		MaxBucketAge:             time.Duration(pc.MaxBucketAgeMs) * time.Millisecond,
+		MaxDimensions:            pc.MaxDimensions,
+		IncludeStats:             pc.IncludeStats,
+		FinalProbabilityFunction: finalProbabilityFunctionFromName(pc.FinalProbabilityFunction),
+		BucketModel:              config.BucketModel(pc.BucketModel),
+		RatioSmoothing:           pc.RatioSmoothing,
+		EWMAAlpha:                pc.EWMAAlpha,
+		AdaptiveMode:             pc.AdaptiveMode,
+		MaxProbability:           pc.MaxProbability,
+		BlockThreshold:           pc.BlockThreshold,
+		WarmUpRequests:           pc.WarmUpRequests,
+		WarmUpDuration:           time.Duration(pc.WarmUpDurationMs) * time.Millisecond,
+		DeterministicThrottle:    pc.DeterministicThrottle,
+	}
+}
+
+// The name of the final probability function of the config in the schema
+func finalProbabilityFunctionToName(conf *config.FairnessTrackerConfig) string {
+	if conf.FinalProbabilityFunctionEx != nil {
+		return finalProbabilityFunctionCustom
+	}
+
+	switch config.FinalProbabilityFunctionName(conf.FinalProbabilityFunction) {
+	case "MinFinalProbabilityFunction":
+		return finalProbabilityFunctionMin
+	case "MeanFinalProbabilityFunction":
+		return finalProbabilityFunctionMean
+	default:
+		return finalProbabilityFunctionCustom
+	}
+}
+
+// The final probability function named in the schema, falling back to the min one for a
+// custom function
+func finalProbabilityFunctionFromName(name string) config.FinalProbabilityFunction {
+	switch name {
+	case finalProbabilityFunctionMin:
+		return config.MinFinalProbabilityFunction
+	case finalProbabilityFunctionMean:
+		return config.MeanFinalProbabilityFunction
+	default:
+		logger.Infof("Falling back to the min final probability function for the %q one", name)
+		return config.MinFinalProbabilityFunction
+	}
+}
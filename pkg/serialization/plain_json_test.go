@@ -0,0 +1,158 @@
+package serialization
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/satmihir/fair/pkg/config"
+	"github.com/satmihir/fair/pkg/data"
+	"github.com/satmihir/fair/pkg/request"
+	"github.com/satmihir/fair/pkg/utils"
+)
+
+func testState() *data.StructureState {
+	return &data.StructureState{
+		ID:         3,
+		MurmurSeed: 42,
+		Config: &config.FairnessTrackerConfig{
+			M:                        2,
+			L:                        2,
+			Pi:                       .04,
+			Pd:                       .00004,
+			Lambda:                   .01,
+			RotationFrequency:        5 * time.Minute,
+			FinalProbabilityFunction: config.MinFinalProbabilityFunction,
+			RatioSmoothing:           1,
+			MaxProbability:           1,
+		},
+		Buckets: [][]data.BucketState{
+			{{Probability: .5, LastUpdatedTimeMillis: 1700000000000}, {}},
+			{{}, {Probability: .25, LastUpdatedTimeMillis: 1700000000001}},
+		},
+	}
+}
+
+func TestPlainJSONGolden(t *testing.T) {
+	out, err := SerializeToPlainJSON(testState())
+	assert.NoError(t, err)
+
+	golden, err := os.ReadFile(filepath.Join("testdata", "structure_v2.json"))
+	assert.NoError(t, err)
+	assert.Equal(t, strings.TrimSpace(string(golden)), string(out))
+}
+
+func TestPlainJSONRoundTrip(t *testing.T) {
+	conf := config.DefaultFairnessTrackerConfig()
+	// No decay between the outcomes and the request on the restored structure
+	clk := utils.NewMockClock(time.Unix(1000, 0))
+	structure, err := data.NewStructureWithClock(conf, 1, true, clk)
+	assert.NoError(t, err)
+
+	ctx := context.Background()
+	id := []byte("hello_world")
+	for i := 0; i < 10; i++ {
+		_, err = structure.ReportOutcome(ctx, id, request.OutcomeFailure)
+		assert.NoError(t, err)
+	}
+	state := structure.State()
+
+	out, err := SerializeToPlainJSON(state)
+	assert.NoError(t, err)
+
+	restoredState, err := DeserializeFromPlainJSON(out)
+	assert.NoError(t, err)
+	assert.Equal(t, restoredState.ID, state.ID)
+	assert.Equal(t, restoredState.MurmurSeed, state.MurmurSeed)
+	assert.Equal(t, restoredState.Buckets, state.Buckets)
+	assert.Equal(t, restoredState.Config.L, conf.L)
+	assert.Equal(t, restoredState.Config.RotationFrequency, conf.RotationFrequency)
+
+	restored, err := data.NewStructureFromState(restoredState, true, clk)
+	assert.NoError(t, err)
+
+	resp, err := restored.RegisterRequest(ctx, id)
+	assert.NoError(t, err)
+	assert.InDelta(t, resp.ResultStats.FinalProbability, .4, 1e-9)
+}
+
+func TestPlainJSONMPerLevel(t *testing.T) {
+	conf := config.DefaultFairnessTrackerConfig()
+	conf.L = 3
+	conf.MPerLevel = []uint32{5, 50, 500}
+	structure, err := data.NewStructure(conf, 1, true)
+	assert.NoError(t, err)
+
+	out, err := SerializeToPlainJSON(structure.State())
+	assert.NoError(t, err)
+	assert.Contains(t, string(out), `"m_per_level"`)
+
+	restoredState, err := DeserializeFromPlainJSON(out)
+	assert.NoError(t, err)
+	assert.Equal(t, restoredState.Config.MPerLevel, conf.MPerLevel)
+
+	_, err = data.NewStructureFromState(restoredState, true, utils.NewRealClock())
+	assert.NoError(t, err)
+}
+
+func TestPlainJSONUnknownVersion(t *testing.T) {
+	_, err := DeserializeFromPlainJSON([]byte(`{"schema_version": 3}`))
+	assert.Error(t, err)
+	assert.Equal(t, err.Error(), "Unknown schema version 3, expected 2")
+
+	_, err = DeserializeFromPlainJSON([]byte(`{"schema_version": 0}`))
+	assert.Error(t, err)
+
+	_, err = DeserializeFromPlainJSON([]byte(`{"id": 1}`))
+	assert.Error(t, err)
+
+	_, err = DeserializeFromPlainJSON([]byte(`not json`))
+	assert.Error(t, err)
+}
+
+func TestPlainJSONMigrateV1(t *testing.T) {
+	v1, err := os.ReadFile(filepath.Join("testdata", "structure_v1.json"))
+	assert.NoError(t, err)
+
+	state, err := DeserializeFromPlainJSON(v1)
+	assert.NoError(t, err)
+	assert.Equal(t, state.ID, uint64(3))
+	assert.Equal(t, state.MurmurSeed, uint32(42))
+	assert.Equal(t, state.Buckets, testState().Buckets)
+
+	// The fields added since version 1 get their defaults
+	assert.Equal(t, config.FinalProbabilityFunctionName(state.Config.FinalProbabilityFunction), "MinFinalProbabilityFunction")
+	assert.Equal(t, state.Config.DecayStrategy, config.DecayExponential)
+	assert.Equal(t, state.Config.MaxProbability, 0.)
+	assert.Nil(t, state.Config.WarmSecondary)
+	assert.Equal(t, state.Config.Pi, .04)
+	assert.Equal(t, state.Config.RotationFrequency, 5*time.Minute)
+
+	_, err = data.NewStructureFromState(state, false, utils.NewRealClock())
+	assert.NoError(t, err)
+}
+
+func TestPlainJSONFinalProbabilityFunction(t *testing.T) {
+	state := testState()
+	state.Config.FinalProbabilityFunction = config.MeanFinalProbabilityFunction
+
+	out, err := SerializeToPlainJSON(state)
+	assert.NoError(t, err)
+	restored, err := DeserializeFromPlainJSON(out)
+	assert.NoError(t, err)
+	assert.Equal(t, config.FinalProbabilityFunctionName(restored.Config.FinalProbabilityFunction), "MeanFinalProbabilityFunction")
+
+	// A custom function can't be restored
+	state.Config.FinalProbabilityFunction = config.PercentileFinalProbabilityFunction(.5)
+	out, err = SerializeToPlainJSON(state)
+	assert.NoError(t, err)
+	assert.Contains(t, string(out), `"final_probability_function": "custom"`)
+	restored, err = DeserializeFromPlainJSON(out)
+	assert.NoError(t, err)
+	assert.Equal(t, config.FinalProbabilityFunctionName(restored.Config.FinalProbabilityFunction), "MinFinalProbabilityFunction")
+}
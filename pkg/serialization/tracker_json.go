@@ -0,0 +1,76 @@
+package serialization
+
+import (
+	"encoding/json"
+
+	"github.com/satmihir/fair/pkg/tracker"
+)
+
+// The plain JSON schema of a tracker. The structures use the same schema as the ones
+// written by SerializeToPlainJSON and share its version.
+type plainJSONTracker struct {
+	// The version of this schema
+	SchemaVersion int `json:"schema_version"`
+	// The ID the next structure created by the tracker gets
+	StructureIDCounter uint64 `json:"structure_id_counter"`
+	// The config of the tracker
+	Config plainJSONConfig `json:"config"`
+	// The main structure
+	Main *plainJSONStructure `json:"main"`
+	// The secondary structure. Readers must tolerate it missing.
+	Secondary *plainJSONStructure `json:"secondary,omitempty"`
+}
+
+// Serialize the state of a tracker, including both of its structures, into the plain JSON schema
+func SerializeTrackerToPlainJSON(state *tracker.TrackerState) ([]byte, error) {
+	if state.Main == nil {
+		return nil, NewSerializationError(nil, "The tracker state has no main structure")
+	}
+
+	pt := &plainJSONTracker{
+		SchemaVersion:      PlainJSONSchemaVersion,
+		StructureIDCounter: state.StructureIDCounter,
+		Config:             toPlainJSONConfig(state.Config),
+		Main:               toPlainJSONStructure(state.Main),
+	}
+	if state.Secondary != nil {
+		pt.Secondary = toPlainJSONStructure(state.Secondary)
+	}
+
+	out, err := json.MarshalIndent(pt, "", "  ")
+	if err != nil {
+		return nil, NewSerializationError(err, "Failed to marshal the tracker")
+	}
+	return out, nil
+}
+
+// Deserialize the state of a tracker from the plain JSON schema. A missing secondary
+// structure is left nil and recreated by tracker.NewFairnessTrackerFromState. Older
+// schema versions and the final probability functions are handled like in
+// DeserializeFromPlainJSON.
+func DeserializeTrackerFromPlainJSON(b []byte) (*tracker.TrackerState, error) {
+	b, err := migratePlainJSON(b)
+	if err != nil {
+		return nil, err
+	}
+
+	var pt plainJSONTracker
+	if err := json.Unmarshal(b, &pt); err != nil {
+		return nil, NewSerializationError(err, "Failed to unmarshal the tracker")
+	}
+
+	if pt.Main == nil {
+		return nil, NewSerializationError(nil, "The tracker has no main structure")
+	}
+
+	state := &tracker.TrackerState{
+		Config:             fromPlainJSONConfig(pt.Config),
+		StructureIDCounter: pt.StructureIDCounter,
+		Main:               fromPlainJSONStructure(pt.Main),
+	}
+	if pt.Secondary != nil {
+		state.Secondary = fromPlainJSONStructure(pt.Secondary)
+	}
+
+	return state, nil
+}
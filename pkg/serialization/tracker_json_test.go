@@ -0,0 +1,127 @@
+package serialization
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/satmihir/fair/pkg/request"
+	"github.com/satmihir/fair/pkg/tracker"
+	"github.com/satmihir/fair/pkg/utils"
+)
+
+func TestTrackerPlainJSONRoundTrip(t *testing.T) {
+	// No decay between the outcomes and the request on the restored tracker
+	clk := utils.NewMockClock(time.Unix(1000, 0))
+	trkB := tracker.NewFairnessTrackerBuilder()
+	trkB.SetClock(clk)
+	trkB.SetTicker(utils.NewMockTicker())
+	trkB.SetIncludeStats(true)
+	trk, err := trkB.Build()
+	assert.NoError(t, err)
+	defer trk.Close()
+
+	ctx := context.Background()
+	id := []byte("hello_world")
+	for i := 0; i < 10; i++ {
+		_, err = trk.ReportOutcome(ctx, id, request.OutcomeFailure)
+		assert.NoError(t, err)
+	}
+	state := trk.State()
+
+	out, err := SerializeTrackerToPlainJSON(state)
+	assert.NoError(t, err)
+
+	restoredState, err := DeserializeTrackerFromPlainJSON(out)
+	assert.NoError(t, err)
+	assert.Equal(t, restoredState.StructureIDCounter, state.StructureIDCounter)
+	assert.Equal(t, restoredState.Config.L, state.Config.L)
+	assert.Equal(t, restoredState.Config.RotationFrequency, state.Config.RotationFrequency)
+	assert.Equal(t, restoredState.Main.ID, state.Main.ID)
+	assert.Equal(t, restoredState.Main.MurmurSeed, state.Main.MurmurSeed)
+	assert.Equal(t, restoredState.Main.Buckets, state.Main.Buckets)
+	assert.Equal(t, restoredState.Secondary.ID, state.Secondary.ID)
+	assert.Equal(t, restoredState.Secondary.MurmurSeed, state.Secondary.MurmurSeed)
+	assert.Equal(t, restoredState.Secondary.Buckets, state.Secondary.Buckets)
+
+	restored, err := tracker.NewFairnessTrackerFromStateWithClockAndTicker(restoredState, clk, utils.NewMockTicker())
+	assert.NoError(t, err)
+	defer restored.Close()
+
+	resp, err := restored.RegisterRequest(ctx, id)
+	assert.NoError(t, err)
+	assert.InDelta(t, resp.ResultStats.FinalProbability, .4, 1e-9)
+
+	again := restored.State()
+	assert.Equal(t, again.StructureIDCounter, state.StructureIDCounter)
+	assert.Equal(t, again.Main.ID, state.Main.ID)
+	assert.Equal(t, again.Secondary.ID, state.Secondary.ID)
+}
+
+func TestTrackerPlainJSONMissingSecondary(t *testing.T) {
+	trk, err := tracker.NewFairnessTrackerBuilder().BuildWithDefaultConfig()
+	assert.NoError(t, err)
+	defer trk.Close()
+
+	ctx := context.Background()
+	id := []byte("hello_world")
+	for i := 0; i < 10; i++ {
+		_, err = trk.ReportOutcome(ctx, id, request.OutcomeFailure)
+		assert.NoError(t, err)
+	}
+	state := trk.State()
+	state.Secondary = nil
+
+	out, err := SerializeTrackerToPlainJSON(state)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(out), "secondary")
+
+	restoredState, err := DeserializeTrackerFromPlainJSON(out)
+	assert.NoError(t, err)
+	assert.Nil(t, restoredState.Secondary)
+
+	restored, err := tracker.NewFairnessTrackerFromState(restoredState)
+	assert.NoError(t, err)
+	defer restored.Close()
+
+	// A fresh secondary structure gets the next ID
+	again := restored.State()
+	assert.Equal(t, again.Secondary.ID, state.StructureIDCounter)
+	assert.Equal(t, again.StructureIDCounter, state.StructureIDCounter+1)
+
+	_, err = DeserializeTrackerFromPlainJSON([]byte(`{"schema_version": 1}`))
+	assert.Error(t, err)
+
+	_, err = DeserializeTrackerFromPlainJSON([]byte(`{"schema_version": 2}`))
+	assert.Error(t, err)
+
+	_, err = DeserializeTrackerFromPlainJSON([]byte(`{"schema_version": 3}`))
+	assert.Error(t, err)
+}
+
+func TestTrackerPlainJSONMigrateV1(t *testing.T) {
+	trk, err := tracker.NewFairnessTrackerBuilder().Build()
+	assert.NoError(t, err)
+	defer trk.Close()
+	state := trk.State()
+
+	out, err := SerializeTrackerToPlainJSON(state)
+	assert.NoError(t, err)
+
+	// Version 1 had no final probability function
+	v1 := strings.ReplaceAll(string(out), `"schema_version": 2`, `"schema_version": 1`)
+	v1 = strings.ReplaceAll(v1, `"final_probability_function": "min",`, "")
+	assert.NotContains(t, v1, "final_probability_function")
+
+	restoredState, err := DeserializeTrackerFromPlainJSON([]byte(v1))
+	assert.NoError(t, err)
+	assert.Equal(t, restoredState.Main.ID, state.Main.ID)
+	assert.Equal(t, restoredState.Main.MurmurSeed, state.Main.MurmurSeed)
+	assert.Equal(t, restoredState.Main.Buckets, state.Main.Buckets)
+	assert.Equal(t, restoredState.Secondary.Buckets, state.Secondary.Buckets)
+	assert.NotNil(t, restoredState.Config.FinalProbabilityFunction)
+	assert.NotNil(t, restoredState.Main.Config.FinalProbabilityFunction)
+}
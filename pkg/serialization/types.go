@@ -0,0 +1,15 @@
+package serialization
+
+import (
+	"github.com/satmihir/fair/pkg/utils"
+)
+
+type SerializationError struct {
+	*utils.BaseError
+}
+
+func NewSerializationError(wrapped error, msg string, args ...any) *SerializationError {
+	return &SerializationError{
+		BaseError: utils.NewBaseError(wrapped, msg, args...),
+	}
+}
@@ -0,0 +1,15 @@
+package serialization
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/satmihir/fair/pkg/testutils"
+)
+
+func TestSerializationError(t *testing.T) {
+	origErr := fmt.Errorf("original error")
+	serErr := NewSerializationError(origErr, "serialization error occurred")
+
+	testutils.TestError(t, &SerializationError{}, serErr, "serialization error occurred: original error", origErr)
+}
@@ -0,0 +1,114 @@
+package sim
+
+import (
+	"context"
+	"time"
+
+	"github.com/satmihir/fair/pkg/config"
+	"github.com/satmihir/fair/pkg/request"
+	"github.com/satmihir/fair/pkg/tracker"
+	"github.com/satmihir/fair/pkg/utils"
+)
+
+// Replays historical request traces against a config to see how it would have
+// throttled the clients, without wiring the tracker into production.
+type Simulator struct {
+	config *config.FairnessTrackerConfig
+	clock  utils.IClock
+	ticker utils.ITicker
+}
+
+// Create a simulator for the given config. The clock is expected to be a mock whose
+// Sleep advances the simulated time without blocking. Rotations happen whenever the
+// ticker fires; if it implements Tickable it's fired automatically every RotationFrequency
+// of simulated time.
+func NewSimulator(trackerConfig *config.FairnessTrackerConfig, clock utils.IClock, ticker utils.ITicker) *Simulator {
+	// A copy, so changing the config of the caller doesn't affect the runs
+	conf := *trackerConfig
+
+	return &Simulator{
+		config: &conf,
+		clock:  clock,
+		ticker: ticker,
+	}
+}
+
+// Replay the events until the channel is closed. Every event registers a request; if it
+// would have been throttled, its outcome is not reported since it never reached the
+// resource. Otherwise the outcome from the trace is reported.
+func (sim *Simulator) Run(events <-chan Event) (*Result, error) {
+	trk, err := tracker.NewFairnessTrackerWithClockAndTicker(sim.config, sim.clock, sim.ticker)
+	if err != nil {
+		return nil, NewSimulationError(err, "Failed to create the tracker")
+	}
+	defer trk.Close()
+
+	ctx := context.Background()
+	result := &Result{Clients: make(map[string]*ClientResult)}
+	tickable, canTick := sim.ticker.(Tickable)
+	nextRotation := sim.clock.Now().Add(sim.config.RotationFrequency)
+
+	for event := range events {
+		if now := uint64(sim.clock.Now().UnixMilli()); event.TimestampMillis > now {
+			sim.clock.Sleep(time.Duration(event.TimestampMillis-now) * time.Millisecond)
+		}
+
+		if canTick && sim.config.RotationFrequency > 0 {
+			for !sim.clock.Now().Before(nextRotation) {
+				tickable.Tick()
+				nextRotation = nextRotation.Add(sim.config.RotationFrequency)
+			}
+		}
+
+		cr, ok := result.Clients[event.ClientID]
+		if !ok {
+			cr = &ClientResult{}
+			result.Clients[event.ClientID] = cr
+		}
+		cr.Requests++
+		result.Requests++
+
+		id := []byte(event.ClientID)
+		resp, err := trk.RegisterRequest(ctx, id)
+		if err != nil {
+			return nil, NewSimulationError(err, "Failed to register a request for %s", event.ClientID)
+		}
+
+		if resp.ShouldThrottle {
+			cr.Throttles++
+			result.Throttles++
+			if cr.Failures == 0 {
+				cr.FalsePositives++
+			}
+			continue
+		}
+
+		if _, err := trk.ReportOutcome(ctx, id, event.Outcome); err != nil {
+			return nil, NewSimulationError(err, "Failed to report an outcome for %s", event.ClientID)
+		}
+
+		if event.Outcome == request.OutcomeSuccess {
+			cr.Successes++
+		} else {
+			cr.Failures++
+		}
+	}
+
+	var falsePositives uint64
+	for clientID, cr := range result.Clients {
+		// Read without registering another request, which would change the state and
+		// depend on the order of the clients
+		explanation, err := trk.Explain([]byte(clientID))
+		if err != nil {
+			return nil, NewSimulationError(err, "Failed to get the final probability for %s", clientID)
+		}
+		cr.FinalProbability = explanation.FinalProbability
+		falsePositives += cr.FalsePositives
+	}
+
+	if result.Throttles > 0 {
+		result.FalsePositiveRate = float64(falsePositives) / float64(result.Throttles)
+	}
+
+	return result, nil
+}
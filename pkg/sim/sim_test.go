@@ -0,0 +1,90 @@
+package sim
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/satmihir/fair/pkg/config"
+	"github.com/satmihir/fair/pkg/request"
+	"github.com/satmihir/fair/pkg/utils"
+)
+
+// A mock ticker that counts its ticks
+type countingTicker struct {
+	*utils.MockTicker
+	ticks int
+}
+
+func (t *countingTicker) Tick() {
+	t.ticks++
+	t.MockTicker.Tick()
+}
+
+func TestSimulator(t *testing.T) {
+	start := time.Unix(1000, 0)
+	clk := utils.NewMockClock(start)
+	ticker := &countingTicker{MockTicker: utils.NewMockTicker()}
+
+	conf := config.DefaultFairnessTrackerConfig()
+	conf.RotationFrequency = time.Minute
+	sim := NewSimulator(conf, clk, ticker)
+
+	// One abusive client hammers the resource every 100ms and mostly fails while the
+	// innocent clients make a request every second and always succeed. Runs for 5 minutes.
+	events := make(chan Event)
+	go func() {
+		defer close(events)
+
+		startMillis := uint64(start.UnixMilli())
+		for ms := uint64(0); ms < 5*60*1000; ms += 100 {
+			outcome := request.OutcomeFailure
+			if ms%1000 == 0 {
+				outcome = request.OutcomeSuccess
+			}
+			events <- Event{TimestampMillis: startMillis + ms, ClientID: "abusive", Outcome: outcome}
+
+			if ms%1000 == 0 {
+				for i := 0; i < 5; i++ {
+					events <- Event{TimestampMillis: startMillis + ms, ClientID: fmt.Sprintf("innocent-%d", i), Outcome: request.OutcomeSuccess}
+				}
+			}
+		}
+	}()
+
+	result, err := sim.Run(events)
+	assert.NoError(t, err)
+
+	assert.Equal(t, len(result.Clients), 6)
+	assert.Equal(t, int(result.Requests), 3000+5*300)
+	assert.Equal(t, ticker.ticks, 4)
+
+	abusive := result.Clients["abusive"]
+	assert.Equal(t, int(abusive.Requests), 3000)
+	assert.Greater(t, int(abusive.Throttles), 2000)
+	assert.Greater(t, abusive.FinalProbability, .5)
+
+	for i := 0; i < 5; i++ {
+		innocent := result.Clients[fmt.Sprintf("innocent-%d", i)]
+		assert.Equal(t, int(innocent.Requests), 300)
+		assert.Equal(t, innocent.Throttles, innocent.FalsePositives)
+		assert.Less(t, int(innocent.Throttles), 10)
+		assert.Equal(t, innocent.FinalProbability, float64(0))
+	}
+
+	assert.Less(t, result.FalsePositiveRate, .01)
+	assert.Equal(t, clk.Now(), start.Add(5*time.Minute-100*time.Millisecond))
+}
+
+func TestSimulatorInvalidConfig(t *testing.T) {
+	conf := config.DefaultFairnessTrackerConfig()
+	conf.Lambda = -1
+
+	events := make(chan Event)
+	close(events)
+
+	_, err := NewSimulator(conf, utils.NewMockClock(time.Unix(0, 0)), utils.NewMockTicker()).Run(events)
+	assert.Error(t, err)
+}
@@ -0,0 +1,62 @@
+package sim
+
+import (
+	"github.com/satmihir/fair/pkg/request"
+	"github.com/satmihir/fair/pkg/utils"
+)
+
+// A request from a historical trace to replay in the simulation
+type Event struct {
+	// The time of the request in millis. Events must be ordered by time.
+	TimestampMillis uint64
+	// The identifier of the client flow
+	ClientID string
+	// The outcome the request had in the trace
+	Outcome request.Outcome
+}
+
+// The result of the simulation for a single client
+type ClientResult struct {
+	// The number of requests of the client in the trace
+	Requests uint64
+	// The number of requests that would have been throttled
+	Throttles uint64
+	// The number of throttled requests while the client had not seen a single failure
+	// among its requests that were let through. An estimate of the false positives.
+	FalsePositives uint64
+	// The number of successes reported for requests that were let through
+	Successes uint64
+	// The number of failures reported for requests that were let through
+	Failures uint64
+	// The final probability of throttling the client at the end of the simulation
+	FinalProbability float64
+}
+
+// The result of a simulation
+type Result struct {
+	// The results of every client in the trace
+	Clients map[string]*ClientResult
+	// The total number of requests in the trace
+	Requests uint64
+	// The total number of throttled requests
+	Throttles uint64
+	// The fraction of the throttles estimated to be false positives
+	FalsePositiveRate float64
+}
+
+// A ticker that can be fired on demand. If the ticker passed to the simulator implements
+// it, the simulator fires it whenever the simulated time crosses a rotation boundary.
+type Tickable interface {
+	utils.ITicker
+	Tick()
+}
+
+type SimulationError struct {
+	*utils.BaseError
+}
+
+func NewSimulationError(wrapped error, msg string, args ...any) *SimulationError {
+	return &SimulationError{
+		BaseError: utils.NewBaseError(wrapped, msg, args...),
+	}
+}
@@ -0,0 +1,15 @@
+package sim
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/satmihir/fair/pkg/testutils"
+)
+
+func TestSimulationError(t *testing.T) {
+	origErr := fmt.Errorf("original error")
+	simErr := NewSimulationError(origErr, "simulation error occurred")
+
+	testutils.TestError(t, &SimulationError{}, simErr, "simulation error occurred: original error", origErr)
+}
@@ -2,6 +2,8 @@ package testutils
 
 import (
 	"errors"
+	"fmt"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -16,3 +18,44 @@ func TestError(t *testing.T, expectedType interface{}, errInstance error, expect
 	assert.Equal(t, expectedMessage, errInstance.Error(), "Error message should match")
 	assert.Equal(t, wrappedErr, errors.Unwrap(errInstance), "Wrapped error should match the expected original error")
 }
+
+// A logger that records every line along with the method it was logged through
+type RecordingLogger struct {
+	lock  sync.Mutex
+	lines map[string][]string
+}
+
+func NewRecordingLogger() *RecordingLogger {
+	return &RecordingLogger{lines: make(map[string][]string)}
+}
+
+func (r *RecordingLogger) record(method string, line string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.lines[method] = append(r.lines[method], line)
+}
+
+// Returns the lines logged through the given method, such as "Debugf"
+func (r *RecordingLogger) Lines(method string) []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]string(nil), r.lines[method]...)
+}
+
+func (r *RecordingLogger) Printf(format string, v ...any) {
+	r.record("Printf", fmt.Sprintf(format, v...))
+}
+func (r *RecordingLogger) Print(v ...any)   { r.record("Print", fmt.Sprint(v...)) }
+func (r *RecordingLogger) Println(v ...any) { r.record("Println", fmt.Sprintln(v...)) }
+func (r *RecordingLogger) Errorf(format string, v ...any) {
+	r.record("Errorf", fmt.Sprintf(format, v...))
+}
+func (r *RecordingLogger) Debugf(format string, v ...any) {
+	r.record("Debugf", fmt.Sprintf(format, v...))
+}
+func (r *RecordingLogger) Infof(format string, v ...any) {
+	r.record("Infof", fmt.Sprintf(format, v...))
+}
+func (r *RecordingLogger) Warnf(format string, v ...any) {
+	r.record("Warnf", fmt.Sprintf(format, v...))
+}
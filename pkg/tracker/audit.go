@@ -0,0 +1,109 @@
+package tracker
+
+import (
+	"context"
+	"time"
+
+	"github.com/satmihir/fair/pkg/request"
+	"github.com/satmihir/fair/pkg/utils"
+)
+
+// The kind of event recorded in an audit entry
+type AuditEvent int
+
+const (
+	// A request was throttled
+	AuditEventThrottled AuditEvent = iota
+	// A failure or a timeout was reported. Successes are not recorded since they are
+	// the bulk of the outcomes and never lead to throttling.
+	AuditEventOutcome
+)
+
+// A record of a throttling decision or a notable outcome
+type AuditEntry struct {
+	// The kind of event
+	Event AuditEvent
+	// The time of the event
+	Time time.Time
+	// The identifier of the client, copied so the caller may reuse its buffer
+	ClientIdentifier []byte
+	// The final probability the throttling decision was made with. Only set for
+	// throttled requests and only if the wrapped tracker includes the result stats.
+	FinalProbability float64
+	// The reported outcome, only set for AuditEventOutcome
+	Outcome request.Outcome
+}
+
+// Receives the audit entries, e.g. to write them to a log. Called synchronously on the
+// request path, so it should return quickly.
+type AuditSink func(AuditEntry)
+
+// A request.Tracker that records an audit entry for every throttled request and every
+// failure or timeout reported, and otherwise calls through to the wrapped tracker, e.g.
+// a FairnessTracker or a data.Structure.
+type AuditTracker struct {
+	tracker request.Tracker
+	sink    AuditSink
+	clock   utils.IClock
+}
+
+// Wrap the tracker to record the audit entries with the sink
+func NewAuditTracker(tracker request.Tracker, sink AuditSink) *AuditTracker {
+	return &AuditTracker{
+		tracker: tracker,
+		sink:    sink,
+		clock:   utils.NewRealClock(),
+	}
+}
+
+func (at *AuditTracker) GetID() uint64 {
+	return at.tracker.GetID()
+}
+
+func (at *AuditTracker) RegisterRequest(ctx context.Context, clientIdentifier []byte) (*request.RegisterRequestResult, error) {
+	resp, err := at.tracker.RegisterRequest(ctx, clientIdentifier)
+	if err != nil || !resp.ShouldThrottle {
+		return resp, err
+	}
+
+	entry := at.newEntry(AuditEventThrottled, clientIdentifier)
+	if resp.ResultStats != nil {
+		entry.FinalProbability = resp.ResultStats.FinalProbability
+	}
+	at.sink(entry)
+
+	return resp, nil
+}
+
+func (at *AuditTracker) ReportOutcome(ctx context.Context, clientIdentifier []byte, outcome request.Outcome) (*request.ReportOutcomeResult, error) {
+	resp, err := at.tracker.ReportOutcome(ctx, clientIdentifier, outcome)
+	if err != nil || outcome == request.OutcomeSuccess {
+		return resp, err
+	}
+
+	entry := at.newEntry(AuditEventOutcome, clientIdentifier)
+	entry.Outcome = outcome
+	at.sink(entry)
+
+	return resp, nil
+}
+
+func (at *AuditTracker) Export() ([]byte, error) {
+	return at.tracker.Export()
+}
+
+func (at *AuditTracker) Import(state []byte) error {
+	return at.tracker.Import(state)
+}
+
+func (at *AuditTracker) Close() {
+	at.tracker.Close()
+}
+
+func (at *AuditTracker) newEntry(event AuditEvent, clientIdentifier []byte) AuditEntry {
+	return AuditEntry{
+		Event:            event,
+		Time:             at.clock.Now(),
+		ClientIdentifier: append([]byte(nil), clientIdentifier...),
+	}
+}
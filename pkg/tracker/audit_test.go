@@ -0,0 +1,65 @@
+package tracker
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/satmihir/fair/pkg/config"
+	"github.com/satmihir/fair/pkg/data"
+	"github.com/satmihir/fair/pkg/request"
+)
+
+func TestAuditTracker(t *testing.T) {
+	conf := &config.FairnessTrackerConfig{
+		L:                        3,
+		M:                        1000,
+		Pd:                       .001,
+		Pi:                       .5,
+		FinalProbabilityFunction: config.MinFinalProbabilityFunction,
+	}
+	structure, err := data.NewStructure(conf, 1, true)
+	assert.NoError(t, err)
+
+	var entries []AuditEntry
+	at := NewAuditTracker(structure, func(e AuditEntry) {
+		entries = append(entries, e)
+	})
+	defer at.Close()
+	assert.Equal(t, at.GetID(), uint64(1))
+
+	ctx := context.Background()
+	id := []byte("client_id")
+
+	// Neither successes nor requests let through are recorded
+	resp, err := at.RegisterRequest(ctx, id)
+	assert.NoError(t, err)
+	assert.False(t, resp.ShouldThrottle)
+	_, err = at.ReportOutcome(ctx, id, request.OutcomeSuccess)
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+
+	for i := 0; i < 2; i++ {
+		_, err = at.ReportOutcome(ctx, id, request.OutcomeFailure)
+		assert.NoError(t, err)
+	}
+	assert.Len(t, entries, 2)
+	assert.Equal(t, entries[0].Event, AuditEventOutcome)
+	assert.Equal(t, entries[0].Outcome, request.OutcomeFailure)
+
+	resp, err = at.RegisterRequest(ctx, id)
+	assert.NoError(t, err)
+	assert.True(t, resp.ShouldThrottle)
+	assert.Len(t, entries, 3)
+	assert.Equal(t, entries[2].Event, AuditEventThrottled)
+	assert.Equal(t, entries[2].ClientIdentifier, id)
+	assert.Equal(t, entries[2].FinalProbability, float64(1))
+	assert.False(t, entries[2].Time.IsZero())
+
+	// It composes with the FairnessTracker
+	trk, err := NewFairnessTrackerBuilder().Build()
+	assert.NoError(t, err)
+	var _ request.Tracker = NewAuditTracker(trk, func(AuditEntry) {})
+	trk.Close()
+}
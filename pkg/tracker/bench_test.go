@@ -0,0 +1,168 @@
+package tracker
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/satmihir/fair/pkg/request"
+)
+
+// How to read these benchmarks:
+//
+// Every tracker call updates both the main and the secondary structure, so these cost
+// about twice the matching benchmarks in pkg/data plus the lock-free load of the
+// structures. BenchmarkWarmSecondary compares that with only updating the main one, and
+// BenchmarkRegisterRequestReadOnly compares RegisterRequest with RegisterRequestReadOnly.
+//
+// The DistinctKeys variants spread the requests over many flows and mostly measure the
+// hashing and bucket updates. The HotKey variants send everything to one flow, so in the
+// parallel benchmark all goroutines contend on the same bucket mutexes. The gap between
+// the two is the cost of contention. Rotation is disabled so it doesn't add noise.
+//
+// Run with: go test -run '^$' -bench . -benchmem ./pkg/tracker
+
+const benchDistinctKeys = 10000
+
+func benchTracker(b *testing.B) *FairnessTracker {
+	b.Helper()
+	return benchTrackerWithBuilder(b, NewFairnessTrackerBuilder())
+}
+
+func benchTrackerWithBuilder(b *testing.B, trkB *FairnessTrackerBuilder) *FairnessTracker {
+	b.Helper()
+
+	trkB.SetRotationFrequency(0)
+	trk, err := trkB.Build()
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(trk.Close)
+	return trk
+}
+
+func benchKeys(hot bool) [][]byte {
+	if hot {
+		return [][]byte{[]byte("hot_client")}
+	}
+
+	keys := make([][]byte, benchDistinctKeys)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("client_%d", i))
+	}
+	return keys
+}
+
+func benchVariants(b *testing.B, fn func(b *testing.B, keys [][]byte)) {
+	b.Run("DistinctKeys", func(b *testing.B) { fn(b, benchKeys(false)) })
+	b.Run("HotKey", func(b *testing.B) { fn(b, benchKeys(true)) })
+}
+
+func BenchmarkRegisterRequest(b *testing.B) {
+	benchVariants(b, func(b *testing.B, keys [][]byte) {
+		trk := benchTracker(b)
+		ctx := context.Background()
+
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := trk.RegisterRequest(ctx, keys[i%len(keys)]); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkReportOutcome(b *testing.B) {
+	benchVariants(b, func(b *testing.B, keys [][]byte) {
+		trk := benchTracker(b)
+		ctx := context.Background()
+
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := trk.ReportOutcome(ctx, keys[i%len(keys)], request.OutcomeFailure); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// Every iteration registers a request and reports its outcome, with one in ten failing
+func BenchmarkConcurrentMixed(b *testing.B) {
+	benchVariants(b, func(b *testing.B, keys [][]byte) {
+		trk := benchTracker(b)
+		ctx := context.Background()
+
+		b.ReportAllocs()
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			i := 0
+			for pb.Next() {
+				key := keys[i%len(keys)]
+				if _, err := trk.RegisterRequest(ctx, key); err != nil {
+					b.Error(err)
+					return
+				}
+
+				outcome := request.OutcomeSuccess
+				if i%10 == 0 {
+					outcome = request.OutcomeFailure
+				}
+				if _, err := trk.ReportOutcome(ctx, key, outcome); err != nil {
+					b.Error(err)
+					return
+				}
+				i++
+			}
+		})
+	})
+}
+
+func BenchmarkWarmSecondary(b *testing.B) {
+	for _, warm := range []bool{true, false} {
+		b.Run(fmt.Sprintf("Warm=%t", warm), func(b *testing.B) {
+			benchVariants(b, func(b *testing.B, keys [][]byte) {
+				trkB := NewFairnessTrackerBuilder()
+				trkB.SetWarmSecondary(warm)
+				trk := benchTrackerWithBuilder(b, trkB)
+				ctx := context.Background()
+
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					key := keys[i%len(keys)]
+					if _, err := trk.RegisterRequest(ctx, key); err != nil {
+						b.Fatal(err)
+					}
+					if _, err := trk.ReportOutcome(ctx, key, request.OutcomeSuccess); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkRegisterRequestReadOnly(b *testing.B) {
+	for _, readOnly := range []bool{false, true} {
+		b.Run(fmt.Sprintf("ReadOnly=%t", readOnly), func(b *testing.B) {
+			benchVariants(b, func(b *testing.B, keys [][]byte) {
+				trk := benchTracker(b)
+				ctx := context.Background()
+				register := trk.RegisterRequest
+				if readOnly {
+					register = trk.RegisterRequestReadOnly
+				}
+
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if _, err := register(ctx, keys[i%len(keys)]); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package tracker
+
+import (
+	"sync"
+	"time"
+
+	"github.com/satmihir/fair/pkg/utils"
+)
+
+// A token bucket capping the number of throttled requests per second across all flows.
+// It holds at most a second worth of tokens, so a burst after a quiet period is capped
+// at the rate too. A rate below 1 holds a single token, e.g. 0.5 throttles one request
+// every 2 seconds.
+type throttleBudget struct {
+	rate float64
+	// The max number of tokens, at least the single token a throttle takes
+	capacity float64
+	clock    utils.IClock
+
+	lock   sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newThrottleBudget(rate float64, clock utils.IClock) *throttleBudget {
+	capacity := max(rate, 1)
+	return &throttleBudget{
+		rate:     rate,
+		capacity: capacity,
+		clock:    clock,
+		tokens:   capacity,
+		last:     clock.Now(),
+	}
+}
+
+// Take a token to throttle a request. Returns false if the budget is exhausted and the
+// request must be let through.
+func (tb *throttleBudget) take() bool {
+	tb.lock.Lock()
+	defer tb.lock.Unlock()
+
+	now := tb.clock.Now()
+	if elapsed := now.Sub(tb.last); elapsed > 0 {
+		tb.tokens = min(tb.tokens+elapsed.Seconds()*tb.rate, tb.capacity)
+		tb.last = now
+	}
+
+	if tb.tokens < 1 {
+		return false
+	}
+	tb.tokens--
+	return true
+}
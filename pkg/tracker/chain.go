@@ -0,0 +1,183 @@
+package tracker
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/satmihir/fair/pkg/config"
+	"github.com/satmihir/fair/pkg/logger"
+	"github.com/satmihir/fair/pkg/request"
+	"github.com/satmihir/fair/pkg/utils"
+)
+
+// A durable store of the state of a tracker, e.g. a file or a blob holding the output of
+// serialization.SerializeTrackerToPlainJSON
+type StateStore interface {
+	// Load the last saved state, or nil if nothing was saved yet
+	Load() (*TrackerState, error)
+	// Save the state, replacing the last one
+	Save(state *TrackerState) error
+}
+
+// A request.Tracker serving all the traffic from an in-memory FairnessTracker backed by a
+// durable StateStore. The tracker starts from the state in the store, so the bad flows
+// known before a restart are throttled from the first request, and its state is saved
+// back periodically and on Close.
+type ChainTracker struct {
+	primary *FairnessTracker
+	store   StateStore
+
+	ticker utils.ITicker
+	// Closed to stop the persisting
+	stop chan struct{}
+	// Closed when the persisting goroutine has exited
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Create the tracker from the state in the store, saving its state back every
+// persistInterval. A zero or negative interval only saves it on Close. The state is
+// restored with the given config if it has the same bucket layout, see config.Compatible,
+// and a fresh tracker is created otherwise.
+func NewChainTracker(trackerConfig *config.FairnessTrackerConfig, store StateStore, persistInterval time.Duration) (*ChainTracker, error) {
+	var ticker utils.ITicker
+	if persistInterval > 0 {
+		ticker = utils.NewRealTicker(persistInterval)
+	}
+	return newChainTracker(trackerConfig, store, utils.NewRealClock(), nil, ticker)
+}
+
+// Creates the tracker with the given clock, rotation ticker and persist ticker. The
+// rotation ticker may be nil for a real one, and a nil persist ticker disables the
+// periodic saves.
+func newChainTracker(trackerConfig *config.FairnessTrackerConfig, store StateStore, clock utils.IClock, rotationTicker, persistTicker utils.ITicker) (*ChainTracker, error) {
+	if store == nil {
+		return nil, NewFairnessTrackerError(nil, "The state store must not be nil")
+	}
+	if err := validateTrackerConfig(trackerConfig); err != nil {
+		return nil, NewFairnessTrackerError(err, "The input config failed validation")
+	}
+
+	state, err := store.Load()
+	if err != nil {
+		return nil, NewFairnessTrackerError(err, "Failed to load the state from the store")
+	}
+
+	var primary *FairnessTracker
+	if state = restorableState(state, trackerConfig); state != nil {
+		primary, err = newFairnessTrackerFromState(state, clock, rotationTicker)
+	} else {
+		primary, err = newFairnessTracker(trackerConfig, clock, rotationTicker)
+	}
+	if err != nil {
+		return nil, err
+	}
+	primary.startRotation()
+	primary.startSweeper()
+
+	ct := &ChainTracker{
+		primary: primary,
+		store:   store,
+		ticker:  persistTicker,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	ct.startPersisting()
+
+	return ct, nil
+}
+
+// The loaded state with the running config, or nil if there's nothing to restore
+func restorableState(state *TrackerState, trackerConfig *config.FairnessTrackerConfig) *TrackerState {
+	if state == nil || state.Main == nil {
+		return nil
+	}
+	if ok, fields := config.Compatible(state.Main.Config, trackerConfig); !ok {
+		logger.Warnf("Not restoring the saved state since its config differs on %v", fields)
+		return nil
+	}
+
+	restored := *state
+	restored.Config = trackerConfig
+	main := *state.Main
+	main.Config = trackerConfig
+	restored.Main = &main
+	if state.Secondary != nil {
+		secondary := *state.Secondary
+		secondary.Config = trackerConfig
+		restored.Secondary = &secondary
+	}
+	return &restored
+}
+
+// Save the state periodically until the tracker is closed, unless there's no ticker
+func (ct *ChainTracker) startPersisting() {
+	if ct.ticker == nil {
+		close(ct.done)
+		return
+	}
+
+	go func() {
+		defer close(ct.done)
+		defer ct.ticker.Stop()
+
+		for {
+			select {
+			case <-ct.stop:
+				return
+			case <-ct.ticker.C():
+				if err := ct.Persist(); err != nil {
+					logger.Errorf("Failed to persist the tracker state: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// Save the current state of the tracker to the store
+func (ct *ChainTracker) Persist() error {
+	if err := ct.store.Save(ct.primary.State()); err != nil {
+		return NewFairnessTrackerError(err, "Failed to save the state to the store")
+	}
+	return nil
+}
+
+// The in-memory tracker serving the traffic, e.g. to use its other methods
+func (ct *ChainTracker) Primary() *FairnessTracker {
+	return ct.primary
+}
+
+func (ct *ChainTracker) GetID() uint64 {
+	return ct.primary.GetID()
+}
+
+func (ct *ChainTracker) RegisterRequest(ctx context.Context, clientIdentifier []byte) (*request.RegisterRequestResult, error) {
+	return ct.primary.RegisterRequest(ctx, clientIdentifier)
+}
+
+func (ct *ChainTracker) ReportOutcome(ctx context.Context, clientIdentifier []byte, outcome request.Outcome) (*request.ReportOutcomeResult, error) {
+	return ct.primary.ReportOutcome(ctx, clientIdentifier, outcome)
+}
+
+func (ct *ChainTracker) Export() ([]byte, error) {
+	return ct.primary.Export()
+}
+
+func (ct *ChainTracker) Import(state []byte) error {
+	return ct.primary.Import(state)
+}
+
+// Stop the periodic saves, save the state one last time and close the primary tracker.
+// A failure to save is logged. Safe to call more than once.
+func (ct *ChainTracker) Close() {
+	ct.closeOnce.Do(func() {
+		close(ct.stop)
+		<-ct.done
+
+		if err := ct.Persist(); err != nil {
+			logger.Errorf("Failed to persist the tracker state on close: %v", err)
+		}
+		ct.primary.Close()
+	})
+}
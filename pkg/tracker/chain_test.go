@@ -0,0 +1,92 @@
+package tracker
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/satmihir/fair/pkg/config"
+	"github.com/satmihir/fair/pkg/request"
+	"github.com/satmihir/fair/pkg/utils"
+)
+
+// A StateStore keeping the state in memory
+type memoryStateStore struct {
+	lock  sync.Mutex
+	state *TrackerState
+	saves int
+}
+
+func (ms *memoryStateStore) Load() (*TrackerState, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	return ms.state, nil
+}
+
+func (ms *memoryStateStore) Save(state *TrackerState) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	ms.state = state
+	ms.saves++
+	return nil
+}
+
+func TestChainTracker(t *testing.T) {
+	conf := config.DefaultFairnessTrackerConfig()
+	conf.Pi = .6
+	conf.Lambda = 0
+
+	ctx := context.Background()
+	bad := []byte("bad_client")
+
+	// A tracker from before the restart learns about the bad flow
+	src, err := newFairnessTracker(conf, utils.NewRealClock(), utils.NewMockTicker())
+	assert.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		_, err = src.ReportOutcome(ctx, bad, request.OutcomeFailure)
+		assert.NoError(t, err)
+	}
+	store := &memoryStateStore{state: src.State()}
+	src.Close()
+
+	persistTicker := utils.NewMockTicker()
+	ct, err := newChainTracker(conf, store, utils.NewRealClock(), utils.NewMockTicker(), persistTicker)
+	assert.NoError(t, err)
+	var _ request.Tracker = ct
+
+	// The bad flow is throttled from the first request
+	resp, err := ct.RegisterRequest(ctx, bad)
+	assert.NoError(t, err)
+	assert.True(t, resp.ShouldThrottle)
+	assert.Equal(t, ct.GetID(), src.GetID())
+
+	// Saved on every tick and on close
+	persistTicker.Tick()
+	ct.Close()
+	ct.Close()
+	assert.Equal(t, store.saves, 2)
+	assert.Equal(t, store.state.Main.ID, src.GetID())
+
+	// A state with another layout isn't restored
+	other := *conf
+	other.M = conf.M / 2
+	ct, err = newChainTracker(&other, store, utils.NewRealClock(), utils.NewMockTicker(), nil)
+	assert.NoError(t, err)
+	resp, err = ct.RegisterRequest(ctx, bad)
+	assert.NoError(t, err)
+	assert.False(t, resp.ShouldThrottle)
+	ct.Close()
+
+	// An empty store starts a fresh tracker
+	ct, err = newChainTracker(conf, &memoryStateStore{}, utils.NewRealClock(), utils.NewMockTicker(), nil)
+	assert.NoError(t, err)
+	resp, err = ct.RegisterRequest(ctx, bad)
+	assert.NoError(t, err)
+	assert.False(t, resp.ShouldThrottle)
+	ct.Close()
+
+	_, err = NewChainTracker(conf, nil, 0)
+	assert.Error(t, err)
+}
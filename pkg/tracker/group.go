@@ -0,0 +1,80 @@
+package tracker
+
+import (
+	"sync"
+
+	"github.com/satmihir/fair/pkg/config"
+)
+
+// Manages isolated trackers for many namespaces, such as the tenants of a service.
+// Every tracker is created lazily with the shared config and runs its own rotation.
+// Safe for concurrent use.
+type Group struct {
+	trackerConfig *config.FairnessTrackerConfig
+
+	lock     sync.Mutex
+	trackers map[string]*FairnessTracker
+}
+
+// Create a group whose trackers all use the given config. The config is validated
+// upfront and copied, so changing it afterwards doesn't affect the group.
+func NewGroup(trackerConfig *config.FairnessTrackerConfig) (*Group, error) {
+	if err := validateTrackerConfig(trackerConfig); err != nil {
+		return nil, NewFairnessTrackerError(err, "The input config failed validation")
+	}
+	c := *trackerConfig
+
+	return &Group{
+		trackerConfig: &c,
+		trackers:      make(map[string]*FairnessTracker),
+	}, nil
+}
+
+// Get the tracker of the namespace, creating it if it doesn't exist yet. Fails if the
+// tracker can't be created.
+func (g *Group) Get(namespace string) (*FairnessTracker, error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if ft, ok := g.trackers[namespace]; ok {
+		return ft, nil
+	}
+
+	ft, err := NewFairnessTracker(g.trackerConfig)
+	if err != nil {
+		return nil, NewFairnessTrackerError(err, "Failed to create the tracker of namespace %q", namespace)
+	}
+	g.trackers[namespace] = ft
+	return ft, nil
+}
+
+// Remove the tracker of the namespace and close it. Returns after its rotation has
+// stopped. A later Get for the namespace creates a fresh tracker.
+func (g *Group) Remove(namespace string) {
+	g.lock.Lock()
+	ft, ok := g.trackers[namespace]
+	delete(g.trackers, namespace)
+	g.lock.Unlock()
+
+	if ok {
+		closeAndWait(ft)
+	}
+}
+
+// Remove and close the trackers of all the namespaces. Returns after all their
+// rotations have stopped. The group can still be used afterwards.
+func (g *Group) CloseAll() {
+	g.lock.Lock()
+	trackers := g.trackers
+	g.trackers = make(map[string]*FairnessTracker)
+	g.lock.Unlock()
+
+	for _, ft := range trackers {
+		closeAndWait(ft)
+	}
+}
+
+func closeAndWait(ft *FairnessTracker) {
+	ft.Close()
+	<-ft.rotationDone
+}
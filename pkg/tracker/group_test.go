@@ -0,0 +1,92 @@
+package tracker
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/satmihir/fair/pkg/config"
+	"github.com/satmihir/fair/pkg/request"
+)
+
+func TestGroup(t *testing.T) {
+	conf := config.DefaultFairnessTrackerConfig()
+	conf.Pi = .5
+	conf.Pd = .01
+	conf.Lambda = 0
+	conf.RotationFrequency = time.Hour
+
+	g, err := NewGroup(conf)
+	assert.NoError(t, err)
+	defer g.CloseAll()
+
+	get := func(namespace string) *FairnessTracker {
+		ft, err := g.Get(namespace)
+		assert.NoError(t, err)
+		return ft
+	}
+
+	// Changing the config after creating the group doesn't affect it
+	conf.FinalProbabilityFunction = nil
+
+	a, b, c := get("a"), get("b"), get("c")
+	assert.Same(t, get("a"), a)
+	assert.NotSame(t, a, b)
+
+	// Failures in one namespace don't throttle the same flow in the others
+	ctx := context.Background()
+	id := []byte("client_id")
+	for i := 0; i < 10; i++ {
+		_, err = a.ReportOutcome(ctx, id, request.OutcomeFailure)
+		assert.NoError(t, err)
+	}
+
+	resp, err := a.RegisterRequest(ctx, id)
+	assert.NoError(t, err)
+	assert.True(t, resp.ShouldThrottle)
+
+	resp, err = b.RegisterRequest(ctx, id)
+	assert.NoError(t, err)
+	assert.False(t, resp.ShouldThrottle)
+
+	g.Remove("a")
+	assertRotationStopped(t, a)
+	assert.False(t, b.closed.Load())
+	assert.False(t, c.closed.Load())
+
+	// Removing an unknown namespace is a no-op and a removed one starts fresh
+	g.Remove("a")
+	fresh := get("a")
+	assert.NotSame(t, fresh, a)
+	resp, err = fresh.RegisterRequest(ctx, id)
+	assert.NoError(t, err)
+	assert.False(t, resp.ShouldThrottle)
+
+	g.CloseAll()
+	for _, ft := range []*FairnessTracker{b, c, fresh} {
+		assertRotationStopped(t, ft)
+	}
+}
+
+func TestGroupInvalidConfig(t *testing.T) {
+	conf := config.DefaultFairnessTrackerConfig()
+	conf.FinalProbabilityFunction = nil
+
+	_, err := NewGroup(conf)
+	assert.Error(t, err)
+
+	_, err = NewGroup(nil)
+	assert.Error(t, err)
+}
+
+func assertRotationStopped(t *testing.T, ft *FairnessTracker) {
+	t.Helper()
+
+	select {
+	case <-ft.rotationDone:
+	default:
+		t.Fatal("the rotation goroutine is still running")
+	}
+}
@@ -0,0 +1,34 @@
+package tracker
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// A concurrent set of client identifiers, e.g. the trusted or the blocked clients. The
+// zero value is an empty set.
+type keySet struct {
+	keys sync.Map
+	// The number of keys in the set, so the request path skips the lookup while it's empty
+	count atomic.Int64
+}
+
+func (ts *keySet) add(clientIdentifier []byte) {
+	if _, loaded := ts.keys.LoadOrStore(string(clientIdentifier), struct{}{}); !loaded {
+		ts.count.Add(1)
+	}
+}
+
+func (ts *keySet) remove(clientIdentifier []byte) {
+	if _, loaded := ts.keys.LoadAndDelete(string(clientIdentifier)); loaded {
+		ts.count.Add(-1)
+	}
+}
+
+func (ts *keySet) contains(clientIdentifier []byte) bool {
+	if ts.count.Load() == 0 {
+		return false
+	}
+	_, ok := ts.keys.Load(string(clientIdentifier))
+	return ok
+}
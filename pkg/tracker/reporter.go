@@ -0,0 +1,59 @@
+package tracker
+
+import (
+	"context"
+
+	"github.com/satmihir/fair/pkg/logger"
+	"github.com/satmihir/fair/pkg/request"
+)
+
+// Start a goroutine reporting the outcomes pushed to the returned channel with
+// ReportOutcome, so the request path doesn't wait for the structures. The channel holds
+// up to buffer items and a push blocks while it's full. Close stops the reporter once it
+// has applied the items left in the channel and waits for it. Items must not be pushed
+// after Close, since nothing drains them anymore. The channel is never closed by the
+// tracker. Returns nil if the tracker is already closed. Failures to report are logged.
+func (ft *FairnessTracker) StartReporter(buffer int) chan<- request.OutcomeItem {
+	ft.swapLock.Lock()
+	defer ft.swapLock.Unlock()
+
+	if ft.closed.Load() {
+		return nil
+	}
+
+	items := make(chan request.OutcomeItem, max(buffer, 0))
+	ft.reporters.Add(1)
+	go func() {
+		defer ft.reporters.Done()
+
+		for {
+			select {
+			case item := <-items:
+				ft.reportItem(item)
+			case <-ft.stopRotation:
+				ft.drainItems(items)
+				return
+			}
+		}
+	}()
+
+	return items
+}
+
+// Report the items left in the channel without waiting for more
+func (ft *FairnessTracker) drainItems(items <-chan request.OutcomeItem) {
+	for {
+		select {
+		case item := <-items:
+			ft.reportItem(item)
+		default:
+			return
+		}
+	}
+}
+
+func (ft *FairnessTracker) reportItem(item request.OutcomeItem) {
+	if _, err := ft.ReportOutcome(context.Background(), item.ClientIdentifier, item.Outcome); err != nil {
+		logger.Errorf("Failed to report the outcome of a queued item: %v", err)
+	}
+}
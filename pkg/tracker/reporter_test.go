@@ -0,0 +1,56 @@
+package tracker
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/satmihir/fair/pkg/request"
+	"github.com/satmihir/fair/pkg/utils"
+)
+
+func TestStartReporter(t *testing.T) {
+	trkB := NewFairnessTrackerBuilder()
+	trkB.SetTicker(utils.NewMockTicker())
+	// A random seed may collide the bad client with a successful one on every level
+	trkB.SetMurmurSeed(42)
+	trkB.SetPi(.01)
+	trkB.SetLambda(0)
+	trk, err := trkB.Build()
+	assert.NoError(t, err)
+
+	const producers, perProducer = 4, 500
+	items := trk.StartReporter(100)
+	other := trk.StartReporter(0)
+
+	wg := &sync.WaitGroup{}
+	for i := 0; i < producers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < perProducer; j++ {
+				items <- request.OutcomeItem{
+					ClientIdentifier: []byte(fmt.Sprintf("client-%d", j%10)),
+					Outcome:          request.OutcomeSuccess,
+				}
+			}
+		}()
+	}
+	other <- request.OutcomeItem{ClientIdentifier: []byte("bad_client"), Outcome: request.OutcomeFailure}
+	wg.Wait()
+
+	// Every item pushed before closing is applied, including the ones still buffered
+	trk.Close()
+	assert.Equal(t, trk.Counters().Outcomes, uint64(producers*perProducer+1))
+	assert.Equal(t, len(items), 0)
+
+	resp, err := trk.TryRegisterRequest(context.Background(), []byte("bad_client"), request.OutcomeSuccess)
+	assert.NoError(t, err)
+	assert.InDelta(t, resp.CurrentProbability, .01, 1e-9)
+
+	// No reporter is started once closed
+	assert.Nil(t, trk.StartReporter(10))
+}
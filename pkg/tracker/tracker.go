@@ -2,11 +2,18 @@ package tracker
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"log"
+	"math"
+	"math/rand"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/satmihir/fair/pkg/config"
 	"github.com/satmihir/fair/pkg/data"
+	"github.com/satmihir/fair/pkg/logger"
 	"github.com/satmihir/fair/pkg/request"
 	"github.com/satmihir/fair/pkg/utils"
 )
@@ -17,22 +24,77 @@ type FairnessTracker struct {
 	trackerConfig *config.FairnessTrackerConfig
 
 	// A counter to uniquely identify a structure
-	structureIDCounter uint64
+	structureIDCounter atomic.Uint64
 
-	mainStructure      request.Tracker
-	secondaryStructure request.Tracker
+	// The structures of all the flow dimensions. Requests load the set without any lock
+	// and writers swap in a new one. A request racing with a swap may update a structure
+	// that was just retired, which loses the update, or the structures of both sets,
+	// which applies it twice to the structure carried over. Both are benign since a
+	// single update barely moves the probabilities.
+	structures atomic.Pointer[structureSet]
+
+	// Serializes the writers publishing a new set of structures, and changes of the
+	// rotation frequency with closing the tracker. Never taken by requests.
+	swapLock sync.Mutex
+
+	// If false, requests and outcomes only update the main structure
+	warmSecondary bool
+	// Caps the throttled requests per second, nil if there's no cap
+	throttleBudget *throttleBudget
+	// The client identifiers that are never throttled
+	trusted keySet
+	// The client identifiers that are always throttled
+	blocked keySet
+
+	// The lifetime counters returned by Counters
+	requestsCount      atomic.Uint64
+	throttledCount     atomic.Uint64
+	wouldThrottleCount atomic.Uint64
+	outcomesCount      atomic.Uint64
+
+	// The global failure rate of the adaptive mode, shared by all the structures so it
+	// survives the rotations. Every outcome is added once, however many structures it updates.
+	failureRate data.FailureRate
+
+	// The function to choose the final probability, guarded by the swap lock
+	finalProbabilityFunction config.FinalProbabilityFunction
 
 	ticker utils.ITicker
 
-	// Rotation lock to ensure that we don't rotate while updating the structures
-	// The act of updating is a "read" in this case since multiple updates can happen
-	// concurrently, but none can happen while we are rotating so that's a write.
-	rotationLock sync.RWMutex
+	// Closed to stop the rotation and the decay sweeper
 	stopRotation chan struct{}
+	// Closed when the rotation goroutine has exited
+	rotationDone chan struct{}
+	// Closed when the decay sweeper goroutine has exited
+	sweeperDone chan struct{}
+	// Set once the tracker is closed so closing is idempotent
+	closed atomic.Bool
+	// The running outcome reporters started by StartReporter, added to under the swap lock
+	reporters sync.WaitGroup
+
+	clock utils.IClock
+
+	// The most recent rotations, oldest first, guarded by its own lock so reading
+	// them never contends with the request path
+	recentRotations     []RotationInfo
+	recentRotationsLock sync.Mutex
+	// Called after every rotation, outside the swap lock
+	onRotation func(RotationInfo)
+	// The time of the last rotation in unix millis, or of the start of the rotation
+	// before the first one. Used to check that the rotation goroutine is alive.
+	lastRotationUnixMs atomic.Int64
 }
 
-// Allows passing an external ticket for simulations
-func NewFairnessTrackerWithClockAndTicker(trackerConfig *config.FairnessTrackerConfig, clock utils.IClock, ticker utils.ITicker) (*FairnessTracker, error) {
+// Creates the tracker without starting the rotation
+func newFairnessTracker(trackerConfig *config.FairnessTrackerConfig, clock utils.IClock, ticker utils.ITicker) (*FairnessTracker, error) {
+	if err := validateTrackerConfig(trackerConfig); err != nil {
+		return nil, NewFairnessTrackerError(err, "The input config failed validation")
+	}
+	// The tracker owns its config, so changing it at runtime doesn't leak to the caller
+	// or to other trackers built from the same config
+	ownConfig := *trackerConfig
+	trackerConfig = &ownConfig
+
 	st1, err := data.NewStructureWithClock(trackerConfig, 1, trackerConfig.IncludeStats, clock)
 	if err != nil {
 		return nil, NewFairnessTrackerError(err, "Failed to create a structure")
@@ -43,91 +105,1103 @@ func NewFairnessTrackerWithClockAndTicker(trackerConfig *config.FairnessTrackerC
 		return nil, NewFairnessTrackerError(err, "Failed to create a structure")
 	}
 
-	stopRotation := make(chan struct{})
 	ft := &FairnessTracker{
-		trackerConfig:      trackerConfig,
-		structureIDCounter: 3,
+		trackerConfig: trackerConfig,
+
+		// Unset means the secondary structure is kept warm
+		warmSecondary: trackerConfig.WarmSecondary == nil || *trackerConfig.WarmSecondary,
 
-		mainStructure:      st1,
-		secondaryStructure: st2,
+		finalProbabilityFunction: trackerConfig.FinalProbabilityFunction,
 
 		ticker: ticker,
 
-		rotationLock: sync.RWMutex{},
-		stopRotation: stopRotation,
+		stopRotation: make(chan struct{}),
+		rotationDone: make(chan struct{}),
+		sweeperDone:  make(chan struct{}),
+
+		clock: clock,
+	}
+	if trackerConfig.MaxThrottlesPerSecond > 0 {
+		ft.throttleBudget = newThrottleBudget(trackerConfig.MaxThrottlesPerSecond, clock)
+	}
+	// No sweeper will ever run, so closing doesn't wait for it
+	if trackerConfig.DecaySweepInterval <= 0 {
+		close(ft.sweeperDone)
+	}
+	st1.ShareFailureRate(&ft.failureRate)
+	st2.ShareFailureRate(&ft.failureRate)
+	ft.structureIDCounter.Store(3)
+	ft.structures.Store(&structureSet{dimensions: []dimension{{main: st1, secondary: st2, promotedAt: clock.Now()}}})
+
+	return ft, nil
+}
+
+// Allows passing an external ticket for simulations. A real ticker is used if it's nil.
+func NewFairnessTrackerWithClockAndTicker(trackerConfig *config.FairnessTrackerConfig, clock utils.IClock, ticker utils.ITicker) (*FairnessTracker, error) {
+	ft, err := newFairnessTracker(trackerConfig, clock, ticker)
+	if err != nil {
+		return nil, err
+	}
+
+	ft.startRotation()
+	ft.startSweeper()
+	return ft, nil
+}
+
+// Start a periodic task to rotate underlying structures to keep
+// changing the hash seeds so we don't continue punishing the same
+// innocent workloads repeatedly in the worst case of a false positive.
+// Nothing is started if the rotation is disabled and a real ticker is
+// created if none was provided.
+func (ft *FairnessTracker) startRotation() {
+	if ft.trackerConfig.RotationFrequency <= 0 {
+		logger.Infof("Rotation is disabled since the rotation frequency is %v", ft.trackerConfig.RotationFrequency)
+		close(ft.rotationDone)
+		return
 	}
 
-	// Start a periodic task to rotate underlying structures to keep
-	// changing the hash seeds so we don't continue punishing the same
-	// innocent workloads repeatedly in the worst case of a false positive.
+	if ft.ticker == nil {
+		ft.ticker = utils.NewRealTicker(ft.trackerConfig.RotationFrequency)
+	}
+	ft.lastRotationUnixMs.Store(ft.clock.Now().UnixMilli())
+	ft.jitterRotation()
+
 	go func() {
+		defer close(ft.rotationDone)
+
+		for {
+			select {
+			case <-ft.stopRotation:
+				return
+			case <-ft.ticker.C():
+				ft.rotate()
+				ft.jitterRotation()
+			}
+		}
+	}()
+}
+
+// Reset the ticker to a random period within RotationJitter of the RotationFrequency so
+// the next rotation is jittered. A no-op without jitter or with a ticker that isn't a
+// utils.ResettableTicker, which keeps the ticker as is.
+func (ft *FairnessTracker) jitterRotation() {
+	ft.swapLock.Lock()
+	defer ft.swapLock.Unlock()
+
+	jitter := ft.trackerConfig.RotationJitter
+	ticker, ok := ft.ticker.(utils.ResettableTicker)
+	if jitter <= 0 || !ok || ft.closed.Load() {
+		return
+	}
+
+	offset := time.Duration(rand.Int63n(int64(2*jitter)+1)) - jitter
+	ticker.Reset(max(ft.trackerConfig.RotationFrequency+offset, config.MinRotationFrequency))
+}
+
+// Start a periodic task applying the pending decay to the buckets of all structures,
+// unless the sweep is disabled
+func (ft *FairnessTracker) startSweeper() {
+	interval := ft.trackerConfig.DecaySweepInterval
+	if interval <= 0 {
+		return
+	}
+
+	ticker := utils.NewRealTicker(interval)
+	go func() {
+		defer close(ft.sweeperDone)
+		defer ticker.Stop()
+
 		for {
 			select {
-			case <-stopRotation:
+			case <-ft.stopRotation:
 				return
 			case <-ticker.C():
-				s, err := data.NewStructureWithClock(trackerConfig, ft.structureIDCounter, trackerConfig.IncludeStats, clock)
-				if err != nil {
-					// TODO: While this should never happen, think if we want to handle this more gracefully
-					log.Fatalf("Failed to create a structure during rotation")
-				}
-				ft.structureIDCounter++
-
-				ft.rotationLock.Lock()
-				ft.mainStructure = ft.secondaryStructure
-				ft.secondaryStructure = s
-				ft.rotationLock.Unlock()
+				ft.sweep()
 			}
 		}
 	}()
+}
+
+// Sweep all structures of the current set
+func (ft *FairnessTracker) sweep() {
+	for _, d := range ft.structures.Load().dimensions {
+		d.main.Sweep()
+		d.secondary.Sweep()
+	}
+}
+
+func (ft *FairnessTracker) rotate() {
+	ft.swapLock.Lock()
+	cur := ft.structures.Load()
+	next := &structureSet{dimensions: make([]dimension, len(cur.dimensions))}
+	promotedAt := ft.clock.Now()
+	for i, d := range cur.dimensions {
+		next.dimensions[i] = rotateDimension(d, ft.newStructure(), ft.finalProbabilityFunction, promotedAt)
+	}
+	ft.structures.Store(next)
+	ft.swapLock.Unlock()
+
+	for i := range next.dimensions {
+		if ft.trackerConfig.OnStructureCreated != nil {
+			ft.trackerConfig.OnStructureCreated(next.dimensions[i].secondary.GetID())
+		}
+		if ft.trackerConfig.OnStructureRetired != nil {
+			ft.trackerConfig.OnStructureRetired(cur.dimensions[i].main.GetID())
+		}
+	}
+
+	retired := cur.dimensions[0].main
+	s := next.dimensions[0].secondary
+
+	now := ft.clock.Now()
+	ft.lastRotationUnixMs.Store(now.UnixMilli())
+
+	info := RotationInfo{
+		At:                 now,
+		NewStructureID:     s.GetID(),
+		RetiredStructureID: retired.GetID(),
+	}
+
+	logger.Debugf("Rotated structures, new structure %d replaces retired structure %d", info.NewStructureID, info.RetiredStructureID)
+
+	ft.recentRotationsLock.Lock()
+	ft.recentRotations = append(ft.recentRotations, info)
+	if len(ft.recentRotations) > recentRotationsToKeep {
+		ft.recentRotations = ft.recentRotations[len(ft.recentRotations)-recentRotationsToKeep:]
+	}
+	ft.recentRotationsLock.Unlock()
+
+	if ft.onRotation != nil {
+		ft.onRotation(info)
+	}
+}
+
+// Rotate the structures right away, exactly like a tick of the rotation timer, e.g. to
+// synchronize the rotations of many instances to an external epoch. Disable the timer with
+// a RotationFrequency <= 0 to only rotate on demand. Safe to call concurrently with
+// requests. The OnRotation callback runs on the calling goroutine.
+func (ft *FairnessTracker) RotateNow() error {
+	if ft.closed.Load() {
+		return NewFairnessTrackerError(nil, "The tracker is already closed")
+	}
+
+	ft.rotate()
+	return nil
+}
+
+// Wipe all the accumulated state by replacing every structure with a fresh one built from
+// the current config. The rotation keeps running. Requests in flight may still update
+// the replaced structures, in which case their updates are lost.
+func (ft *FairnessTracker) Reset() {
+	ft.swapLock.Lock()
+	defer ft.swapLock.Unlock()
+
+	next := &structureSet{dimensions: make([]dimension, len(ft.structures.Load().dimensions))}
+	for i := range next.dimensions {
+		next.dimensions[i] = ft.newDimension()
+	}
+	ft.structures.Store(next)
+}
+
+// Create a dimension with fresh structures using the current final probability function.
+// Must be called with the swap lock held.
+func (ft *FairnessTracker) newDimension() dimension {
+	d := dimension{main: ft.newStructure(), secondary: ft.newStructure(), promotedAt: ft.clock.Now()}
+	d.main.SetFinalProbabilityFunction(ft.finalProbabilityFunction)
+	d.secondary.SetFinalProbabilityFunction(ft.finalProbabilityFunction)
+	return d
+}
+
+// Promote the secondary structure of the dimension to main and install the new structure
+// as the secondary.
+func rotateDimension(d dimension, s *data.Structure, fn config.FinalProbabilityFunction, promotedAt time.Time) dimension {
+	s.SetFinalProbabilityFunction(fn)
+	// The new secondary structure carries forward the probabilities of the structure
+	// becoming the main one, which no longer needs its own seed source
+	s.Seed(d.secondary)
+	d.secondary.Seed(nil)
+
+	return dimension{main: d.secondary, secondary: s, promotedAt: promotedAt}
+}
+
+// Create a new structure with the next ID
+func (ft *FairnessTracker) newStructure() *data.Structure {
+	s, err := data.NewStructureWithClock(ft.trackerConfig, ft.structureIDCounter.Add(1)-1, ft.trackerConfig.IncludeStats, ft.clock)
+	if err != nil {
+		// TODO: While this should never happen, think if we want to handle this more gracefully
+		logger.Errorf("Failed to create a structure during rotation: %v", err)
+		log.Fatalf("Failed to create a structure during rotation")
+	}
+	s.ShareFailureRate(&ft.failureRate)
+	return s
+}
+
+// Returns the most recent rotations of the underlying structures, oldest first
+func (ft *FairnessTracker) RecentRotations() []RotationInfo {
+	ft.recentRotationsLock.Lock()
+	defer ft.recentRotationsLock.Unlock()
+
+	rotations := make([]RotationInfo, len(ft.recentRotations))
+	copy(rotations, ft.recentRotations)
+	return rotations
+}
+
+// Get the state of the tracker to persist it and restore it later with
+// NewFairnessTrackerFromState. No rotation can happen while the state is taken, but
+// like data.Structure.State it's only consistent per bucket with requests in flight.
+func (ft *FairnessTracker) State() *TrackerState {
+	ft.swapLock.Lock()
+	defer ft.swapLock.Unlock()
+
+	c := *ft.trackerConfig
+	c.FinalProbabilityFunction = ft.finalProbabilityFunction
+
+	d := ft.structures.Load().dimensions[0]
+	return &TrackerState{
+		Config:             &c,
+		StructureIDCounter: ft.structureIDCounter.Load(),
+		Main:               d.main.State(),
+		Secondary:          d.secondary.State(),
+	}
+}
 
+// The state of a tracker encoded by Export, holding the blobs exported by its structures
+type exportedTracker struct {
+	Main      json.RawMessage `json:"main"`
+	Secondary json.RawMessage `json:"secondary"`
+}
+
+// Export the structures of the dimension tracked by RegisterRequest, to restore them into
+// a tracker with the same bucket layout with Import. Unlike State, the config isn't
+// included. No rotation can happen while the structures are exported.
+func (ft *FairnessTracker) Export() ([]byte, error) {
+	ft.swapLock.Lock()
+	defer ft.swapLock.Unlock()
+
+	d := ft.structures.Load().dimensions[0]
+	main, err := d.main.Export()
+	if err != nil {
+		return nil, NewFairnessTrackerError(err, "Failed to export the main structure")
+	}
+	secondary, err := d.secondary.Export()
+	if err != nil {
+		return nil, NewFairnessTrackerError(err, "Failed to export the secondary structure")
+	}
+
+	b, err := json.Marshal(&exportedTracker{Main: main, Secondary: secondary})
+	if err != nil {
+		return nil, NewFairnessTrackerError(err, "Failed to encode the tracker state")
+	}
+	return b, nil
+}
+
+// Replace the structures of the dimension tracked by RegisterRequest with fresh ones
+// restored from a blob exported by Export. Like Reset, requests in flight may still
+// update the replaced structures, in which case their updates are lost.
+func (ft *FairnessTracker) Import(state []byte) error {
+	var et exportedTracker
+	if err := json.Unmarshal(state, &et); err != nil {
+		return NewFairnessTrackerError(err, "Failed to decode the tracker state")
+	}
+
+	ft.swapLock.Lock()
+	defer ft.swapLock.Unlock()
+
+	d := ft.newDimension()
+	if err := d.main.Import(et.Main); err != nil {
+		return NewFairnessTrackerError(err, "Failed to import the main structure")
+	}
+	if err := d.secondary.Import(et.Secondary); err != nil {
+		return NewFairnessTrackerError(err, "Failed to import the secondary structure")
+	}
+
+	cur := ft.structures.Load()
+	next := &structureSet{dimensions: make([]dimension, len(cur.dimensions))}
+	copy(next.dimensions, cur.dimensions)
+	next.dimensions[0] = d
+	ft.structures.Store(next)
+	return nil
+}
+
+// Restore a tracker from a state taken by State and start its rotation
+func NewFairnessTrackerFromState(state *TrackerState) (*FairnessTracker, error) {
+	return NewFairnessTrackerFromStateWithClockAndTicker(state, utils.NewRealClock(), nil)
+}
+
+// Like NewFairnessTrackerFromState with an external clock and ticker for simulations. A
+// real ticker is used if it's nil.
+func NewFairnessTrackerFromStateWithClockAndTicker(state *TrackerState, clock utils.IClock, ticker utils.ITicker) (*FairnessTracker, error) {
+	ft, err := newFairnessTrackerFromState(state, clock, ticker)
+	if err != nil {
+		return nil, err
+	}
+
+	ft.startRotation()
+	ft.startSweeper()
 	return ft, nil
 }
 
+// Restores the tracker without starting the rotation
+func newFairnessTrackerFromState(state *TrackerState, clock utils.IClock, ticker utils.ITicker) (*FairnessTracker, error) {
+	if state == nil || state.Main == nil {
+		return nil, NewFairnessTrackerError(nil, "The state must have a main structure")
+	}
+
+	ft, err := newFairnessTracker(state.Config, clock, ticker)
+	if err != nil {
+		return nil, err
+	}
+
+	main, err := ft.restoreStructure(state.Main)
+	if err != nil {
+		return nil, NewFairnessTrackerError(err, "Failed to restore the main structure")
+	}
+	main.SetFinalProbabilityFunction(ft.finalProbabilityFunction)
+
+	// Never hand out an ID that a restored structure already has
+	counter := max(state.StructureIDCounter, state.Main.ID+1)
+	if state.Secondary != nil {
+		counter = max(counter, state.Secondary.ID+1)
+	}
+	ft.structureIDCounter.Store(counter)
+
+	var secondary *data.Structure
+	if state.Secondary != nil {
+		secondary, err = ft.restoreStructure(state.Secondary)
+		if err != nil {
+			return nil, NewFairnessTrackerError(err, "Failed to restore the secondary structure")
+		}
+		secondary.SetFinalProbabilityFunction(ft.finalProbabilityFunction)
+	} else {
+		secondary = ft.newStructure()
+		secondary.SetFinalProbabilityFunction(ft.finalProbabilityFunction)
+		secondary.Seed(main)
+	}
+
+	ft.structures.Store(&structureSet{dimensions: []dimension{{main: main, secondary: secondary, promotedAt: ft.clock.Now()}}})
+	return ft, nil
+}
+
+// Restore a structure from the state with the config owned by the tracker
+func (ft *FairnessTracker) restoreStructure(state *data.StructureState) (*data.Structure, error) {
+	st := *state
+	st.Config = ft.trackerConfig
+	s, err := data.NewStructureFromState(&st, ft.trackerConfig.IncludeStats, ft.clock)
+	if err != nil {
+		return nil, err
+	}
+	s.ShareFailureRate(&ft.failureRate)
+	return s, nil
+}
+
+// Add the outcome to the failure rate of the adaptive mode. Must be called once for every
+// outcome before the structures apply it. Timeouts don't count, like in the structures.
+func (ft *FairnessTracker) addOutcome(outcome request.Outcome) {
+	if ft.trackerConfig.AdaptiveMode && outcome != request.OutcomeTimeout {
+		ft.failureRate.Add(outcome)
+	}
+}
+
 func NewFairnessTracker(trackerConfig *config.FairnessTrackerConfig) (*FairnessTracker, error) {
 	clk := utils.NewRealClock()
-	ticker := utils.NewRealTicker(trackerConfig.RotationFrequency)
-	return NewFairnessTrackerWithClockAndTicker(trackerConfig, clk, ticker)
+	return NewFairnessTrackerWithClockAndTicker(trackerConfig, clk, newRotationTicker(trackerConfig))
+}
+
+// Validate the whole config, including the structure parameters, so a bad config fails
+// before anything is started
+func validateTrackerConfig(trackerConfig *config.FairnessTrackerConfig) error {
+	if trackerConfig == nil {
+		return fmt.Errorf("the config must not be nil")
+	}
+	return trackerConfig.Validate()
+}
+
+// Create a real ticker for the rotation, or nil if the rotation is disabled
+func newRotationTicker(trackerConfig *config.FairnessTrackerConfig) utils.ITicker {
+	if trackerConfig.RotationFrequency <= 0 {
+		return nil
+	}
+	return utils.NewRealTicker(trackerConfig.RotationFrequency)
+}
+
+// Atomically swap the function used to choose the final probability for both the
+// structures and the ones created by future rotations without losing any state.
+// Requests in flight finish with the previous function. A nil function is ignored. Has no
+// effect on the decisions while the FinalProbabilityFunctionEx of the config is set.
+func (ft *FairnessTracker) SetFinalProbabilityFunction(fn config.FinalProbabilityFunction) {
+	if fn == nil {
+		return
+	}
+
+	ft.swapLock.Lock()
+	defer ft.swapLock.Unlock()
+
+	ft.finalProbabilityFunction = fn
+	for _, d := range ft.structures.Load().dimensions {
+		d.main.SetFinalProbabilityFunction(fn)
+		d.secondary.SetFinalProbabilityFunction(fn)
+	}
+}
+
+// Change how often the structures are rotated without rebuilding the tracker. The next
+// rotation happens a full period after the change. Fails if the tracker is closed, if
+// the rotation was disabled when the tracker was created, if its ticker isn't a
+// utils.ResettableTicker or if the frequency is too low.
+func (ft *FairnessTracker) SetRotationFrequency(d time.Duration) error {
+	if d < config.MinRotationFrequency {
+		return NewFairnessTrackerError(nil, "The rotation frequency must be at least %v, found: %v", config.MinRotationFrequency, d)
+	}
+
+	ft.swapLock.Lock()
+	defer ft.swapLock.Unlock()
+
+	if ft.closed.Load() {
+		return NewFairnessTrackerError(nil, "The tracker is already closed")
+	}
+
+	if ft.ticker == nil {
+		return NewFairnessTrackerError(nil, "The rotation is disabled")
+	}
+	ticker, ok := ft.ticker.(utils.ResettableTicker)
+	if !ok {
+		return NewFairnessTrackerError(nil, "The ticker doesn't implement utils.ResettableTicker")
+	}
+
+	if d <= ft.trackerConfig.RotationJitter {
+		return NewFairnessTrackerError(nil, "The rotation frequency must be greater than the RotationJitter %v, found: %v",
+			ft.trackerConfig.RotationJitter, d)
+	}
+
+	ticker.Reset(d)
+	ft.trackerConfig.RotationFrequency = d
+	return nil
+}
+
+// Check that the rotation is still happening, e.g. for a liveness probe. Returns false if
+// the last rotation is older than twice the rotation frequency or than maxStaleness if
+// it's positive, and once the tracker is closed. Always true if the rotation is disabled.
+func (ft *FairnessTracker) RotationHealthy(maxStaleness time.Duration) bool {
+	ft.swapLock.Lock()
+	frequency := ft.trackerConfig.RotationFrequency
+	ft.swapLock.Unlock()
+
+	if frequency <= 0 {
+		return true
+	}
+	if ft.closed.Load() {
+		return false
+	}
+
+	staleness := ft.clock.Now().Sub(time.UnixMilli(ft.lastRotationUnixMs.Load()))
+	if staleness > 2*frequency {
+		return false
+	}
+	return maxStaleness <= 0 || staleness <= maxStaleness
+}
+
+// Get a copy of the effective config of the tracker, including the parameters computed
+// when it was built with the defaults. The FinalProbabilityFunction is the one in use,
+// which may have been swapped since. Mutating the copy doesn't affect the tracker.
+func (ft *FairnessTracker) Config() config.FairnessTrackerConfig {
+	ft.swapLock.Lock()
+	defer ft.swapLock.Unlock()
+
+	c := *ft.trackerConfig
+	c.FinalProbabilityFunction = ft.finalProbabilityFunction
+	return c
+}
+
+// Get how long the current main structure has been the main one, which resets with every
+// rotation. The time a structure spent as the secondary one doesn't count, see
+// data.Structure.Age for the time since its creation.
+func (ft *FairnessTracker) MainStructureAge() time.Duration {
+	promotedAt := ft.structures.Load().dimensions[0].promotedAt
+	if now := ft.clock.Now(); now.After(promotedAt) {
+		return now.Sub(promotedAt)
+	}
+	return 0
+}
+
+// Get the occupancy of the main structure aggregated over all its levels.
+// Useful to detect if the buckets per level are too few for the number of flows.
+func (ft *FairnessTracker) Occupancy() data.LevelOccupancy {
+	return aggregateOccupancy(ft.structures.Load().dimensions[0].main.Occupancy())
+}
+
+// Get the histogram of the decayed probabilities of the main structure's buckets across
+// all levels, e.g. to chart the distribution of the throttling pressure on a dashboard.
+// See data.Structure.ProbabilityHistogram.
+func (ft *FairnessTracker) ProbabilityHistogram(bins int) []uint64 {
+	return ft.structures.Load().dimensions[0].main.ProbabilityHistogram(bins)
+}
+
+// Aggregate the occupancy of several levels, possibly of several structures, into one
+func aggregateOccupancy(levels []data.LevelOccupancy) data.LevelOccupancy {
+	var total data.LevelOccupancy
+	for _, lvl := range levels {
+		total.Buckets += lvl.Buckets
+		total.NonZeroBuckets += lvl.NonZeroBuckets
+		total.MaxProbability = math.Max(total.MaxProbability, lvl.MaxProbability)
+		total.MeanProbability += lvl.MeanProbability * float64(lvl.Buckets)
+	}
+
+	if total.Buckets > 0 {
+		total.MeanProbability /= float64(total.Buckets)
+	}
+
+	return total
+}
+
+// Get aggregate stats of both structures, e.g. for a metrics scraper. The structures are
+// loaded once without any lock and every bucket lock is only held while reading that
+// bucket, so scraping never blocks requests for long.
+func (ft *FairnessTracker) AggregateStats() TrackerStats {
+	d := ft.structures.Load().dimensions[0]
+	now := ft.clock.Now()
+
+	mainLevels := d.main.Occupancy()
+	secondaryLevels := d.secondary.Occupancy()
+
+	return TrackerStats{
+		Main:      structureStats(d.main, mainLevels, now),
+		Secondary: structureStats(d.secondary, secondaryLevels, now),
+		Total:     aggregateOccupancy(append(mainLevels, secondaryLevels...)),
+	}
+}
+
+func structureStats(s *data.Structure, levels []data.LevelOccupancy, now time.Time) StructureStats {
+	return StructureStats{
+		ID:        s.GetID(),
+		Age:       s.Age(now),
+		Occupancy: aggregateOccupancy(levels),
+	}
+}
+
+// Estimate the probability that an innocent flow is throttled only because every one of
+// its buckets collides with a bad flow, from the current occupancy of the main structure.
+// The runtime analog of config.CollisionProbability that CalculateL is designed against:
+// the product over the levels of the fraction of buckets with a non-zero probability.
+func (ft *FairnessTracker) EstimatedFalsePositiveRate() float64 {
+	rate := 1.
+	for _, occ := range ft.structures.Load().dimensions[0].main.Occupancy() {
+		if occ.Buckets == 0 {
+			return 0
+		}
+		rate *= float64(occ.NonZeroBuckets) / float64(occ.Buckets)
+	}
+	return rate
+}
+
+// Dump the buckets of the main structure with a non-negligible probability, ordered by
+// level and then index, e.g. for an admin endpoint. See data.Structure.ActiveBuckets.
+func (ft *FairnessTracker) DumpActiveBuckets() []data.BucketInfo {
+	return ft.structures.Load().dimensions[0].main.ActiveBuckets()
 }
 
 func (ft *FairnessTracker) RegisterRequest(ctx context.Context, clientIdentifier []byte) (*request.RegisterRequestResult, error) {
-	// We must take the rotation lock to avoid rotation while updating the structures
-	ft.rotationLock.RLock()
-	defer ft.rotationLock.RUnlock()
+	return ft.registerRequest(ctx, clientIdentifier, ft.warmSecondary)
+}
+
+// Register a request with the main structure only, for callers registering far more
+// requests than they report outcomes who want the lightest path. The decision is the
+// same as with RegisterRequest, which also makes it with the main structure, but the
+// secondary structure neither counts the request nor decays the buckets it hashes to.
+// That only trades some warmth of the structure taking over at the next rotation for
+// about half the hashing and locking, since the outcomes still update both structures.
+func (ft *FairnessTracker) RegisterRequestReadOnly(ctx context.Context, clientIdentifier []byte) (*request.RegisterRequestResult, error) {
+	return ft.registerRequest(ctx, clientIdentifier, false)
+}
+
+func (ft *FairnessTracker) registerRequest(ctx context.Context, clientIdentifier []byte, updateSecondary bool) (*request.RegisterRequestResult, error) {
+	if resp := ft.overrideResult(clientIdentifier); resp != nil {
+		ft.countResult(resp)
+		return resp, nil
+	}
+	d := ft.structures.Load().dimensions[0]
 
-	resp, err := ft.mainStructure.RegisterRequest(ctx, clientIdentifier)
+	resp, err := d.main.RegisterRequest(ctx, clientIdentifier)
 	if err != nil {
 		return nil, NewFairnessTrackerError(err, "Failed updating the primary structure")
 	}
 
 	// To keep the bad workloads data "warm" in the rotated structure, we will update both
-	if _, err := ft.secondaryStructure.RegisterRequest(ctx, clientIdentifier); err != nil {
-		// TODO: We don't really have to fail here perhaps, but I cannot think any reason this will actually fail
-		return nil, NewFairnessTrackerError(err, "Failed updating the secondary structure")
+	if updateSecondary {
+		secondaryResp, err := d.secondary.RegisterRequest(ctx, clientIdentifier)
+		if err != nil {
+			// TODO: We don't really have to fail here perhaps, but I cannot think any reason this will actually fail
+			return nil, NewFairnessTrackerError(err, "Failed updating the secondary structure")
+		}
+		addSecondaryStats(resp, secondaryResp)
 	}
+	ft.allowResult(resp)
 
 	return resp, nil
 }
 
+// Never throttle the client, e.g. an internal or privileged one, whatever the probability
+// of its buckets. Its requests are let through without registering them, while its
+// outcomes are still reported so it's throttled as usual once it's removed. The client
+// identifier is matched as is, before any KeyNormalizer.
+func (ft *FairnessTracker) AddTrusted(clientIdentifier []byte) {
+	ft.trusted.add(clientIdentifier)
+}
+
+// Remove the client added with AddTrusted, so its requests are throttled again
+func (ft *FairnessTracker) RemoveTrusted(clientIdentifier []byte) {
+	ft.trusted.remove(clientIdentifier)
+}
+
+// Always throttle the client, e.g. one known to be abusive, without waiting for its
+// failures to raise the probabilities. Unlike SeedClient it doesn't touch the buckets,
+// so the flows colliding with the client aren't affected and removing it restores the
+// probabilistic throttling as it was. Its requests are throttled without registering
+// them and regardless of the MaxThrottlesPerSecond. A client that is also trusted is
+// never throttled. Matched like AddTrusted.
+func (ft *FairnessTracker) AddBlocked(clientIdentifier []byte) {
+	ft.blocked.add(clientIdentifier)
+}
+
+// Remove the client added with AddBlocked
+func (ft *FairnessTracker) RemoveBlocked(clientIdentifier []byte) {
+	ft.blocked.remove(clientIdentifier)
+}
+
+// The result for a trusted or blocked client, or nil if the request must be registered
+func (ft *FairnessTracker) overrideResult(clientIdentifier []byte) *request.RegisterRequestResult {
+	if ft.trusted.contains(clientIdentifier) {
+		return &request.RegisterRequestResult{}
+	}
+	if ft.blocked.contains(clientIdentifier) {
+		return &request.RegisterRequestResult{ShouldThrottle: true, SuggestedBackoff: ft.trackerConfig.SuggestedBackoff(1)}
+	}
+	return nil
+}
+
+// Count a registered request and whether it should be throttled. Returns whether it's
+// actually throttled, which it never is in the dry run.
+func (ft *FairnessTracker) countRequest(throttled bool) bool {
+	ft.requestsCount.Add(1)
+	if !throttled {
+		return false
+	}
+	if ft.trackerConfig.DryRun {
+		ft.wouldThrottleCount.Add(1)
+		return false
+	}
+	ft.throttledCount.Add(1)
+	return true
+}
+
+// Get the lifetime counters of the tracker. The counters are read one after the other, so
+// they may be slightly out of sync with requests in flight.
+func (ft *FairnessTracker) Counters() TrackerCounters {
+	return TrackerCounters{
+		Requests:      ft.requestsCount.Load(),
+		Throttled:     ft.throttledCount.Load(),
+		WouldThrottle: ft.wouldThrottleCount.Load(),
+		Outcomes:      ft.outcomesCount.Load(),
+	}
+}
+
+// Check a throttling decision against the global budget of throttles per second. A
+// request that should be throttled is let through once the budget is exhausted.
+func (ft *FairnessTracker) allowThrottle(shouldThrottle bool) bool {
+	if !shouldThrottle || ft.throttleBudget == nil {
+		return shouldThrottle
+	}
+	return ft.throttleBudget.take()
+}
+
+// Apply the throttle budget to the result of a request and count it
+func (ft *FairnessTracker) allowResult(resp *request.RegisterRequestResult) {
+	resp.ShouldThrottle = ft.allowThrottle(resp.ShouldThrottle)
+	ft.countResult(resp)
+}
+
+// Count the result of a request, dropping the suggested backoff of a request let through
+func (ft *FairnessTracker) countResult(resp *request.RegisterRequestResult) {
+	resp.ShouldThrottle = ft.countRequest(resp.ShouldThrottle)
+	if !resp.ShouldThrottle {
+		resp.SuggestedBackoff = 0
+	}
+}
+
+// Fill the result of a multi-dimensional request overridden by a trusted or blocked key
+func overrideMultiResult(result *request.MultiRegisterRequestResult, shouldThrottle bool) *request.MultiRegisterRequestResult {
+	for i := range result.Dimensions {
+		result.Dimensions[i] = &request.RegisterRequestResult{ShouldThrottle: shouldThrottle}
+	}
+	result.ShouldThrottle = shouldThrottle
+	return result
+}
+
+// Add the probabilities the secondary structure computed to the stats of the main
+// structure's result, if stats are included
+func addSecondaryStats(resp, secondaryResp *request.RegisterRequestResult) {
+	if resp.ResultStats == nil || secondaryResp.ResultStats == nil {
+		return
+	}
+
+	resp.ResultStats.SecondaryFinalProbability = secondaryResp.ResultStats.FinalProbability
+	resp.ResultStats.SecondaryBucketProbabilities = secondaryResp.ResultStats.BucketProbabilities
+}
+
+// Check if the client is effectively shut down, i.e. its final probability in the main
+// structure is at or above the BlockThreshold of the config. Doesn't register a request.
+func (ft *FairnessTracker) IsBlocked(clientIdentifier []byte) bool {
+	blocked, err := ft.structures.Load().dimensions[0].main.IsBlocked(clientIdentifier)
+	if err != nil {
+		// Only a broken final probability function can fail here
+		logger.Errorf("Failed checking if the client is blocked: %v", err)
+		return false
+	}
+	return blocked
+}
+
+// Set the probability of the client's buckets in both structures, e.g. to start throttling
+// a flow known to be abusive from another region without waiting for local failures.
+// Flows colliding with the client on a level share that bucket and are seeded too, so
+// only seed flows known to be bad. See data.Structure.SeedClient.
+func (ft *FairnessTracker) SeedClient(clientIdentifier []byte, probability float64) {
+	d := ft.structures.Load().dimensions[0]
+	d.main.SeedClient(clientIdentifier, probability)
+	d.secondary.SeedClient(clientIdentifier, probability)
+}
+
+// Explain the throttling decision the main structure would make for the next request of
+// the client, without registering it. Doesn't need IncludeStats. See data.Structure.Explain.
+func (ft *FairnessTracker) Explain(clientIdentifier []byte) (*data.Explanation, error) {
+	e, err := ft.structures.Load().dimensions[0].main.Explain(clientIdentifier)
+	if err != nil {
+		return nil, NewFairnessTrackerError(err, "Failed explaining the decision of the primary structure")
+	}
+	return e, nil
+}
+
+// Estimate how long the client has to wait until its probability of being throttled
+// decays to the target, e.g. for a Retry-After header. See data.Structure.EstimateRetryAfter.
+func (ft *FairnessTracker) EstimateRetryAfter(ctx context.Context, clientIdentifier []byte, targetProbability float64) (time.Duration, error) {
+	d, err := ft.structures.Load().dimensions[0].main.EstimateRetryAfter(ctx, clientIdentifier, targetProbability)
+	if err != nil {
+		return 0, NewFairnessTrackerError(err, "Failed estimating the retry after for the primary structure")
+	}
+	return d, nil
+}
+
+// Register a batch of requests from distinct clients at once, e.g. to pre-check the
+// keys of a batch job before admitting it. The structures are loaded once so every key
+// is checked against the same structures even if a rotation happens meanwhile. Like
+// RegisterRequest, every key also updates the secondary structure. The results are in
+// the order of the keys.
+func (ft *FairnessTracker) RegisterRequestBatch(ctx context.Context, keys [][]byte) ([]*request.RegisterRequestResult, error) {
+	d := ft.structures.Load().dimensions[0]
+
+	results := make([]*request.RegisterRequestResult, len(keys))
+	for i, key := range keys {
+		if resp := ft.overrideResult(key); resp != nil {
+			ft.countResult(resp)
+			results[i] = resp
+			continue
+		}
+
+		resp, err := d.main.RegisterRequest(ctx, key)
+		if err != nil {
+			return nil, NewFairnessTrackerError(err, "Failed updating the primary structure for key %d", i)
+		}
+
+		if ft.warmSecondary {
+			secondaryResp, err := d.secondary.RegisterRequest(ctx, key)
+			if err != nil {
+				return nil, NewFairnessTrackerError(err, "Failed updating the secondary structure for key %d", i)
+			}
+			addSecondaryStats(resp, secondaryResp)
+		}
+		ft.allowResult(resp)
+
+		results[i] = resp
+	}
+
+	return results, nil
+}
+
+// Project how close to throttled the client would get if a request were let through
+// and had the given outcome, without mutating any state. Useful for predictive backpressure.
+// The projection is made against the main structure that makes the throttling decisions.
+func (ft *FairnessTracker) TryRegisterRequest(ctx context.Context, clientIdentifier []byte, outcome request.Outcome) (*request.TryRegisterRequestResult, error) {
+	resp, err := ft.structures.Load().dimensions[0].main.TryRegisterRequest(ctx, clientIdentifier, outcome)
+	if err != nil {
+		return nil, NewFairnessTrackerError(err, "Failed projecting the primary structure")
+	}
+
+	return resp, nil
+}
+
+// Register an incoming request that is tracked independently along several flow
+// dimensions, e.g. a client ID and an API endpoint. Every key is tracked by its own
+// structures, so the keys don't have to be concatenated which would explode the key
+// space. The request should be throttled if any of the dimensions says so. Keys must
+// always be passed in the same order of dimensions.
+func (ft *FairnessTracker) RegisterRequestMulti(ctx context.Context, keys [][]byte) (*request.MultiRegisterRequestResult, error) {
+	if len(keys) == 0 {
+		return nil, NewFairnessTrackerError(nil, "At least one key is required")
+	}
+	dimensions, err := ft.ensureDimensions(len(keys))
+	if err != nil {
+		return nil, err
+	}
+
+	result := &request.MultiRegisterRequestResult{
+		Dimensions: make([]*request.RegisterRequestResult, len(keys)),
+	}
+	// A trusted key in any dimension lets the whole request through and otherwise a
+	// blocked key in any dimension throttles it
+	for _, key := range keys {
+		if ft.trusted.contains(key) {
+			ft.countRequest(false)
+			return overrideMultiResult(result, false), nil
+		}
+	}
+	for _, key := range keys {
+		if ft.blocked.contains(key) {
+			return overrideMultiResult(result, ft.countRequest(true)), nil
+		}
+	}
+	for i, key := range keys {
+		d := dimensions[i]
+
+		resp, err := d.main.RegisterRequest(ctx, key)
+		if err != nil {
+			return nil, NewFairnessTrackerError(err, "Failed updating the primary structure of dimension %d", i)
+		}
+
+		if ft.warmSecondary {
+			secondaryResp, err := d.secondary.RegisterRequest(ctx, key)
+			if err != nil {
+				return nil, NewFairnessTrackerError(err, "Failed updating the secondary structure of dimension %d", i)
+			}
+			addSecondaryStats(resp, secondaryResp)
+		}
+
+		result.Dimensions[i] = resp
+		result.ShouldThrottle = result.ShouldThrottle || resp.ShouldThrottle
+	}
+	// The request takes a single token however many dimensions say to throttle it
+	result.ShouldThrottle = ft.countRequest(ft.allowThrottle(result.ShouldThrottle))
+	// The dimensions must not contradict a request let through by the budget or the dry run
+	if !result.ShouldThrottle {
+		for _, resp := range result.Dimensions {
+			resp.ShouldThrottle = false
+			resp.SuggestedBackoff = 0
+		}
+	}
+
+	return result, nil
+}
+
+// Report the outcome of a request registered with RegisterRequestMulti to all of its dimensions
+func (ft *FairnessTracker) ReportOutcomeMulti(ctx context.Context, keys [][]byte, outcome request.Outcome) (*request.ReportOutcomeResult, error) {
+	if len(keys) == 0 {
+		return nil, NewFairnessTrackerError(nil, "At least one key is required")
+	}
+	dimensions, err := ft.ensureDimensions(len(keys))
+	if err != nil {
+		return nil, err
+	}
+
+	// The outcome counts once towards the failure rate, not once per dimension
+	ft.addOutcome(outcome)
+	for i, key := range keys {
+		d := dimensions[i]
+
+		if _, err := d.main.ReportOutcome(ctx, key, outcome); err != nil {
+			return nil, NewFairnessTrackerError(err, "Failed updating the primary structure of dimension %d", i)
+		}
+
+		if ft.warmSecondary {
+			if _, err := d.secondary.ReportOutcome(ctx, key, outcome); err != nil {
+				return nil, NewFairnessTrackerError(err, "Failed updating the secondary structure of dimension %d", i)
+			}
+		}
+	}
+	ft.outcomesCount.Add(1)
+
+	return &request.ReportOutcomeResult{}, nil
+}
+
+// Make sure there are structures for at least n dimensions and return them. More
+// dimensions than the configured max are rejected.
+func (ft *FairnessTracker) ensureDimensions(n int) ([]dimension, error) {
+	if set := ft.structures.Load(); len(set.dimensions) >= n {
+		return set.dimensions, nil
+	}
+
+	maxDimensions := int(ft.trackerConfig.MaxDimensions)
+	if maxDimensions == 0 {
+		maxDimensions = defaultMaxDimensions
+	}
+	if n > maxDimensions {
+		return nil, NewFairnessTrackerError(nil, "At most %d dimensions are allowed, found: %d", maxDimensions, n)
+	}
+
+	ft.swapLock.Lock()
+	defer ft.swapLock.Unlock()
+
+	cur := ft.structures.Load()
+	if len(cur.dimensions) >= n {
+		return cur.dimensions, nil
+	}
+
+	next := &structureSet{dimensions: make([]dimension, len(cur.dimensions), n)}
+	copy(next.dimensions, cur.dimensions)
+	for len(next.dimensions) < n {
+		next.dimensions = append(next.dimensions, ft.newDimension())
+	}
+	ft.structures.Store(next)
+
+	return next.dimensions, nil
+}
+
+// Return the ID of the current main structure, which changes with every rotation.
+// Together with RegisterRequest, ReportOutcome, Export, Import and Close it implements
+// request.Tracker.
+func (ft *FairnessTracker) GetID() uint64 {
+	return ft.structures.Load().dimensions[0].main.GetID()
+}
+
 func (ft *FairnessTracker) ReportOutcome(ctx context.Context, clientIdentifier []byte, outcome request.Outcome) (*request.ReportOutcomeResult, error) {
-	// We must take the rotation lock to avoid rotation while updating the structures
-	ft.rotationLock.RLock()
-	defer ft.rotationLock.RUnlock()
+	d := ft.structures.Load().dimensions[0]
+	ft.addOutcome(outcome)
 
-	resp, err := ft.mainStructure.ReportOutcome(ctx, clientIdentifier, outcome)
+	resp, err := d.main.ReportOutcome(ctx, clientIdentifier, outcome)
 	if err != nil {
 		return nil, NewFairnessTrackerError(err, "Failed updating the primary structure")
 	}
 
 	// To keep the bad workloads data "warm" in the rotated structure, we will update both
-	if _, err := ft.secondaryStructure.ReportOutcome(ctx, clientIdentifier, outcome); err != nil {
-		return nil, NewFairnessTrackerError(err, "Failed updating the secondary structure")
+	if ft.warmSecondary {
+		if _, err := d.secondary.ReportOutcome(ctx, clientIdentifier, outcome); err != nil {
+			return nil, NewFairnessTrackerError(err, "Failed updating the secondary structure")
+		}
 	}
+	ft.outcomesCount.Add(1)
 
 	return resp, nil
 }
 
+// Report a batch of outcomes with a weight each, e.g. from an asynchronous pipeline of
+// outcome events. The structures are loaded once so the whole batch lands on the same
+// structures even if a rotation happens meanwhile. All weights are validated before any
+// outcome is applied. Every outcome updates both structures like ReportOutcome.
+func (ft *FairnessTracker) ReportOutcomeWeightedBatch(ctx context.Context, items []request.WeightedOutcomeItem) (*request.ReportOutcomeResult, error) {
+	for i, item := range items {
+		if item.Weight < 0 || math.IsNaN(item.Weight) {
+			return nil, NewFairnessTrackerError(nil, "The weight of item %d must not be negative, found: %f", i, item.Weight)
+		}
+	}
+
+	d := ft.structures.Load().dimensions[0]
+	for i, item := range items {
+		ft.addOutcome(item.Outcome)
+		if _, err := d.main.ReportOutcomeWeighted(ctx, item.ClientIdentifier, item.Outcome, item.Weight); err != nil {
+			return nil, NewFairnessTrackerError(err, "Failed updating the primary structure for item %d", i)
+		}
+
+		if ft.warmSecondary {
+			if _, err := d.secondary.ReportOutcomeWeighted(ctx, item.ClientIdentifier, item.Outcome, item.Weight); err != nil {
+				return nil, NewFairnessTrackerError(err, "Failed updating the secondary structure for item %d", i)
+			}
+		}
+		ft.outcomesCount.Add(1)
+	}
+
+	return &request.ReportOutcomeResult{}, nil
+}
+
+// Report an outcome to the structure with the given ID only, whether it's a main or a
+// secondary structure, e.g. to replay a log of outcomes against the structures that saw
+// them. A no-op if the structure has already been rotated out. Not meant for regular
+// outcomes, which must go through ReportOutcome to update both structures.
+func (ft *FairnessTracker) ReportOutcomeToStructure(ctx context.Context, structureID uint64, clientIdentifier []byte, outcome request.Outcome) (*request.ReportOutcomeResult, error) {
+	for _, d := range ft.structures.Load().dimensions {
+		for _, s := range []*data.Structure{d.main, d.secondary} {
+			if s.GetID() != structureID {
+				continue
+			}
+
+			ft.addOutcome(outcome)
+			resp, err := s.ReportOutcome(ctx, clientIdentifier, outcome)
+			if err != nil {
+				return nil, NewFairnessTrackerError(err, "Failed updating the structure %d", structureID)
+			}
+			return resp, nil
+		}
+	}
+
+	return &request.ReportOutcomeResult{}, nil
+}
+
+// Report an outcome as a signed delta to the probabilities of the client's buckets.
+// Useful for outcomes beyond binary success and failure such as a soft failure that
+// should count as a fraction of Pi. See data.Structure.ReportOutcomeDelta.
+func (ft *FairnessTracker) ReportOutcomeDelta(ctx context.Context, clientIdentifier []byte, delta float64) (*request.ReportOutcomeResult, error) {
+	d := ft.structures.Load().dimensions[0]
+
+	resp, err := d.main.ReportOutcomeDelta(ctx, clientIdentifier, delta)
+	if err != nil {
+		return nil, NewFairnessTrackerError(err, "Failed updating the primary structure")
+	}
+
+	// To keep the bad workloads data "warm" in the rotated structure, we will update both
+	if ft.warmSecondary {
+		if _, err := d.secondary.ReportOutcomeDelta(ctx, clientIdentifier, delta); err != nil {
+			return nil, NewFairnessTrackerError(err, "Failed updating the secondary structure")
+		}
+	}
+	ft.outcomesCount.Add(1)
+
+	return resp, nil
+}
+
+// Stop the rotation and the decay sweeper and release the resources of the tracker.
+// Returns after the sweeper and the outcome reporters have exited.
 func (ft *FairnessTracker) Close() {
+	ft.stop()
+	<-ft.sweeperDone
+	ft.reporters.Wait()
+}
+
+// Stop the rotation and release the resources of the tracker, then take a final
+// snapshot of the main structure. The rotation and sweeper goroutines have exited and
+// the swap lock is held while taking the snapshot, so no rotation or reset can race with
+// it. Requests still in flight may land on either side of the snapshot. Safe to call
+// instead of Close.
+func (ft *FairnessTracker) DrainAndClose() (*data.StructureSnapshot, error) {
+	if !ft.stop() {
+		return nil, NewFairnessTrackerError(nil, "The tracker is already closed")
+	}
+	<-ft.rotationDone
+	<-ft.sweeperDone
+	ft.reporters.Wait()
+
+	ft.swapLock.Lock()
+	defer ft.swapLock.Unlock()
+
+	return ft.structures.Load().dimensions[0].main.Snapshot(), nil
+}
+
+// Stop the rotation if the tracker isn't already closed. Returns false if it was.
+func (ft *FairnessTracker) stop() bool {
+	// Don't race with a change of the rotation frequency resetting the ticker
+	ft.swapLock.Lock()
+	defer ft.swapLock.Unlock()
+
+	if !ft.closed.CompareAndSwap(false, true) {
+		return false
+	}
+
 	close(ft.stopRotation)
-	ft.ticker.Stop()
+	if ft.ticker != nil {
+		ft.ticker.Stop()
+	}
+	return true
 }
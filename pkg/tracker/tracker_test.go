@@ -2,12 +2,21 @@ package tracker
 
 import (
 	"context"
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
 
+	"github.com/satmihir/fair/pkg/config"
+	"github.com/satmihir/fair/pkg/data"
+	"github.com/satmihir/fair/pkg/logger"
 	"github.com/satmihir/fair/pkg/request"
+	"github.com/satmihir/fair/pkg/testutils"
+	"github.com/satmihir/fair/pkg/utils"
 )
 
 func TestEndToEnd(t *testing.T) {
@@ -52,11 +61,1833 @@ func TestRotation(t *testing.T) {
 	trkB.SetRotationFrequency(1 * time.Second)
 	trk, err := trkB.Build()
 	assert.NoError(t, err)
+	defer closeAndWait(trk)
 
 	for i := 0; i < 3; i++ {
-		assert.Equal(t, int(trk.secondaryStructure.GetID()-trk.mainStructure.GetID()), 1)
+		d := trk.structures.Load().dimensions[0]
+		assert.Equal(t, int(d.secondary.GetID()-d.main.GetID()), 1)
 		time.Sleep(1 * time.Second)
 	}
 
-	assert.True(t, trk.secondaryStructure.GetID() >= 2)
+	assert.True(t, trk.structures.Load().dimensions[0].secondary.GetID() >= 2)
+}
+
+func TestRecentRotations(t *testing.T) {
+	clk := utils.NewMockClock(time.Unix(1000, 0))
+	ticker := utils.NewMockTicker()
+
+	trk, err := newFairnessTracker(config.DefaultFairnessTrackerConfig(), clk, ticker)
+	assert.NoError(t, err)
+	defer trk.Close()
+
+	rotations := make(chan RotationInfo)
+	trk.onRotation = func(info RotationInfo) {
+		// The swap lock must not be held while the callback runs
+		trk.swapLock.Lock()
+		defer trk.swapLock.Unlock()
+		rotations <- info
+	}
+	trk.startRotation()
+
+	assert.Empty(t, trk.RecentRotations())
+
+	for i := 0; i < 3; i++ {
+		clk.Advance(time.Minute)
+		ticker.Tick()
+
+		info := <-rotations
+		assert.Equal(t, info.At, time.Unix(1000, 0).Add(time.Duration(i+1)*time.Minute))
+		assert.Equal(t, int(info.NewStructureID), i+3)
+		assert.Equal(t, int(info.RetiredStructureID), i+1)
+	}
+
+	recent := trk.RecentRotations()
+	assert.Equal(t, len(recent), 3)
+	for i, info := range recent {
+		assert.Equal(t, int(info.NewStructureID), i+3)
+		assert.True(t, i == 0 || info.At.After(recent[i-1].At))
+	}
+
+	for i := 0; i < recentRotationsToKeep; i++ {
+		ticker.Tick()
+		<-rotations
+	}
+
+	recent = trk.RecentRotations()
+	assert.Equal(t, len(recent), recentRotationsToKeep)
+	assert.Equal(t, int(recent[len(recent)-1].NewStructureID), recentRotationsToKeep+5)
+}
+
+func TestBuilderOnRotation(t *testing.T) {
+	rotations := make(chan RotationInfo, 1)
+
+	trkB := NewFairnessTrackerBuilder()
+	trkB.SetRotationFrequency(10 * time.Millisecond)
+	trkB.SetOnRotation(func(info RotationInfo) {
+		select {
+		case rotations <- info:
+		default:
+		}
+	})
+	trk, err := trkB.Build()
+	assert.NoError(t, err)
+	defer closeAndWait(trk)
+
+	info := <-rotations
+	assert.Equal(t, int(info.RetiredStructureID), 1)
+}
+
+func TestBuilderClockAndTicker(t *testing.T) {
+	clk := utils.NewMockClock(time.Unix(1000, 0))
+	ticker := utils.NewMockTicker()
+	rotations := make(chan RotationInfo)
+
+	trkB := NewFairnessTrackerBuilder()
+	trkB.SetClock(clk)
+	trkB.SetTicker(ticker)
+	trkB.SetOnRotation(func(info RotationInfo) {
+		rotations <- info
+	})
+	trk, err := trkB.Build()
+	assert.NoError(t, err)
+	defer trk.Close()
+
+	clk.Advance(time.Minute)
+	ticker.Tick()
+
+	info := <-rotations
+	assert.Equal(t, info.At, time.Unix(1060, 0))
+	assert.Equal(t, int(info.RetiredStructureID), 1)
+	assert.Equal(t, trk.MainStructureAge(), time.Duration(0))
+}
+
+func TestSetFinalProbabilityFunction(t *testing.T) {
+	trkB := NewFairnessTrackerBuilder()
+	trkB.SetIncludeStats(true)
+	trk, err := trkB.Build()
+	assert.NoError(t, err)
+	defer trk.Close()
+
+	never := func([]float64) (float64, error) { return 0, nil }
+	always := func([]float64) (float64, error) { return 1, nil }
+
+	ctx := context.Background()
+	stop := make(chan struct{})
+	wg := &sync.WaitGroup{}
+
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				resp, err := trk.RegisterRequest(ctx, []byte("client_id"))
+				assert.NoError(t, err)
+
+				// The decision must come entirely from one function or the other
+				p := resp.ResultStats.FinalProbability
+				assert.True(t, p == 0 || p == 1)
+				assert.Equal(t, resp.ShouldThrottle, p == 1)
+			}
+		}()
+	}
+
+	for i := 0; i < 100; i++ {
+		if i%2 == 0 {
+			trk.SetFinalProbabilityFunction(always)
+		} else {
+			trk.SetFinalProbabilityFunction(never)
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	trk.SetFinalProbabilityFunction(nil)
+	resp, err := trk.RegisterRequest(ctx, []byte("client_id"))
+	assert.NoError(t, err)
+	assert.False(t, resp.ShouldThrottle)
+}
+
+func TestThrottledFlowSurvivesRotation(t *testing.T) {
+	clk := utils.NewMockClock(time.Unix(1000, 0))
+	ticker := utils.NewMockTicker()
+
+	conf := config.DefaultFairnessTrackerConfig()
+	conf.Lambda = 0
+	trk, err := newFairnessTracker(conf, clk, ticker)
+	assert.NoError(t, err)
+	defer trk.Close()
+
+	rotations := make(chan RotationInfo)
+	trk.onRotation = func(info RotationInfo) {
+		rotations <- info
+	}
+	trk.startRotation()
+
+	ctx := context.Background()
+	id := []byte("client_id")
+
+	for i := 0; i < 30; i++ {
+		_, err = trk.ReportOutcome(ctx, id, request.OutcomeFailure)
+		assert.NoError(t, err)
+	}
+
+	// The throttled flow keeps making requests but reports no outcomes, so neither of the
+	// structures created after this point see a failure for it
+	for i := 0; i < 3; i++ {
+		ticker.Tick()
+		<-rotations
+
+		resp, err := trk.RegisterRequest(ctx, id)
+		assert.NoError(t, err)
+		assert.True(t, resp.ShouldThrottle)
+	}
+}
+
+func TestOccupancy(t *testing.T) {
+	trk, err := NewFairnessTrackerBuilder().BuildWithDefaultConfig()
+	assert.NoError(t, err)
+	defer trk.Close()
+
+	occ := trk.Occupancy()
+	assert.Equal(t, int(occ.Buckets), 3000)
+	assert.Equal(t, int(occ.NonZeroBuckets), 0)
+
+	ctx := context.Background()
+	for i := 0; i < 20; i++ {
+		_, err = trk.ReportOutcome(ctx, []byte(fmt.Sprintf("client-%d", i)), request.OutcomeFailure)
+		assert.NoError(t, err)
+	}
+
+	occ = trk.Occupancy()
+	assert.Greater(t, int(occ.NonZeroBuckets), 20)
+	assert.LessOrEqual(t, int(occ.NonZeroBuckets), 60)
+	assert.Greater(t, occ.MaxProbability, float64(0))
+	assert.Greater(t, occ.MeanProbability, float64(0))
+}
+
+func TestDrainAndClose(t *testing.T) {
+	trkB := NewFairnessTrackerBuilder()
+	trkB.SetIncludeStats(true)
+	trk, err := trkB.Build()
+	assert.NoError(t, err)
+
+	ctx := context.Background()
+	id := []byte("client_id")
+
+	for i := 0; i < 30; i++ {
+		_, err = trk.ReportOutcome(ctx, id, request.OutcomeFailure)
+		assert.NoError(t, err)
+	}
+
+	resp, err := trk.RegisterRequest(ctx, id)
+	assert.NoError(t, err)
+	assert.True(t, resp.ShouldThrottle)
+
+	snap, err := trk.DrainAndClose()
+	assert.NoError(t, err)
+	assert.Equal(t, snap.ID, trk.structures.Load().dimensions[0].main.GetID())
+	for l, m := range resp.ResultStats.BucketIndexes {
+		assert.InDelta(t, snap.Probabilities[l][m], 1, 1e-3)
+	}
+
+	// Closing again is safe
+	trk.Close()
+	_, err = trk.DrainAndClose()
+	assert.Error(t, err)
+}
+
+func TestRegisterRequestMulti(t *testing.T) {
+	trkB := NewFairnessTrackerBuilder()
+	trkB.SetPi(.1)
+	trkB.SetPd(.001)
+	trkB.SetLambda(0)
+	trkB.SetIncludeStats(true)
+	trk, err := trkB.Build()
+	assert.NoError(t, err)
+	defer trk.Close()
+
+	ctx := context.Background()
+
+	_, err = trk.RegisterRequestMulti(ctx, nil)
+	assert.Error(t, err)
+
+	// Every customer fails once on the same endpoint, saturating only the endpoint dimension
+	for i := 0; i < 20; i++ {
+		keys := [][]byte{[]byte(fmt.Sprintf("customer-%d", i)), []byte("endpoint-a")}
+		_, err = trk.ReportOutcomeMulti(ctx, keys, request.OutcomeFailure)
+		assert.NoError(t, err)
+	}
+
+	resp, err := trk.RegisterRequestMulti(ctx, [][]byte{[]byte("customer-new"), []byte("endpoint-a")})
+	assert.NoError(t, err)
+	assert.True(t, resp.ShouldThrottle)
+	assert.Equal(t, len(resp.Dimensions), 2)
+	assert.Equal(t, resp.Dimensions[0].ResultStats.FinalProbability, float64(0))
+	assert.False(t, resp.Dimensions[0].ShouldThrottle)
+	assert.True(t, resp.Dimensions[1].ShouldThrottle)
+
+	resp, err = trk.RegisterRequestMulti(ctx, [][]byte{[]byte("customer-new"), []byte("endpoint-b")})
+	assert.NoError(t, err)
+	assert.False(t, resp.ShouldThrottle)
+
+	// The first dimension is shared with RegisterRequest
+	single, err := trk.RegisterRequest(ctx, []byte("customer-1"))
+	assert.NoError(t, err)
+	assert.InDelta(t, single.ResultStats.FinalProbability, .1, 1e-9)
+}
+
+func TestRegisterRequestMultiRotation(t *testing.T) {
+	clk := utils.NewMockClock(time.Unix(1000, 0))
+	ticker := utils.NewMockTicker()
+
+	trk, err := newFairnessTracker(config.DefaultFairnessTrackerConfig(), clk, ticker)
+	assert.NoError(t, err)
+	defer trk.Close()
+
+	rotations := make(chan RotationInfo)
+	trk.onRotation = func(info RotationInfo) {
+		rotations <- info
+	}
+	trk.startRotation()
+
+	_, err = trk.RegisterRequestMulti(context.Background(), [][]byte{[]byte("a"), []byte("b"), []byte("c")})
+	assert.NoError(t, err)
+
+	dimensions := trk.structures.Load().dimensions
+	assert.Equal(t, len(dimensions), 3)
+	before := dimensions[2].secondary
+
+	ticker.Tick()
+	<-rotations
+
+	dimensions = trk.structures.Load().dimensions
+	assert.Equal(t, dimensions[2].main, before)
+	assert.NotEqual(t, dimensions[2].secondary, before)
+}
+
+func TestMaxDimensions(t *testing.T) {
+	trkB := NewFairnessTrackerBuilder()
+	trkB.SetMaxDimensions(2)
+	trk, err := trkB.Build()
+	assert.NoError(t, err)
+	defer trk.Close()
+
+	ctx := context.Background()
+	keys := [][]byte{[]byte("a"), []byte("b"), []byte("c")}
+
+	_, err = trk.RegisterRequestMulti(ctx, keys)
+	assert.Error(t, err)
+	_, err = trk.ReportOutcomeMulti(ctx, keys, request.OutcomeFailure)
+	assert.Error(t, err)
+	assert.Equal(t, len(trk.structures.Load().dimensions), 1)
+
+	_, err = trk.RegisterRequestMulti(ctx, keys[:2])
+	assert.NoError(t, err)
+	assert.Equal(t, len(trk.structures.Load().dimensions), 2)
+
+	// The default applies when the max isn't configured
+	dflt, err := NewFairnessTrackerBuilder().Build()
+	assert.NoError(t, err)
+	defer dflt.Close()
+
+	_, err = dflt.RegisterRequestMulti(ctx, make([][]byte, defaultMaxDimensions))
+	assert.NoError(t, err)
+	_, err = dflt.RegisterRequestMulti(ctx, make([][]byte, defaultMaxDimensions+1))
+	assert.Error(t, err)
+}
+
+func TestReset(t *testing.T) {
+	trkB := NewFairnessTrackerBuilder()
+	trkB.SetLambda(0)
+	trk, err := trkB.Build()
+	assert.NoError(t, err)
+	defer trk.Close()
+
+	ctx := context.Background()
+	id := []byte("client_id")
+
+	for i := 0; i < 30; i++ {
+		_, err = trk.ReportOutcome(ctx, id, request.OutcomeFailure)
+		assert.NoError(t, err)
+	}
+
+	resp, err := trk.RegisterRequest(ctx, id)
+	assert.NoError(t, err)
+	assert.True(t, resp.ShouldThrottle)
+
+	stop := make(chan struct{})
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			_, err := trk.ReportOutcome(ctx, []byte("other_client"), request.OutcomeSuccess)
+			assert.NoError(t, err)
+		}
+	}()
+
+	before := trk.structureIDCounter.Load()
+	for i := 0; i < 10; i++ {
+		trk.Reset()
+	}
+	close(stop)
+	wg.Wait()
+
+	assert.Equal(t, int(trk.structureIDCounter.Load()-before), 20)
+
+	resp, err = trk.RegisterRequest(ctx, id)
+	assert.NoError(t, err)
+	assert.False(t, resp.ShouldThrottle)
+}
+
+func TestRotationDisabled(t *testing.T) {
+	trkB := NewFairnessTrackerBuilder()
+	trkB.SetRotationFrequency(0)
+	trk, err := trkB.Build()
+	assert.NoError(t, err)
+	assert.Nil(t, trk.ticker)
+
+	ctx := context.Background()
+	id := []byte("client_id")
+
+	_, err = trk.RegisterRequest(ctx, id)
+	assert.NoError(t, err)
+	_, err = trk.ReportOutcome(ctx, id, request.OutcomeFailure)
+	assert.NoError(t, err)
+
+	assert.Equal(t, int(trk.structures.Load().dimensions[0].main.GetID()), 1)
+	assert.Equal(t, int(trk.structures.Load().dimensions[0].secondary.GetID()), 2)
+
+	trk.Close()
+
+	conf := config.DefaultFairnessTrackerConfig()
+	conf.RotationFrequency = -1 * time.Second
+	trk, err = NewFairnessTracker(conf)
+	assert.NoError(t, err)
+
+	_, err = trk.DrainAndClose()
+	assert.NoError(t, err)
+}
+
+func TestRotationLogging(t *testing.T) {
+	rec := testutils.NewRecordingLogger()
+	defer logger.SetLogger(logger.GetLogger())
+	logger.SetLogger(rec)
+
+	ticker := utils.NewMockTicker()
+	trk, err := newFairnessTracker(config.DefaultFairnessTrackerConfig(), utils.NewMockClock(time.Unix(1000, 0)), ticker)
+	assert.NoError(t, err)
+	defer trk.Close()
+
+	rotations := make(chan RotationInfo)
+	trk.onRotation = func(info RotationInfo) {
+		rotations <- info
+	}
+	trk.startRotation()
+
+	ticker.Tick()
+	<-rotations
+
+	assert.Equal(t, rec.Lines("Debugf"), []string{"Rotated structures, new structure 3 replaces retired structure 1"})
+	assert.Empty(t, rec.Lines("Infof"))
+
+	trkB := NewFairnessTrackerBuilder()
+	trkB.SetRotationFrequency(0)
+	trk2, err := trkB.Build()
+	assert.NoError(t, err)
+	defer trk2.Close()
+
+	assert.Equal(t, len(rec.Lines("Infof")), 1)
+	assert.Empty(t, rec.Lines("Errorf"))
+}
+
+func TestReportOutcomeDelta(t *testing.T) {
+	trkB := NewFairnessTrackerBuilder()
+	trkB.SetLambda(0)
+	trkB.SetIncludeStats(true)
+	trk, err := trkB.Build()
+	assert.NoError(t, err)
+	defer trk.Close()
+
+	ctx := context.Background()
+	id := []byte("client_id")
+
+	_, err = trk.ReportOutcomeDelta(ctx, id, trk.trackerConfig.Pi/2)
+	assert.NoError(t, err)
+
+	resp, err := trk.RegisterRequest(ctx, id)
+	assert.NoError(t, err)
+	assert.InDelta(t, resp.ResultStats.FinalProbability, trk.trackerConfig.Pi/2, 1e-9)
+
+	resp, err = trk.structures.Load().dimensions[0].secondary.RegisterRequest(ctx, id)
+	assert.NoError(t, err)
+	assert.InDelta(t, resp.ResultStats.FinalProbability, trk.trackerConfig.Pi/2, 1e-9)
+}
+
+func TestTryRegisterRequest(t *testing.T) {
+	trkB := NewFairnessTrackerBuilder()
+	trkB.SetLambda(0)
+	trkB.SetIncludeStats(true)
+	trk, err := trkB.Build()
+	assert.NoError(t, err)
+	defer trk.Close()
+
+	ctx := context.Background()
+	id := []byte("client_id")
+
+	projection, err := trk.TryRegisterRequest(ctx, id, request.OutcomeFailure)
+	assert.NoError(t, err)
+	assert.Equal(t, projection.CurrentProbability, float64(0))
+	assert.InDelta(t, projection.ProjectedProbability, trk.trackerConfig.Pi, 1e-9)
+
+	_, err = trk.ReportOutcome(ctx, id, request.OutcomeFailure)
+	assert.NoError(t, err)
+
+	resp, err := trk.RegisterRequest(ctx, id)
+	assert.NoError(t, err)
+	assert.InDelta(t, resp.ResultStats.FinalProbability, projection.ProjectedProbability, 1e-9)
+}
+
+func TestRequestsDuringRapidRotations(t *testing.T) {
+	trkB := NewFairnessTrackerBuilder()
+	trkB.SetRotationFrequency(config.MinRotationFrequency)
+	trk, err := trkB.Build()
+	assert.NoError(t, err)
+
+	ctx := context.Background()
+	bad := []byte("bad_client")
+	stop := make(chan struct{})
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+
+			good := []byte(fmt.Sprintf("good_client_%d", w))
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				_, err := trk.RegisterRequest(ctx, good)
+				assert.NoError(t, err)
+				_, err = trk.ReportOutcome(ctx, good, request.OutcomeSuccess)
+				assert.NoError(t, err)
+
+				_, err = trk.RegisterRequest(ctx, bad)
+				assert.NoError(t, err)
+				_, err = trk.ReportOutcome(ctx, bad, request.OutcomeFailure)
+				assert.NoError(t, err)
+			}
+		}(w)
+	}
+
+	// Stop the rotation first so the final structures see plenty of requests
+	time.Sleep(200 * time.Millisecond)
+	trk.Close()
+	<-trk.rotationDone
+	time.Sleep(10 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+
+	assert.Greater(t, len(trk.RecentRotations()), 1)
+
+	throttled := func(id []byte) int {
+		n := 0
+		for i := 0; i < 1000; i++ {
+			resp, err := trk.RegisterRequest(ctx, id)
+			assert.NoError(t, err)
+			if resp.ShouldThrottle {
+				n++
+			}
+		}
+		return n
+	}
+
+	assert.Greater(t, throttled(bad), 900)
+	assert.Less(t, throttled([]byte("good_client_0")), 100)
+}
+
+func TestConfig(t *testing.T) {
+	trk, err := NewFairnessTrackerBuilder().BuildWithDefaultConfig()
+	assert.NoError(t, err)
+	defer trk.Close()
+
+	tuned := config.DefaultFairnessTrackerConfig()
+	c := trk.Config()
+	assert.Equal(t, c.L, tuned.L)
+	assert.Equal(t, c.M, tuned.M)
+	assert.Equal(t, c.Pi, tuned.Pi)
+	assert.Equal(t, c.Pd, tuned.Pd)
+	assert.Equal(t, c.Lambda, tuned.Lambda)
+	assert.Equal(t, c.RotationFrequency, tuned.RotationFrequency)
+
+	c.L = 100
+	c.Pi = 1
+	assert.Equal(t, trk.Config().L, tuned.L)
+	assert.Equal(t, trk.Config().Pi, tuned.Pi)
+
+	called := false
+	trk.SetFinalProbabilityFunction(func(buckets []float64) (float64, error) {
+		called = true
+		return buckets[0], nil
+	})
+	_, err = trk.Config().FinalProbabilityFunction([]float64{.5})
+	assert.NoError(t, err)
+	assert.True(t, called)
+}
+
+func TestSetRotationFrequency(t *testing.T) {
+	ticker := utils.NewMockTicker()
+	conf := config.DefaultFairnessTrackerConfig()
+	trk, err := NewFairnessTrackerWithClockAndTicker(conf, utils.NewRealClock(), ticker)
+	assert.NoError(t, err)
+	other, err := NewFairnessTrackerWithClockAndTicker(conf, utils.NewRealClock(), utils.NewMockTicker())
+	assert.NoError(t, err)
+	defer other.Close()
+
+	ctx := context.Background()
+	stop := make(chan struct{})
+	var served atomic.Int64
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			_, err := trk.RegisterRequest(ctx, []byte("client_id"))
+			assert.NoError(t, err)
+			served.Add(1)
+		}
+	}()
+
+	waitServed := func(n int64) {
+		for served.Load() <= n {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	waitServed(0)
+	assert.NoError(t, trk.SetRotationFrequency(time.Hour))
+	assert.NoError(t, trk.SetRotationFrequency(time.Second))
+	assert.Error(t, trk.SetRotationFrequency(0))
+	assert.Error(t, trk.SetRotationFrequency(-time.Second))
+
+	// Requests keep being served after the change
+	waitServed(served.Load())
+	close(stop)
+	wg.Wait()
+
+	assert.Equal(t, ticker.Resets(), []time.Duration{time.Hour, time.Second})
+	assert.Equal(t, trk.Config().RotationFrequency, time.Second)
+	// Only the tracker's own copy of the config changes
+	assert.Equal(t, conf.RotationFrequency, config.DefaultFairnessTrackerConfig().RotationFrequency)
+	assert.Equal(t, other.Config().RotationFrequency, conf.RotationFrequency)
+
+	trk.Close()
+	assert.Error(t, trk.SetRotationFrequency(time.Minute))
+	assert.Equal(t, len(ticker.Resets()), 2)
+
+	trkB := NewFairnessTrackerBuilder()
+	trkB.SetRotationFrequency(0)
+	trk, err = trkB.Build()
+	assert.NoError(t, err)
+	defer trk.Close()
+	assert.Error(t, trk.SetRotationFrequency(time.Minute))
+
+	// A ticker that can't be reset keeps its period
+	plain := struct{ utils.ITicker }{utils.NewMockTicker()}
+	trk, err = NewFairnessTrackerWithClockAndTicker(config.DefaultFairnessTrackerConfig(), utils.NewRealClock(), plain)
+	assert.NoError(t, err)
+	defer trk.Close()
+	assert.Error(t, trk.SetRotationFrequency(time.Minute))
+}
+
+func TestMainStructureAge(t *testing.T) {
+	clk := utils.NewMockClock(time.Unix(1000, 0))
+	ticker := utils.NewMockTicker()
+
+	trk, err := newFairnessTracker(config.DefaultFairnessTrackerConfig(), clk, ticker)
+	assert.NoError(t, err)
+	defer trk.Close()
+
+	rotations := make(chan RotationInfo)
+	trk.onRotation = func(info RotationInfo) {
+		rotations <- info
+	}
+	trk.startRotation()
+
+	assert.Equal(t, trk.MainStructureAge(), time.Duration(0))
+	clk.Advance(time.Minute)
+	assert.Equal(t, trk.MainStructureAge(), time.Minute)
+
+	// The age resets with every rotation even though the promoted structure is older
+	ticker.Tick()
+	<-rotations
+	assert.Equal(t, trk.MainStructureAge(), time.Duration(0))
+	clk.Advance(time.Minute)
+	assert.Equal(t, trk.MainStructureAge(), time.Minute)
+	assert.Equal(t, trk.structures.Load().dimensions[0].main.Age(clk.Now()), 2*time.Minute)
+
+	ticker.Tick()
+	<-rotations
+	assert.Equal(t, trk.MainStructureAge(), time.Duration(0))
+}
+
+func TestRegisterRequestBatch(t *testing.T) {
+	trkB := NewFairnessTrackerBuilder()
+	trkB.SetPi(.5)
+	trkB.SetPd(.01)
+	trkB.SetLambda(0)
+	trk, err := trkB.Build()
+	assert.NoError(t, err)
+	defer trk.Close()
+
+	ctx := context.Background()
+	keys := make([][]byte, 10)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("client_%d", i))
+	}
+
+	// Every odd client is fully throttled
+	for i := 1; i < len(keys); i += 2 {
+		for j := 0; j < 5; j++ {
+			_, err = trk.ReportOutcome(ctx, keys[i], request.OutcomeFailure)
+			assert.NoError(t, err)
+		}
+	}
+
+	results, err := trk.RegisterRequestBatch(ctx, keys)
+	assert.NoError(t, err)
+	assert.Equal(t, len(results), len(keys))
+	for i, resp := range results {
+		assert.Equal(t, resp.ShouldThrottle, i%2 == 1, "key %d", i)
+	}
+
+	results, err = trk.RegisterRequestBatch(ctx, nil)
+	assert.NoError(t, err)
+	assert.Empty(t, results)
+}
+
+func TestEstimateRetryAfter(t *testing.T) {
+	trkB := NewFairnessTrackerBuilder()
+	trkB.SetPi(.5)
+	trkB.SetPd(.01)
+	trkB.SetLambda(.1)
+	trk, err := trkB.Build()
+	assert.NoError(t, err)
+	defer trk.Close()
+
+	ctx := context.Background()
+	id := []byte("client_id")
+
+	d, err := trk.EstimateRetryAfter(ctx, id, .1)
+	assert.NoError(t, err)
+	assert.Equal(t, d, time.Duration(0))
+
+	_, err = trk.ReportOutcome(ctx, id, request.OutcomeFailure)
+	assert.NoError(t, err)
+
+	d, err = trk.EstimateRetryAfter(ctx, id, .1)
+	assert.NoError(t, err)
+	assert.InDelta(t, d.Seconds(), math.Log(5)/.1, .1)
+}
+
+func TestIsBlocked(t *testing.T) {
+	trkB := NewFairnessTrackerBuilder()
+	trkB.SetPi(.2)
+	trkB.SetPd(.05)
+	trkB.SetLambda(0)
+	trk, err := trkB.Build()
+	assert.NoError(t, err)
+	defer trk.Close()
+
+	ctx := context.Background()
+	id := []byte("client_id")
+	assert.False(t, trk.IsBlocked(id))
+
+	// 0.8 is below the default threshold
+	for i := 0; i < 4; i++ {
+		_, err = trk.ReportOutcome(ctx, id, request.OutcomeFailure)
+		assert.NoError(t, err)
+	}
+	assert.False(t, trk.IsBlocked(id))
+
+	_, err = trk.ReportOutcome(ctx, id, request.OutcomeFailure)
+	assert.NoError(t, err)
+	assert.True(t, trk.IsBlocked(id))
+	assert.False(t, trk.IsBlocked([]byte("other_client")))
+
+	_, err = trk.ReportOutcome(ctx, id, request.OutcomeSuccess)
+	assert.NoError(t, err)
+	assert.False(t, trk.IsBlocked(id))
+}
+
+func TestIsBlockedThreshold(t *testing.T) {
+	trkB := NewFairnessTrackerBuilder()
+	trkB.SetPi(.2)
+	trkB.SetPd(.01)
+	trkB.SetLambda(0)
+	trkB.SetBlockThreshold(.5)
+	trk, err := trkB.Build()
+	assert.NoError(t, err)
+	defer trk.Close()
+
+	ctx := context.Background()
+	id := []byte("client_id")
+	for i := 0; i < 3; i++ {
+		_, err = trk.ReportOutcome(ctx, id, request.OutcomeFailure)
+		assert.NoError(t, err)
+	}
+	assert.True(t, trk.IsBlocked(id))
+
+	trkB.SetBlockThreshold(1.5)
+	_, err = trkB.Build()
+	assert.Error(t, err)
+}
+
+func TestSecondaryStats(t *testing.T) {
+	clk := utils.NewMockClock(time.Unix(1000, 0))
+	ticker := utils.NewMockTicker()
+
+	conf := config.DefaultFairnessTrackerConfig()
+	conf.Lambda = 0
+	conf.Pi = .1
+	conf.IncludeStats = true
+	trk, err := newFairnessTracker(conf, clk, ticker)
+	assert.NoError(t, err)
+	defer trk.Close()
+
+	rotations := make(chan RotationInfo)
+	trk.onRotation = func(info RotationInfo) {
+		rotations <- info
+	}
+	trk.startRotation()
+
+	ctx := context.Background()
+	id := []byte("client_id")
+
+	for i := 0; i < 3; i++ {
+		_, err = trk.ReportOutcome(ctx, id, request.OutcomeFailure)
+		assert.NoError(t, err)
+	}
+
+	// After a rotation, the main structure is the old secondary that saw the failures and
+	// the new secondary is seeded from it
+	ticker.Tick()
+	<-rotations
+	_, err = trk.ReportOutcome(ctx, id, request.OutcomeFailure)
+	assert.NoError(t, err)
+
+	resp, err := trk.RegisterRequest(ctx, id)
+	assert.NoError(t, err)
+	stats := resp.ResultStats
+	assert.InDelta(t, stats.FinalProbability, .4, 1e-6)
+	assert.InDelta(t, stats.SecondaryFinalProbability, .4, 1e-6)
+	assert.Equal(t, len(stats.SecondaryBucketProbabilities), int(conf.L))
+	for _, p := range stats.SecondaryBucketProbabilities {
+		assert.Greater(t, p, float64(0))
+	}
+
+	// The main structure makes the decision even when the secondary disagrees
+	trk.structures.Load().dimensions[0].secondary.SetFinalProbabilityFunction(func([]float64) (float64, error) { return 1, nil })
+	resp, err = trk.RegisterRequest(ctx, id)
+	assert.NoError(t, err)
+	assert.Equal(t, resp.ResultStats.SecondaryFinalProbability, float64(1))
+	assert.InDelta(t, resp.ResultStats.FinalProbability, .4, 1e-6)
+}
+
+func TestDumpActiveBuckets(t *testing.T) {
+	clk := utils.NewMockClock(time.Unix(1000, 0))
+
+	trkB := NewFairnessTrackerBuilder()
+	trkB.SetClock(clk)
+	trkB.SetRotationFrequency(0)
+	trkB.SetIncludeStats(true)
+	trkB.SetPi(.1)
+	trk, err := trkB.Build()
+	assert.NoError(t, err)
+	defer trk.Close()
+
+	assert.Empty(t, trk.DumpActiveBuckets())
+
+	ctx := context.Background()
+	id := []byte("client_id")
+	clk.Advance(time.Second)
+	_, err = trk.ReportOutcome(ctx, id, request.OutcomeFailure)
+	assert.NoError(t, err)
+	resp, err := trk.RegisterRequest(ctx, id)
+	assert.NoError(t, err)
+
+	active := trk.DumpActiveBuckets()
+	assert.Equal(t, len(active), len(resp.ResultStats.BucketIndexes))
+	for l, info := range active {
+		assert.Equal(t, int(info.Level), l)
+		assert.Equal(t, int(info.Index), resp.ResultStats.BucketIndexes[l])
+		assert.Equal(t, info.LastUpdatedMs, uint64(1001000))
+		assert.InDelta(t, info.Probability, .1, 1e-6)
+	}
+
+	// The dump is ordered by level and then index
+	for i := 0; i < 50; i++ {
+		_, err = trk.ReportOutcome(ctx, []byte(fmt.Sprintf("client-%d", i)), request.OutcomeFailure)
+		assert.NoError(t, err)
+	}
+	active = trk.DumpActiveBuckets()
+	for i := 1; i < len(active); i++ {
+		prev, cur := active[i-1], active[i]
+		assert.True(t, prev.Level < cur.Level || (prev.Level == cur.Level && prev.Index < cur.Index))
+	}
+}
+
+func TestSeedClient(t *testing.T) {
+	trkB := NewFairnessTrackerBuilder()
+	// No decay between the requests
+	trkB.SetClock(utils.NewMockClock(time.Unix(1000, 0)))
+	trkB.SetIncludeStats(true)
+	trkB.SetRotationFrequency(0)
+	trk, err := trkB.Build()
+	assert.NoError(t, err)
+	defer trk.Close()
+
+	ctx := context.Background()
+	id := []byte("client_id")
+
+	trk.SeedClient(id, 1.5)
+	for i := 0; i < 10; i++ {
+		resp, err := trk.RegisterRequest(ctx, id)
+		assert.NoError(t, err)
+		assert.True(t, resp.ShouldThrottle)
+		assert.Equal(t, resp.ResultStats.FinalProbability, float64(1))
+		assert.Equal(t, resp.ResultStats.SecondaryFinalProbability, float64(1))
+	}
+
+	trk.SeedClient(id, -1)
+	resp, err := trk.RegisterRequest(ctx, id)
+	assert.NoError(t, err)
+	assert.False(t, resp.ShouldThrottle)
+	assert.Equal(t, resp.ResultStats.FinalProbability, float64(0))
+}
+
+func TestRotationHealthy(t *testing.T) {
+	clk := utils.NewMockClock(time.Unix(1000, 0))
+	ticker := utils.NewMockTicker()
+	rotations := make(chan RotationInfo)
+
+	trkB := NewFairnessTrackerBuilder()
+	trkB.SetClock(clk)
+	trkB.SetTicker(ticker)
+	trkB.SetRotationFrequency(time.Minute)
+	trkB.SetOnRotation(func(info RotationInfo) {
+		rotations <- info
+	})
+	trk, err := trkB.Build()
+	assert.NoError(t, err)
+
+	assert.True(t, trk.RotationHealthy(0))
+	assert.Equal(t, trk.lastRotationUnixMs.Load(), int64(1000000))
+
+	// The rotation is overdue
+	clk.Advance(3 * time.Minute)
+	assert.False(t, trk.RotationHealthy(0))
+
+	ticker.Tick()
+	<-rotations
+	assert.Equal(t, trk.lastRotationUnixMs.Load(), int64(1180000))
+	assert.True(t, trk.RotationHealthy(0))
+
+	// A tighter staleness bound than twice the frequency
+	clk.Advance(30 * time.Second)
+	assert.True(t, trk.RotationHealthy(0))
+	assert.False(t, trk.RotationHealthy(10*time.Second))
+
+	trk.Close()
+	assert.False(t, trk.RotationHealthy(0))
+
+	trkB = NewFairnessTrackerBuilder()
+	trkB.SetRotationFrequency(0)
+	trk, err = trkB.Build()
+	assert.NoError(t, err)
+	defer trk.Close()
+	assert.True(t, trk.RotationHealthy(time.Nanosecond))
+}
+
+func TestReportOutcomeToStructure(t *testing.T) {
+	clk := utils.NewMockClock(time.Unix(1000, 0))
+	ticker := utils.NewMockTicker()
+	rotations := make(chan RotationInfo)
+
+	trkB := NewFairnessTrackerBuilder()
+	trkB.SetClock(clk)
+	trkB.SetTicker(ticker)
+	trkB.SetPi(.1)
+	trkB.SetOnRotation(func(info RotationInfo) {
+		rotations <- info
+	})
+	trk, err := trkB.Build()
+	assert.NoError(t, err)
+	defer trk.Close()
+
+	ctx := context.Background()
+	id := []byte("client_id")
+	probability := func(s *data.Structure) float64 {
+		resp, err := s.TryRegisterRequest(ctx, id, request.OutcomeSuccess)
+		assert.NoError(t, err)
+		return resp.CurrentProbability
+	}
+
+	// Only the secondary structure changes
+	_, err = trk.ReportOutcomeToStructure(ctx, 2, id, request.OutcomeFailure)
+	assert.NoError(t, err)
+	d := trk.structures.Load().dimensions[0]
+	assert.Equal(t, probability(d.main), float64(0))
+	assert.InDelta(t, probability(d.secondary), .1, 1e-9)
+
+	// Structure 1 is rotated out, so reporting to it is a no-op
+	ticker.Tick()
+	<-rotations
+	_, err = trk.ReportOutcomeToStructure(ctx, 1, id, request.OutcomeFailure)
+	assert.NoError(t, err)
+	d = trk.structures.Load().dimensions[0]
+	assert.InDelta(t, probability(d.main), .1, 1e-9)
+	// The new secondary structure only carries the probability forward from the main one
+	assert.InDelta(t, probability(d.secondary), .1, 1e-9)
+	for _, lvl := range d.secondary.State().Buckets {
+		for _, b := range lvl {
+			assert.Equal(t, b.Probability, float64(0))
+		}
+	}
+}
+
+func TestRequestMeta(t *testing.T) {
+	trkB := NewFairnessTrackerBuilder()
+	trkB.SetIncludeStats(true)
+	trk, err := trkB.Build()
+	assert.NoError(t, err)
+	defer trk.Close()
+
+	id := []byte("client_id")
+
+	ctx := request.WithRequestMeta(context.Background(), "request-42")
+	resp, err := trk.RegisterRequest(ctx, id)
+	assert.NoError(t, err)
+	assert.Equal(t, resp.ResultStats.RequestMeta, "request-42")
+
+	resp, err = trk.RegisterRequest(context.Background(), id)
+	assert.NoError(t, err)
+	assert.Nil(t, resp.ResultStats.RequestMeta)
+}
+
+func TestAdaptiveFailureRateSurvivesRotation(t *testing.T) {
+	trkB := NewFairnessTrackerBuilder()
+	trkB.SetAdaptiveMode(true)
+	trkB.SetLambda(0)
+	trkB.SetRotationFrequency(0)
+	trkB.SetIncludeStats(true)
+	trk, err := trkB.Build()
+	assert.NoError(t, err)
+	defer trk.Close()
+
+	ctx := context.Background()
+	var expected data.FailureRate
+	for i := 0; i < 50; i++ {
+		_, err = trk.ReportOutcome(ctx, []byte("bad"), request.OutcomeFailure)
+		assert.NoError(t, err)
+		expected.Add(request.OutcomeFailure)
+	}
+	// Every outcome counts once even though it updates both structures
+	assert.Equal(t, trk.failureRate.Rate(), expected.Rate())
+
+	// The rate survives the rotation, so the failures of a new flow are scaled down right away
+	assert.NoError(t, trk.RotateNow())
+	_, err = trk.ReportOutcome(ctx, []byte("fresh"), request.OutcomeFailure)
+	assert.NoError(t, err)
+	expected.Add(request.OutcomeFailure)
+
+	resp, err := trk.RegisterRequest(ctx, []byte("fresh"))
+	assert.NoError(t, err)
+	assert.InDelta(t, resp.ResultStats.FinalProbability, trk.Config().Pi*(1-expected.Rate()), 1e-9)
+}
+
+func TestRotateNow(t *testing.T) {
+	var rotations []RotationInfo
+
+	trkB := NewFairnessTrackerBuilder()
+	trkB.SetRotationFrequency(0)
+	trkB.SetOnRotation(func(info RotationInfo) {
+		rotations = append(rotations, info)
+	})
+	trk, err := trkB.Build()
+	assert.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		before := trk.structures.Load().dimensions[0]
+
+		assert.NoError(t, trk.RotateNow())
+
+		after := trk.structures.Load().dimensions[0]
+		assert.Equal(t, after.main.GetID(), before.main.GetID()+1)
+		assert.Equal(t, after.secondary.GetID(), before.secondary.GetID()+1)
+		assert.Equal(t, after.main, before.secondary)
+	}
+	assert.Equal(t, len(rotations), 3)
+	assert.Equal(t, len(trk.RecentRotations()), 3)
+
+	trk.Close()
+	assert.Error(t, trk.RotateNow())
+}
+
+func TestAggregateStats(t *testing.T) {
+	trkB := NewFairnessTrackerBuilder()
+	trkB.SetRotationFrequency(0)
+	trk, err := trkB.Build()
+	assert.NoError(t, err)
+	defer trk.Close()
+
+	stats := trk.AggregateStats()
+	assert.Equal(t, stats.Secondary.ID, stats.Main.ID+1)
+	assert.Equal(t, int(stats.Total.Buckets), 6000)
+	assert.Equal(t, int(stats.Total.NonZeroBuckets), 0)
+
+	ctx := context.Background()
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			_, err := trk.ReportOutcome(ctx, []byte(fmt.Sprintf("client-%d", i%100)), request.OutcomeFailure)
+			assert.NoError(t, err)
+		}
+	}()
+
+	deadline := time.Now().Add(100 * time.Millisecond)
+	for time.Now().Before(deadline) {
+		assert.NoError(t, trk.RotateNow())
+		stats = trk.AggregateStats()
+		assert.Equal(t, stats.Secondary.ID, stats.Main.ID+1)
+		assert.GreaterOrEqual(t, stats.Main.Age, time.Duration(0))
+		assert.Equal(t, stats.Total.NonZeroBuckets, stats.Main.Occupancy.NonZeroBuckets+stats.Secondary.Occupancy.NonZeroBuckets)
+		assert.LessOrEqual(t, stats.Total.MaxProbability, float64(1))
+		assert.LessOrEqual(t, stats.Total.MeanProbability, stats.Total.MaxProbability)
+	}
+	close(stop)
+	<-done
+
+	_, err = trk.ReportOutcome(ctx, []byte("client_id"), request.OutcomeFailure)
+	assert.NoError(t, err)
+	stats = trk.AggregateStats()
+	assert.Greater(t, int(stats.Total.NonZeroBuckets), 0)
+	assert.Greater(t, stats.Total.MaxProbability, float64(0))
+}
+
+func TestExplain(t *testing.T) {
+	// A frozen clock, so the seeded probability doesn't decay before it's read
+	trkB := NewFairnessTrackerBuilder()
+	trkB.SetClock(utils.NewMockClock(time.Unix(1000, 0)))
+	trk, err := trkB.BuildWithDefaultConfig()
+	assert.NoError(t, err)
+	defer trk.Close()
+
+	ctx := context.Background()
+	id := []byte("client_id")
+	trk.SeedClient(id, 1)
+
+	e, err := trk.Explain(id)
+	assert.NoError(t, err)
+	assert.Equal(t, e.StructureID, trk.structures.Load().dimensions[0].main.GetID())
+	assert.Equal(t, e.FinalProbability, float64(1))
+	assert.True(t, e.Blocked)
+
+	resp, err := trk.RegisterRequest(ctx, id)
+	assert.NoError(t, err)
+	assert.True(t, resp.ShouldThrottle)
+}
+
+func TestDecaySweeper(t *testing.T) {
+	trkB := NewFairnessTrackerBuilder()
+	trkB.SetRotationFrequency(0)
+	trkB.SetLambda(20)
+	trkB.SetPi(.5)
+	trkB.SetDecaySweepInterval(5 * time.Millisecond)
+	trk, err := trkB.Build()
+	assert.NoError(t, err)
+	defer trk.Close()
+
+	_, err = trk.ReportOutcome(context.Background(), []byte("client_id"), request.OutcomeFailure)
+	assert.NoError(t, err)
+
+	// The stored probabilities decay without any request touching the buckets
+	maxStored := func() float64 {
+		var maxP float64
+		for _, lvl := range trk.structures.Load().dimensions[0].main.State().Buckets {
+			for _, b := range lvl {
+				maxP = math.Max(maxP, b.Probability)
+			}
+		}
+		return maxP
+	}
+	assert.Eventually(t, func() bool { return maxStored() < .25 }, time.Second, 5*time.Millisecond)
+
+	trkB = NewFairnessTrackerBuilder()
+	trkB.SetDecaySweepInterval(time.Microsecond)
+	_, err = trkB.Build()
+	assert.Error(t, err)
+
+	// The eviction needs the sweeper
+	trkB = NewFairnessTrackerBuilder()
+	trkB.SetMaxBucketAge(time.Minute)
+	_, err = trkB.Build()
+	assert.Error(t, err)
+}
+
+func TestCloseJoinsSweeper(t *testing.T) {
+	trkB := NewFairnessTrackerBuilder()
+	trkB.SetRotationFrequency(0)
+	trkB.SetDecaySweepInterval(5 * time.Millisecond)
+	trk, err := trkB.Build()
+	assert.NoError(t, err)
+
+	// The sweeper has exited once Close returns
+	trk.Close()
+	select {
+	case <-trk.sweeperDone:
+	default:
+		t.Fatal("the sweeper is still running after Close")
+	}
+}
+
+func TestReportOutcomeWeightedBatch(t *testing.T) {
+	newTracker := func() *FairnessTracker {
+		trkB := NewFairnessTrackerBuilder()
+		trkB.SetClock(utils.NewMockClock(time.Unix(1000, 0)))
+		trkB.SetTicker(utils.NewMockTicker())
+		trkB.SetMurmurSeed(42)
+		trkB.SetPi(.1)
+		trkB.SetPd(.01)
+		trk, err := trkB.Build()
+		assert.NoError(t, err)
+		return trk
+	}
+	batched, individual := newTracker(), newTracker()
+	defer batched.Close()
+	defer individual.Close()
+
+	ctx := context.Background()
+	items := []request.WeightedOutcomeItem{
+		{ClientIdentifier: []byte("a"), Outcome: request.OutcomeFailure, Weight: 2},
+		{ClientIdentifier: []byte("b"), Outcome: request.OutcomeFailure, Weight: .5},
+		{ClientIdentifier: []byte("a"), Outcome: request.OutcomeSuccess, Weight: 3},
+		{ClientIdentifier: []byte("c"), Outcome: request.OutcomeFailure, Weight: 0},
+		{ClientIdentifier: []byte("b"), Outcome: request.OutcomeFailure, Weight: 20},
+	}
+
+	_, err := batched.ReportOutcomeWeightedBatch(ctx, items)
+	assert.NoError(t, err)
+	for _, item := range items {
+		_, err := individual.ReportOutcomeWeightedBatch(ctx, []request.WeightedOutcomeItem{item})
+		assert.NoError(t, err)
+	}
+
+	for _, id := range []string{"a", "b", "c"} {
+		expected, err := individual.Explain([]byte(id))
+		assert.NoError(t, err)
+		actual, err := batched.Explain([]byte(id))
+		assert.NoError(t, err)
+		assert.Equal(t, actual.FinalProbability, expected.FinalProbability, "client %s", id)
+	}
+
+	explanation, err := batched.Explain([]byte("a"))
+	assert.NoError(t, err)
+	assert.InDelta(t, explanation.FinalProbability, .2-.03, 1e-9)
+	// Clamped to 1
+	explanation, err = batched.Explain([]byte("b"))
+	assert.NoError(t, err)
+	assert.Equal(t, explanation.FinalProbability, float64(1))
+
+	// Nothing is applied if any weight is negative
+	_, err = batched.ReportOutcomeWeightedBatch(ctx, []request.WeightedOutcomeItem{
+		{ClientIdentifier: []byte("c"), Outcome: request.OutcomeFailure, Weight: 1},
+		{ClientIdentifier: []byte("c"), Outcome: request.OutcomeFailure, Weight: -1},
+	})
+	assert.Error(t, err)
+	explanation, err = batched.Explain([]byte("c"))
+	assert.NoError(t, err)
+	assert.Equal(t, explanation.FinalProbability, float64(0))
+}
+
+func TestStructureLifecycleCallbacks(t *testing.T) {
+	ticker := utils.NewMockTicker()
+	created := make(chan uint64, 10)
+	retired := make(chan uint64, 10)
+
+	trkB := NewFairnessTrackerBuilder()
+	trkB.SetTicker(ticker)
+	trkB.SetStructureLifecycleCallbacks(
+		func(id uint64) { created <- id },
+		func(id uint64) { retired <- id },
+	)
+	trk, err := trkB.Build()
+	assert.NoError(t, err)
+	defer trk.Close()
+
+	var lastCreated, lastRetired uint64
+	for i := 0; i < 5; i++ {
+		ticker.Tick()
+
+		c, r := <-created, <-retired
+		assert.Greater(t, c, lastCreated)
+		assert.Greater(t, r, lastRetired)
+		// The retired structure is always older than the one created
+		assert.Less(t, r, c)
+		lastCreated, lastRetired = c, r
+	}
+	assert.Equal(t, lastCreated, uint64(7))
+	assert.Equal(t, lastRetired, uint64(5))
+
+	// Nil callbacks are fine
+	trkB.SetStructureLifecycleCallbacks(nil, nil)
+	trk2, err := trkB.Build()
+	assert.NoError(t, err)
+	defer trk2.Close()
+	assert.NoError(t, trk2.RotateNow())
+}
+
+func TestRotationJitter(t *testing.T) {
+	ticker := utils.NewMockTicker()
+
+	trkB := NewFairnessTrackerBuilder()
+	trkB.SetTicker(ticker)
+	trkB.SetRotationFrequency(time.Minute)
+	trkB.SetRotationJitter(10 * time.Second)
+	trk, err := trkB.Build()
+	assert.NoError(t, err)
+	defer trk.Close()
+
+	// The first rotation is jittered too
+	assert.Len(t, ticker.Resets(), 1)
+	for i := 0; i < 20; i++ {
+		ticker.Tick()
+	}
+	assert.Eventually(t, func() bool { return len(ticker.Resets()) == 21 }, time.Second, time.Millisecond)
+
+	distinct := make(map[time.Duration]bool)
+	for _, d := range ticker.Resets() {
+		assert.GreaterOrEqual(t, d, 50*time.Second)
+		assert.LessOrEqual(t, d, 70*time.Second)
+		distinct[d] = true
+	}
+	assert.Greater(t, len(distinct), 1)
+
+	// Without jitter the ticker is never reset
+	ticker = utils.NewMockTicker()
+	trkB.SetTicker(ticker)
+	trkB.SetRotationJitter(0)
+	trk2, err := trkB.Build()
+	assert.NoError(t, err)
+	defer trk2.Close()
+	ticker.Tick()
+	assert.NoError(t, trk2.RotateNow())
+	assert.Empty(t, ticker.Resets())
+
+	trkB.SetRotationJitter(time.Minute)
+	_, err = trkB.Build()
+	assert.Error(t, err)
+}
+
+func TestColdSecondary(t *testing.T) {
+	trkB := NewFairnessTrackerBuilder()
+	trkB.SetRotationFrequency(0)
+	trkB.SetIncludeStats(true)
+	trkB.SetWarmSecondary(false)
+	trk, err := trkB.Build()
+	assert.NoError(t, err)
+	defer trk.Close()
+
+	ctx := context.Background()
+	id := []byte("client_id")
+	for i := 0; i < 10; i++ {
+		_, err = trk.RegisterRequest(ctx, id)
+		assert.NoError(t, err)
+		_, err = trk.ReportOutcome(ctx, id, request.OutcomeFailure)
+		assert.NoError(t, err)
+	}
+	_, err = trk.ReportOutcomeDelta(ctx, id, .1)
+	assert.NoError(t, err)
+
+	d := trk.structures.Load().dimensions[0]
+	assert.Greater(t, d.main.Occupancy()[0].NonZeroBuckets, uint32(0))
+	for _, occ := range d.secondary.Occupancy() {
+		assert.Equal(t, occ.NonZeroBuckets, uint32(0))
+	}
+
+	// Kept warm by default
+	trkB.SetWarmSecondary(true)
+	trk2, err := trkB.Build()
+	assert.NoError(t, err)
+	defer trk2.Close()
+	_, err = trk2.ReportOutcome(ctx, id, request.OutcomeFailure)
+	assert.NoError(t, err)
+	assert.Greater(t, trk2.structures.Load().dimensions[0].secondary.Occupancy()[0].NonZeroBuckets, uint32(0))
+}
+
+func TestMaxThrottlesPerSecond(t *testing.T) {
+	clk := utils.NewMockClock(time.Unix(1000, 0))
+
+	trkB := NewFairnessTrackerBuilder()
+	trkB.SetClock(clk)
+	trkB.SetTicker(utils.NewMockTicker())
+	trkB.SetPi(.6)
+	trkB.SetLambda(0)
+	trkB.SetMaxThrottlesPerSecond(5)
+	trk, err := trkB.Build()
+	assert.NoError(t, err)
+	defer trk.Close()
+
+	// Every request of the client should be throttled
+	ctx := context.Background()
+	id := []byte("client_id")
+	for i := 0; i < 2; i++ {
+		_, err = trk.ReportOutcome(ctx, id, request.OutcomeFailure)
+		assert.NoError(t, err)
+	}
+
+	throttled := func(n int) int {
+		var count int
+		for i := 0; i < n; i++ {
+			resp, err := trk.RegisterRequest(ctx, id)
+			assert.NoError(t, err)
+			if resp.ShouldThrottle {
+				count++
+			}
+		}
+		return count
+	}
+
+	assert.Equal(t, throttled(100), 5)
+	clk.Advance(time.Second)
+	assert.Equal(t, throttled(100), 5)
+	clk.Advance(200 * time.Millisecond)
+	assert.Equal(t, throttled(100), 1)
+	// The budget doesn't accumulate beyond a second
+	clk.Advance(time.Minute)
+	assert.Equal(t, throttled(100), 5)
+}
+
+func TestMaxThrottlesPerSecondBelowOne(t *testing.T) {
+	clk := utils.NewMockClock(time.Unix(1000, 0))
+
+	trkB := NewFairnessTrackerBuilder()
+	trkB.SetClock(clk)
+	trkB.SetTicker(utils.NewMockTicker())
+	trkB.SetPi(.6)
+	trkB.SetLambda(0)
+	trkB.SetMaxThrottlesPerSecond(.5)
+	trk, err := trkB.Build()
+	assert.NoError(t, err)
+	defer trk.Close()
+
+	ctx := context.Background()
+	id := []byte("client_id")
+	for i := 0; i < 2; i++ {
+		_, err = trk.ReportOutcome(ctx, id, request.OutcomeFailure)
+		assert.NoError(t, err)
+	}
+
+	throttled := func(n int) int {
+		var count int
+		for i := 0; i < n; i++ {
+			resp, err := trk.RegisterRequest(ctx, id)
+			assert.NoError(t, err)
+			if resp.ShouldThrottle {
+				count++
+			}
+		}
+		return count
+	}
+
+	// One throttle every 2 seconds, never more after a quiet period
+	assert.Equal(t, throttled(100), 1)
+	clk.Advance(time.Second)
+	assert.Equal(t, throttled(100), 0)
+	clk.Advance(time.Second)
+	assert.Equal(t, throttled(100), 1)
+	clk.Advance(time.Minute)
+	assert.Equal(t, throttled(100), 1)
+
+	// A multi-dimensional request let through by the exhausted budget doesn't say to
+	// throttle in any dimension
+	multi, err := trk.RegisterRequestMulti(ctx, [][]byte{id})
+	assert.NoError(t, err)
+	assert.False(t, multi.ShouldThrottle)
+	assert.False(t, multi.Dimensions[0].ShouldThrottle)
+
+	trkB.SetMaxThrottlesPerSecond(-1)
+	_, err = trkB.Build()
+	assert.Error(t, err)
+}
+
+func TestTrustedClients(t *testing.T) {
+	trkB := NewFairnessTrackerBuilder()
+	trkB.SetTicker(utils.NewMockTicker())
+	trkB.SetPi(.6)
+	trkB.SetLambda(0)
+	trk, err := trkB.Build()
+	assert.NoError(t, err)
+	defer trk.Close()
+
+	ctx := context.Background()
+	id := []byte("client_id")
+	throttled := func() int {
+		var count int
+		for i := 0; i < 100; i++ {
+			resp, err := trk.RegisterRequest(ctx, id)
+			assert.NoError(t, err)
+			if resp.ShouldThrottle {
+				count++
+			}
+		}
+		return count
+	}
+
+	trk.AddTrusted(id)
+	// The outcomes are still applied while the client is trusted
+	for i := 0; i < 2; i++ {
+		_, err = trk.ReportOutcome(ctx, id, request.OutcomeFailure)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, throttled(), 0)
+
+	batch, err := trk.RegisterRequestBatch(ctx, [][]byte{id, id})
+	assert.NoError(t, err)
+	assert.False(t, batch[0].ShouldThrottle || batch[1].ShouldThrottle)
+
+	multi, err := trk.RegisterRequestMulti(ctx, [][]byte{[]byte("tenant"), id})
+	assert.NoError(t, err)
+	assert.False(t, multi.ShouldThrottle)
+	assert.Equal(t, len(multi.Dimensions), 2)
+
+	trk.RemoveTrusted(id)
+	assert.Equal(t, throttled(), 100)
+
+	// Adding and removing concurrently with the requests is safe
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				trk.AddTrusted(id)
+				_, err := trk.RegisterRequest(ctx, id)
+				assert.NoError(t, err)
+				trk.RemoveTrusted(id)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, throttled(), 100)
+}
+
+func TestBlockedClients(t *testing.T) {
+	trkB := NewFairnessTrackerBuilder()
+	trkB.SetTicker(utils.NewMockTicker())
+	trkB.SetPi(.6)
+	trkB.SetLambda(0)
+	trkB.SetMaxThrottlesPerSecond(1)
+	trk, err := trkB.Build()
+	assert.NoError(t, err)
+	defer trk.Close()
+
+	ctx := context.Background()
+	id := []byte("client_id")
+	throttled := func() int {
+		var count int
+		for i := 0; i < 100; i++ {
+			resp, err := trk.RegisterRequest(ctx, id)
+			assert.NoError(t, err)
+			if resp.ShouldThrottle {
+				count++
+			}
+		}
+		return count
+	}
+
+	// Blocking overrides the probabilities and the throttle budget
+	trk.AddBlocked(id)
+	assert.Equal(t, throttled(), 100)
+
+	batch, err := trk.RegisterRequestBatch(ctx, [][]byte{[]byte("other"), id})
+	assert.NoError(t, err)
+	assert.False(t, batch[0].ShouldThrottle)
+	assert.True(t, batch[1].ShouldThrottle)
+
+	multi, err := trk.RegisterRequestMulti(ctx, [][]byte{[]byte("tenant"), id})
+	assert.NoError(t, err)
+	assert.True(t, multi.ShouldThrottle)
+
+	// Trusting the client takes precedence
+	trk.AddTrusted(id)
+	assert.Equal(t, throttled(), 0)
+	trk.RemoveTrusted(id)
+
+	// Unblocking restores the probabilistic throttling of the untouched buckets
+	trk.RemoveBlocked(id)
+	assert.Equal(t, throttled(), 0)
+	for i := 0; i < 2; i++ {
+		_, err = trk.ReportOutcome(ctx, id, request.OutcomeFailure)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, throttled(), 1)
+}
+
+func TestEstimatedFalsePositiveRate(t *testing.T) {
+	conf := config.DefaultFairnessTrackerConfig()
+	conf.L = 3
+	conf.M = 4
+	conf.Lambda = 0
+
+	level := func(probabilities ...float64) []data.BucketState {
+		buckets := make([]data.BucketState, len(probabilities))
+		for i, p := range probabilities {
+			buckets[i] = data.BucketState{Probability: p}
+		}
+		return buckets
+	}
+	state := &TrackerState{
+		Config: conf,
+		Main: &data.StructureState{
+			ID:     1,
+			Config: conf,
+			Buckets: [][]data.BucketState{
+				level(.5, 0, .1, 0),
+				level(0, 0, 1, 0),
+				level(.2, .3, .4, 0),
+			},
+		},
+	}
+
+	trk, err := newFairnessTrackerFromState(state, utils.NewRealClock(), utils.NewMockTicker())
+	assert.NoError(t, err)
+	defer trk.Close()
+
+	assert.InDelta(t, trk.EstimatedFalsePositiveRate(), 2./4*1./4*3./4, 1e-9)
+
+	// No collision is possible while a level is empty
+	trk.Reset()
+	assert.Equal(t, trk.EstimatedFalsePositiveRate(), 0.)
+}
+
+func TestExportImport(t *testing.T) {
+	newTracker := func() *FairnessTracker {
+		trkB := NewFairnessTrackerBuilder()
+		trkB.SetTicker(utils.NewMockTicker())
+		trkB.SetLambda(0)
+		trk, err := trkB.Build()
+		assert.NoError(t, err)
+		return trk
+	}
+	trk := newTracker()
+	defer trk.Close()
+	other := newTracker()
+	defer other.Close()
+
+	ctx := context.Background()
+	id := []byte("client_id")
+	for i := 0; i < 30; i++ {
+		_, err := trk.ReportOutcome(ctx, id, request.OutcomeFailure)
+		assert.NoError(t, err)
+	}
+
+	var src, dst request.Tracker = trk, other
+	state, err := src.Export()
+	assert.NoError(t, err)
+
+	before := other.GetID()
+	assert.NoError(t, dst.Import(state))
+	// The imported structures get fresh IDs from the importing tracker
+	assert.NotEqual(t, other.GetID(), before)
+	assert.Equal(t, other.State().Main.Buckets, trk.State().Main.Buckets)
+	assert.Equal(t, other.State().Secondary.Buckets, trk.State().Secondary.Buckets)
+
+	resp, err := dst.RegisterRequest(ctx, id)
+	assert.NoError(t, err)
+	assert.True(t, resp.ShouldThrottle)
+
+	assert.Error(t, dst.Import([]byte("{}")))
+}
+
+func TestProbabilityHistogram(t *testing.T) {
+	conf := config.DefaultFairnessTrackerConfig()
+	conf.L = 2
+	conf.M = 5
+	conf.Lambda = 0
+
+	level := func(probabilities ...float64) []data.BucketState {
+		buckets := make([]data.BucketState, len(probabilities))
+		for i, p := range probabilities {
+			buckets[i] = data.BucketState{Probability: p}
+		}
+		return buckets
+	}
+	state := &TrackerState{
+		Config: conf,
+		Main: &data.StructureState{
+			ID:     1,
+			Config: conf,
+			Buckets: [][]data.BucketState{
+				level(0, .05, .1, .45, 1),
+				level(0, 0, .3, .99, .5),
+			},
+		},
+	}
+
+	trk, err := newFairnessTrackerFromState(state, utils.NewRealClock(), utils.NewMockTicker())
+	assert.NoError(t, err)
+	defer trk.Close()
+
+	assert.Equal(t, trk.ProbabilityHistogram(10), []uint64{4, 1, 0, 1, 1, 1, 0, 0, 0, 2})
+	assert.Equal(t, trk.ProbabilityHistogram(2), []uint64{7, 3})
+	assert.Equal(t, trk.ProbabilityHistogram(1), []uint64{10})
+	assert.Nil(t, trk.ProbabilityHistogram(0))
+}
+
+func TestCounters(t *testing.T) {
+	trkB := NewFairnessTrackerBuilder()
+	trkB.SetTicker(utils.NewMockTicker())
+	trkB.SetPi(.6)
+	trkB.SetLambda(0)
+	trk, err := trkB.Build()
+	assert.NoError(t, err)
+	defer trk.Close()
+
+	ctx := context.Background()
+	bad := []byte("bad_client")
+	good := []byte("good_client")
+
+	// Every request of the bad client is throttled and none of the good one
+	for i := 0; i < 2; i++ {
+		_, err = trk.ReportOutcome(ctx, bad, request.OutcomeFailure)
+		assert.NoError(t, err)
+	}
+	for i := 0; i < 5; i++ {
+		_, err = trk.RegisterRequest(ctx, bad)
+		assert.NoError(t, err)
+		_, err = trk.RegisterRequest(ctx, good)
+		assert.NoError(t, err)
+	}
+	_, err = trk.RegisterRequestBatch(ctx, [][]byte{bad, good})
+	assert.NoError(t, err)
+	_, err = trk.RegisterRequestMulti(ctx, [][]byte{good, bad})
+	assert.NoError(t, err)
+	_, err = trk.ReportOutcomeWeightedBatch(ctx, []request.WeightedOutcomeItem{
+		{ClientIdentifier: good, Outcome: request.OutcomeSuccess, Weight: 1},
+		{ClientIdentifier: good, Outcome: request.OutcomeSuccess, Weight: 1},
+	})
+	assert.NoError(t, err)
+
+	assert.Equal(t, trk.Counters(), TrackerCounters{Requests: 13, Throttled: 6, Outcomes: 4})
+}
+
+func TestDryRun(t *testing.T) {
+	trkB := NewFairnessTrackerBuilder()
+	trkB.SetTicker(utils.NewMockTicker())
+	trkB.SetPi(.6)
+	trkB.SetLambda(0)
+	trkB.SetIncludeStats(true)
+	trkB.SetBackoffBase(time.Second)
+	trkB.SetDryRun(true)
+	trk, err := trkB.Build()
+	assert.NoError(t, err)
+	defer trk.Close()
+
+	ctx := context.Background()
+	bad := []byte("bad_client")
+	for i := 0; i < 2; i++ {
+		_, err = trk.ReportOutcome(ctx, bad, request.OutcomeFailure)
+		assert.NoError(t, err)
+	}
+
+	// The decisions are computed but every request is let through
+	for i := 0; i < 5; i++ {
+		resp, err := trk.RegisterRequest(ctx, bad)
+		assert.NoError(t, err)
+		assert.False(t, resp.ShouldThrottle)
+		assert.Equal(t, resp.SuggestedBackoff, time.Duration(0))
+		assert.Equal(t, resp.ResultStats.FinalProbability, 1.)
+	}
+	results, err := trk.RegisterRequestBatch(ctx, [][]byte{bad, []byte("good_client")})
+	assert.NoError(t, err)
+	assert.False(t, results[0].ShouldThrottle)
+	multi, err := trk.RegisterRequestMulti(ctx, [][]byte{bad})
+	assert.NoError(t, err)
+	assert.False(t, multi.ShouldThrottle)
+	assert.False(t, multi.Dimensions[0].ShouldThrottle)
+	assert.Equal(t, multi.Dimensions[0].SuggestedBackoff, time.Duration(0))
+
+	// Even the blocked keys
+	trk.AddBlocked([]byte("blocked_client"))
+	resp, err := trk.RegisterRequest(ctx, []byte("blocked_client"))
+	assert.NoError(t, err)
+	assert.False(t, resp.ShouldThrottle)
+
+	assert.Equal(t, trk.Counters(), TrackerCounters{Requests: 9, WouldThrottle: 8, Outcomes: 2})
+}
+
+func TestRegisterRequestReadOnly(t *testing.T) {
+	trkB := NewFairnessTrackerBuilder()
+	trkB.SetTicker(utils.NewMockTicker())
+	trkB.SetPi(.6)
+	trkB.SetLambda(0)
+	trkB.SetIncludeStats(true)
+	trk, err := trkB.Build()
+	assert.NoError(t, err)
+	defer trk.Close()
+
+	ctx := context.Background()
+	id := []byte("client_id")
+	for i := 0; i < 2; i++ {
+		_, err = trk.ReportOutcome(ctx, id, request.OutcomeFailure)
+		assert.NoError(t, err)
+	}
+
+	// The decision matches the main structure and the secondary one isn't consulted
+	resp, err := trk.RegisterRequestReadOnly(ctx, id)
+	assert.NoError(t, err)
+	assert.True(t, resp.ShouldThrottle)
+	assert.Equal(t, resp.ResultStats.FinalProbability, 1.)
+	assert.Nil(t, resp.ResultStats.SecondaryBucketProbabilities)
+
+	resp, err = trk.RegisterRequest(ctx, id)
+	assert.NoError(t, err)
+	assert.Equal(t, resp.ResultStats.FinalProbability, 1.)
+	assert.NotNil(t, resp.ResultStats.SecondaryBucketProbabilities)
+	assert.Equal(t, trk.Counters().Requests, uint64(2))
 }
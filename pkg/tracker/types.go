@@ -4,12 +4,97 @@ import (
 	"time"
 
 	"github.com/satmihir/fair/pkg/config"
+	"github.com/satmihir/fair/pkg/data"
 	"github.com/satmihir/fair/pkg/utils"
 )
 
+const (
+	// The number of recent rotations a FairnessTracker keeps
+	recentRotationsToKeep = 16
+	// The max number of dimensions of the multi-dimensional requests if not configured
+	defaultMaxDimensions = 8
+)
+
+// Information about a rotation of the underlying structures
+type RotationInfo struct {
+	// The time of the rotation
+	At time.Time
+	// The ID of the structure that was created as the new secondary structure
+	NewStructureID uint64
+	// The ID of the main structure that was retired
+	RetiredStructureID uint64
+}
+
+// The main and secondary structures tracking one flow dimension
+type dimension struct {
+	main      *data.Structure
+	secondary *data.Structure
+	// The time the main structure became the main one, by creation or by a rotation
+	promotedAt time.Time
+}
+
+// The stats of a structure returned by FairnessTracker.AggregateStats
+type StructureStats struct {
+	// The ID of the structure
+	ID uint64
+	// The time since the structure was created
+	Age time.Duration
+	// The occupancy of the structure aggregated over all its levels
+	Occupancy data.LevelOccupancy
+}
+
+// The stats of both structures of a tracker returned by FairnessTracker.AggregateStats
+type TrackerStats struct {
+	// The stats of the main structure
+	Main StructureStats
+	// The stats of the secondary structure
+	Secondary StructureStats
+	// The occupancy aggregated over both structures
+	Total data.LevelOccupancy
+}
+
+// The lifetime counters of a tracker returned by FairnessTracker.Counters
+type TrackerCounters struct {
+	// The number of requests registered. Every key of a batch counts as a request, while
+	// a multi-dimensional request counts once.
+	Requests uint64
+	// The number of registered requests that were throttled
+	Throttled uint64
+	// The number of registered requests that would have been throttled but were let
+	// through by the DryRun of the config
+	WouldThrottle uint64
+	// The number of outcomes reported, counting every item of a batch
+	Outcomes uint64
+}
+
+// The state of a tracker to persist it and restore it later with NewFairnessTrackerFromState.
+// Only the structures of the dimension tracked by RegisterRequest are included.
+type TrackerState struct {
+	// The config of the tracker
+	Config *config.FairnessTrackerConfig
+	// The ID the next structure created by the tracker gets
+	StructureIDCounter uint64
+	// The state of the main structure
+	Main *data.StructureState
+	// The state of the secondary structure. May be nil, in which case a fresh secondary
+	// structure seeded from the main one is created on restore.
+	Secondary *data.StructureState
+}
+
+// The structures of every flow dimension, the first one being the dimension tracked by
+// RegisterRequest. A set is never mutated once published. Rotations, resets and new
+// dimensions publish a new set instead.
+type structureSet struct {
+	dimensions []dimension
+}
+
 // The builder struct to build a FairnessTracker
 type FairnessTrackerBuilder struct {
 	configuration *config.FairnessTrackerConfig
+	onRotation    func(RotationInfo)
+	// The clock and ticker to use instead of the real ones, mostly for tests
+	clock  utils.IClock
+	ticker utils.ITicker
 }
 
 func NewFairnessTrackerBuilder() *FairnessTrackerBuilder {
@@ -19,15 +104,33 @@ func NewFairnessTrackerBuilder() *FairnessTrackerBuilder {
 }
 
 func (bl *FairnessTrackerBuilder) BuildWithDefaultConfig() (*FairnessTracker, error) {
-	return NewFairnessTracker(config.DefaultFairnessTrackerConfig())
+	return bl.build(config.DefaultFairnessTrackerConfig())
 }
 
 func (bl *FairnessTrackerBuilder) BuildWithConfig(configuration *config.FairnessTrackerConfig) (*FairnessTracker, error) {
-	return NewFairnessTracker(configuration)
+	return bl.build(configuration)
 }
 
 func (bl *FairnessTrackerBuilder) Build() (*FairnessTracker, error) {
-	return NewFairnessTracker(bl.configuration)
+	return bl.build(bl.configuration)
+}
+
+func (bl *FairnessTrackerBuilder) build(configuration *config.FairnessTrackerConfig) (*FairnessTracker, error) {
+	clock := bl.clock
+	if clock == nil {
+		clock = utils.NewRealClock()
+	}
+
+	// A real ticker is created when the rotation starts if none was set
+	ft, err := newFairnessTracker(configuration, clock, bl.ticker)
+	if err != nil {
+		return nil, err
+	}
+
+	ft.onRotation = bl.onRotation
+	ft.startRotation()
+	ft.startSweeper()
+	return ft, nil
 }
 
 func (bl *FairnessTrackerBuilder) SetL(L uint32) {
@@ -38,10 +141,22 @@ func (bl *FairnessTrackerBuilder) SetM(M uint32) {
 	bl.configuration.M = M
 }
 
+func (bl *FairnessTrackerBuilder) SetMurmurSeed(murmurSeed uint32) {
+	bl.configuration.MurmurSeed = &murmurSeed
+}
+
+func (bl *FairnessTrackerBuilder) SetMPerLevel(mPerLevel []uint32) {
+	bl.configuration.MPerLevel = mPerLevel
+}
+
 func (bl *FairnessTrackerBuilder) SetPd(Pd float64) {
 	bl.configuration.Pd = Pd
 }
 
+func (bl *FairnessTrackerBuilder) SetMinPd(minPd float64) {
+	bl.configuration.MinPd = minPd
+}
+
 func (bl *FairnessTrackerBuilder) SetPi(Pi float64) {
 	bl.configuration.Pi = Pi
 }
@@ -50,18 +165,147 @@ func (bl *FairnessTrackerBuilder) SetLambda(Lambda float64) {
 	bl.configuration.Lambda = Lambda
 }
 
+func (bl *FairnessTrackerBuilder) SetSampleRate(sampleRate float64) {
+	bl.configuration.SampleRate = sampleRate
+}
+
+func (bl *FairnessTrackerBuilder) SetTimeoutPenaltyFraction(timeoutPenaltyFraction float64) {
+	bl.configuration.TimeoutPenaltyFraction = timeoutPenaltyFraction
+}
+
 func (bl *FairnessTrackerBuilder) SetIncludeStats(IncludeStats bool) {
 	bl.configuration.IncludeStats = IncludeStats
 }
 
+func (bl *FairnessTrackerBuilder) SetDecayStrategy(decayStrategy config.DecayStrategy) {
+	bl.configuration.DecayStrategy = decayStrategy
+}
+
+func (bl *FairnessTrackerBuilder) SetDecayStepIdle(decayStepIdle time.Duration) {
+	bl.configuration.DecayStepIdle = decayStepIdle
+}
+
 func (bl *FairnessTrackerBuilder) SetRotationFrequency(rotationFrequency time.Duration) {
 	bl.configuration.RotationFrequency = rotationFrequency
 }
 
+func (bl *FairnessTrackerBuilder) SetRotationJitter(rotationJitter time.Duration) {
+	bl.configuration.RotationJitter = rotationJitter
+}
+
+func (bl *FairnessTrackerBuilder) SetMaxThrottlesPerSecond(maxThrottlesPerSecond float64) {
+	bl.configuration.MaxThrottlesPerSecond = maxThrottlesPerSecond
+}
+
+func (bl *FairnessTrackerBuilder) SetBackoffBase(backoffBase time.Duration) {
+	bl.configuration.BackoffBase = backoffBase
+}
+
+func (bl *FairnessTrackerBuilder) SetDryRun(dryRun bool) {
+	bl.configuration.DryRun = dryRun
+}
+
+func (bl *FairnessTrackerBuilder) SetWarmSecondary(warmSecondary bool) {
+	bl.configuration.WarmSecondary = &warmSecondary
+}
+
+func (bl *FairnessTrackerBuilder) SetMaxDimensions(maxDimensions uint32) {
+	bl.configuration.MaxDimensions = maxDimensions
+}
+
+func (bl *FairnessTrackerBuilder) SetDecaySweepInterval(decaySweepInterval time.Duration) {
+	bl.configuration.DecaySweepInterval = decaySweepInterval
+}
+
+func (bl *FairnessTrackerBuilder) SetMaxBucketAge(maxBucketAge time.Duration) {
+	bl.configuration.MaxBucketAge = maxBucketAge
+}
+
 func (bl *FairnessTrackerBuilder) SetFinalProbabilityFunction(finalProbabilityFunction config.FinalProbabilityFunction) {
 	bl.configuration.FinalProbabilityFunction = finalProbabilityFunction
 }
 
+func (bl *FairnessTrackerBuilder) SetFinalProbabilityFunctionEx(finalProbabilityFunctionEx config.FinalProbabilityFuncEx) {
+	bl.configuration.FinalProbabilityFunctionEx = finalProbabilityFunctionEx
+}
+
+func (bl *FairnessTrackerBuilder) SetKeyNormalizer(keyNormalizer config.KeyNormalizer) {
+	bl.configuration.KeyNormalizer = keyNormalizer
+}
+
+func (bl *FairnessTrackerBuilder) SetAdaptiveMode(adaptiveMode bool) {
+	bl.configuration.AdaptiveMode = adaptiveMode
+}
+
+func (bl *FairnessTrackerBuilder) SetMaxProbability(maxProbability float64) {
+	bl.configuration.MaxProbability = maxProbability
+}
+
+func (bl *FairnessTrackerBuilder) SetBlockThreshold(blockThreshold float64) {
+	bl.configuration.BlockThreshold = blockThreshold
+}
+
+func (bl *FairnessTrackerBuilder) SetWarmUpRequests(warmUpRequests uint64) {
+	bl.configuration.WarmUpRequests = warmUpRequests
+}
+
+func (bl *FairnessTrackerBuilder) SetWarmUpDuration(warmUpDuration time.Duration) {
+	bl.configuration.WarmUpDuration = warmUpDuration
+}
+
+func (bl *FairnessTrackerBuilder) SetDecayOnReportOnly(decayOnReportOnly bool) {
+	bl.configuration.DecayOnReportOnly = decayOnReportOnly
+}
+
+func (bl *FairnessTrackerBuilder) SetDeterministicThrottle(deterministicThrottle bool) {
+	bl.configuration.DeterministicThrottle = deterministicThrottle
+}
+
+func (bl *FairnessTrackerBuilder) SetBucketModel(bucketModel config.BucketModel) {
+	bl.configuration.BucketModel = bucketModel
+}
+
+func (bl *FairnessTrackerBuilder) SetRatioSmoothing(ratioSmoothing float64) {
+	bl.configuration.RatioSmoothing = ratioSmoothing
+}
+
+func (bl *FairnessTrackerBuilder) SetEWMAAlpha(ewmaAlpha float64) {
+	bl.configuration.EWMAAlpha = ewmaAlpha
+}
+
+// Estimate the probability of an innocent flow colliding with bad flows at every level
+// with the L and M currently set on the builder, given the expected number of bad flows.
+func (bl *FairnessTrackerBuilder) EstimateCollisionProbability(expectedBadFlows uint32) float64 {
+	return config.CollisionProbability(bl.configuration.M, expectedBadFlows, bl.configuration.L)
+}
+
+// Set a callback to be called after every rotation of the underlying structures.
+// The callback runs on the rotation goroutine after the new structures are published,
+// so it does not block request handling but should return quickly to avoid delaying
+// rotations.
+func (bl *FairnessTrackerBuilder) SetOnRotation(onRotation func(RotationInfo)) {
+	bl.onRotation = onRotation
+}
+
+// Set the callbacks to be called with the ID of every structure created and retired by a
+// rotation. Either may be nil. See config.FairnessTrackerConfig.OnStructureCreated.
+func (bl *FairnessTrackerBuilder) SetStructureLifecycleCallbacks(onCreated, onRetired func(id uint64)) {
+	bl.configuration.OnStructureCreated = onCreated
+	bl.configuration.OnStructureRetired = onRetired
+}
+
+// Set the clock used by the structures, e.g. a mock clock in tests. The real clock is
+// used if it's not set or nil.
+func (bl *FairnessTrackerBuilder) SetClock(clock utils.IClock) {
+	bl.clock = clock
+}
+
+// Set the ticker driving the rotation, e.g. a mock ticker in tests to rotate on demand.
+// A real ticker with the rotation frequency is used if it's not set or nil.
+func (bl *FairnessTrackerBuilder) SetTicker(ticker utils.ITicker) {
+	bl.ticker = ticker
+}
+
 // The public facing errors from the FairnessTracker
 type FairnessTrackerError struct {
 	*utils.BaseError
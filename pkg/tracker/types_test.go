@@ -28,11 +28,16 @@ func TestBuildFairnessTracker(t *testing.T) {
 	b.SetRotationFrequency(1 * time.Second)
 	b.SetIncludeStats(true)
 	b.SetFinalProbabilityFunction(config.MeanFinalProbabilityFunction)
+	b.SetAdaptiveMode(true)
+	b.SetMaxProbability(.9)
 
 	tr, err := b.Build()
 	assert.NoError(t, err)
+	defer closeAndWait(tr)
 	assert.Equal(t, int(tr.trackerConfig.L), 10)
 	assert.Equal(t, int(tr.trackerConfig.M), 10)
+	assert.True(t, tr.trackerConfig.AdaptiveMode)
+	assert.Equal(t, tr.trackerConfig.MaxProbability, .9)
 }
 
 func TestBuildWithConfig(t *testing.T) {
@@ -43,3 +48,50 @@ func TestBuildWithConfig(t *testing.T) {
 	assert.Equal(t, int(tr.trackerConfig.L), 4)
 	assert.Equal(t, int(tr.trackerConfig.M), 10)
 }
+
+func TestBuildWithPercentileFinalProbabilityFunction(t *testing.T) {
+	b := NewFairnessTrackerBuilder()
+	b.SetFinalProbabilityFunction(config.PercentileFinalProbabilityFunction(.5))
+
+	tr, err := b.Build()
+	assert.NoError(t, err)
+	defer tr.Close()
+
+	p, err := tr.trackerConfig.FinalProbabilityFunction([]float64{.1, .2, .3})
+	assert.NoError(t, err)
+	assert.Equal(t, p, .2)
+}
+
+func TestBuildValidation(t *testing.T) {
+	b := NewFairnessTrackerBuilder()
+	b.SetLambda(-1)
+	_, err := b.Build()
+	assert.Error(t, err)
+
+	var trackerErr *FairnessTrackerError
+	assert.ErrorAs(t, err, &trackerErr)
+	assert.Contains(t, err.Error(), "the value of Lambda must be >=0")
+
+	b = NewFairnessTrackerBuilder()
+	b.SetRotationFrequency(time.Microsecond)
+	_, err = b.Build()
+	assert.ErrorAs(t, err, &trackerErr)
+	assert.Contains(t, err.Error(), "the RotationFrequency must be at least 1ms")
+
+	b = NewFairnessTrackerBuilder()
+	b.SetFinalProbabilityFunction(nil)
+	_, err = b.Build()
+	assert.ErrorAs(t, err, &trackerErr)
+
+	_, err = b.BuildWithConfig(nil)
+	assert.ErrorAs(t, err, &trackerErr)
+}
+
+func TestEstimateCollisionProbability(t *testing.T) {
+	b := NewFairnessTrackerBuilder()
+	b.SetL(4)
+	b.SetM(1000)
+
+	assert.Equal(t, b.EstimateCollisionProbability(100), config.CollisionProbability(1000, 100, 4))
+	assert.Less(t, b.EstimateCollisionProbability(100), .0001)
+}
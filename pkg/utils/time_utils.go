@@ -1,6 +1,9 @@
 package utils
 
-import "time"
+import (
+	"sync"
+	"time"
+)
 
 // The interface for a clock that's used inside the library.
 // Can be implemented using a mock clock to run in a simulation mode.
@@ -33,6 +36,15 @@ type ITicker interface {
 	Stop()
 }
 
+// An ITicker whose period can be changed while it runs. It's optional, so tickers that
+// only implement ITicker keep working, but the tracker can then neither jitter its
+// rotations nor change their frequency.
+type ResettableTicker interface {
+	ITicker
+	// Stop the ticker and reset its period to the given duration
+	Reset(duration time.Duration)
+}
+
 // A real implementation of a Ticker
 type Ticker struct {
 	ticker *time.Ticker
@@ -51,3 +63,78 @@ func (t *Ticker) C() <-chan time.Time {
 func (t *Ticker) Stop() {
 	t.ticker.Stop()
 }
+
+func (t *Ticker) Reset(duration time.Duration) {
+	t.ticker.Reset(duration)
+}
+
+// A mock clock that only moves when advanced. Useful to run deterministic simulations.
+type MockClock struct {
+	now time.Time
+	lk  sync.Mutex
+}
+
+func NewMockClock(start time.Time) *MockClock {
+	return &MockClock{
+		now: start,
+	}
+}
+
+func (c *MockClock) Now() time.Time {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	return c.now
+}
+
+// Advances the virtual time by the given duration without blocking
+func (c *MockClock) Sleep(duration time.Duration) {
+	c.Advance(duration)
+}
+
+// Advance the virtual time by the given duration
+func (c *MockClock) Advance(duration time.Duration) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	c.now = c.now.Add(duration)
+}
+
+// A mock ticker that only ticks when told to
+type MockTicker struct {
+	c chan time.Time
+
+	// The durations passed to Reset, in order
+	resets []time.Duration
+	lk     sync.Mutex
+}
+
+func NewMockTicker() *MockTicker {
+	return &MockTicker{
+		c: make(chan time.Time),
+	}
+}
+
+func (t *MockTicker) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *MockTicker) Stop() {}
+
+// Records the duration without changing when the ticker ticks
+func (t *MockTicker) Reset(duration time.Duration) {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	t.resets = append(t.resets, duration)
+}
+
+// Get the durations passed to Reset so far, in order
+func (t *MockTicker) Resets() []time.Duration {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	return append([]time.Duration(nil), t.resets...)
+}
+
+// Push a tick onto C. Blocks until the tick is received so the receiver has
+// started handling it by the time Tick returns.
+func (t *MockTicker) Tick() {
+	t.c <- time.Now()
+}
@@ -31,3 +31,46 @@ func TestTicker(t *testing.T) {
 
 	assert.True(t, found)
 }
+
+func TestMockClock(t *testing.T) {
+	start := time.Unix(1000, 0)
+	var clk IClock = NewMockClock(start)
+	assert.Equal(t, clk.Now(), start)
+
+	clk.(*MockClock).Advance(time.Minute)
+	assert.Equal(t, clk.Now(), start.Add(time.Minute))
+
+	// Sleep advances the virtual time instead of blocking
+	t1 := time.Now()
+	clk.Sleep(time.Hour)
+	assert.Equal(t, clk.Now(), start.Add(time.Minute+time.Hour))
+	assert.Less(t, time.Since(t1), time.Second)
+}
+
+func TestMockTicker(t *testing.T) {
+	ticker := NewMockTicker()
+	var iticker ITicker = ticker
+
+	go ticker.Tick()
+
+	var found bool
+	select {
+	case <-iticker.C():
+		found = true
+	case <-time.After(time.Second):
+	}
+	assert.True(t, found)
+
+	select {
+	case <-iticker.C():
+		t.Fatal("Unexpected tick")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	iticker.Stop()
+
+	var rticker ResettableTicker = ticker
+	rticker.Reset(time.Minute)
+	rticker.Reset(time.Second)
+	assert.Equal(t, ticker.Resets(), []time.Duration{time.Minute, time.Second})
+}